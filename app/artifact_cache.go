@@ -0,0 +1,214 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The artifact cache directory holds at most one Artifact, together with the
+// deployment it was downloaded for, and its checksum.
+const (
+	cachedArtifactFile     = "artifact"
+	cachedArtifactInfoFile = "artifact.json"
+	// Where an Artifact is written while it is being downloaded.
+	cachedArtifactPartial = "artifact.partial"
+)
+
+type cachedArtifactInfo struct {
+	DeploymentID string `json:"deployment_id"`
+	// Hex encoded SHA256 sum of the cached Artifact.
+	Checksum string `json:"checksum"`
+}
+
+// openCachedArtifact returns the Artifact cached in dir for update, or nil if
+// there is none. A cached Artifact for another deployment is removed, and so
+// is one which does not match its checksum, or the one given by the server.
+func openCachedArtifact(dir string, update *datastore.UpdateInfo) (io.ReadCloser, int64) {
+	if dir == "" {
+		return nil, 0
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, cachedArtifactInfoFile))
+	if os.IsNotExist(err) {
+		return nil, 0
+	}
+	var info cachedArtifactInfo
+	if err == nil {
+		err = json.Unmarshal(data, &info)
+	}
+	if err != nil {
+		log.Errorf("Could not read the cached Artifact information: %v", err)
+		clearArtifactCache(dir)
+		return nil, 0
+	}
+
+	if info.DeploymentID != update.ID {
+		clearArtifactCache(dir)
+		return nil, 0
+	}
+	if expected := update.Artifact.Source.Checksum; expected != "" &&
+		strings.ToLower(expected) != info.Checksum {
+		log.Infof("The checksum of the Artifact has changed since it was cached; " +
+			"downloading it again")
+		clearArtifactCache(dir)
+		return nil, 0
+	}
+
+	f, err := os.Open(path.Join(dir, cachedArtifactFile))
+	if err != nil {
+		log.Errorf("Could not open the cached Artifact: %v", err)
+		clearArtifactCache(dir)
+		return nil, 0
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != info.Checksum {
+		err = errors.New("checksum mismatch")
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Errorf("The cached Artifact is broken; downloading it again: %v", err)
+		f.Close()
+		clearArtifactCache(dir)
+		return nil, 0
+	}
+
+	log.Infof("Installing Artifact %s from the cache", update.ArtifactName())
+	return f, size
+}
+
+// cacheArtifact returns a reader which passes on in, and writes it to dir as it
+// goes. The copy is only kept if in is read through to the end. Problems with
+// the cache are logged, and do not affect the reader.
+func cacheArtifact(dir string, update *datastore.UpdateInfo, in io.ReadCloser) io.ReadCloser {
+	if dir == "" {
+		return in
+	}
+	clearArtifactCache(dir)
+	err := os.MkdirAll(dir, 0700)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path.Join(dir, cachedArtifactPartial),
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+	if err != nil {
+		log.Errorf("Could not cache the Artifact: %v", err)
+		return in
+	}
+	return &cachingReader{
+		in:           in,
+		f:            f,
+		h:            sha256.New(),
+		dir:          dir,
+		deploymentID: update.ID,
+	}
+}
+
+type cachingReader struct {
+	in           io.ReadCloser
+	f            *os.File
+	h            hash.Hash
+	dir          string
+	deploymentID string
+	complete     bool
+}
+
+func (c *cachingReader) Read(p []byte) (int, error) {
+	n, err := c.in.Read(p)
+	if n > 0 && c.f != nil {
+		if _, werr := c.f.Write(p[:n]); werr != nil {
+			log.Errorf("Could not cache the Artifact: %v", werr)
+			c.abandon()
+		} else {
+			c.h.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		c.complete = true
+	}
+	return n, err
+}
+
+func (c *cachingReader) Close() error {
+	err := c.in.Close()
+	if c.f == nil {
+		return err
+	}
+	if !c.complete {
+		c.abandon()
+		return err
+	}
+	if ferr := c.finish(); ferr != nil {
+		log.Errorf("Could not cache the Artifact: %v", ferr)
+		clearArtifactCache(c.dir)
+	}
+	return err
+}
+
+// finish moves the complete Artifact in place, and records what it is.
+func (c *cachingReader) finish() error {
+	syncErr := c.f.Sync()
+	closeErr := c.f.Close()
+	c.f = nil
+	if syncErr != nil {
+		return syncErr
+	} else if closeErr != nil {
+		return closeErr
+	}
+	if err := os.Rename(path.Join(c.dir, cachedArtifactPartial),
+		path.Join(c.dir, cachedArtifactFile)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cachedArtifactInfo{
+		DeploymentID: c.deploymentID,
+		Checksum:     hex.EncodeToString(c.h.Sum(nil)),
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(c.dir, cachedArtifactInfoFile), data, 0600)
+}
+
+func (c *cachingReader) abandon() {
+	c.f.Close()
+	c.f = nil
+	os.Remove(path.Join(c.dir, cachedArtifactPartial))
+}
+
+// clearArtifactCache removes the Artifact, if any, cached in dir.
+func clearArtifactCache(dir string) {
+	if dir == "" {
+		return
+	}
+	for _, name := range []string{cachedArtifactInfoFile, cachedArtifactFile,
+		cachedArtifactPartial} {
+		if err := os.Remove(path.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Could not remove the cached Artifact: %v", err)
+		}
+	}
+}
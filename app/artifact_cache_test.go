@@ -0,0 +1,138 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fetchThroughCache runs the fetch state, reads the Artifact it hands over to
+// the store state, and returns it.
+func fetchThroughCache(t *testing.T, stc *stateTestController,
+	update *datastore.UpdateInfo) []byte {
+
+	ctx := &StateContext{Store: store.NewMemStore()}
+	s, _ := NewUpdateFetchState(update).Handle(ctx, stc)
+	require.IsType(t, &updateStoreState{}, s)
+	in := s.(*updateStoreState).imagein
+	data, err := ioutil.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	return data
+}
+
+func TestArtifactCache(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	cacheDir, _ := ioutil.TempDir("", "artifact-cache")
+	defer os.RemoveAll(cacheDir)
+
+	artifact := []byte("artifact contents")
+	sum := sha256.Sum256(artifact)
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+
+	stc := &stateTestController{
+		cacheDir: cacheDir,
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewReader(artifact)),
+			fetchUpdateReturnSize:       int64(len(artifact)),
+		},
+	}
+	assert.Equal(t, artifact, fetchThroughCache(t, stc, update))
+	cached, err := ioutil.ReadFile(path.Join(cacheDir, cachedArtifactFile))
+	require.NoError(t, err)
+	assert.Equal(t, artifact, cached)
+
+	// The next cycle for the same deployment does not download anything.
+	stc.updater = fakeUpdater{fetchUpdateReturnError: io.ErrUnexpectedEOF}
+	assert.Equal(t, artifact, fetchThroughCache(t, stc, update))
+
+	// The cache goes once the update is committed.
+	s, _ := NewUpdateStatusReportState(update, client.StatusSuccess).Handle(
+		&StateContext{Store: store.NewMemStore()}, stc)
+	assert.IsType(t, &idleState{}, s)
+	_, err = os.Stat(path.Join(cacheDir, cachedArtifactFile))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(cacheDir, cachedArtifactInfoFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArtifactCacheInvalidation(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	cacheDir, _ := ioutil.TempDir("", "artifact-cache")
+	defer os.RemoveAll(cacheDir)
+
+	old := []byte("old artifact")
+	cache := func(update *datastore.UpdateInfo, data []byte) {
+		in := cacheArtifact(cacheDir, update, ioutil.NopCloser(bytes.NewReader(data)))
+		_, err := ioutil.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+	}
+	oldSum := sha256.Sum256(old)
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.Source.Checksum = hex.EncodeToString(oldSum[:])
+
+	// The server now offers another Artifact under the same deployment.
+	cache(update, old)
+	changed := *update
+	changed.Artifact.Source.Checksum = "0123"
+	in, _ := openCachedArtifact(cacheDir, &changed)
+	assert.Nil(t, in)
+	_, err := os.Stat(path.Join(cacheDir, cachedArtifactFile))
+	assert.True(t, os.IsNotExist(err))
+
+	// A cached file which no longer matches its checksum.
+	cache(update, old)
+	require.NoError(t, ioutil.WriteFile(path.Join(cacheDir, cachedArtifactFile),
+		[]byte("tampered"), 0600))
+	in, _ = openCachedArtifact(cacheDir, update)
+	assert.Nil(t, in)
+
+	// Another deployment.
+	cache(update, old)
+	in, _ = openCachedArtifact(cacheDir, &datastore.UpdateInfo{ID: "bar"})
+	assert.Nil(t, in)
+
+	// A download which is cut short is not kept.
+	in = cacheArtifact(cacheDir, update, ioutil.NopCloser(bytes.NewReader(old)))
+	_, err = in.Read(make([]byte, 3))
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	in, _ = openCachedArtifact(cacheDir, update)
+	assert.Nil(t, in)
+	_, err = os.Stat(path.Join(cacheDir, cachedArtifactPartial))
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing is cached without a directory.
+	in = ioutil.NopCloser(bytes.NewReader(old))
+	assert.Equal(t, in, cacheArtifact("", update, in))
+}
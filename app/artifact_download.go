@@ -0,0 +1,119 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errArtifactChecksum is the cause of the error downloadArtifact returns for
+// an Artifact which does not match the checksum given by the server.
+var errArtifactChecksum = errors.New("the downloaded Artifact does not match its checksum")
+
+// downloadArtifact reads all of in into a file in dir, and returns the file,
+// which is removed again when it is closed. The Artifact is verified against
+// the checksum of update, if it has one, before it is returned. in is closed.
+// If dir is on a read-only filesystem, in is returned as it is instead, with
+// size 0, to be installed as it is downloaded.
+func downloadArtifact(dir string, update *datastore.UpdateInfo,
+	in io.ReadCloser) (io.ReadCloser, int64, error) {
+
+	// Whatever an earlier download left behind, such as across a power
+	// loss, is of no use.
+	clearArtifactDownloads(dir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = errors.Wrap(err, "could not create the download directory")
+	}
+	var f *os.File
+	if err == nil {
+		f, err = ioutil.TempFile(dir, "artifact-")
+		if err != nil {
+			err = errors.Wrap(err, "could not create the download file")
+		}
+	}
+	if store.IsReadOnlyError(err) {
+		log.Warnf("Downloading the Artifact first is not possible; "+
+			"installing it as it is downloaded instead: %v", err)
+		return in, 0, nil
+	} else if err != nil {
+		in.Close()
+		return nil, 0, err
+	}
+	defer in.Close()
+	fail := func(err error) (io.ReadCloser, int64, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+
+	var checksum *utils.ChecksumReadCloser
+	src := in
+	if expected := update.Artifact.Source.Checksum; expected != "" {
+		checksum = utils.NewChecksumReadCloser(in, expected)
+		src = checksum
+	}
+	size, err := io.Copy(f, src)
+	if err != nil {
+		return fail(errors.Wrapf(err, "downloading the Artifact failed after %d bytes", size))
+	}
+	if err = f.Sync(); err != nil {
+		return fail(errors.Wrap(err, "could not write the downloaded Artifact"))
+	}
+	if checksum != nil {
+		if err = checksum.Verify(); err != nil {
+			return fail(errors.Wrap(errArtifactChecksum, err.Error()))
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	log.Infof("Downloaded Artifact %s (%d bytes); installing it", update.ArtifactName(), size)
+	return &downloadedArtifact{f}, size, nil
+}
+
+type downloadedArtifact struct {
+	*os.File
+}
+
+func (d *downloadedArtifact) Close() error {
+	err := d.File.Close()
+	if rerr := os.Remove(d.Name()); rerr != nil && !os.IsNotExist(rerr) {
+		log.Errorf("Could not remove the downloaded Artifact: %v", rerr)
+	}
+	return err
+}
+
+// clearArtifactDownloads removes any Artifacts downloaded to dir.
+func clearArtifactDownloads(dir string) {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if err := os.Remove(path.Join(dir, name.Name())); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Could not remove the downloaded Artifact: %v", err)
+		}
+	}
+}
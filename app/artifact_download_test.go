@@ -0,0 +1,122 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactDownloadMode(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	downloadDir, _ := ioutil.TempDir("", "artifact-download")
+	defer os.RemoveAll(downloadDir)
+
+	artifact := []byte("artifact contents")
+	sum := sha256.Sum256(artifact)
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+
+	fetch := func(stc *stateTestController, ctx *StateContext) State {
+		stc.updater = fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewReader(artifact)),
+			fetchUpdateReturnSize:       int64(len(artifact)),
+		}
+		s, _ := NewUpdateFetchState(update).Handle(ctx, stc)
+		return s
+	}
+	downloads := func() []os.FileInfo {
+		files, err := ioutil.ReadDir(downloadDir)
+		require.NoError(t, err)
+		return files
+	}
+
+	// Streamed, the download is handed over to the store state as it is.
+	stc := &stateTestController{}
+	s := fetch(stc, &StateContext{Store: store.NewMemStore()})
+	require.IsType(t, &updateStoreState{}, s)
+	_, isDownload := s.(*updateStoreState).imagein.(*downloadedArtifact)
+	assert.False(t, isDownload)
+	assert.Empty(t, downloads())
+
+	// Otherwise the store state gets the whole of it from a file, which
+	// goes once it is done with it.
+	stc.downloadDir = downloadDir
+	s = fetch(stc, &StateContext{Store: store.NewMemStore()})
+	require.IsType(t, &updateStoreState{}, s)
+	in := s.(*updateStoreState).imagein
+	require.IsType(t, &downloadedArtifact{}, in)
+	assert.Len(t, downloads(), 1)
+	data, err := ioutil.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, artifact, data)
+	require.NoError(t, in.Close())
+	assert.Empty(t, downloads())
+
+	// An Artifact which does not match its checksum is never handed over,
+	// but downloaded again, as long as there are retries left.
+	update.Artifact.Source.Checksum = hex.EncodeToString(make([]byte, sha256.Size))
+	stc.checksumMismatchRetries = 1
+	ctx := &StateContext{Store: store.NewMemStore()}
+	s = fetch(stc, ctx)
+	assert.IsType(t, &fetchStoreRetryState{}, s)
+	assert.Equal(t, 1, ctx.checksumMismatches)
+	assert.Empty(t, downloads())
+	s = fetch(stc, ctx)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+	assert.Empty(t, downloads())
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+
+	// A download which breaks off is retried, and leaves nothing behind.
+	stc.updater = fakeUpdater{
+		fetchUpdateReturnReadCloser: ioutil.NopCloser(io.MultiReader(
+			bytes.NewReader(artifact[:5]), &failingReader{io.ErrUnexpectedEOF})),
+		fetchUpdateReturnSize: int64(len(artifact)),
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&StateContext{Store: store.NewMemStore()}, stc)
+	assert.IsType(t, &fetchStoreRetryState{}, s)
+	assert.Empty(t, downloads())
+
+	// Leftovers of an earlier download are cleared by the next one.
+	require.NoError(t, ioutil.WriteFile(path.Join(downloadDir, "artifact-old"),
+		[]byte("old"), 0600))
+	s = fetch(stc, &StateContext{Store: store.NewMemStore()})
+	require.IsType(t, &updateStoreState{}, s)
+	assert.Len(t, downloads(), 1)
+	require.NoError(t, s.(*updateStoreState).imagein.Close())
+	assert.Empty(t, downloads())
+}
+
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	return 0, f.err
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Replaced by tests, which cannot change the system clock.
+var (
+	clockNow = time.Now
+	setClock = func(t time.Time) error {
+		tv := unix.NsecToTimeval(t.UnixNano())
+		return unix.Settimeofday(&tv)
+	}
+	clockPollInterval = 5 * time.Second
+)
+
+// Used if ClockCheckTimeoutSeconds is not set.
+const defaultClockCheckTimeout = 5 * time.Minute
+
+// CheckClock deals with a system clock set before the client was built,
+// which would make every certificate look invalid, as configured by
+// ClockCheck. An error means the clock is still wrong.
+func (m *Mender) CheckClock() error {
+	buildTime := conf.BuildTime()
+	if m.Config.ClockCheck == "" || !clockNow().Before(buildTime) {
+		return nil
+	}
+	log.Warnf("The system clock (%s) is earlier than the build date of the client (%s)",
+		clockNow().UTC().Format(time.RFC3339), buildTime.Format("2006-01-02"))
+
+	switch m.Config.ClockCheck {
+	case conf.ClockCheckWait:
+		timeout := time.Duration(m.Config.ClockCheckTimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = defaultClockCheckTimeout
+		}
+		log.Infof("Waiting up to %s for the clock to be synchronized", timeout)
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+			time.Sleep(clockPollInterval)
+			if !clockNow().Before(buildTime) {
+				log.Infof("The system clock is now %s", clockNow().UTC().Format(time.RFC3339))
+				return nil
+			}
+		}
+		return errors.Errorf("The clock was not synchronized within %s", timeout)
+
+	case conf.ClockCheckServer:
+		if len(m.Config.Servers) == 0 {
+			return errors.New("No server to get the time from")
+		}
+		serverTime, err := m.serverTime(m.Config.Servers[0].ServerURL)
+		if err != nil {
+			return errors.Wrap(err, "Could not get the time from the server")
+		}
+		if serverTime.Before(buildTime) {
+			return errors.Errorf("The server time (%s) is earlier than the build date too",
+				serverTime.Format(time.RFC3339))
+		}
+		log.Infof("Setting the system clock to the server time: %s",
+			serverTime.Format(time.RFC3339))
+		return setClock(serverTime)
+	}
+	return nil
+}
+
+// serverTime returns the time in the Date header of the server. The
+// certificate of the server cannot be verified while the clock is wrong, so
+// the time is only used to get the clock close enough for verifying it.
+func (m *Mender) serverTime(serverURL string) (time.Time, error) {
+	config := m.Config.GetHttpConfig()
+	config.NoVerify = true
+	config.ServerCertFingerprints = nil
+	api, err := client.New(config)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req, err := http.NewRequest(http.MethodHead, serverURL, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	rsp, err := api.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	rsp.Body.Close()
+	return http.ParseTime(rsp.Header.Get("Date"))
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock starts out in 1970, before the build date, until it is set.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Set(t time.Time) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = t
+	return nil
+}
+
+func useFakeClock(t *testing.T) *fakeClock {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	oldNow, oldSet, oldInterval := clockNow, setClock, clockPollInterval
+	clockNow, setClock, clockPollInterval = clock.Now, clock.Set, time.Millisecond
+	t.Cleanup(func() {
+		clockNow, setClock, clockPollInterval = oldNow, oldSet, oldInterval
+	})
+	return clock
+}
+
+func TestCheckClockServer(t *testing.T) {
+	clock := useFakeClock(t)
+	serverTime := conf.BuildTime().Add(48 * time.Hour)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			Servers:    []client.MenderServer{{ServerURL: ts.URL}},
+			ClockCheck: conf.ClockCheckServer,
+		},
+	}, testMenderPieces{})
+	require.NoError(t, mender.CheckClock())
+	assert.True(t, clock.Now().Equal(serverTime))
+
+	// A server which is just as wrong is not believed.
+	clock.Set(time.Unix(0, 0))
+	serverTime = time.Unix(3600, 0)
+	assert.Error(t, mender.CheckClock())
+	assert.True(t, clock.Now().Equal(time.Unix(0, 0)))
+}
+
+func TestCheckClockWait(t *testing.T) {
+	clock := useFakeClock(t)
+	mender := newTestMender(nil, conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			Servers:                  []client.MenderServer{{}},
+			ClockCheck:               conf.ClockCheckWait,
+			ClockCheckTimeoutSeconds: 1,
+		},
+	}, testMenderPieces{})
+
+	// Gives up after the timeout.
+	start := time.Now()
+	assert.Error(t, mender.CheckClock())
+	assert.WithinDuration(t, start.Add(time.Second), time.Now(), 500*time.Millisecond)
+
+	// Done as soon as the clock is synchronized.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		clock.Set(time.Now())
+	}()
+	start = time.Now()
+	assert.NoError(t, mender.CheckClock())
+	assert.WithinDuration(t, start, time.Now(), 500*time.Millisecond)
+
+	// Nothing to wait for with a sane clock, nor when the check is off.
+	assert.NoError(t, mender.CheckClock())
+	clock.Set(time.Unix(0, 0))
+	mender.Config.ClockCheck = ""
+	assert.NoError(t, mender.CheckClock())
+}
@@ -0,0 +1,558 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ControlStatus is what the local control API reports at /status.
+type ControlStatus struct {
+	// The state the daemon is in, or last ran.
+	State             string            `json:"state"`
+	InstalledArtifact InstalledArtifact `json:"installed_artifact"`
+	// The outcome of the last update check, if any.
+	LastUpdate *datastore.LastUpdate `json:"last_update,omitempty"`
+	// How far the update being downloaded has come, if any.
+	Download *DownloadProgress `json:"download,omitempty"`
+	// Set while polling is suspended.
+	Suspended bool `json:"suspended,omitempty"`
+	// Set while reboots into installed updates are paused.
+	RebootPaused bool `json:"reboot_paused,omitempty"`
+	// The update channel asked for by update checks, if any.
+	Channel string `json:"channel,omitempty"`
+	// Set while the server does not accept the identity of the device,
+	// which then has to be accepted on the server.
+	NotAuthorized bool `json:"not_authorized,omitempty"`
+	// Set while the data directory is read-only, and the state of the
+	// client, or the log of the deployment, is only kept in memory.
+	DataReadOnly bool `json:"data_read_only,omitempty"`
+	// The root filesystem partitions, if the device has them.
+	Partitions []installer.Partition `json:"partitions,omitempty"`
+}
+
+// ControlChannel is the body of a request to /channel.
+type ControlChannel struct {
+	Channel string `json:"channel"`
+}
+
+// DownloadProgress tells how the download of an update goes. The rate is
+// averaged over the last utils.RateWindow.
+type DownloadProgress struct {
+	Bytes          int64   `json:"bytes"`
+	TotalBytes     int64   `json:"total_bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// Estimated time left; 0 until the rate is known.
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+type InstalledArtifact struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// recordState keeps track of the state the daemon is in, for the control API.
+func (d *MenderDaemon) recordState(state State) {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	d.state = state.Id()
+	_, d.inUpdate = state.(UpdateState)
+	d.lastUpdate = d.Sctx.lastUpdate
+	// The update is read through while it is stored.
+	if d.state != datastore.MenderStateUpdateFetch &&
+		d.state != datastore.MenderStateUpdateStore {
+		d.download = nil
+	}
+}
+
+// recordProgress keeps track of the download of an update, for the control
+// API.
+func (d *MenderDaemon) recordProgress(progress utils.Progress) {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	d.download = &DownloadProgress{
+		Bytes:          progress.Current,
+		TotalBytes:     progress.Total,
+		BytesPerSecond: progress.Rate,
+		ETASeconds:     progress.ETA.Seconds(),
+	}
+}
+
+// loadLastUpdate picks up the outcome of the last update check from the
+// store, which may be from before the daemon was restarted.
+func (d *MenderDaemon) loadLastUpdate() {
+	last, err := datastore.LoadLastUpdate(d.Sctx.Store)
+	if err != nil {
+		log.Errorf("Could not load the outcome of the last update: %v", err)
+	}
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	d.Sctx.lastUpdate = last
+	d.lastUpdate = last
+}
+
+// Status returns the state of the daemon, and the Artifact it runs.
+func (d *MenderDaemon) Status() ControlStatus {
+	d.statusLock.Lock()
+	status := ControlStatus{
+		State:      d.state.String(),
+		LastUpdate: d.lastUpdate,
+		Download:   d.download,
+		Suspended:  d.suspended,
+	}
+	d.statusLock.Unlock()
+
+	name, version, err := d.Mender.InstalledArtifact()
+	if err != nil {
+		log.Errorf("Control API: Could not read the installed Artifact: %s", err)
+	}
+	status.InstalledArtifact = InstalledArtifact{Name: name, Version: version}
+	status.RebootPaused = rebootPaused(d.Sctx.Store)
+	status.Channel = d.Mender.GetChannel()
+	status.NotAuthorized = d.Mender.NotAuthorized()
+	if s, ok := d.Sctx.Store.(interface{ ReadOnly() bool }); ok {
+		status.DataReadOnly = s.ReadOnly()
+	}
+	if DeploymentLogger != nil && DeploymentLogger.InMemory() {
+		status.DataReadOnly = true
+	}
+	status.Partitions, err = d.Mender.GetPartitions()
+	if err != nil {
+		log.Errorf("Control API: Could not read the partitions: %s", err)
+	}
+	return status
+}
+
+// betweenUpdates returns whether the daemon is waiting for the next update
+// check, or doing one, rather than working on an update.
+func (d *MenderDaemon) betweenUpdates() bool {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	switch d.state {
+	case datastore.MenderStateIdle,
+		datastore.MenderStateAuthorize,
+		datastore.MenderStateAuthorizeWait,
+		datastore.MenderStateCheckWait,
+		datastore.MenderStateUpdateCheck,
+		datastore.MenderStateInventoryUpdate:
+		return true
+	}
+	return false
+}
+
+// ForceUpdateCheck makes the daemon check for an update straight away, if it
+// is waiting for the next check. Otherwise the request is dropped, and the
+// daemon carries on with what it is doing; only one update runs at a time.
+func (d *MenderDaemon) ForceUpdateCheck() {
+	d.forceState(States.UpdateCheck)
+}
+
+// ForceInventoryUpdate is ForceUpdateCheck for sending the inventory.
+func (d *MenderDaemon) ForceInventoryUpdate() {
+	d.forceState(States.InventoryUpdate)
+}
+
+// forceState never blocks, so that the signal handler is always free to shut
+// the daemon down.
+func (d *MenderDaemon) forceState(state State) {
+	if !d.betweenUpdates() {
+		log.Infof("An update is in progress; skipping the requested %s", state)
+		return
+	}
+	select {
+	case d.ForceToState <- state:
+	default:
+	}
+	select {
+	case d.Sctx.WakeupChan <- true:
+	default:
+	}
+}
+
+// Suspend stops the daemon from polling the server until Resume is called,
+// for when the device is known to be offline. An update in progress carries
+// on regardless.
+func (d *MenderDaemon) Suspend() {
+	d.statusLock.Lock()
+	d.suspended = true
+	d.statusLock.Unlock()
+	log.Info("Polling suspended")
+}
+
+// Resume lets the daemon poll again, starting straight away.
+func (d *MenderDaemon) Resume() {
+	d.statusLock.Lock()
+	suspended := d.suspended
+	d.suspended = false
+	d.statusLock.Unlock()
+	if !suspended {
+		return
+	}
+	log.Info("Polling resumed")
+	select {
+	case d.Sctx.WakeupChan <- true:
+	default:
+	}
+}
+
+func (d *MenderDaemon) isSuspended() bool {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	return d.suspended
+}
+
+// waitForResume blocks while polling is suspended, unless the daemon is
+// stopped.
+func (d *MenderDaemon) waitForResume() {
+	for d.isSuspended() && !d.shouldStop() {
+		<-d.Sctx.WakeupChan
+	}
+}
+
+// ConfirmHealthy tells the daemon that the device works with the update it
+// just rebooted into, so that the update can be committed. It fails unless the
+// daemon is waiting for the confirmation.
+func (d *MenderDaemon) ConfirmHealthy() error {
+	d.statusLock.Lock()
+	state := d.state
+	d.statusLock.Unlock()
+	if state != datastore.MenderStateUpdateHealthWait {
+		return errors.Errorf("no update is waiting to be confirmed healthy (state %s)", state)
+	}
+	select {
+	case d.Sctx.HealthyChan <- true:
+	default:
+	}
+	return nil
+}
+
+// RequestReboot lets the daemon reboot into the update it installed, when
+// AutoReboot is off. It fails unless the daemon is waiting for it.
+func (d *MenderDaemon) RequestReboot() error {
+	d.statusLock.Lock()
+	state := d.state
+	d.statusLock.Unlock()
+	if state != datastore.MenderStateUpdateRebootWait {
+		return errors.Errorf("no update is waiting for a reboot (state %s)", state)
+	}
+	if rebootPaused(d.Sctx.Store) {
+		return errors.New("reboots are paused")
+	}
+	select {
+	case d.Sctx.RebootChan <- true:
+	default:
+	}
+	return nil
+}
+
+// AbortUpdate aborts the update being downloaded, or waiting to be downloaded
+// again. Anything of it written to the device is invalidated, and the update
+// is reported failed to the server. It fails once the update has been stored,
+// since it is then on its way to being installed.
+func (d *MenderDaemon) AbortUpdate() error {
+	d.statusLock.Lock()
+	state := d.state
+	d.statusLock.Unlock()
+	switch state {
+	case datastore.MenderStateUpdateFetch,
+		datastore.MenderStateUpdateStore,
+		datastore.MenderStateFetchStoreRetryWait:
+	default:
+		return errors.Errorf("no update is being downloaded (state %s)", state)
+	}
+	d.Sctx.aborter.abort("aborted through the control API")
+	d.cancelFetchRetries()
+	select {
+	case d.Sctx.WakeupChan <- true:
+	default:
+	}
+	return nil
+}
+
+// PauseReboot keeps the daemon from rebooting into the updates it installs,
+// even with AutoReboot on, until UnpauseReboot is called. The pause is kept in
+// the store, so that it lasts across restarts of the daemon and the device.
+// Pausing when paused does nothing.
+func (d *MenderDaemon) PauseReboot() error {
+	changed, err := setRebootPaused(d.Sctx.Store, true)
+	if err == nil && changed {
+		log.Info("Reboots into installed updates paused")
+	}
+	return err
+}
+
+// UnpauseReboot lets the daemon reboot into an installed update again,
+// straight away if one is waiting for it. Unpausing when not paused does
+// nothing.
+func (d *MenderDaemon) UnpauseReboot() error {
+	changed, err := setRebootPaused(d.Sctx.Store, false)
+	if err != nil || !changed {
+		return err
+	}
+	log.Info("Reboots into installed updates unpaused")
+	select {
+	case d.Sctx.WakeupChan <- true:
+	default:
+	}
+	return nil
+}
+
+func (d *MenderDaemon) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d.Status()); err != nil {
+			log.Errorf("Control API: Could not send the status: %s", err)
+		}
+	})
+	mux.HandleFunc("/check", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Info("Control API: Update check requested")
+		d.ForceUpdateCheck()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/suspend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Info("Control API: Suspending polling")
+		d.Suspend()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Info("Control API: Resuming polling")
+		d.Resume()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/channel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var channel ControlChannel
+		if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+			http.Error(w, "invalid channel: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("Control API: Switching to update channel %q", channel.Channel)
+		d.Mender.SetChannel(channel.Channel)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/healthy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := d.ConfirmHealthy(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Info("Control API: Device confirmed healthy")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/reboot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := d.RequestReboot(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Info("Control API: Reboot requested")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := d.AbortUpdate(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Info("Control API: Update aborted")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/pause-reboot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Info("Control API: Pausing reboots")
+		if err := d.PauseReboot(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/unpause-reboot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Info("Control API: Unpausing reboots")
+		if err := d.UnpauseReboot(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
+
+// isControlSocket returns whether address is the path of a unix socket,
+// rather than a TCP address.
+func isControlSocket(address string) bool {
+	return strings.HasPrefix(address, "/")
+}
+
+// listenControl listens on address, which is either the path of a unix
+// socket, or a TCP address on the loopback interface. The socket is only
+// accessible to the user the daemon runs as. The TCP address is accessible to
+// all users of the device, so only the status is served there; see
+// readOnlyControl.
+func listenControl(address string) (net.Listener, error) {
+	if isControlSocket(address) {
+		// Left behind if the daemon did not stop cleanly.
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// The socket is created with the permissions left by the
+		// umask, so it must not be accessible to others at any point.
+		umask := syscall.Umask(0177)
+		listener, err := net.Listen("unix", address)
+		syscall.Umask(umask)
+		return listener, err
+	}
+
+	if err := checkControlAddress(address); err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", address)
+}
+
+// readOnlyControl serves the control API on a TCP address, which any user of
+// the device, and any web page opened on it, can send requests to. Only
+// reading the status is allowed there; everything which changes what the
+// daemon does is only served on the unix socket. Requests for any host but
+// the loopback interface, as sent after a DNS rebinding, are refused too.
+func readOnlyControl(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.Trim(host, "[]")
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, "only requests for localhost are allowed", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "changing the state of the daemon is only allowed "+
+				"on the control socket", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// checkControlAddress returns an error unless address is a TCP address on the
+// loopback interface.
+func checkControlAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.Errorf("the control API is only served on a unix socket "+
+			"or the loopback interface, not on %q", address)
+	}
+	return nil
+}
+
+// startControl starts serving the control API on ControlAddress. Failing to
+// do so is logged, but does not stop the daemon.
+func (d *MenderDaemon) startControl() {
+	if d.ControlAddress == "" {
+		return
+	}
+	listener, err := listenControl(d.ControlAddress)
+	if err != nil {
+		log.Errorf("Could not serve the control API on %s: %s", d.ControlAddress, err)
+		return
+	}
+
+	handler := d.controlHandler()
+	if !isControlSocket(d.ControlAddress) {
+		handler = readOnlyControl(handler)
+	}
+	server := &http.Server{Handler: handler}
+
+	d.controlLock.Lock()
+	d.controlServer = server
+	d.controlLock.Unlock()
+
+	log.Infof("Serving the control API on %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Errorf("Serving the control API failed: %s", err)
+		}
+	}()
+}
+
+func (d *MenderDaemon) stopControl() {
+	d.controlLock.Lock()
+	defer d.controlLock.Unlock()
+	if d.controlServer != nil {
+		d.controlServer.Close()
+		d.controlServer = nil
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlStatus(t *testing.T) {
+	stc := &stateTestController{artifactName: "release-1"}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	handler := daemon.controlHandler()
+
+	getStatus := func() ControlStatus {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var status ControlStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return status
+	}
+
+	daemon.recordState(States.CheckWait)
+	assert.Equal(t, ControlStatus{
+		State:             "check-wait",
+		InstalledArtifact: InstalledArtifact{Name: "release-1"},
+	}, getStatus())
+
+	last := &datastore.LastUpdate{
+		Time:         time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+		DeploymentID: "foo",
+		ArtifactName: "release-2",
+		Status:       client.StatusSuccess,
+	}
+	daemon.Sctx.lastUpdate = last
+	daemon.recordState(States.Idle)
+	assert.Equal(t, ControlStatus{
+		State:             "idle",
+		InstalledArtifact: InstalledArtifact{Name: "release-1"},
+		LastUpdate:        last,
+	}, getStatus())
+
+	// While downloading.
+	daemon.recordState(NewUpdateFetchState(&datastore.UpdateInfo{}))
+	daemon.recordProgress(utils.Progress{Current: 1000, Total: 3000, Rate: 500,
+		ETA: 4 * time.Second})
+	assert.Equal(t, &DownloadProgress{Bytes: 1000, TotalBytes: 3000,
+		BytesPerSecond: 500, ETASeconds: 4}, getStatus().Download)
+	daemon.recordState(States.Idle)
+	assert.Nil(t, getStatus().Download)
+
+	// A device the server does not accept.
+	assert.False(t, getStatus().NotAuthorized)
+	stc.notAuthorized = true
+	assert.True(t, getStatus().NotAuthorized)
+	stc.notAuthorized = false
+
+	// A data directory which has become read-only.
+	assert.False(t, getStatus().DataReadOnly)
+	disk := store.NewReadOnlyFSStore()
+	disk.ReadOnlyFS(true)
+	daemon.Sctx.Store = store.NewFallbackStore(disk)
+	require.NoError(t, daemon.Sctx.Store.WriteAll("foo", []byte("bar")))
+	assert.True(t, getStatus().DataReadOnly)
+	disk.ReadOnlyFS(false)
+	require.NoError(t, daemon.Sctx.Store.WriteAll("foo", []byte("bar")))
+	assert.False(t, getStatus().DataReadOnly)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/status", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestControlStatusPartitions(t *testing.T) {
+	layout := []installer.Partition{
+		{Device: "/dev/mmcblk0p2", Active: true, FreeSpace: 200 * 1024 * 1024},
+		{Device: "/dev/mmcblk0p3", FreeSpace: 1024 * 1024 * 1024},
+	}
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, conf.MenderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			Store:            ms,
+			DualRootfsDevice: FakeDevice{RetPartitions: layout},
+		},
+	})
+	daemon := NewDaemon(mender, ms)
+
+	w := httptest.NewRecorder()
+	daemon.controlHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"partitions":[`+
+		`{"device":"/dev/mmcblk0p2","active":true,"free_space":209715200},`+
+		`{"device":"/dev/mmcblk0p3","active":false,"free_space":1073741824}]`)
+
+	// The rest of the status is still reported when the layout is unknown.
+	daemon.Mender = newTestMender(nil, conf.MenderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			Store: ms,
+			DualRootfsDevice: FakeDevice{
+				RetPartitionsErr: errors.New("no such partition"),
+			},
+		},
+	})
+	assert.Nil(t, daemon.Status().Partitions)
+
+	// Nor are there any without dual rootfs.
+	daemon.Mender = newTestMender(nil, conf.MenderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{Store: ms},
+	})
+	assert.Nil(t, daemon.Status().Partitions)
+}
+
+func TestControlCheck(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{}, store.NewMemStore())
+	handler := daemon.controlHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/check", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Empty(t, daemon.ForceToState)
+
+	// Dropped while an update is in progress.
+	daemon.recordState(NewUpdateFetchState(&datastore.UpdateInfo{ID: "foo"}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Empty(t, daemon.ForceToState)
+	assert.Empty(t, daemon.Sctx.WakeupChan)
+
+	daemon.recordState(States.CheckWait)
+
+	for i := 0; i < 2; i++ {
+		// Asking again before the daemon got to it does not block.
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	assert.Equal(t, States.UpdateCheck, <-daemon.ForceToState)
+	assert.True(t, <-daemon.Sctx.WakeupChan)
+}
+
+func TestControlSuspend(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{}, store.NewMemStore())
+	handler := daemon.controlHandler()
+
+	for _, path := range []string{"/suspend", "/resume"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	}
+	assert.False(t, daemon.Status().Suspended)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/suspend", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.True(t, daemon.Status().Suspended)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/resume", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.False(t, daemon.Status().Suspended)
+	// Resuming wakes the daemon for a poll, once.
+	assert.True(t, <-daemon.Sctx.WakeupChan)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/resume", nil))
+	assert.Empty(t, daemon.Sctx.WakeupChan)
+}
+
+func TestControlChannel(t *testing.T) {
+	stc := &stateTestController{channel: "stable"}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	handler := daemon.controlHandler()
+	assert.Equal(t, "stable", daemon.Status().Channel)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/channel", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/channel",
+		strings.NewReader("beta")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "stable", stc.channel)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/channel",
+		strings.NewReader(`{"channel": "beta"}`)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "beta", stc.channel)
+	assert.Equal(t, "beta", daemon.Status().Channel)
+}
+
+func TestControlHealthy(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{}, store.NewMemStore())
+	handler := daemon.controlHandler()
+
+	// Nothing is waiting for it.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/healthy", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, daemon.Sctx.HealthyChan)
+
+	daemon.recordState(NewUpdateHealthWaitState(&datastore.UpdateInfo{ID: "foo"},
+		time.Now().Add(time.Hour)))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthy", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/healthy", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	assert.True(t, <-daemon.Sctx.HealthyChan)
+}
+
+func TestControlReboot(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{noAutoReboot: true}, store.NewMemStore())
+	handler := daemon.controlHandler()
+
+	// No update is waiting for it.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reboot", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, daemon.Sctx.RebootChan)
+
+	daemon.recordState(NewUpdateRebootWaitState(&datastore.UpdateInfo{ID: "foo"}))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reboot", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reboot", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	assert.True(t, <-daemon.Sctx.RebootChan)
+}
+
+func TestControlAbort(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{}, store.NewMemStore())
+	handler := daemon.controlHandler()
+	update := &datastore.UpdateInfo{ID: "foo"}
+
+	// Nothing is being downloaded, or it is too late.
+	for _, state := range []State{States.Idle, NewUpdateAfterStoreState(update)} {
+		daemon.recordState(state)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/abort", nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.NoError(t, daemon.Sctx.aborter.aborted())
+	}
+
+	daemon.recordState(NewUpdateStoreState(ioutil.NopCloser(nil), update))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/abort", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/abort", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	assert.Error(t, daemon.Sctx.aborter.aborted())
+}
+
+func TestControlPauseReboot(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{}, store.NewMemStore())
+	handler := daemon.controlHandler()
+
+	for _, path := range []string{"/pause-reboot", "/unpause-reboot"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	}
+	assert.False(t, daemon.Status().RebootPaused)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/pause-reboot", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.True(t, daemon.Status().RebootPaused)
+	}
+
+	// No reboot while paused.
+	daemon.recordState(NewUpdateRebootWaitState(&datastore.UpdateInfo{ID: "foo"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reboot", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/unpause-reboot", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.False(t, daemon.Status().RebootPaused)
+	}
+	// Unpausing wakes the daemon, once.
+	assert.True(t, <-daemon.Sctx.WakeupChan)
+	assert.Empty(t, daemon.Sctx.WakeupChan)
+}
+
+func TestControlAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:9101", "localhost:9101", "[::1]:9101"} {
+		assert.NoError(t, checkControlAddress(address), address)
+	}
+	for _, address := range []string{"0.0.0.0:9101", ":9101", "192.168.1.2:9101", "control.sock"} {
+		assert.Error(t, checkControlAddress(address), address)
+	}
+}
+
+func TestControlReadOnly(t *testing.T) {
+	daemon := NewDaemon(&stateTestController{}, store.NewMemStore())
+	handler := readOnlyControl(daemon.controlHandler())
+
+	request := func(method, path, host string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Host = host
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, host := range []string{"localhost:9101", "127.0.0.1:9101", "[::1]:9101", "localhost"} {
+		assert.Equal(t, http.StatusOK, request(http.MethodGet, "/status", host), host)
+	}
+	// As sent by a web page after rebinding its name to the loopback
+	// interface.
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodGet, "/status", "attacker.example.com:9101"))
+	// Any user can connect; none of them may change what the daemon does.
+	for _, path := range []string{"/check", "/suspend", "/resume", "/channel", "/healthy",
+		"/reboot", "/abort", "/pause-reboot", "/unpause-reboot"} {
+
+		assert.Equal(t, http.StatusForbidden,
+			request(http.MethodPost, path, "localhost:9101"), path)
+	}
+	assert.False(t, daemon.isSuspended())
+}
+
+func TestDaemonControlSocket(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestDaemonControlSocket")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	socket := path.Join(tmpdir, "control.sock")
+
+	stc := &slowTransitionController{
+		stateTestController: stateTestController{
+			state:        States.Idle,
+			artifactName: "release-1",
+		},
+		delay: 10 * time.Millisecond,
+	}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	daemon.ControlAddress = socket
+
+	done := make(chan error)
+	go func() { done <- daemon.Run() }()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		rsp, err = httpClient.Get("http://mender/status")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	var status ControlStatus
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&status))
+	rsp.Body.Close()
+	assert.Equal(t, "idle", status.State)
+	assert.Equal(t, "release-1", status.InstalledArtifact.Name)
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	daemon.StopDaemon()
+	assert.NoError(t, <-done)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
@@ -14,21 +14,54 @@
 package app
 
 import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
 	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
 	"github.com/mendersoftware/mender/system"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 // Config section
 
+// How long Shutdown waits for the daemon if StopTimeout is not set.
+const defaultStopTimeout = 60 * time.Second
+
 type MenderDaemon struct {
 	Mender       Controller
 	Sctx         StateContext
 	Store        store.Store
 	ForceToState chan State
-	stop         bool
+	// Configuration to apply, read again from the configuration files.
+	ReloadConfig chan *conf.MenderConfig
+	// How long Shutdown waits for the running state to finish.
+	StopTimeout time.Duration
+	// If set, metrics are served on this address while the daemon runs.
+	MetricsAddress string
+	// If set, the local control API is served on this unix socket path or
+	// loopback address while the daemon runs.
+	ControlAddress string
+	stop           bool
+	running        sync.WaitGroup
+	metricsLock    sync.Mutex
+	metricsServer  *http.Server
+	controlLock    sync.Mutex
+	controlServer  *http.Server
+	// What the control API reports.
+	statusLock sync.Mutex
+	state      datastore.MenderState
+	inUpdate   bool
+	lastUpdate *datastore.LastUpdate
+	download   *DownloadProgress
+	suspended  bool
 }
 
 func NewDaemon(mender Controller, store store.Store) *MenderDaemon {
@@ -36,18 +69,149 @@ func NewDaemon(mender Controller, store store.Store) *MenderDaemon {
 	daemon := MenderDaemon{
 		Mender: mender,
 		Sctx: StateContext{
-			Store:      store,
-			Rebooter:   system.NewSystemRebootCmd(system.OsCalls{}),
-			WakeupChan: make(chan bool, 1),
+			Store:       store,
+			Rebooter:    system.NewSystemRebootCmd(system.OsCalls{}),
+			WakeupChan:  make(chan bool, 1),
+			HealthyChan: make(chan bool, 1),
+			RebootChan:  make(chan bool, 1),
 		},
 		Store:        store,
 		ForceToState: make(chan State, 1),
+		ReloadConfig: make(chan *conf.MenderConfig, 1),
+	}
+	if m, ok := mender.(interface {
+		SetUpdateProgressCallback(utils.ProgressFunc)
+	}); ok {
+		m.SetUpdateProgressCallback(daemon.recordProgress)
 	}
 	return &daemon
 }
 
+// NewRebooter returns the Rebooter which config's RebootMethod asks for.
+func NewRebooter(config *conf.MenderConfig, command system.Commander) (installer.Rebooter, error) {
+	switch config.RebootMethod {
+	case "", conf.RebootMethodCommand:
+		if len(config.RebootCommand) == 0 {
+			return system.NewSystemRebootCmd(command), nil
+		}
+		return system.NewRebootCommand(command, config.RebootCommand...), nil
+	case conf.RebootMethodSystemd:
+		return system.NewRebootCommand(command, "systemctl", "reboot"), nil
+	case conf.RebootMethodSyscall:
+		return system.SyscallReboot{}, nil
+	default:
+		return nil, errors.Errorf("Unknown RebootMethod: %q", config.RebootMethod)
+	}
+}
+
 func (d *MenderDaemon) StopDaemon() {
 	d.stop = true
+	d.stopMetrics()
+	d.stopControl()
+	d.cancelRequests()
+	d.cancelFetchRetries()
+}
+
+// cancelFetchRetries ends the wait for retrying a failed download of an
+// update, which the fetch state then handles as the failure it is.
+func (d *MenderDaemon) cancelFetchRetries() {
+	if m, ok := d.Mender.(interface {
+		CancelFetchRetries()
+	}); ok {
+		m.CancelFetchRetries()
+	}
+}
+
+// cancelRequests makes a request to the server which the daemon waits for,
+// such as an update check, give up at once, so that stopping does not have to
+// wait for it to time out. Of an update, only such requests as the daemon can
+// pick up again on the next start are safe to cancel, so requests are left to
+// finish while one is in progress.
+func (d *MenderDaemon) cancelRequests() {
+	d.statusLock.Lock()
+	inUpdate := d.inUpdate
+	d.statusLock.Unlock()
+	if inUpdate {
+		return
+	}
+	if m, ok := d.Mender.(interface {
+		CancelRequests()
+	}); ok {
+		m.CancelRequests()
+	}
+}
+
+// startMetrics starts serving /metrics on MetricsAddress. Failing to do so is
+// logged, but does not stop the daemon.
+func (d *MenderDaemon) startMetrics() {
+	if d.MetricsAddress == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", d.MetricsAddress)
+	if err != nil {
+		log.Errorf("Could not serve metrics on %s: %s", d.MetricsAddress, err)
+		return
+	}
+
+	if d.Sctx.metrics == nil {
+		d.Sctx.metrics = NewMetrics()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.Sctx.metrics)
+	server := &http.Server{Handler: mux}
+
+	d.metricsLock.Lock()
+	d.metricsServer = server
+	d.metricsLock.Unlock()
+
+	log.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Errorf("Serving metrics failed: %s", err)
+		}
+	}()
+}
+
+func (d *MenderDaemon) stopMetrics() {
+	d.metricsLock.Lock()
+	defer d.metricsLock.Unlock()
+	if d.metricsServer != nil {
+		d.metricsServer.Close()
+		d.metricsServer = nil
+	}
+}
+
+// Shutdown stops the daemon, and waits for it to finish the state it is
+// running. States are never interrupted, so an update which is being written
+// to disk is allowed to complete that step, and the daemon picks up from the
+// stored state on the next start. Outside of updates, a request to the server
+// which the state waits for is cancelled, see cancelRequests. An error is
+// returned if the daemon does not stop within StopTimeout.
+func (d *MenderDaemon) Shutdown() error {
+	d.StopDaemon()
+	// Wake up the daemon if it is waiting for the next poll.
+	select {
+	case d.Sctx.WakeupChan <- true:
+	default:
+	}
+
+	timeout := d.StopTimeout
+	if timeout == 0 {
+		timeout = defaultStopTimeout
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		return errors.Errorf("daemon did not stop within %v, while in state %s",
+			timeout, d.Mender.GetCurrentState())
+	}
 }
 
 func (d *MenderDaemon) Cleanup() {
@@ -64,10 +228,53 @@ func (d *MenderDaemon) shouldStop() bool {
 }
 
 func (d *MenderDaemon) Run() error {
+	d.running.Add(1)
+	defer d.running.Done()
+
+	d.startMetrics()
+	defer d.stopMetrics()
+	if decommissioned(d.Sctx.Store) {
+		log.Warnf("The server has decommissioned the device; not running. "+
+			"Remove %q from the store to put it back in service.",
+			datastore.DecommissionedKey)
+		return nil
+	}
+	if err := d.Mender.CheckClock(); err != nil {
+		log.Errorf("%s; connecting to the server will fail until the clock is right", err)
+	}
+	d.loadLastUpdate()
+	d.startControl()
+	defer d.stopControl()
+
+	if delay := d.Mender.GetStartupDelay(); delay > 0 {
+		delay = time.Duration(pollJitterRand() * float64(delay))
+		log.Infof("Delaying the first update check by %v", delay)
+		d.Sctx.updateCheckNotBefore = time.Now().Add(delay)
+	}
+
+	if err := watchdog(&d.Sctx).Enable(); err != nil {
+		log.Errorf("Could not enable the watchdog: %s", err)
+	}
+	defer func() {
+		if err := watchdog(&d.Sctx).Disable(); err != nil {
+			log.Errorf("Could not disable the watchdog: %s", err)
+		}
+	}()
+
 	// set the first state transition
 	var toState State = d.Mender.GetCurrentState()
+	d.recordState(toState)
 	cancelled := false
 	for {
+		// A new configuration is only applied in between states, so the
+		// state which is running, or an update in progress, is not
+		// disturbed.
+		select {
+		case config := <-d.ReloadConfig:
+			d.Mender.ReloadConfig(config)
+		default:
+		}
+
 		// If signal SIGUSR1 or SIGUSR2 is received, force the state-machine to the correct state.
 		select {
 		case nState := <-d.ForceToState:
@@ -85,7 +292,30 @@ func (d *MenderDaemon) Run() error {
 		default:
 			// Identity op - do nothing.
 		}
-		toState, cancelled = d.Mender.TransitionState(toState, &d.Sctx)
+		// While suspended, the next poll waits until polling is resumed.
+		switch toState.(type) {
+		case *authorizeState, *updateCheckState, *inventoryUpdateState:
+			if d.isSuspended() {
+				log.Infof("Polling is suspended; %s waits until polling is resumed", toState)
+				d.waitForResume()
+				if d.shouldStop() {
+					log.Infof("Shutting down.")
+					return nil
+				}
+			}
+		}
+
+		// Waiting for the next poll takes as long as the poll interval.
+		if _, ok := toState.(WaitState); ok {
+			stopPetting := keepWatchdogPetted(&d.Sctx)
+			toState, cancelled = d.Mender.TransitionState(toState, &d.Sctx)
+			stopPetting()
+		} else {
+			petWatchdog(&d.Sctx)
+			toState, cancelled = d.Mender.TransitionState(toState, &d.Sctx)
+		}
+		d.Sctx.metrics.setState(toState.Id())
+		d.recordState(toState)
 		if toState.Id() == datastore.MenderStateError {
 			es, ok := toState.(*errorState)
 			if ok {
@@ -106,3 +336,68 @@ func (d *MenderDaemon) Run() error {
 	}
 	return nil
 }
+
+// ErrorUpdateApplied is returned by RunOnce when it installed an update.
+var ErrorUpdateApplied = errors.New("Update applied")
+
+// RunOnce runs a single update cycle instead of polling: it checks for an
+// update, installs it if there is one, and returns once the state machine is
+// back to waiting for the next check. An update which was in progress when the
+// client last stopped is finished instead of checking for a new one.
+//
+// It returns nil if there was no update, ErrorUpdateApplied if an update was
+// installed, and any other error if the update or the check failed. Updates
+// which need a reboot reboot the device, just like the daemon would; the next
+// start of the client finishes them.
+func (d *MenderDaemon) RunOnce() error {
+	var toState State = d.Mender.GetCurrentState()
+	var lastErr error
+	var status string
+	checked := false
+	authorizing := false
+	for {
+		switch state := toState.(type) {
+		case *checkWaitState:
+			if checked || status != "" {
+				return runOnceResult(status, lastErr)
+			}
+			toState = States.UpdateCheck
+			checked = true
+		case *authorizeWaitState:
+			// The first wait is immediately followed by an
+			// authorization attempt, give up if that one fails.
+			if authorizing {
+				return errors.New("authorization failed")
+			}
+			authorizing = true
+		case *updateStatusReportState:
+			status = state.status
+			if state.dryRun != nil && state.dryRun.Installable {
+				status = datastore.LastUpdateDryRun
+			}
+		}
+
+		var cancelled bool
+		toState, cancelled = d.Mender.TransitionState(toState, &d.Sctx)
+		if es, ok := toState.(*errorState); ok {
+			if es.IsFatal() {
+				return es.cause
+			}
+			lastErr = es.cause
+		}
+		if cancelled || toState.Id() == datastore.MenderStateDone {
+			return runOnceResult(status, lastErr)
+		}
+	}
+}
+
+func runOnceResult(status string, err error) error {
+	switch status {
+	case "", client.StatusAlreadyInstalled, datastore.LastUpdateDryRun:
+		return err
+	case client.StatusSuccess:
+		return ErrorUpdateApplied
+	default:
+		return errors.Errorf("update finished with status: %s", status)
+	}
+}
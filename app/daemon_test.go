@@ -18,6 +18,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +30,7 @@ import (
 	"github.com/mendersoftware/mender/datastore"
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/system"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,6 +42,24 @@ type FakeDevice struct {
 	RetRollback    error
 	RetHasUpdate   bool
 	ConsumeUpdate  bool
+	RetInvalidate  error
+	// Counts calls to InvalidatePartition, if set. A pointer, since
+	// FakeDevice is passed around by value.
+	InvalidateCalls *int
+	RetFreeSpace    uint64
+	RetFreeSpaceErr error
+
+	// Partitions to report; GetActive and GetInactive fail if not set.
+	RetActive         string
+	RetInactive       string
+	RetEnableInactive error
+	// Counts calls to EnableInactive, if set.
+	EnableInactiveCalls *int
+	// How long InstallUpdate takes.
+	InstallDelay time.Duration
+	// Layout for Partitions to report.
+	RetPartitions    []installer.Partition
+	RetPartitionsErr error
 }
 
 func (f FakeDevice) NeedsReboot() (installer.RebootAction, error) {
@@ -84,7 +105,23 @@ func (f FakeDevice) FinishStoreUpdate() error {
 	return nil
 }
 
+func (f FakeDevice) InvalidatePartition() error {
+	if f.InvalidateCalls != nil {
+		*f.InvalidateCalls++
+	}
+	return f.RetInvalidate
+}
+
+func (f FakeDevice) FreeSpace() (uint64, error) {
+	return f.RetFreeSpace, f.RetFreeSpaceErr
+}
+
+func (f FakeDevice) Partitions() ([]installer.Partition, error) {
+	return f.RetPartitions, f.RetPartitionsErr
+}
+
 func (f FakeDevice) InstallUpdate() error {
+	time.Sleep(f.InstallDelay)
 	return f.RetEnablePart
 }
 
@@ -116,11 +153,32 @@ func (f FakeDevice) Cleanup() error {
 }
 
 func (f FakeDevice) GetActive() (string, error) {
-	return "", errors.New("Not implemented")
+	if f.RetActive == "" {
+		return "", errors.New("Not implemented")
+	}
+	return f.RetActive, nil
 }
 
 func (f FakeDevice) GetInactive() (string, error) {
-	return "", errors.New("Not implemented")
+	if f.RetInactive == "" {
+		return "", errors.New("Not implemented")
+	}
+	return f.RetInactive, nil
+}
+
+func (f FakeDevice) EnableInactive() error {
+	if f.EnableInactiveCalls != nil {
+		*f.EnableInactiveCalls++
+	}
+	return f.RetEnableInactive
+}
+
+func (f FakeDevice) IsInactiveMounted() (bool, error) {
+	return false, nil
+}
+
+func (f FakeDevice) InactiveIsSafe() (bool, error) {
+	return true, nil
 }
 
 func (f FakeDevice) NewUpdateStorer(string, int) (handlers.UpdateStorer, error) {
@@ -174,6 +232,275 @@ func TestDaemon(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+// checkErrUpdater fails every update check with err.
+type checkErrUpdater struct {
+	err error
+}
+
+func (c checkErrUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current *client.CurrentUpdate) (interface{}, error) {
+	return nil, c.err
+}
+
+func (c checkErrUpdater) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	return nil, -1, errors.New("not implemented")
+}
+
+// slowUpdater has an update, the download of which hangs until release is
+// closed.
+type slowUpdater struct {
+	checks      *int32
+	downloading chan struct{}
+	release     chan struct{}
+}
+
+func (s slowUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current *client.CurrentUpdate) (interface{}, error) {
+	atomic.AddInt32(s.checks, 1)
+	update := datastore.UpdateInfo{ID: "slow"}
+	update.Artifact.ArtifactName = "release-2"
+	update.Artifact.CompatibleDevices = []string{"fake-device"}
+	update.Artifact.Source.URI = "https://localhost/artifact"
+	return update, nil
+}
+
+func (s slowUpdater) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	return ioutil.NopCloser(s), 1024, nil
+}
+
+func (s slowUpdater) Read(p []byte) (int, error) {
+	select {
+	case s.downloading <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestDaemonNoOverlappingUpdates(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-overlap-")
+	defer os.RemoveAll(td)
+	DeploymentLogger = NewDeploymentLogManager(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-1"), 0600)
+
+	ms := store.NewMemStore()
+	ms.WriteAll(datastore.AuthTokenName, []byte("token"))
+	mender := newTestMender(nil,
+		conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{
+				Servers:                   []client.MenderServer{{ServerURL: "https://localhost"}},
+				UpdatePollIntervalSeconds: 1,
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				Store: ms,
+			},
+		})
+	mender.ArtifactInfoFile = artifactInfo
+	var checks int32
+	updater := slowUpdater{
+		checks:      &checks,
+		downloading: make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+	mender.updater = updater
+	mender.state = States.UpdateCheck
+
+	d := NewDaemon(mender, ms)
+	d.StopTimeout = 10 * time.Second
+	done := make(chan error, 1)
+	go func() { done <- d.Run() }()
+
+	select {
+	case <-updater.downloading:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the download did not start")
+	}
+	// Neither the poll interval running out, nor asking for checks, starts
+	// another update while the download hangs.
+	for i := 0; i < 3; i++ {
+		d.ForceUpdateCheck()
+		d.ForceInventoryUpdate()
+	}
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&checks))
+	assert.Empty(t, d.ForceToState)
+
+	// Stopping waits for the download to give up.
+	stopped := make(chan error, 1)
+	go func() { stopped <- d.Shutdown() }()
+	time.Sleep(100 * time.Millisecond)
+	close(updater.release)
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(15 * time.Second):
+		t.Fatal("the daemon did not stop")
+	}
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&checks))
+}
+
+// countingUpdater never has an update.
+type countingUpdater struct {
+	checks *int32
+}
+
+func (c countingUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current *client.CurrentUpdate) (interface{}, error) {
+	atomic.AddInt32(c.checks, 1)
+	return nil, nil
+}
+
+func (c countingUpdater) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	return nil, -1, errors.New("not implemented")
+}
+
+func TestDaemonSuspend(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-suspend-")
+	defer os.RemoveAll(td)
+	DeploymentLogger = NewDeploymentLogManager(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-1"), 0600)
+
+	ms := store.NewMemStore()
+	ms.WriteAll(datastore.AuthTokenName, []byte("token"))
+	mender := newTestMender(nil,
+		conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{
+				Servers:                      []client.MenderServer{{ServerURL: "https://localhost"}},
+				UpdatePollIntervalSeconds:    1,
+				InventoryPollIntervalSeconds: 3600,
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				Store: ms,
+			},
+		})
+	mender.ArtifactInfoFile = artifactInfo
+	var checks int32
+	mender.updater = countingUpdater{checks: &checks}
+	mender.state = States.UpdateCheck
+
+	d := NewDaemon(mender, ms)
+	d.Suspend()
+	assert.True(t, d.Status().Suspended)
+	done := make(chan error, 1)
+	go func() { done <- d.Run() }()
+
+	// Nothing is polled while suspended, not even when asked to.
+	time.Sleep(500 * time.Millisecond)
+	d.ForceUpdateCheck()
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&checks))
+
+	// Resuming polls straight away, and then on schedule.
+	d.Resume()
+	assert.False(t, d.Status().Suspended)
+	time.Sleep(1500 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&checks) >= 2)
+
+	d.Suspend()
+	time.Sleep(100 * time.Millisecond)
+	suspendedAt := atomic.LoadInt32(&checks)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, suspendedAt, atomic.LoadInt32(&checks))
+
+	// A suspended daemon still stops.
+	assert.NoError(t, d.Shutdown())
+	assert.NoError(t, <-done)
+}
+
+func TestDaemonDecommissioned(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-decommission-")
+	defer os.RemoveAll(td)
+	DeploymentLogger = NewDeploymentLogManager(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+
+	ms := store.NewMemStore()
+	ms.WriteAll(datastore.AuthTokenName, []byte("token"))
+	ms.WriteAll(datastore.ArtifactNameKey, []byte("fake-id"))
+	mender := newTestMender(nil,
+		conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{
+				Servers: []client.MenderServer{{ServerURL: "https://localhost"}},
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				Store: ms,
+			},
+		})
+	mender.ArtifactInfoFile = artifactInfo
+	mender.updater = checkErrUpdater{&client.DecommissionedError{Wipe: true}}
+
+	run := func() {
+		mender.state = States.UpdateCheck
+		d := NewDaemon(mender, ms)
+		done := make(chan error, 1)
+		go func() { done <- d.Run() }()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			d.StopDaemon()
+			t.Fatal("the daemon did not stop")
+		}
+	}
+
+	run()
+	assert.Equal(t, datastore.MenderStateDecommissioned, mender.state.Id())
+	_, err := ms.ReadAll(datastore.DecommissionedKey)
+	assert.NoError(t, err)
+	_, err = ms.ReadAll(datastore.AuthTokenName)
+	assert.True(t, os.IsNotExist(err))
+	name, err := ms.ReadAll(datastore.ArtifactNameKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-id", string(name))
+
+	// Once decommissioned, the daemon stops straight away, even if the
+	// server has changed its mind.
+	mender.updater = checkErrUpdater{}
+	run()
+	assert.Equal(t, States.UpdateCheck, mender.state)
+}
+
+func TestNewRebooter(t *testing.T) {
+	command := system.OsCalls{}
+	for method, expected := range map[string]installer.Rebooter{
+		"":                       system.NewSystemRebootCmd(command),
+		conf.RebootMethodCommand: system.NewSystemRebootCmd(command),
+		conf.RebootMethodSystemd: system.NewRebootCommand(command, "systemctl", "reboot"),
+		conf.RebootMethodSyscall: system.SyscallReboot{},
+	} {
+		rebooter, err := NewRebooter(&conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{RebootMethod: method},
+		}, command)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, rebooter, method)
+	}
+
+	rebooter, err := NewRebooter(&conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			RebootCommand: []string{"/sbin/shutdown", "-r", "now"},
+		},
+	}, command)
+	assert.NoError(t, err)
+	assert.Equal(t, system.NewRebootCommand(command, "/sbin/shutdown", "-r", "now"), rebooter)
+
+	_, err = NewRebooter(&conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{RebootMethod: "kexec"},
+	}, command)
+	assert.Error(t, err)
+}
+
 func TestDaemonCleanup(t *testing.T) {
 	mstore := &store.MockStore{}
 	mstore.On("Close").Return(nil)
@@ -275,3 +602,249 @@ func TestDaemonRun(t *testing.T) {
 		assert.Equal(t, States.CheckWait, daemon.Mender.GetCurrentState())
 	})
 }
+
+// slowTransitionController spends delay in every state, and signals entered,
+// if set, when it starts one.
+type slowTransitionController struct {
+	stateTestController
+	delay   time.Duration
+	entered chan struct{}
+}
+
+func (s *slowTransitionController) TransitionState(_ State, ctx *StateContext) (State, bool) {
+	if s.entered != nil {
+		select {
+		case s.entered <- struct{}{}:
+		default:
+		}
+	}
+	time.Sleep(s.delay)
+	return s.state, false
+}
+
+func TestDaemonShutdown(t *testing.T) {
+	stc := &slowTransitionController{
+		stateTestController: stateTestController{state: States.Idle},
+		delay:               100 * time.Millisecond,
+		entered:             make(chan struct{}, 1),
+	}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	daemon.StopTimeout = time.Second
+
+	done := make(chan error)
+	go func() { done <- daemon.Run() }()
+	<-stc.entered
+	assert.NoError(t, daemon.Shutdown())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("daemon still running after Shutdown returned")
+	}
+
+	// The running state is not interrupted, even if it takes too long.
+	stc.delay = 500 * time.Millisecond
+	stc.entered = make(chan struct{}, 1)
+	daemon = NewDaemon(stc, store.NewMemStore())
+	daemon.StopTimeout = 50 * time.Millisecond
+	go func() { done <- daemon.Run() }()
+	<-stc.entered
+	assert.Error(t, daemon.Shutdown())
+	assert.NoError(t, <-done)
+}
+
+// cancellingController counts the times its requests are cancelled.
+type cancellingController struct {
+	stateTestController
+	cancelled int
+}
+
+func (c *cancellingController) CancelRequests() {
+	c.cancelled++
+}
+
+func TestDaemonStopCancelsRequests(t *testing.T) {
+	c := &cancellingController{
+		stateTestController: stateTestController{state: States.UpdateCheck},
+	}
+	daemon := NewDaemon(c, store.NewMemStore())
+	daemon.recordState(States.UpdateCheck)
+	daemon.StopDaemon()
+	assert.Equal(t, 1, c.cancelled)
+
+	// The requests of an update are left to finish.
+	daemon.recordState(NewUpdateFetchState(&datastore.UpdateInfo{ID: "foo"}))
+	daemon.StopDaemon()
+	assert.Equal(t, 1, c.cancelled)
+}
+
+func TestDaemonReloadConfig(t *testing.T) {
+	stc := &slowTransitionController{
+		stateTestController: stateTestController{
+			state:           States.CheckWait,
+			updatePollIntvl: time.Hour,
+		},
+	}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	daemon.ReloadConfig <- &conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			UpdatePollIntervalSeconds: 5,
+		},
+	}
+	daemon.StopDaemon() // Stop after a single pass.
+	assert.NoError(t, daemon.Run())
+	assert.Equal(t, 5*time.Second, stc.GetUpdatePollInterval())
+}
+
+func TestDaemonStartupDelay(t *testing.T) {
+	oldRand := pollJitterRand
+	defer func() { pollJitterRand = oldRand }()
+	pollJitterRand = func() float64 { return 0.5 }
+
+	stc := &slowTransitionController{
+		stateTestController: stateTestController{
+			state:           States.CheckWait,
+			updatePollIntvl: time.Minute,
+			inventPollIntvl: 24 * time.Hour,
+			startupDelay:    time.Hour,
+		},
+	}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	daemon.StopDaemon() // Stop after a single pass.
+	assert.NoError(t, daemon.Run())
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute),
+		daemon.Sctx.updateCheckNotBefore, time.Second)
+
+	// The first check waits for the delay, rather than going ahead.
+	cws := NewCheckWaitState().(*checkWaitState)
+	cws.WaitState = &waitStateTest{baseState{id: datastore.MenderStateCheckWait}}
+	daemon.Sctx.lastInventoryUpdateAttempt = time.Now()
+	s, _ := cws.Handle(&daemon.Sctx, stc)
+	assert.IsType(t, &updateCheckState{}, s)
+	assert.Equal(t, daemon.Sctx.updateCheckNotBefore, daemon.Sctx.lastUpdateCheckAttempt)
+
+	// Without a delay the first check is not held back.
+	stc.startupDelay = 0
+	daemon = NewDaemon(stc, store.NewMemStore())
+	daemon.StopDaemon()
+	assert.NoError(t, daemon.Run())
+	assert.True(t, daemon.Sctx.updateCheckNotBefore.IsZero())
+}
+
+// runOnceTestController runs the states it is given, but skips downloading
+// and installing updates: they are reported with installStatus right away.
+type runOnceTestController struct {
+	daemonTestController
+	installStatus string
+	dryRunResult  *datastore.DryRunResult
+}
+
+func (r *runOnceTestController) TransitionState(to State, ctx *StateContext) (State, bool) {
+	next, cancel := to.Handle(ctx, r)
+	if fetch, ok := next.(*updateFetchState); ok {
+		if r.dryRunResult != nil {
+			next = NewDryRunStatusReportState(fetch.Update(), r.dryRunResult)
+		} else {
+			next = NewUpdateStatusReportState(fetch.Update(), r.installStatus)
+		}
+	}
+	r.state = next
+	return next, cancel
+}
+
+func TestDaemonRunOnce(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{ID: "foo"}
+
+	tests := map[string]struct {
+		authorized    bool
+		updateResp    *datastore.UpdateInfo
+		updateRespErr menderError
+		authorizeErr  menderError
+		installStatus string
+		dryRunResult  *datastore.DryRunResult
+		err           error
+		errMsg        string
+		reportStatus  string
+	}{
+		"no update": {
+			authorized: true,
+		},
+		"update applied": {
+			authorized:    true,
+			updateResp:    update,
+			installStatus: client.StatusSuccess,
+			err:           ErrorUpdateApplied,
+			reportStatus:  client.StatusSuccess,
+		},
+		"update failed": {
+			authorized:    true,
+			updateResp:    update,
+			installStatus: client.StatusFailure,
+			errMsg:        "update finished with status: failure",
+			reportStatus:  client.StatusFailure,
+		},
+		"dry run": {
+			authorized:   true,
+			updateResp:   update,
+			dryRunResult: &datastore.DryRunResult{Installable: true},
+			reportStatus: client.StatusFailure,
+		},
+		"dry run failed": {
+			authorized:   true,
+			updateResp:   update,
+			dryRunResult: &datastore.DryRunResult{Error: "checksum mismatch"},
+			errMsg:       "update finished with status: failure",
+			reportStatus: client.StatusFailure,
+		},
+		"already installed": {
+			authorized:    true,
+			updateResp:    update,
+			updateRespErr: NewTransientError(os.ErrExist),
+			reportStatus:  client.StatusAlreadyInstalled,
+		},
+		"check failed": {
+			authorized:    true,
+			updateRespErr: NewTransientError(errors.New("server unreachable")),
+			errMsg:        "transient error: server unreachable",
+		},
+		"authorized on the way": {},
+		"not authorized": {
+			authorizeErr: NewTransientError(errors.New("unauthorized")),
+			errMsg:       "authorization failed",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rtc := &runOnceTestController{
+				daemonTestController: daemonTestController{
+					stateTestController: stateTestController{
+						state:         States.Init,
+						authorized:    test.authorized,
+						updateResp:    test.updateResp,
+						updateRespErr: test.updateRespErr,
+						authorizeErr:  test.authorizeErr,
+					},
+				},
+				installStatus: test.installStatus,
+				dryRunResult:  test.dryRunResult,
+			}
+			daemon := NewDaemon(rtc, store.NewMemStore())
+
+			err := daemon.RunOnce()
+			if test.errMsg != "" {
+				assert.EqualError(t, err, test.errMsg)
+			} else {
+				assert.Equal(t, test.err, err)
+			}
+			assert.Equal(t, test.reportStatus, rtc.reportStatus)
+			if test.authorizeErr == nil {
+				assert.Equal(t, 1, rtc.updateCheckCount)
+			}
+		})
+	}
+}
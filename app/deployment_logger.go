@@ -15,6 +15,7 @@ package app
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,10 +25,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/mendersoftware/mender/conf"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // error messages
@@ -61,6 +64,45 @@ func NewFileLogger(name string) *FileLogger {
 	}
 }
 
+// memoryLog keeps a deployment log which cannot be written to the log
+// directory, up to limit bytes of its most recent entries.
+type memoryLog struct {
+	lock  sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (m *memoryLog) Write(p []byte) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n, err := m.buf.Write(p)
+	if excess := m.buf.Len() - m.limit; excess > 0 {
+		m.buf.Next(excess)
+		// Drop the rest of the entry cut off at the start.
+		m.buf.ReadBytes('\n')
+	}
+	return n, err
+}
+
+func (m *memoryLog) Close() error {
+	return nil
+}
+
+func (m *memoryLog) contents() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]byte{}, m.buf.Bytes()...)
+}
+
+// logDirReadOnly returns whether dir is on a read-only filesystem.
+var logDirReadOnly = func(dir string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Flags&unix.ST_RDONLY != 0
+}
+
 func (fl *FileLogger) Write(log []byte) (int, error) {
 	return fl.logFile.Write(log)
 }
@@ -77,6 +119,8 @@ type DeploymentLogManager struct {
 	maxLogFiles int
 
 	minLogSizeBytes uint64
+	// at most how much of the log is handed over for uploading
+	maxUploadBytes int
 	// it is easy to add logging hook, but not so much remove it;
 	// we need a mechanism for emabling and disabling logging
 	loggingEnabled bool
@@ -93,6 +137,7 @@ func NewDeploymentLogManager(logDirLocation string) *DeploymentLogManager {
 		// for now we can hardcode this
 		maxLogFiles:     5,
 		minLogSizeBytes: 1024 * 100, //100kb
+		maxUploadBytes:  1024 * 1024,
 		loggingEnabled:  false,
 	}
 }
@@ -120,18 +165,31 @@ func (dlm *DeploymentLogManager) Enable(deploymentID string) error {
 		return nil
 	}
 
-	if !dlm.haveEnoughSpaceForStoringLogs() {
+	readOnly := logDirReadOnly(dlm.logLocation)
+	if !readOnly && !dlm.haveEnoughSpaceForStoringLogs() {
 		return ErrNotEnoughSpaceForLogs
 	}
 
 	dlm.deploymentID = deploymentID
+	logFileName := filepath.Join(dlm.logLocation,
+		fmt.Sprintf(logFileNameScheme, 1, deploymentID))
+
+	if readOnly {
+		// The log is kept, and can be uploaded, all the same; only
+		// not across restarts.
+		log.Warnf("The log directory %s is read-only; keeping the deployment log in memory",
+			dlm.logLocation)
+		dlm.logger = &FileLogger{
+			logFileName: logFileName,
+			logFile:     &memoryLog{limit: 2 * dlm.maxUploadBytes},
+		}
+	} else {
+		// we might have new deployment so might need to rotate files
+		dlm.Rotate()
 
-	// we might have new deployment so might need to rotate files
-	dlm.Rotate()
-
-	// instantiate logger
-	logFileName := fmt.Sprintf(logFileNameScheme, 1, deploymentID)
-	dlm.logger = NewFileLogger(filepath.Join(dlm.logLocation, logFileName))
+		// instantiate logger
+		dlm.logger = NewFileLogger(logFileName)
+	}
 
 	if dlm.logger == nil {
 		return ErrLoggerNotInitialized
@@ -241,6 +299,21 @@ func (dlm DeploymentLogManager) findLogsForSpecificID(deploymentID string) (stri
 	return "", os.ErrNotExist
 }
 
+// memoryLogOf returns the log of the deployment, if it is kept in memory.
+func (dlm DeploymentLogManager) memoryLogOf(deploymentID string) *memoryLog {
+	if dlm.logger == nil || dlm.deploymentID != deploymentID {
+		return nil
+	}
+	mem, _ := dlm.logger.logFile.(*memoryLog)
+	return mem
+}
+
+// InMemory returns whether the deployment log is kept in memory, since the log
+// directory is read-only.
+func (dlm *DeploymentLogManager) InMemory() bool {
+	return dlm.loggingEnabled && dlm.memoryLogOf(dlm.deploymentID) != nil
+}
+
 // GetLogs is returns logs as a JSON []byte string. Function is having the same
 // signature as json.Marshal() ([]byte, error)
 func (dlm DeploymentLogManager) GetLogs(deploymentID string) ([]byte, error) {
@@ -253,26 +326,33 @@ func (dlm DeploymentLogManager) GetLogs(deploymentID string) ([]byte, error) {
 	// to JSON we will end up with `{"messages":null}` instead of `{"messages":[]}`
 	logsList := make([]json.RawMessage, 0)
 
-	logFileName, err := dlm.findLogsForSpecificID(deploymentID)
-	// log file for specific deployment id does not exist
-	if err == os.ErrNotExist {
-		logs := formattedDeploymentLogs{logsList}
-		return json.Marshal(logs)
-	}
+	var src io.Reader
+	var err error
+	if mem := dlm.memoryLogOf(deploymentID); mem != nil {
+		src = bytes.NewReader(mem.contents())
+	} else {
+		var logFileName string
+		logFileName, err = dlm.findLogsForSpecificID(deploymentID)
+		// log file for specific deployment id does not exist
+		if err == os.ErrNotExist {
+			return json.Marshal(formattedDeploymentLogs{logsList})
+		}
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	logF, err := os.Open(logFileName)
-	if err != nil {
-		return nil, err
-	}
+		logF, err := os.Open(logFileName)
+		if err != nil {
+			return nil, err
+		}
 
-	defer logF.Close()
+		defer logF.Close()
+		src = logF
+	}
 
 	// read log file line by line
-	scanner := bufio.NewScanner(logF)
+	scanner := bufio.NewScanner(src)
 
 	// read log file line by line
 	for scanner.Scan() {
@@ -291,6 +371,22 @@ func (dlm DeploymentLogManager) GetLogs(deploymentID string) ([]byte, error) {
 		return nil, err
 	}
 
+	// The end of the log is what tells why the deployment failed; drop the
+	// oldest entries if there is too much of it.
+	size := 0
+	for _, entry := range logsList {
+		size += len(entry) + 1
+	}
+	dropped := 0
+	for size > dlm.maxUploadBytes && dropped < len(logsList) {
+		size -= len(logsList[dropped]) + 1
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warnf("Deployment log too big; leaving out the first %d entries", dropped)
+		logsList = logsList[dropped:]
+	}
+
 	logs := formattedDeploymentLogs{logsList}
 
 	return json.Marshal(logs)
@@ -251,6 +251,47 @@ func TestEnabligLogsNoSpceForStoringLogs(t *testing.T) {
 
 }
 
+func TestDeploymentLogInMemory(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	oldReadOnly := logDirReadOnly
+	defer func() { logDirReadOnly = oldReadOnly }()
+	readOnly := true
+	logDirReadOnly = func(string) bool { return readOnly }
+
+	// In a read-only log directory, the log is kept in memory, and can be
+	// uploaded all the same.
+	logManager := NewDeploymentLogManager(tempDir)
+	assert.NoError(t, logManager.Enable("1111-2222"))
+	assert.True(t, logManager.InMemory())
+	assert.NoError(t, logManager.WriteLog([]byte(`{"msg":"in memory"}`+"\n")))
+	logManager.Disable()
+	assert.False(t, logManager.InMemory())
+	logs, err := logManager.GetLogs("1111-2222")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[{"msg":"in memory"}]}`, string(logs))
+	files, _ := ioutil.ReadDir(tempDir)
+	assert.Empty(t, files)
+
+	// The next deployment is logged to the directory again, once it can be.
+	readOnly = false
+	assert.NoError(t, logManager.Enable("3333-4444"))
+	assert.False(t, logManager.InMemory())
+	assert.NoError(t, logManager.WriteLog([]byte(`{"msg":"on disk"}`+"\n")))
+	logManager.Disable()
+	assert.True(t, logFileContains(path.Join(tempDir,
+		fmt.Sprintf(logFileNameScheme, 1, "3333-4444")), "on disk"))
+}
+
+func TestMemoryLogLimit(t *testing.T) {
+	mem := &memoryLog{limit: 10}
+	mem.Write([]byte("first\n"))
+	mem.Write([]byte("second\n"))
+	mem.Write([]byte("third\n"))
+	// Only whole entries of the end of it are kept.
+	assert.Equal(t, "third\n", string(mem.contents()))
+}
+
 func TestDeploymentLoggingHook(t *testing.T) {
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
@@ -326,6 +367,25 @@ func TestGetLogs(t *testing.T) {
 	assert.JSONEq(t, `{"messages":[{"msg":"test"}, {"msg": "test2"}]}`, string(logs))
 }
 
+func TestGetLogsSizeLimit(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	deploymentLogger := NewDeploymentLogManager(tempDir)
+	deploymentLogger.maxUploadBytes = 40
+
+	logFileWithContent := path.Join(tempDir, fmt.Sprintf(logFileNameScheme, 1, "1111-2222"))
+	err := openLogFileWithContent(logFileWithContent, `{"msg":"first"}
+{"msg":"second"}
+{"msg":"third"}`)
+	assert.NoError(t, err)
+
+	// Only the newest entries which fit are kept.
+	logs, err := deploymentLogger.GetLogs("1111-2222")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[{"msg":"second"}, {"msg":"third"}]}`, string(logs))
+}
+
 func TestFindLogFiles(t *testing.T) {
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
@@ -14,6 +14,7 @@
 package app
 
 import (
+	"github.com/mendersoftware/mender/installer"
 	"github.com/pkg/errors"
 )
 
@@ -68,3 +69,49 @@ func NewTransientError(err error) menderError {
 		fatal: false,
 	}
 }
+
+// The steps of a standalone update. The errors returned by
+// DoStandaloneInstall, DoStandaloneCommit and DoStandaloneRollback match the
+// step which failed with errors.Is.
+var (
+	ErrFetch    = errors.New("fetching the Artifact failed")
+	ErrVerify   = errors.New("verifying the Artifact failed")
+	ErrInstall  = errors.New("installing the Artifact failed")
+	ErrCommit   = errors.New("committing the Artifact failed")
+	ErrRollback = errors.New("rolling back the Artifact failed")
+	// Returned as is when committing or rolling back without an update in
+	// progress.
+	ErrNoUpdate = installer.ErrorNothingToCommit
+)
+
+// UpdateError is an error from one of the steps of an update. errors.Cause
+// returns the error which made the step fail.
+type UpdateError struct {
+	step  error
+	cause error
+}
+
+// newUpdateError returns nil if cause is nil, so that return values can be
+// wrapped as they are.
+func newUpdateError(step, cause error) error {
+	if cause == nil {
+		return nil
+	}
+	return &UpdateError{step: step, cause: cause}
+}
+
+func (e *UpdateError) Error() string {
+	return e.step.Error() + ": " + e.cause.Error()
+}
+
+func (e *UpdateError) Is(target error) bool {
+	return target == e.step
+}
+
+func (e *UpdateError) Cause() error {
+	return e.cause
+}
+
+func (e *UpdateError) Unwrap() error {
+	return e.cause
+}
@@ -17,6 +17,7 @@ import (
 	"errors"
 	"testing"
 
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,3 +34,18 @@ func TestMenderError(t *testing.T) {
 	assert.False(t, tt.IsFatal())
 	assert.Equal(t, err, tt.Cause())
 }
+
+func TestUpdateError(t *testing.T) {
+	cause := pkgerrors.New("disk full")
+	err := newUpdateError(ErrInstall, pkgerrors.Wrap(cause, "writing payload"))
+
+	assert.True(t, errors.Is(err, ErrInstall))
+	assert.False(t, errors.Is(err, ErrFetch))
+	assert.Equal(t, cause, pkgerrors.Cause(err))
+	assert.EqualError(t, err, "installing the Artifact failed: writing payload: disk full")
+
+	var updateErr *UpdateError
+	assert.True(t, errors.As(err, &updateErr))
+
+	assert.NoError(t, newUpdateError(ErrInstall, nil))
+}
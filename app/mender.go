@@ -18,6 +18,8 @@ import (
 	"io"
 	"os"
 	"path"
+	"reflect"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -39,16 +41,39 @@ type Controller interface {
 	Authorize() menderError
 
 	GetCurrentArtifactName() (string, error)
+	InstalledArtifact() (name, version string, err error)
 	GetUpdatePollInterval() time.Duration
+	GetUpdatePollJitter() float64
 	GetInventoryPollInterval() time.Duration
 	GetRetryPollInterval() time.Duration
+	GetMaintenanceWindow() conf.MaintenanceWindow
+	GetAutoReboot() bool
+	IsDryRun() bool
+	GetMaxUpdateAttempts() int
+	GetHealthCheckTimeout() time.Duration
+	GetStartupDelay() time.Duration
+	GetBatteryPollIntervalFactor() int
+	GetLowBatteryPercent() int
+	GetUpdateWebhookURL() string
+	GetChannel() string
+	SetChannel(channel string)
+	NotAuthorized() bool
+	GetArtifactCacheDir() string
+	GetArtifactDownloadDir() string
+	GetMaxConcurrentInstalls() int
+	GetChecksumMismatchRetries() int
+	ReloadConfig(config *conf.MenderConfig)
 
 	CheckUpdate() (*datastore.UpdateInfo, menderError)
 	FetchUpdate(url string) (io.ReadCloser, int64, error)
+	CheckFreeSpace(update *datastore.UpdateInfo, size int64) error
+	GetPartitions() ([]installer.Partition, error)
+	CheckClock() error
 
 	NewStatusReportWrapper(updateId string,
 		stateId datastore.MenderState) *client.StatusReportWrapper
 	ReportUpdateStatus(update *datastore.UpdateInfo, status string) menderError
+	NewStatusReporter(update *datastore.UpdateInfo) func(status string) error
 	UploadLog(update *datastore.UpdateInfo, logs []byte) menderError
 	InventoryRefresh() error
 
@@ -67,6 +92,12 @@ var (
 	errNoArtifactName = errors.New("cannot determine current artifact name")
 )
 
+// Unit of UpdateFetchRetryBackoffSeconds. Only changed by tests.
+var updateFetchRetryUnit = time.Second
+
+// How often the update progress callback is called, at most.
+const updateProgressInterval = 250 * time.Millisecond
+
 var (
 	//IMPORTANT: make sure that all the statuses that require
 	// the report to be sent to the backend are assigned here.
@@ -111,13 +142,34 @@ type Mender struct {
 	authReq             client.AuthRequester
 	authMgr             AuthManager
 	api                 *client.ApiClient
-	authToken           client.AuthToken
+	updateProgress      utils.ProgressFunc
+	inventoryGetters    []inv.InventoryDataGetter
+	// Update channel, which the control API changes from another goroutine.
+	channelLock sync.Mutex
+	channel     string
+	// Guards the authorization with the servers, which the control API
+	// reads from another goroutine.
+	authLock  sync.Mutex
+	authToken client.AuthToken
+	// Index in Config.Servers of the server which last served us; it is
+	// tried first on the next request.
+	lastGoodServer int
+	// Set while the server rejects the identity of the device, until it
+	// authorizes again.
+	notAuthorized bool
+	// Closed by CancelFetchRetries, to end the wait of FetchUpdate for the
+	// next attempt.
+	fetchRetryLock   sync.Mutex
+	fetchRetryCancel chan struct{}
 }
 
 type MenderPieces struct {
 	DualRootfsDevice installer.DualRootfsDevice
 	Store            store.Store
 	AuthMgr          AuthManager
+	// Additional sources of inventory data, on top of the inventory
+	// scripts.
+	InventoryDataGetters []inv.InventoryDataGetter
 }
 
 func NewMender(config *conf.MenderConfig, pieces MenderPieces) (*Mender, error) {
@@ -137,6 +189,19 @@ func NewMender(config *conf.MenderConfig, pieces MenderPieces) (*Mender, error)
 		authReq:             client.NewAuth(),
 		api:                 api,
 		authToken:           noAuthToken,
+		inventoryGetters:    pieces.InventoryDataGetters,
+		channel:             config.Channel,
+	}
+	if updater, ok := m.updater.(*client.UpdateClient); ok {
+		updater.SetStorageCredentials(config.ArtifactStorageCredentials)
+		updater.SetMaxResumes(config.DownloadMaxResumes)
+		updater.SetMaxArtifactSize(config.MaxArtifactSizeBytes)
+		updater.SetLocalSources(config.LocalArtifactSources)
+	}
+	m.loadUpdateCheckETag()
+	if len(config.InventoryServices) > 0 || config.InventoryCommand != "" {
+		m.inventoryGetters = append(m.inventoryGetters,
+			inv.NewServicesInventory(config.InventoryServices, config.InventoryCommand))
 	}
 
 	if m.authMgr != nil {
@@ -175,7 +240,7 @@ func (m *Mender) Bootstrap() menderError {
 
 // cache authorization code
 func (m *Mender) loadAuth() menderError {
-	if m.authToken != noAuthToken {
+	if m.getAuthToken() != noAuthToken {
 		return nil
 	}
 
@@ -184,10 +249,22 @@ func (m *Mender) loadAuth() menderError {
 		return NewFatalError(errors.Wrap(err, "failed to cache authorization code"))
 	}
 
-	m.authToken = code
+	m.setAuthToken(code)
 	return nil
 }
 
+func (m *Mender) getAuthToken() client.AuthToken {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	return m.authToken
+}
+
+func (m *Mender) setAuthToken(token client.AuthToken) {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	m.authToken = token
+}
+
 func (m *Mender) IsAuthorized() bool {
 	if m.authMgr.IsAuthorized() {
 		// AuthToken is present in store
@@ -217,7 +294,7 @@ func (m *Mender) Authorize() menderError {
 	}
 
 	// Cycle through servers and attempt to authorize.
-	m.authToken = noAuthToken
+	m.setAuthToken(noAuthToken)
 	serverIterator := nextServerIterator(m)
 	if serverIterator == nil {
 		return NewFatalError(errors.New("Empty server list in mender.conf!"))
@@ -230,6 +307,7 @@ func (m *Mender) Authorize() menderError {
 
 		if err == nil {
 			// SUCCESS!
+			rememberServer(m)(server)
 			break
 		}
 		prevHost := server.ServerURL
@@ -248,6 +326,9 @@ func (m *Mender) Authorize() menderError {
 			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 				log.Warn("can not remove rejected authentication token")
 			}
+			m.setNotAuthorized(true)
+			log.Warn("The server does not accept the identity of the device; " +
+				"it has to be accepted on the server before it gets updates")
 		}
 		return NewTransientError(errors.Wrap(err, "authorization request failed"))
 	}
@@ -258,6 +339,7 @@ func (m *Mender) Authorize() menderError {
 	}
 
 	log.Info("successfully received new authorization data")
+	m.setNotAuthorized(false)
 
 	return m.loadAuth()
 }
@@ -283,7 +365,72 @@ func (m *Mender) doBootstrap() menderError {
 }
 
 func (m *Mender) FetchUpdate(url string) (io.ReadCloser, int64, error) {
-	return m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+	backoff := time.Duration(m.Config.UpdateFetchRetryBackoffSeconds) * updateFetchRetryUnit
+	if backoff == 0 {
+		backoff = updateFetchRetryUnit
+	}
+	cancelled := m.fetchRetriesCancelled()
+	for attempt := 0; ; attempt++ {
+		in, size, err := m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+		if err == nil && m.Config.DownloadLimitBytesPerSecond > 0 {
+			in = utils.NewRateLimitedReadCloser(in, m.Config.DownloadLimitBytesPerSecond)
+		}
+		// A stream of unknown size has no progress to report.
+		if err == nil && m.updateProgress != nil && size > 0 {
+			in = utils.NewProgressReadCloser(in, size, updateProgressInterval,
+				m.updateProgress)
+		}
+		if err == nil || attempt >= m.Config.UpdateFetchRetries ||
+			!client.IsTransientFetchError(err) {
+			return in, size, err
+		}
+		log.Warnf("Update fetch failed: %s. Retrying in %v (%d/%d)",
+			err, backoff, attempt+1, m.Config.UpdateFetchRetries)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-cancelled:
+			timer.Stop()
+			return in, size, err
+		}
+		backoff *= 2
+	}
+}
+
+func (m *Mender) fetchRetriesCancelled() <-chan struct{} {
+	m.fetchRetryLock.Lock()
+	defer m.fetchRetryLock.Unlock()
+	if m.fetchRetryCancel == nil {
+		m.fetchRetryCancel = make(chan struct{})
+	}
+	return m.fetchRetryCancel
+}
+
+// CancelFetchRetries makes FetchUpdate stop waiting to try a failed download
+// again, and return the error it failed with, so that stopping the daemon or
+// aborting the update does not have to wait for the backoff.
+func (m *Mender) CancelFetchRetries() {
+	m.fetchRetryLock.Lock()
+	defer m.fetchRetryLock.Unlock()
+	if m.fetchRetryCancel != nil {
+		close(m.fetchRetryCancel)
+		m.fetchRetryCancel = nil
+	}
+}
+
+// SetUpdateProgressCallback sets a function which is called with the progress
+// of the update, including the download rate and the time left, while the
+// update is downloaded and stored. It must be set before the daemon is started.
+func (m *Mender) SetUpdateProgressCallback(f utils.ProgressFunc) {
+	m.updateProgress = f
+}
+
+// CancelRequests cancels the requests to the server which are in flight, apart
+// from downloads of updates.
+func (m *Mender) CancelRequests() {
+	if m.api != nil {
+		m.api.CancelRequests()
+	}
 }
 
 func verifyArtifactDependencies(
@@ -337,7 +484,7 @@ func verifyArtifactDependencies(
 // and error that occurred. If no update is available *UpdateInfo is nil,
 // otherwise it contains update information.
 func (m *Mender) CheckUpdate() (*datastore.UpdateInfo, menderError) {
-	currentArtifactName, err := m.GetCurrentArtifactName()
+	currentArtifactName, artifactVersion, err := m.InstalledArtifact()
 	if err != nil || currentArtifactName == "" {
 		log.Error("could not get the current Artifact name")
 		if err == nil {
@@ -357,15 +504,16 @@ func (m *Mender) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 			err)
 	}
 	haveUpdate, err := m.updater.GetScheduledUpdate(
-		m.api.Request(m.authToken,
-			nextServerIterator(m),
-			reauthorize(m)),
+		m.apiRequest(),
 		m.Config.Servers[0].ServerURL,
 		&client.CurrentUpdate{
-			Artifact:   currentArtifactName,
-			DeviceType: deviceType,
-			Provides:   provides,
+			Artifact:        currentArtifactName,
+			ArtifactVersion: artifactVersion,
+			DeviceType:      deviceType,
+			Channel:         m.GetChannel(),
+			Provides:        provides,
 		})
+	m.storeUpdateCheckETag()
 
 	if err != nil {
 		// remove authentication token if device is not authorized
@@ -374,6 +522,7 @@ func (m *Mender) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 				log.Warn("can not remove rejected authentication token")
 			}
+			m.setNotAuthorized(true)
 		}
 		log.Error("Error receiving scheduled update data: ", err)
 		return nil, NewTransientError(err)
@@ -394,14 +543,82 @@ func (m *Mender) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 		log.Info("Attempting to upgrade to currently installed artifact name, not performing upgrade.")
 		return &update, NewTransientError(os.ErrExist)
 	}
+	// Without a device type it is up to the Artifact itself, once it is
+	// downloaded, as for standalone installs.
+	if deviceType != "" {
+		err = installer.CheckCompatibleDevices(update.CompatibleDevices(), deviceType)
+		if err != nil {
+			return &update, NewTransientError(err)
+		}
+	}
+	if now := timeNow(); !update.ValidAt(now) {
+		log.Infof("Update %s is outside of the window in which it may be started "+
+			"(after: %s, before: %s); checking again on the next poll",
+			update.ID, formatWindowTime(update.ValidAfter), formatWindowTime(update.ValidBefore))
+		return nil, nil
+	}
 	return &update, nil
 }
 
+// etagUpdater is implemented by updaters which make conditional update checks;
+// see client.UpdateClient.SetETag.
+type etagUpdater interface {
+	ETag() string
+	SetETag(etag string)
+}
+
+// loadUpdateCheckETag picks up the ETag of the last update check from the
+// store, which may be from before the client was restarted.
+func (m *Mender) loadUpdateCheckETag() {
+	updater, ok := m.updater.(etagUpdater)
+	if !ok || m.Store == nil {
+		return
+	}
+	etag, err := m.Store.ReadAll(datastore.UpdateCheckETagKey)
+	if err == nil {
+		updater.SetETag(string(etag))
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Could not load the ETag of the last update check: %v", err)
+	}
+}
+
+// storeUpdateCheckETag keeps the ETag of the last update check in the store,
+// if it has changed.
+func (m *Mender) storeUpdateCheckETag() {
+	updater, ok := m.updater.(etagUpdater)
+	if !ok || m.Store == nil {
+		return
+	}
+	etag := updater.ETag()
+	stored, err := m.Store.ReadAll(datastore.UpdateCheckETagKey)
+	if (err == nil && string(stored) == etag) || (os.IsNotExist(err) && etag == "") {
+		return
+	}
+	if etag == "" {
+		err = m.Store.Remove(datastore.UpdateCheckETagKey)
+	} else {
+		err = m.Store.WriteAll(datastore.UpdateCheckETagKey, []byte(etag))
+	}
+	if err != nil {
+		log.Errorf("Could not store the ETag of the last update check: %v", err)
+	}
+}
+
+// Source of the current time for CheckUpdate. Only changed by tests.
+var timeNow = time.Now
+
+func formatWindowTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
 func (m *Mender) NewStatusReportWrapper(updateId string,
 	stateId datastore.MenderState) *client.StatusReportWrapper {
 
 	return &client.StatusReportWrapper{
-		API: m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)),
+		API: m.apiRequest(),
 		URL: m.Config.Servers[0].ServerURL,
 		Report: client.StatusReport{
 			DeploymentID: updateId,
@@ -410,11 +627,55 @@ func (m *Mender) NewStatusReportWrapper(updateId string,
 	}
 }
 
+// ReportUpdateStatus sends the status of a deployment, after any earlier ones
+// which are still queued, so that the server gets them in order. Those which
+// are not final are queued in turn if the server cannot be reached.
 func (m *Mender) ReportUpdateStatus(update *datastore.UpdateInfo, status string) menderError {
+	merr := m.sendQueuedStatusReports(update.ID, status)
+	if merr == nil {
+		merr = m.sendUpdateStatus(update.ID, status)
+	}
+	if merr != nil && !merr.IsFatal() {
+		m.queueStatusReport(update.ID, status)
+	}
+	return merr
+}
+
+// NewStatusReporter returns a function which reports the status of update
+// from another goroutine, while the state machine carries on. It works on the
+// servers and the authorization as they are now, so it neither reauthorizes,
+// nor changes the server used by other requests, nor queues the report if the
+// server cannot be reached.
+func (m *Mender) NewStatusReporter(update *datastore.UpdateInfo) func(status string) error {
+	token := m.getAuthToken()
+	servers := make([]client.MenderServer, len(m.Config.Servers))
+	copy(servers, m.Config.Servers)
+	m.authLock.Lock()
+	first := m.lastGoodServer
+	m.authLock.Unlock()
+	deploymentID := update.ID
+
+	return func(status string) error {
+		if len(servers) == 0 {
+			return errors.New("empty server list")
+		}
+		req := m.api.Request(token, serverListIterator(servers, first%len(servers)),
+			func(string) (client.AuthToken, error) {
+				return noAuthToken, errors.New("not reauthorizing outside of the state machine")
+			})
+		return client.NewStatus().Report(req, servers[0].ServerURL,
+			client.StatusReport{
+				DeploymentID: deploymentID,
+				Status:       status,
+			})
+	}
+}
+
+func (m *Mender) sendUpdateStatus(deploymentID, status string) menderError {
 	s := client.NewStatus()
-	err := s.Report(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)), m.Config.Servers[0].ServerURL,
+	err := s.Report(m.apiRequest(), m.Config.Servers[0].ServerURL,
 		client.StatusReport{
-			DeploymentID: update.ID,
+			DeploymentID: deploymentID,
 			Status:       status,
 		})
 	if err != nil {
@@ -433,6 +694,17 @@ func (m *Mender) ReportUpdateStatus(update *datastore.UpdateInfo, status string)
 	return nil
 }
 
+// apiRequest returns a request which fails over between the configured
+// servers, and remembers which of them served it.
+func (m *Mender) apiRequest() *client.ApiRequest {
+	req := m.api.Request(m.getAuthToken(), nextServerIterator(m), reauthorize(m)).
+		OnServerSuccess(rememberServer(m))
+	if m.Config.ReauthorizeOnForbidden {
+		req.ReauthorizeOnForbidden()
+	}
+	return req
+}
+
 /* client closures */
 // see client.go: ApiRequest.Do()
 
@@ -454,7 +726,7 @@ func reauthorize(m *Mender) func(string) (client.AuthToken, error) {
 			return noAuthToken, errors.New("Failed to remove auth token")
 		}
 
-		m.authToken = noAuthToken
+		m.setAuthToken(noAuthToken)
 		rsp, err = m.authReq.Request(m.api, serverURL, m.authMgr)
 		if err != nil {
 			// Generate and report error.
@@ -464,6 +736,7 @@ func reauthorize(m *Mender) func(string) (client.AuthToken, error) {
 				if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 					log.Warn("can not remove rejected authentication token")
 				}
+				m.setNotAuthorized(true)
 			}
 			return noAuthToken, NewTransientError(errors.Wrap(err, "authorization request failed"))
 		}
@@ -472,6 +745,7 @@ func reauthorize(m *Mender) func(string) (client.AuthToken, error) {
 		if err != nil {
 			return noAuthToken, NewTransientError(errors.Wrap(err, "failed to parse authorization response"))
 		}
+		m.setNotAuthorized(false)
 
 		err = m.loadAuth()
 		if err == nil {
@@ -482,7 +756,8 @@ func reauthorize(m *Mender) func(string) (client.AuthToken, error) {
 }
 
 // nextServerIterator returns an iterator like function that cycles through the
-// list of available servers in mender.conf.MenderConfig.Servers
+// list of available servers in mender.conf.MenderConfig.Servers, starting with
+// the one that last served us.
 func nextServerIterator(m *Mender) func() *client.MenderServer {
 	numServers := len(m.Config.Servers)
 	if m.Config.Servers == nil || numServers == 0 {
@@ -491,11 +766,21 @@ func nextServerIterator(m *Mender) func() *client.MenderServer {
 		return nil
 	}
 
+	m.authLock.Lock()
+	first := m.lastGoodServer % numServers
+	m.authLock.Unlock()
+	return serverListIterator(m.Config.Servers, first)
+}
+
+// serverListIterator returns an iterator like function that cycles through
+// servers, starting with the one at first.
+func serverListIterator(servers []client.MenderServer, first int) func() *client.MenderServer {
+	numServers := len(servers)
 	idx := 0
 	return func() (server *client.MenderServer) {
 		var ret *client.MenderServer
 		if idx < numServers {
-			ret = &m.Config.Servers[idx]
+			ret = &servers[(first+idx)%numServers]
 			idx++
 		} else {
 			// return nil which terminates Do()
@@ -507,11 +792,31 @@ func nextServerIterator(m *Mender) func() *client.MenderServer {
 	}
 }
 
+// rememberServer returns a closure which records the server that served a
+// request, so that nextServerIterator starts with it next time.
+func rememberServer(m *Mender) func(*client.MenderServer) {
+	return func(server *client.MenderServer) {
+		for i := range m.Config.Servers {
+			if &m.Config.Servers[i] == server {
+				m.authLock.Lock()
+				changed := i != m.lastGoodServer
+				m.lastGoodServer = i
+				m.authLock.Unlock()
+				if changed {
+					log.Infof("Using server %q for subsequent requests",
+						server.ServerURL)
+				}
+				return
+			}
+		}
+	}
+}
+
 /* client closures END */
 
 func (m *Mender) UploadLog(update *datastore.UpdateInfo, logs []byte) menderError {
 	s := client.NewLog()
-	err := s.Upload(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)), m.Config.Servers[0].ServerURL,
+	err := s.Upload(m.apiRequest(), m.Config.Servers[0].ServerURL,
 		client.LogData{
 			DeploymentID: update.ID,
 			Messages:     logs,
@@ -523,6 +828,12 @@ func (m *Mender) UploadLog(update *datastore.UpdateInfo, logs []byte) menderErro
 	return nil
 }
 
+// GetUpdatePollJitter returns how much each update poll interval may vary, as a
+// fraction of the interval.
+func (m *Mender) GetUpdatePollJitter() float64 {
+	return float64(m.Config.UpdatePollIntervalJitterPercent) / 100
+}
+
 func (m *Mender) GetUpdatePollInterval() time.Duration {
 	t := time.Duration(m.Config.UpdatePollIntervalSeconds) * time.Second
 	if t == 0 {
@@ -550,6 +861,274 @@ func (m *Mender) GetRetryPollInterval() time.Duration {
 	return t
 }
 
+// CheckFreeSpace returns an error if the device does not have room for an
+// Artifact of the given size. It cannot know how much the payload expands
+// when uncompressed, so it only catches the hopeless cases early.
+func (m *Mender) CheckFreeSpace(update *datastore.UpdateInfo, size int64) error {
+	if size <= 0 {
+		// Size unknown.
+		return nil
+	}
+	for _, payloadType := range update.Artifact.PayloadTypes {
+		if payloadType != "rootfs-image" {
+			continue
+		}
+		reporter, ok := m.InstallerFactories.DualRootfs.(installer.FreeSpaceReporter)
+		if !ok {
+			continue
+		}
+		free, err := reporter.FreeSpace()
+		if err != nil {
+			log.Warnf("Could not determine free space for the update; continuing: %s", err)
+			continue
+		}
+		needed := uint64(size)
+		if m.Config.FreeSpaceMarginBytes > 0 {
+			needed += uint64(m.Config.FreeSpaceMarginBytes)
+		}
+		if needed > free {
+			return errors.Errorf("Not enough space for the update: need %d bytes "+
+				"(including a margin of %d bytes), but only %d are available",
+				needed, needed-uint64(size), free)
+		}
+	}
+	return nil
+}
+
+// GetPartitions returns the root filesystem partitions, or nothing if the
+// device does not have any.
+func (m *Mender) GetPartitions() ([]installer.Partition, error) {
+	lister, ok := m.InstallerFactories.DualRootfs.(installer.PartitionLister)
+	if !ok {
+		return nil, nil
+	}
+	return lister.Partitions()
+}
+
+func (m *Mender) GetMaintenanceWindow() conf.MaintenanceWindow {
+	return m.Config.MaintenanceWindow
+}
+
+func (m *Mender) GetAutoReboot() bool {
+	return m.Config.AutoReboot == nil || *m.Config.AutoReboot
+}
+
+func (m *Mender) IsDryRun() bool {
+	return m.Config.DryRun
+}
+
+func (m *Mender) GetMaxUpdateAttempts() int {
+	return m.Config.MaxUpdateAttempts
+}
+
+func (m *Mender) GetHealthCheckTimeout() time.Duration {
+	return time.Duration(m.Config.HealthCheckTimeoutSeconds) * time.Second
+}
+
+func (m *Mender) GetStartupDelay() time.Duration {
+	return time.Duration(m.Config.StartupDelaySeconds) * time.Second
+}
+
+func (m *Mender) GetBatteryPollIntervalFactor() int {
+	return m.Config.BatteryPollIntervalFactor
+}
+
+func (m *Mender) GetLowBatteryPercent() int {
+	return m.Config.LowBatteryPercent
+}
+
+func (m *Mender) GetUpdateWebhookURL() string {
+	return m.Config.UpdateWebhookURL
+}
+
+// GetChannel returns the update channel which the next update check asks for.
+func (m *Mender) GetChannel() string {
+	m.channelLock.Lock()
+	defer m.channelLock.Unlock()
+	return m.channel
+}
+
+// SetChannel changes the update channel, starting with the next update check.
+// The channel in the configuration is used again once the client is
+// restarted.
+func (m *Mender) SetChannel(channel string) {
+	m.channelLock.Lock()
+	defer m.channelLock.Unlock()
+	m.channel = channel
+}
+
+// NotAuthorized tells whether the server rejected the identity of the device
+// the last time it authorized, or checked for an update.
+func (m *Mender) NotAuthorized() bool {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	return m.notAuthorized
+}
+
+func (m *Mender) setNotAuthorized(notAuthorized bool) {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	m.notAuthorized = notAuthorized
+}
+
+func (m *Mender) GetMaxConcurrentInstalls() int {
+	return m.Config.MaxConcurrentInstalls
+}
+
+func (m *Mender) GetChecksumMismatchRetries() int {
+	return m.Config.ChecksumMismatchRetries
+}
+
+// GetArtifactCacheDir returns where downloaded Artifacts are cached, or "" if
+// they are not.
+func (m *Mender) GetArtifactCacheDir() string {
+	if !m.Config.CacheArtifacts {
+		return ""
+	}
+	return m.Config.GetArtifactCacheDir()
+}
+
+// GetArtifactDownloadDir returns where Artifacts are downloaded to before they
+// are installed, or "" if they are written to the device as they are
+// downloaded.
+func (m *Mender) GetArtifactDownloadDir() string {
+	if m.Config.ArtifactDownloadMode != conf.ArtifactDownloadThenInstall {
+		return ""
+	}
+	return m.Config.GetArtifactDownloadDir()
+}
+
+// reloadedSettings tells, for each setting of the configuration file, whether
+// ReloadConfig takes it from the new configuration. Those which are read as
+// they are used are; the servers, the intervals, and how updates are
+// downloaded and installed. The others are only read when the client starts,
+// so a new value of them is logged, and ignored until the client is restarted.
+var reloadedSettings = map[string]bool{
+	// Read as they are used.
+	"UpdatePollIntervalSeconds":       true,
+	"UpdatePollIntervalJitterPercent": true,
+	"Channel":                         true,
+	"InventoryPollIntervalSeconds":    true,
+	"RetryPollIntervalSeconds":        true,
+	"UpdateFetchRetries":              true,
+	"UpdateFetchRetryBackoffSeconds":  true,
+	"DownloadLimitBytesPerSecond":     true,
+	"DownloadMaxResumes":              true,
+	"ChecksumMismatchRetries":         true,
+	"MaxArtifactSizeBytes":            true,
+	"LocalArtifactSources":            true,
+	"MaintenanceWindow":               true,
+	"AutoReboot":                      true,
+	"FreeSpaceMarginBytes":            true,
+	"CacheArtifacts":                  true,
+	"ArtifactDownloadMode":            true,
+	"DryRun":                          true,
+	"HealthCheckTimeoutSeconds":       true,
+	"MaxUpdateAttempts":               true,
+	"BatteryPollIntervalFactor":       true,
+	"LowBatteryPercent":               true,
+	"UpdateWebhookURL":                true,
+	"ArtifactStorageCredentials":      true,
+	"ServerURL":                       true,
+	"Servers":                         true,
+	"ReauthorizeOnForbidden":          true,
+
+	// Only read when the client starts.
+	"ClientProtocol":                  false,
+	"ArtifactVerifyKey":               false,
+	"HttpsClient":                     false,
+	"Security":                        false,
+	"RootfsPartA":                     false,
+	"RootfsPartB":                     false,
+	"RefuseMountedInactivePartition":  false,
+	"DeviceTypeFile":                  false,
+	"ProvisioningFile":                false,
+	"DeviceIdentitySource":            false,
+	"DeviceIdentityFile":              false,
+	"InventoryServices":               false,
+	"InventoryCommand":                false,
+	"SkipVerify":                      false,
+	"ConnectTimeoutSeconds":           false,
+	"TLSHandshakeTimeoutSeconds":      false,
+	"ResponseHeaderTimeoutSeconds":    false,
+	"RequestTimeoutSeconds":           false,
+	"DownloadIdleTimeoutSeconds":      false,
+	"IdleConnectionTimeoutSeconds":    false,
+	"StateScriptTimeoutSeconds":       false,
+	"StateScriptRetryTimeoutSeconds":  false,
+	"StateScriptRetryIntervalSeconds": false,
+	"StopTimeoutSeconds":              false,
+	"MetricsListenAddress":            false,
+	"ControlAPIAddress":               false,
+	"StartupDelaySeconds":             false,
+	"ClockCheck":                      false,
+	"ClockCheckTimeoutSeconds":        false,
+	"RebootMethod":                    false,
+	"RebootCommand":                   false,
+	"ModuleTimeoutSeconds":            false,
+	"MaxConcurrentInstalls":           false,
+	"ServerCertificate":               false,
+	"IgnoreSystemCertificates":        false,
+	"ServerCertificateFingerprints":   false,
+	"DataDir":                         false,
+	"UpdateLogPath":                   false,
+	"TenantToken":                     false,
+	"ServerDiscoveryLeaseFile":        false,
+	"ServerDiscoveryOption":           false,
+	"HttpProxy":                       false,
+	"HttpsProxy":                      false,
+	"NoProxy":                         false,
+	"DNSServer":                       false,
+	"TLSMinVersion":                   false,
+	"TLSCipherSuites":                 false,
+	"ServerName":                      false,
+	"UserAgent":                       false,
+	"HttpHeaders":                     false,
+}
+
+// ReloadConfig takes the settings from config which can be changed while the
+// client runs, as reloadedSettings tells. Differences from the running
+// configuration in the other settings are logged, and ignored until the client
+// is restarted.
+func (m *Mender) ReloadConfig(config *conf.MenderConfig) {
+	running := m.Config
+	if !reflect.DeepEqual(running.Servers, config.Servers) {
+		m.authLock.Lock()
+		m.lastGoodServer = 0
+		m.authLock.Unlock()
+	}
+	// A channel set through the control API stays, unless the
+	// configuration changes it too.
+	if running.Channel != config.Channel {
+		m.SetChannel(config.Channel)
+	}
+
+	settings := reflect.ValueOf(&running.MenderConfigFromFile).Elem()
+	loaded := reflect.ValueOf(config.MenderConfigFromFile)
+	for i := 0; i < settings.NumField(); i++ {
+		if reflect.DeepEqual(settings.Field(i).Interface(), loaded.Field(i).Interface()) {
+			continue
+		}
+		name := settings.Type().Field(i).Name
+		if reloadedSettings[name] {
+			settings.Field(i).Set(loaded.Field(i))
+		} else {
+			log.Warnf("The new %s setting takes effect when the client is restarted",
+				name)
+		}
+	}
+
+	if updater, ok := m.updater.(*client.UpdateClient); ok {
+		updater.SetStorageCredentials(running.ArtifactStorageCredentials)
+		updater.SetMaxResumes(running.DownloadMaxResumes)
+		updater.SetMaxArtifactSize(running.MaxArtifactSizeBytes)
+		updater.SetLocalSources(running.LocalArtifactSources)
+	}
+
+	m.Config = running
+	log.Info("Configuration reloaded")
+}
+
 func (m *Mender) SetNextState(s State) {
 	m.state = s
 }
@@ -672,6 +1251,15 @@ func (m *Mender) InventoryRefresh() error {
 		log.Errorf("Failed to obtain inventory data: %s", err.Error())
 	}
 
+	for _, g := range m.inventoryGetters {
+		extra, err := g.Get()
+		if err != nil {
+			log.Errorf("Failed to obtain inventory data: %s", err.Error())
+			continue
+		}
+		_ = idata.ReplaceAttributes(extra)
+	}
+
 	deviceType, err := m.GetDeviceType()
 	if err != nil {
 		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", m.Config.DeviceTypeFile, err)
@@ -692,7 +1280,7 @@ func (m *Mender) InventoryRefresh() error {
 		return nil
 	}
 
-	err = ic.Submit(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)), m.Config.Servers[0].ServerURL, idata)
+	err = ic.Submit(m.apiRequest(), m.Config.Servers[0].ServerURL, idata)
 	if err != nil {
 		return errors.Wrapf(err, "failed to submit inventory data")
 	}
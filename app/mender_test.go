@@ -20,8 +20,11 @@ import (
 	"crypto/x509"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path"
+	"reflect"
 	"syscall"
 	"testing"
 	"time"
@@ -34,9 +37,14 @@ import (
 	"github.com/mendersoftware/mender/conf"
 	"github.com/mendersoftware/mender/datastore"
 	dev "github.com/mendersoftware/mender/device"
+	"github.com/mendersoftware/mender/installer"
+	inv "github.com/mendersoftware/mender/inventory"
 	"github.com/mendersoftware/mender/store"
 	stest "github.com/mendersoftware/mender/system/testing"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -305,10 +313,17 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	assert.Equal(t, err, NewTransientError(os.ErrExist))
 	assert.NotNil(t, up)
 
-	// make artifact name different from current
+	// make artifact name different from current, but for another device
 	srv.Update.Data.Artifact.ArtifactName = currID + "-fake"
+	srv.Update.Data.Artifact.CompatibleDevices = []string{"nail"}
 	srv.Update.Has = true
 	up, err = mender.CheckUpdate()
+	require.Error(t, err)
+	assert.IsType(t, &installer.IncompatibleDeviceError{}, errors.Cause(err.Cause()))
+	assert.NotNil(t, up)
+
+	srv.Update.Data.Artifact.CompatibleDevices = []string{"nail", "hammer"}
+	up, err = mender.CheckUpdate()
 	assert.NoError(t, err)
 	if assert.NotNil(t, up) {
 		assert.Equal(t, *up, srv.Update.Data)
@@ -321,6 +336,185 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	assert.Nil(t, up)
 }
 
+// channelUpdater records the channel of each update check.
+type channelUpdater struct {
+	flakyUpdater
+	channels []string
+}
+
+func (c *channelUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current *client.CurrentUpdate) (interface{}, error) {
+	c.channels = append(c.channels, current.Channel)
+	return nil, nil
+}
+
+func TestCheckUpdateChannel(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-check-update-channel-")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+
+	config := conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			Servers: []client.MenderServer{{ServerURL: "https://localhost"}},
+			Channel: "beta",
+		},
+	}
+	mender := newTestMender(nil, config, testMenderPieces{})
+	mender.ArtifactInfoFile = artifactInfo
+	updater := &channelUpdater{}
+	mender.updater = updater
+
+	check := func() {
+		_, err := mender.CheckUpdate()
+		require.Nil(t, err)
+	}
+	check()
+	mender.SetChannel("stable")
+	check()
+	// Reloading an unchanged configuration keeps the channel which was set.
+	mender.ReloadConfig(&config)
+	check()
+	config.Channel = "nightly"
+	mender.ReloadConfig(&config)
+	check()
+	assert.Equal(t, []string{"beta", "stable", "stable", "nightly"}, updater.channels)
+}
+
+// etagFakeUpdater answers update checks with the ETag next, and records the ETags
+// sent along with them.
+type etagFakeUpdater struct {
+	flakyUpdater
+	etag string
+	next string
+	sent []string
+}
+
+func (u *etagFakeUpdater) ETag() string {
+	return u.etag
+}
+
+func (u *etagFakeUpdater) SetETag(etag string) {
+	u.etag = etag
+}
+
+func (u *etagFakeUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current *client.CurrentUpdate) (interface{}, error) {
+	u.sent = append(u.sent, u.etag)
+	u.etag = u.next
+	return nil, nil
+}
+
+func TestCheckUpdateETag(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-check-update-etag-")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+
+	config := conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			Servers: []client.MenderServer{{ServerURL: "https://localhost"}},
+		},
+	}
+	ms := store.NewMemStore()
+	require.NoError(t, ms.WriteAll(datastore.UpdateCheckETagKey, []byte(`"v1"`)))
+
+	// The ETag of the last check is sent along with the first after a
+	// restart.
+	mender := newTestMender(nil, config, testMenderPieces{
+		MenderPieces: MenderPieces{Store: ms},
+	})
+	assert.Equal(t, `"v1"`, mender.updater.(*client.UpdateClient).ETag())
+
+	mender.ArtifactInfoFile = artifactInfo
+	updater := &etagFakeUpdater{etag: `"v1"`, next: `"v2"`}
+	mender.updater = updater
+	_, err := mender.CheckUpdate()
+	require.Nil(t, err)
+	etag, rerr := ms.ReadAll(datastore.UpdateCheckETagKey)
+	require.NoError(t, rerr)
+	assert.Equal(t, `"v2"`, string(etag))
+
+	// Without one, there is none to send with the next.
+	updater.next = ""
+	_, err = mender.CheckUpdate()
+	require.Nil(t, err)
+	_, rerr = ms.ReadAll(datastore.UpdateCheckETagKey)
+	assert.True(t, os.IsNotExist(rerr))
+	_, err = mender.CheckUpdate()
+	require.Nil(t, err)
+	assert.Equal(t, []string{`"v1"`, `"v2"`, ""}, updater.sent)
+}
+
+func TestCheckUpdateWindow(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-check-update-window-")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	oldTimeNow := timeNow
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = oldTimeNow }()
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Has = true
+	srv.Update.Current = &client.CurrentUpdate{
+		Artifact:   "fake-id",
+		DeviceType: "hammer",
+	}
+	srv.Update.Data.Artifact.ArtifactName = "fake-id-new"
+	srv.Update.Data.Artifact.CompatibleDevices = []string{"hammer"}
+
+	mender := newTestMender(nil,
+		conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{
+				Servers: []client.MenderServer{{ServerURL: srv.URL}},
+			},
+		},
+		testMenderPieces{})
+	mender.ArtifactInfoFile = artifactInfo
+	mender.DeviceTypeFile = deviceType
+
+	tests := map[string]struct {
+		window    datastore.UpdateWindow
+		available bool
+	}{
+		"no window": {
+			available: true,
+		},
+		"before the window": {
+			window: datastore.UpdateWindow{ValidAfter: &after},
+		},
+		"inside the window": {
+			window:    datastore.UpdateWindow{ValidAfter: &before, ValidBefore: &after},
+			available: true,
+		},
+		"window has expired": {
+			window: datastore.UpdateWindow{ValidBefore: &before},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv.Update.Data.UpdateWindow = test.window
+			up, err := mender.CheckUpdate()
+			assert.NoError(t, err)
+			if test.available {
+				require.NotNil(t, up)
+				assert.Equal(t, test.window, up.UpdateWindow)
+			} else {
+				assert.Nil(t, up)
+			}
+		})
+	}
+}
+
 func TestMenderGetUpdatePollInterval(t *testing.T) {
 	mender := newTestMender(nil, conf.MenderConfig{
 		MenderConfigFromFile: conf.MenderConfigFromFile{
@@ -332,6 +526,58 @@ func TestMenderGetUpdatePollInterval(t *testing.T) {
 	assert.Equal(t, time.Duration(20)*time.Second, intvl)
 }
 
+func TestMenderReloadConfig(t *testing.T) {
+	running := conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			UpdatePollIntervalSeconds: 20,
+			ServerCertificate:         "/etc/mender/server.crt",
+			Servers:                   []client.MenderServer{{ServerURL: "https://old.example.com"}},
+		},
+	}
+	mender := newTestMender(nil, running, testMenderPieces{})
+	mender.lastGoodServer = 1
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	reloaded := running
+	reloaded.UpdatePollIntervalSeconds = 60
+	reloaded.ServerCertificate = "/etc/mender/new-server.crt"
+	reloaded.Servers = []client.MenderServer{{ServerURL: "https://new.example.com"}}
+	mender.ReloadConfig(&reloaded)
+
+	assert.Equal(t, 60*time.Second, mender.GetUpdatePollInterval())
+	assert.Equal(t, "https://new.example.com", mender.Config.Servers[0].ServerURL)
+	assert.Equal(t, 0, mender.lastGoodServer)
+
+	// The certificate is only loaded on start.
+	assert.Equal(t, "/etc/mender/server.crt", mender.Config.ServerCertificate)
+	var warned []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warned = append(warned, entry.Message)
+		}
+	}
+	assert.Equal(t, []string{
+		"The new ServerCertificate setting takes effect when the client is restarted",
+	}, warned)
+}
+
+func TestReloadedSettings(t *testing.T) {
+	// Every setting has to be either reloaded, or known to be only read
+	// when the client starts.
+	settings := reflect.TypeOf(conf.MenderConfigFromFile{})
+	names := make(map[string]bool)
+	for i := 0; i < settings.NumField(); i++ {
+		name := settings.Field(i).Name
+		names[name] = true
+		_, ok := reloadedSettings[name]
+		assert.True(t, ok, "%s is not in reloadedSettings", name)
+	}
+	for name := range reloadedSettings {
+		assert.True(t, names[name], "%s is not a setting", name)
+	}
+}
+
 func TestMenderGetInventoryPollInterval(t *testing.T) {
 	mender := newTestMender(nil, conf.MenderConfig{
 		MenderConfigFromFile: conf.MenderConfigFromFile{
@@ -452,6 +698,7 @@ func TestMenderAuthorize(t *testing.T) {
 	assert.False(t, err.IsFatal())
 	assert.True(t, srv.Auth.Called)
 	assert.Equal(t, noAuthToken, mender.authToken)
+	assert.True(t, mender.NotAuthorized())
 
 	// 4. pretend authorization manager fails to parse response
 	srv.Auth.Called = false
@@ -478,6 +725,7 @@ func TestMenderAuthorize(t *testing.T) {
 	// Authorize() should have reloaded the cache (token comes from mock
 	// auth manager)
 	assert.Equal(t, atok, mender.authToken)
+	assert.False(t, mender.NotAuthorized())
 }
 
 func TestMenderReportStatus(t *testing.T) {
@@ -545,6 +793,87 @@ func TestMenderReportStatus(t *testing.T) {
 	assert.True(t, err.IsFatal())
 }
 
+func TestMenderReportStatusQueue(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{
+				Servers: []client.MenderServer{{ServerURL: srv.URL}},
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				Store: ms,
+			},
+		},
+	)
+
+	ms.WriteAll(datastore.AuthTokenName, []byte("tokendata"))
+	require.NoError(t, mender.Authorize())
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+
+	update := &datastore.UpdateInfo{ID: "foobar"}
+
+	// The server is down, so the reports are queued, each of them once.
+	srv.Status.Unavailable = true
+	for _, status := range []string{client.StatusDownloading,
+		client.StatusDownloading, client.StatusInstalling} {
+		err := mender.ReportUpdateStatus(update, status)
+		require.NotNil(t, err)
+		assert.False(t, err.IsFatal())
+	}
+	// Final statuses are retried by the state machine instead.
+	err := mender.ReportUpdateStatus(update, client.StatusSuccess)
+	require.NotNil(t, err)
+	queue, lerr := datastore.LoadStatusReportQueue(ms)
+	require.NoError(t, lerr)
+	assert.Equal(t, []datastore.QueuedStatusReport{
+		{DeploymentID: "foobar", Status: client.StatusDownloading},
+		{DeploymentID: "foobar", Status: client.StatusInstalling},
+	}, queue)
+	assert.Empty(t, srv.Status.Reported)
+
+	// Back up again; the queued reports go first, in order.
+	srv.Status.Unavailable = false
+	err = mender.ReportUpdateStatus(update, client.StatusRebooting)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{client.StatusDownloading,
+		client.StatusInstalling, client.StatusRebooting}, srv.Status.Reported)
+	queue, lerr = datastore.LoadStatusReportQueue(ms)
+	require.NoError(t, lerr)
+	assert.Empty(t, queue)
+
+	// The retry of a report which was queued is only sent once.
+	srv.Status.Unavailable = true
+	srv.Status.Reported = nil
+	err = mender.ReportUpdateStatus(update, client.StatusInstalling)
+	require.NotNil(t, err)
+	srv.Status.Unavailable = false
+	err = mender.ReportUpdateStatus(update, client.StatusInstalling)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{client.StatusInstalling}, srv.Status.Reported)
+	queue, lerr = datastore.LoadStatusReportQueue(ms)
+	require.NoError(t, lerr)
+	assert.Empty(t, queue)
+
+	// Reports queued for an earlier deployment are dropped.
+	require.NoError(t, datastore.StoreStatusReportQueue(ms,
+		[]datastore.QueuedStatusReport{
+			{DeploymentID: "old", Status: client.StatusInstalling},
+		}))
+	srv.Status.Reported = nil
+	err = mender.ReportUpdateStatus(update, client.StatusSuccess)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{client.StatusSuccess}, srv.Status.Reported)
+	queue, lerr = datastore.LoadStatusReportQueue(ms)
+	require.NoError(t, lerr)
+	assert.Empty(t, queue)
+}
+
 func TestMenderLogUpload(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -647,14 +976,25 @@ func TestAuthToken(t *testing.T) {
 	mender.ArtifactInfoFile = artifactInfo
 	mender.DeviceTypeFile = deviceType
 
+	assert.False(t, mender.NotAuthorized())
 	_, updErr := mender.CheckUpdate()
 	assert.EqualError(t, errors.Cause(updErr), client.ErrNotAuthorized.Error())
+	assert.True(t, mender.NotAuthorized())
 
 	token, err = ms.ReadAll(datastore.AuthTokenName)
 	assert.Equal(t, os.ErrNotExist, err)
 	assert.Empty(t, token)
 }
 
+type fakeInventoryDataGetter struct {
+	data client.InventoryData
+	err  error
+}
+
+func (f *fakeInventoryDataGetter) Get() (client.InventoryData, error) {
+	return f.data, f.err
+}
+
 func TestMenderInventoryRefresh(t *testing.T) {
 	// create temp dir
 	td, _ := ioutil.TempDir("", "mender-install-update-")
@@ -747,6 +1087,39 @@ echo foo=bar`),
 		assert.Contains(t, srv.Inventory.Attrs, a)
 	}
 
+	// 2a. additional inventory sources
+	mender.inventoryGetters = []inv.InventoryDataGetter{
+		&fakeInventoryDataGetter{
+			data: client.InventoryData{{Name: "extra", Value: "attr"}},
+		},
+		&fakeInventoryDataGetter{
+			err: errors.New("no data"),
+		},
+	}
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	err = mender.InventoryRefresh()
+	assert.Nil(t, err)
+	exp = append(exp, client.InventoryAttribute{Name: "extra", Value: "attr"})
+	for _, a := range exp {
+		assert.Contains(t, srv.Inventory.Attrs, a)
+	}
+	mender.inventoryGetters = nil
+
+	// 2b. service states and command output
+	mender.inventoryGetters = []inv.InventoryDataGetter{
+		inv.NewServicesInventory(nil, "echo service_version=1.2.3"),
+	}
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	err = mender.InventoryRefresh()
+	assert.Nil(t, err)
+	assert.Contains(t, srv.Inventory.Attrs,
+		client.InventoryAttribute{Name: "service_version", Value: "1.2.3"})
+	mender.inventoryGetters = nil
+
 	// no artifact name should error
 	ioutil.WriteFile(artifactInfo, []byte(""), 0600)
 	err = mender.InventoryRefresh()
@@ -980,6 +1353,204 @@ func TestMenderFetchUpdate(t *testing.T) {
 	assert.True(t, bytes.Equal(rbytes, dl.Bytes()))
 }
 
+// flakyUpdater returns the given errors from FetchUpdate, one per call, and
+// succeeds once it runs out of them.
+type flakyUpdater struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current *client.CurrentUpdate) (interface{}, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *flakyUpdater) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return nil, -1, f.errs[f.calls-1]
+	}
+	return ioutil.NopCloser(bytes.NewBufferString("data")), 4, nil
+}
+
+func TestMenderFetchUpdateRetry(t *testing.T) {
+	oldUnit := updateFetchRetryUnit
+	updateFetchRetryUnit = time.Millisecond
+	defer func() { updateFetchRetryUnit = oldUnit }()
+
+	response := func(code int) *http.Response {
+		return &http.Response{
+			StatusCode: code,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("{}")),
+		}
+	}
+	netErr := errors.Wrap(&net.OpError{Op: "read", Err: syscall.ECONNRESET},
+		"update fetch request failed")
+	serverErr := client.NewAPIError(errors.New("error receiving scheduled update information"),
+		response(http.StatusServiceUnavailable))
+	clientErr := client.NewAPIError(errors.New("error receiving scheduled update information"),
+		response(http.StatusNotFound))
+
+	tc := map[string]struct {
+		retries   int
+		errs      []error
+		calls     int
+		expectErr bool
+	}{
+		"succeeds on third attempt": {
+			retries: 3,
+			errs:    []error{netErr, serverErr},
+			calls:   3,
+		},
+		"retries disabled": {
+			retries:   0,
+			errs:      []error{netErr},
+			calls:     1,
+			expectErr: true,
+		},
+		"retries exhausted": {
+			retries:   2,
+			errs:      []error{netErr, serverErr, netErr, serverErr},
+			calls:     3,
+			expectErr: true,
+		},
+		"no retry on 4xx": {
+			retries:   3,
+			errs:      []error{clientErr},
+			calls:     1,
+			expectErr: true,
+		},
+	}
+
+	for name, c := range tc {
+		t.Run(name, func(t *testing.T) {
+			mender := newDefaultTestMender()
+			mender.Config.UpdateFetchRetries = c.retries
+			updater := &flakyUpdater{errs: c.errs}
+			mender.updater = updater
+
+			img, _, err := mender.FetchUpdate("http://localhost/download")
+			assert.Equal(t, c.calls, updater.calls)
+			if c.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, img)
+			}
+		})
+	}
+}
+
+// signallingUpdater tells when a download has been tried.
+type signallingUpdater struct {
+	flakyUpdater
+	fetched chan struct{}
+}
+
+func (s *signallingUpdater) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	defer func() { s.fetched <- struct{}{} }()
+	return s.flakyUpdater.FetchUpdate(api, url, maxWait)
+}
+
+func TestMenderFetchUpdateCancelRetries(t *testing.T) {
+	oldUnit := updateFetchRetryUnit
+	updateFetchRetryUnit = time.Hour
+	defer func() { updateFetchRetryUnit = oldUnit }()
+
+	netErr := errors.Wrap(&net.OpError{Op: "read", Err: syscall.ECONNRESET},
+		"update fetch request failed")
+	mender := newDefaultTestMender()
+	mender.Config.UpdateFetchRetries = 3
+	updater := &signallingUpdater{
+		flakyUpdater: flakyUpdater{errs: []error{netErr}},
+		fetched:      make(chan struct{}, 1),
+	}
+	mender.updater = updater
+
+	done := make(chan error)
+	go func() {
+		_, _, err := mender.FetchUpdate("http://localhost/download")
+		done <- err
+	}()
+	<-updater.fetched
+	mender.CancelFetchRetries()
+	select {
+	case err := <-done:
+		assert.Equal(t, netErr, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("FetchUpdate still waits to retry")
+	}
+	assert.Equal(t, 1, updater.calls)
+}
+
+func TestMenderFetchUpdateRateLimit(t *testing.T) {
+	mender := newDefaultTestMender()
+	mender.updater = &flakyUpdater{}
+
+	img, _, err := mender.FetchUpdate("http://localhost/download")
+	require.NoError(t, err)
+	_, limited := img.(*utils.RateLimitedReadCloser)
+	assert.False(t, limited)
+
+	mender.Config.DownloadLimitBytesPerSecond = 1024
+	img, _, err = mender.FetchUpdate("http://localhost/download")
+	require.NoError(t, err)
+	assert.IsType(t, &utils.RateLimitedReadCloser{}, img)
+	data, err := ioutil.ReadAll(img)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestMenderCheckFreeSpace(t *testing.T) {
+	device := &FakeDevice{RetFreeSpace: 1000}
+	mender := newTestMender(nil, conf.MenderConfig{},
+		testMenderPieces{MenderPieces{DualRootfsDevice: device}})
+
+	update := &datastore.UpdateInfo{}
+	update.Artifact.PayloadTypes = []string{"rootfs-image"}
+
+	assert.NoError(t, mender.CheckFreeSpace(update, 1000))
+	// Unknown size.
+	assert.NoError(t, mender.CheckFreeSpace(update, -1))
+
+	err := mender.CheckFreeSpace(update, 1001)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Not enough space for the update")
+
+	mender.Config.FreeSpaceMarginBytes = 100
+	assert.Error(t, mender.CheckFreeSpace(update, 901))
+	assert.NoError(t, mender.CheckFreeSpace(update, 900))
+
+	// Only rootfs-image payloads go to the inactive partition.
+	update.Artifact.PayloadTypes = []string{"single-file"}
+	assert.NoError(t, mender.CheckFreeSpace(update, 5000))
+
+	// Failing to get the size should not block the update.
+	update.Artifact.PayloadTypes = []string{"rootfs-image"}
+	device.RetFreeSpaceErr = errors.New("no such device")
+	assert.NoError(t, mender.CheckFreeSpace(update, 5000))
+}
+
+func TestMenderFetchUpdateProgress(t *testing.T) {
+	mender := newDefaultTestMender()
+	mender.updater = &flakyUpdater{}
+
+	var current, total int64
+	mender.SetUpdateProgressCallback(func(progress utils.Progress) {
+		current, total = progress.Current, progress.Total
+	})
+
+	img, _, err := mender.FetchUpdate("http://localhost/download")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(img)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, current)
+	assert.EqualValues(t, 4, total)
+}
+
 // TestReauthorization triggers the reauthorization mechanic when
 // issuing an API request and getting a 401 response code.
 // In this test we use check update as our reference API-request for
@@ -1045,12 +1616,16 @@ func TestReauthorization(t *testing.T) {
 //
 // Add multiple servers into conf.MenderConfig, and let the first one "fail".
 // 1.
-// Make the first server fail by having inconsistent artifact- / device name.
-// This should trigger a 400 response (bad request) if we issue a check for
-// pending updates, and hence swap to the second server.
+// Make the second server serve the authorization request, which the first
+// server refuses. The second server is then remembered as the good one.
 // 2.
-// Make the second server fail by refusing to authorize client, where as the
-// first server serves this authorization request.
+// Check for pending updates, which should go straight to the second
+// server.
+// 3.
+// Make the first server the only one knowing about the client. A client error
+// (400) from the second server should not trigger failover.
+// 4.
+// Take down the second server; a network error fails over to the first.
 func TestFailoverServers(t *testing.T) {
 
 	// Create temporary artifact_info / device_type files
@@ -1076,10 +1651,12 @@ func TestFailoverServers(t *testing.T) {
 	srv2.Update.Data = datastore.UpdateInfo{
 		ID: "foo",
 	}
+	srv2.Update.Data.Artifact.CompatibleDevices = []string{"dev"}
 	// Create mender- and conf.MenderConfig structs
 	srvrs := make([]client.MenderServer, 2)
 	srvrs[0].ServerURL = srv1.URL
 	srvrs[1].ServerURL = srv2.URL
+	srv1.Auth.Token = []byte(`jwt`)
 	srv2.Auth.Token = []byte(`jwt`)
 	srv2.Auth.Authorize = true
 	mender := newTestMender(nil,
@@ -1099,14 +1676,39 @@ func TestFailoverServers(t *testing.T) {
 	assert.True(t, srv1.Auth.Called)
 	assert.True(t, srv2.Auth.Called)
 
-	// Check for update: causes srv1 to return bad request (400) and trigger failover.
+	// Check for update: server 2 served the last request, so it is asked
+	// first.
 	rsp, err := mender.CheckUpdate()
 	assert.NoError(t, err)
-	// Both callbacks called, but only one returns 200
-	assert.True(t, srv1.Update.Called)
+	assert.False(t, srv1.Update.Called)
 	assert.True(t, srv2.Update.Called)
 	assert.NotNil(t, rsp)
 	assert.Equal(t, rsp.ID, srv2.Update.Data.ID)
+
+	// Check for update: server 2 returns bad request (400); no failover.
+	srv1.Update.Current = srv2.Update.Current
+	srv1.Update.Has = true
+	srv1.Update.Data = datastore.UpdateInfo{
+		ID: "bar",
+	}
+	srv1.Update.Data.Artifact.CompatibleDevices = []string{"dev"}
+	srv2.Update.Current = &client.CurrentUpdate{
+		Artifact:   "other-image",
+		DeviceType: "dev",
+	}
+	srv2.Update.Called = false
+	_, err = mender.CheckUpdate()
+	assert.Error(t, err)
+	assert.False(t, srv1.Update.Called)
+	assert.True(t, srv2.Update.Called)
+
+	// Check for update: server 2 is gone, so server 1 takes over.
+	srv2.Close()
+	rsp, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+	assert.True(t, srv1.Update.Called)
+	assert.NotNil(t, rsp)
+	assert.Equal(t, "bar", rsp.ID)
 }
 
 func TestMutualTLSClientConnection(t *testing.T) {
@@ -0,0 +1,141 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+)
+
+// Metrics collects statistics about the daemon, which are served in the
+// Prometheus text format. All methods may be called on a nil *Metrics, in
+// which case nothing is collected.
+type Metrics struct {
+	lock             sync.Mutex
+	updateChecks     uint64
+	updatesAttempted uint64
+	updatesSucceeded uint64
+	updatesFailed    uint64
+	bytesDownloaded  uint64
+	lastUpdateCheck  time.Time
+	state            datastore.MenderState
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) updateCheck() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.updateChecks++
+	m.lastUpdateCheck = time.Now()
+}
+
+func (m *Metrics) updateAttempt() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.updatesAttempted++
+}
+
+// updateReported counts the outcome of an update, once it has been reported
+// to the server.
+func (m *Metrics) updateReported(status string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch status {
+	case client.StatusSuccess:
+		m.updatesSucceeded++
+	case client.StatusFailure:
+		m.updatesFailed++
+	}
+}
+
+func (m *Metrics) setState(state datastore.MenderState) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.state = state
+}
+
+// countDownload returns a reader which adds everything read through it to the
+// downloaded bytes.
+func (m *Metrics) countDownload(rc io.ReadCloser) io.ReadCloser {
+	if m == nil {
+		return rc
+	}
+	return &downloadCounter{ReadCloser: rc, metrics: m}
+}
+
+type downloadCounter struct {
+	io.ReadCloser
+	metrics *Metrics
+}
+
+func (d *downloadCounter) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.metrics.lock.Lock()
+	d.metrics.bytesDownloaded += uint64(n)
+	d.metrics.lock.Unlock()
+	return n, err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n",
+			name, help, name, kind, name, value)
+	}
+	metric("mender_update_checks_total", "counter",
+		"Number of times the server was polled for updates.", m.updateChecks)
+	metric("mender_updates_attempted_total", "counter",
+		"Number of updates started.", m.updatesAttempted)
+	metric("mender_updates_succeeded_total", "counter",
+		"Number of updates reported as successful.", m.updatesSucceeded)
+	metric("mender_updates_failed_total", "counter",
+		"Number of updates reported as failed.", m.updatesFailed)
+	metric("mender_downloaded_bytes_total", "counter",
+		"Number of bytes of Artifacts downloaded.", m.bytesDownloaded)
+
+	var lastCheck int64
+	if !m.lastUpdateCheck.IsZero() {
+		lastCheck = m.lastUpdateCheck.Unix()
+	}
+	metric("mender_last_update_check_timestamp_seconds", "gauge",
+		"Time of the last poll for updates, in seconds since the epoch.", lastCheck)
+
+	fmt.Fprintf(w, "# HELP mender_state The state the daemon is in.\n"+
+		"# TYPE mender_state gauge\nmender_state{state=%q} 1\n", m.state.String())
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	// Disabled metrics are nil; none of this should panic.
+	var disabled *Metrics
+	disabled.updateCheck()
+	disabled.updateReported(client.StatusSuccess)
+	rc := ioutil.NopCloser(bytes.NewBufferString("data"))
+	assert.Equal(t, rc, disabled.countDownload(rc))
+
+	m := NewMetrics()
+	m.updateCheck()
+	m.updateCheck()
+	m.updateAttempt()
+	m.updateReported(client.StatusSuccess)
+	m.updateReported(client.StatusFailure)
+	m.updateReported(client.StatusAlreadyInstalled)
+	m.setState(datastore.MenderStateIdle)
+	data, err := ioutil.ReadAll(m.countDownload(
+		ioutil.NopCloser(bytes.NewBufferString("data"))))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE mender_update_checks_total counter\n"+
+		"mender_update_checks_total 2\n")
+	assert.Contains(t, body, "mender_updates_attempted_total 1\n")
+	assert.Contains(t, body, "mender_updates_succeeded_total 1\n")
+	assert.Contains(t, body, "mender_updates_failed_total 1\n")
+	assert.Contains(t, body, "mender_downloaded_bytes_total 4\n")
+	assert.Contains(t, body, "# TYPE mender_last_update_check_timestamp_seconds gauge\n")
+	assert.NotContains(t, body, "mender_last_update_check_timestamp_seconds 0\n")
+	assert.Contains(t, body, `mender_state{state="idle"} 1`)
+}
+
+func TestDaemonMetrics(t *testing.T) {
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	stc := &slowTransitionController{
+		stateTestController: stateTestController{state: States.Idle},
+		delay:               10 * time.Millisecond,
+	}
+	daemon := NewDaemon(stc, store.NewMemStore())
+	daemon.MetricsAddress = addr
+
+	done := make(chan error)
+	go func() { done <- daemon.Run() }()
+
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		rsp, err = http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Contains(t, string(body), "mender_update_checks_total 0\n")
+
+	daemon.StopDaemon()
+	assert.NoError(t, <-done)
+
+	// The listener is gone with the daemon.
+	_, err = http.Get("http://" + addr + "/metrics")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+)
+
+// PowerStateProvider tells whether the device runs on battery, so that the
+// daemon can poll the server less often, and put off downloads while the
+// charge is low.
+type PowerStateProvider interface {
+	OnBattery() bool
+	// Charge left, from 0 to 100. Only asked for while on battery.
+	BatteryPercent() int
+}
+
+// MainsPower is the PowerStateProvider of devices which are always plugged in.
+type MainsPower struct{}
+
+func (MainsPower) OnBattery() bool {
+	return false
+}
+
+func (MainsPower) BatteryPercent() int {
+	return 100
+}
+
+func powerState(ctx *StateContext) PowerStateProvider {
+	if ctx.PowerState == nil {
+		return MainsPower{}
+	}
+	return ctx.PowerState
+}
+
+// powerPollInterval returns interval, stretched by the battery poll interval
+// factor while the device is on battery.
+func powerPollInterval(ctx *StateContext, c Controller,
+	interval time.Duration) time.Duration {
+	factor := c.GetBatteryPollIntervalFactor()
+	if factor > 1 && powerState(ctx).OnBattery() {
+		return interval * time.Duration(factor)
+	}
+	return interval
+}
+
+// lowBattery returns the battery charge, and whether it is too low to download
+// an update. Mains power is never too low.
+func lowBattery(ctx *StateContext, c Controller) (int, bool) {
+	threshold := c.GetLowBatteryPercent()
+	power := powerState(ctx)
+	if threshold <= 0 || !power.OnBattery() {
+		return 100, false
+	}
+	percent := power.BatteryPercent()
+	return percent, percent < threshold
+}
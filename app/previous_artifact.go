@@ -0,0 +1,135 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/mendersoftware/mender/datastore"
+	dev "github.com/mendersoftware/mender/device"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoPreviousArtifact = errors.New("No previous Artifact to restore")
+)
+
+func partitionRestorer(installers []installer.PayloadUpdatePerformer) installer.PartitionRestorer {
+	for _, i := range installers {
+		if r, ok := i.(installer.PartitionRestorer); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// forgetPreviousArtifact is called before installers write a new root
+// filesystem over the previous one.
+func forgetPreviousArtifact(txn store.Transaction,
+	installers []installer.PayloadUpdatePerformer) {
+	if partitionRestorer(installers) == nil {
+		return
+	}
+	if err := txn.Remove(datastore.PreviousArtifactKey); err != nil {
+		log.Errorf("Could not remove the previous Artifact: %s", err)
+	}
+}
+
+// rememberPreviousArtifact records the currently installed Artifact as the
+// previous one. It must be called when installers have committed a new root
+// filesystem, before the new Artifact name is written.
+func rememberPreviousArtifact(txn store.Transaction,
+	installers []installer.PayloadUpdatePerformer) error {
+	restorer := partitionRestorer(installers)
+	if restorer == nil {
+		return nil
+	}
+	partition, err := restorer.GetInactive()
+	if err != nil {
+		log.Errorf("Could not get the partition of the previous Artifact; "+
+			"it cannot be restored: %s", err)
+		return txn.Remove(datastore.PreviousArtifactKey)
+	}
+	return datastore.StorePreviousArtifact(txn, partition)
+}
+
+// DoRestorePrevious enables the partition of the previously committed
+// Artifact, if it is still intact. The device boots it on the next reboot.
+func DoRestorePrevious(device *dev.DeviceManager) error {
+	return newUpdateError(ErrRollback, restorePrevious(device))
+}
+
+func restorePrevious(device *dev.DeviceManager) error {
+	for _, key := range []string{datastore.StateDataKey, datastore.StandaloneStateKey} {
+		if _, err := device.Store.ReadAll(key); err == nil {
+			return errors.New("An update is in progress; " +
+				"commit or roll it back first")
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	prev, err := datastore.LoadPreviousArtifact(device.Store)
+	if err != nil {
+		return err
+	} else if prev == nil {
+		return ErrNoPreviousArtifact
+	}
+	restorer, ok := device.InstallerFactories.DualRootfs.(installer.PartitionRestorer)
+	if !ok {
+		return errors.New("The device has no root filesystem partitions to switch between")
+	}
+	inactive, err := restorer.GetInactive()
+	if err != nil {
+		return err
+	}
+	if inactive != prev.Partition {
+		return errors.Errorf("The previous Artifact %s was on partition %s, "+
+			"but the inactive partition is %s", prev.ArtifactName,
+			prev.Partition, inactive)
+	}
+
+	active, err := restorer.GetActive()
+	if err != nil {
+		return err
+	}
+	if err = restorer.EnableInactive(); err != nil {
+		return err
+	}
+
+	// The Artifact being left becomes the previous one in turn.
+	log.Infof("Restoring the previous Artifact %s", prev.ArtifactName)
+	return device.Store.WriteTransaction(func(txn store.Transaction) error {
+		if err := datastore.StorePreviousArtifact(txn, active); err != nil {
+			return err
+		}
+		if err := txn.WriteAll(datastore.ArtifactNameKey,
+			[]byte(prev.ArtifactName)); err != nil {
+			return err
+		}
+		if err := txn.WriteAll(datastore.ArtifactGroupKey,
+			[]byte(prev.ArtifactGroup)); err != nil {
+			return err
+		}
+		providesBuf, err := json.Marshal(prev.TypeInfoProvides)
+		if err != nil {
+			return err
+		}
+		return txn.WriteAll(datastore.ArtifactTypeInfoProvidesKey, providesBuf)
+	})
+}
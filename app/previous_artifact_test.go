@@ -0,0 +1,83 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	dev "github.com/mendersoftware/mender/device"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestorePrevious(t *testing.T) {
+	ms := store.NewMemStore()
+	enableCalls := 0
+	newDevice := func(active, inactive string) *dev.DeviceManager {
+		return dev.NewDeviceManager(&FakeDevice{
+			RetActive:           active,
+			RetInactive:         inactive,
+			EnableInactiveCalls: &enableCalls,
+		}, &conf.MenderConfig{}, ms)
+	}
+
+	// Nothing committed yet.
+	err := DoRestorePrevious(newDevice("/dev/p2", "/dev/p3"))
+	assert.Equal(t, ErrNoPreviousArtifact, errors.Cause(err))
+
+	// Commit release-2 on top of release-1, which stays on /dev/p2.
+	require.NoError(t, ms.WriteAll(datastore.ArtifactNameKey, []byte("release-1")))
+	require.NoError(t, ms.WriteAll(datastore.ArtifactGroupKey, []byte("stable")))
+	installers := []installer.PayloadUpdatePerformer{
+		&FakeDevice{RetActive: "/dev/p3", RetInactive: "/dev/p2"},
+	}
+	require.NoError(t, rememberPreviousArtifact(ms, installers))
+	require.NoError(t, ms.WriteAll(datastore.ArtifactNameKey, []byte("release-2")))
+	require.NoError(t, ms.WriteAll(datastore.ArtifactGroupKey, []byte("")))
+
+	// Not while an update is in progress.
+	require.NoError(t, ms.WriteAll(datastore.StateDataKey, []byte("{}")))
+	assert.Error(t, DoRestorePrevious(newDevice("/dev/p3", "/dev/p2")))
+	require.NoError(t, ms.Remove(datastore.StateDataKey))
+
+	// Not if the partitions have been switched since.
+	assert.Error(t, DoRestorePrevious(newDevice("/dev/p2", "/dev/p3")))
+	assert.Equal(t, 0, enableCalls)
+
+	require.NoError(t, DoRestorePrevious(newDevice("/dev/p3", "/dev/p2")))
+	assert.Equal(t, 1, enableCalls)
+	name, _ := ms.ReadAll(datastore.ArtifactNameKey)
+	assert.Equal(t, "release-1", string(name))
+	group, _ := ms.ReadAll(datastore.ArtifactGroupKey)
+	assert.Equal(t, "stable", string(group))
+
+	// release-2 can be restored in turn.
+	prev, err := datastore.LoadPreviousArtifact(ms)
+	require.NoError(t, err)
+	assert.Equal(t, &datastore.PreviousArtifact{
+		ArtifactName: "release-2",
+		Partition:    "/dev/p3",
+	}, prev)
+
+	// Until a new update is written over it.
+	forgetPreviousArtifact(ms, installers)
+	err = DoRestorePrevious(newDevice("/dev/p2", "/dev/p3"))
+	assert.Equal(t, ErrNoPreviousArtifact, errors.Cause(err))
+	assert.Equal(t, 1, enableCalls)
+}
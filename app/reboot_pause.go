@@ -0,0 +1,52 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"time"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+)
+
+// rebootPaused tells whether reboots into installed updates are paused.
+func rebootPaused(s store.Store) bool {
+	if s == nil {
+		return false
+	}
+	_, err := s.ReadAll(datastore.RebootPausedKey)
+	return err == nil
+}
+
+// setRebootPaused pauses or unpauses reboots into installed updates, and
+// returns whether that changed anything.
+func setRebootPaused(s store.Store, paused bool) (bool, error) {
+	if paused == rebootPaused(s) {
+		return false, nil
+	}
+	if !paused {
+		err := s.Remove(datastore.RebootPausedKey)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return true, nil
+	}
+	err := s.WriteAll(datastore.RebootPausedKey,
+		[]byte(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
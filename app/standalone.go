@@ -65,9 +65,14 @@ func DoStandaloneInstall(device *dev.DeviceManager, updateURI string,
 		// we are having remote update
 		ac, err = client.New(clientConfig)
 		if err != nil {
-			return errors.New("Can not initialize client for performing network update.")
+			return newUpdateError(ErrFetch,
+				errors.New("Can not initialize client for performing network update."))
 		}
-		upclient = client.NewUpdate()
+		updateClient := client.NewUpdate()
+		updateClient.SetStorageCredentials(device.Config.ArtifactStorageCredentials)
+		updateClient.SetMaxResumes(device.Config.DownloadMaxResumes)
+		updateClient.SetMaxArtifactSize(device.Config.MaxArtifactSizeBytes)
+		upclient = updateClient
 
 		log.Debug("Client initialized. Start downloading image.")
 
@@ -82,7 +87,8 @@ func DoStandaloneInstall(device *dev.DeviceManager, updateURI string,
 	}
 
 	if image == nil || err != nil {
-		return errors.Wrapf(err, "Error while installing Artifact from command line")
+		return newUpdateError(ErrFetch,
+			errors.Wrapf(err, "Error while installing Artifact from command line"))
 	}
 	defer image.Close()
 
@@ -102,7 +108,7 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 	dt, err := device.GetDeviceType()
 	if err != nil {
 		log.Errorf("Could not determine device type: %s", err.Error())
-		return nil, err
+		return nil, newUpdateError(ErrInstall, err)
 	}
 
 	// Download state
@@ -111,7 +117,7 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 		log.Errorf("Download_Enter script failed: %s", err.Error())
 		callErrorScript("Download", stateExec)
 		// No doStandaloneFailureStates here, since we have not done anything yet.
-		return nil, err
+		return nil, newUpdateError(ErrInstall, err)
 	}
 	installer, installers, err := installer.ReadHeaders(art, dt, key,
 		device.StateScriptPath, &device.InstallerFactories)
@@ -122,13 +128,13 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 		log.Errorf("Reading headers failed: %s", err.Error())
 		callErrorScript("Download", stateExec)
 		doStandaloneFailureStates(device, standaloneData, stateExec, false, false, true)
-		return nil, err
+		return nil, newUpdateError(ErrVerify, err)
 	}
 
 	standaloneData.artifactName = installer.GetArtifactName()
 	standaloneData.artifactTypeInfoProvides, err = installer.GetArtifactProvides()
 	if err != nil {
-		return nil, err
+		return nil, newUpdateError(ErrVerify, err)
 	}
 	if standaloneData.artifactTypeInfoProvides != nil {
 		if _, ok := standaloneData.
@@ -145,31 +151,33 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 	}
 	depends, err := installer.GetArtifactDepends()
 	if err != nil {
-		return nil, err
+		return nil, newUpdateError(ErrVerify, err)
 	} else if depends != nil {
 		currentProvides, err := datastore.LoadProvides(device.Store)
 		if err != nil {
-			return nil, err
+			return nil, newUpdateError(ErrVerify, err)
 		}
 		if err = verifyArtifactDependencies(depends, currentProvides); err != nil {
 			log.Error(err.Error())
-			return nil, err
+			return nil, newUpdateError(ErrVerify, err)
 		}
 	}
 
+	forgetPreviousArtifact(device.Store, standaloneData.installers)
 	err = installer.StorePayloads()
 	if err != nil {
 		log.Errorf("Download failed: %s", err.Error())
+		invalidatePartitions(standaloneData.installers)
 		callErrorScript("Download", stateExec)
 		doStandaloneFailureStates(device, standaloneData, stateExec, false, false, true)
-		return nil, err
+		return nil, newUpdateError(ErrInstall, err)
 	}
 	err = stateExec.ExecuteAll("Download", "Leave", false, nil)
 	if err != nil {
 		log.Errorf("Download_Leave script failed: %s", err.Error())
 		callErrorScript("Download", stateExec)
 		doStandaloneFailureStates(device, standaloneData, stateExec, false, false, true)
-		return nil, err
+		return nil, newUpdateError(ErrInstall, err)
 	}
 
 	return standaloneData, nil
@@ -190,7 +198,7 @@ func doStandaloneInstallStates(art io.ReadCloser, key []byte,
 	if err != nil {
 		log.Error(err.Error())
 		doStandaloneFailureStates(device, standaloneData, stateExec, false, false, true)
-		return err
+		return newUpdateError(ErrInstall, err)
 	}
 
 	// ArtifactInstall state
@@ -199,35 +207,33 @@ func doStandaloneInstallStates(art io.ReadCloser, key []byte,
 		log.Errorf("ArtifactInstall_Enter script failed: %s", err.Error())
 		callErrorScript("ArtifactInstall", stateExec)
 		doStandaloneFailureStates(device, standaloneData, stateExec, true, true, true)
-		return err
+		return newUpdateError(ErrInstall, err)
 	}
-	for _, inst := range installers {
-		err = inst.InstallUpdate()
-		if err != nil {
-			log.Errorf("Installation failed: %s", err.Error())
-			callErrorScript("ArtifactInstall", stateExec)
-			doStandaloneFailureStates(device, standaloneData, stateExec, true, true, true)
-			return err
-		}
+	err = installer.InstallPayloads(installers, device.Config.MaxConcurrentInstalls)
+	if err != nil {
+		log.Errorf("Installation failed: %s", err.Error())
+		callErrorScript("ArtifactInstall", stateExec)
+		doStandaloneFailureStates(device, standaloneData, stateExec, true, true, true)
+		return newUpdateError(ErrInstall, err)
 	}
 	err = stateExec.ExecuteAll("ArtifactInstall", "Leave", false, nil)
 	if err != nil {
 		log.Errorf("ArtifactInstall_Leave script failed: %s", err.Error())
 		callErrorScript("ArtifactInstall", stateExec)
 		doStandaloneFailureStates(device, standaloneData, stateExec, true, true, true)
-		return err
+		return newUpdateError(ErrInstall, err)
 	}
 
 	rebootNeeded, err := determineRebootNeeded(installers)
 	if err != nil {
 		doStandaloneFailureStates(device, standaloneData, stateExec, true, true, true)
-		return err
+		return newUpdateError(ErrInstall, err)
 	}
 
 	err = storeStandaloneData(device.Store, standaloneData)
 	if err != nil {
 		log.Errorf("Could not update database: %s", err.Error())
-		return err
+		return newUpdateError(ErrInstall, err)
 	}
 
 	if rollbackSupport {
@@ -252,12 +258,15 @@ func doStandaloneInstallStates(art io.ReadCloser, key []byte,
 
 func DoStandaloneCommit(device *dev.DeviceManager, stateExec statescript.Executor) error {
 	standaloneData, err := restoreStandaloneData(device)
-	if err != nil {
-		log.Errorf("Could not commit Artifact: %s", err.Error())
+	if err == ErrNoUpdate {
 		return err
+	} else if err != nil {
+		log.Errorf("Could not commit Artifact: %s", err.Error())
+		return newUpdateError(ErrCommit, err)
 	}
 
-	return doStandaloneCommitStates(device, standaloneData, stateExec)
+	return newUpdateError(ErrCommit,
+		doStandaloneCommitStates(device, standaloneData, stateExec))
 }
 
 func doStandaloneCommitStates(device *dev.DeviceManager, standaloneData *standaloneData,
@@ -282,6 +291,9 @@ func doStandaloneCommitStates(device *dev.DeviceManager, standaloneData *standal
 			return err
 		}
 	}
+	if err = rememberPreviousArtifact(device.Store, standaloneData.installers); err != nil {
+		log.Errorf("Could not record the previous Artifact: %s", err.Error())
+	}
 	var errorToReturn error
 	err = stateExec.ExecuteAll("ArtifactCommit", "Leave", false, nil)
 	if err != nil {
@@ -302,17 +314,19 @@ func doStandaloneCommitStates(device *dev.DeviceManager, standaloneData *standal
 
 func DoStandaloneRollback(device *dev.DeviceManager, stateExec statescript.Executor) error {
 	standaloneData, err := restoreStandaloneData(device)
-	if err != nil {
-		log.Error(err.Error())
+	if err == ErrNoUpdate {
 		return err
+	} else if err != nil {
+		log.Error(err.Error())
+		return newUpdateError(ErrRollback, err)
 	}
 
 	rollbackSupport, err := determineRollbackSupport(standaloneData.installers)
 	if err != nil {
 		log.Error(err.Error())
-		return err
+		return newUpdateError(ErrRollback, err)
 	} else if !rollbackSupport {
-		return errors.New("No rollback support")
+		return newUpdateError(ErrRollback, errors.New("No rollback support"))
 	}
 
 	var firstErr error
@@ -337,7 +351,7 @@ func DoStandaloneRollback(device *dev.DeviceManager, stateExec statescript.Execu
 	if firstErr == nil {
 		firstErr = err
 	}
-	return firstErr
+	return newUpdateError(ErrRollback, firstErr)
 }
 
 func doStandaloneRollbackState(standaloneData *standaloneData, stateExec statescript.Executor) error {
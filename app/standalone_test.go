@@ -16,6 +16,7 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -64,9 +65,9 @@ func Test_doManualUpdate_noParams_fail(t *testing.T) {
 
 	dualRootfsDevice := installer.NewDualRootfsDevice(nil, nil, installer.DualRootfsDeviceConfig{})
 	if err := DoStandaloneInstall(getTestDeviceManager(dualRootfsDevice, &config, deviceType, dbdir),
-		"", client.Config{}, nil, dev.NewStateScriptExecutor(&config), false); err == nil {
+		"", client.Config{}, nil, dev.NewStateScriptExecutor(&config), false); !errors.Is(err, ErrFetch) {
 
-		t.FailNow()
+		t.Fatalf("expected a fetch error, got %v", err)
 	}
 }
 
@@ -87,9 +88,9 @@ func Test_doManualUpdate_invalidHttpsClientConfig_updateFails(t *testing.T) {
 	if err := DoStandaloneInstall(getTestDeviceManager(
 		dualRootfsDevice, &config, deviceType, dbdir),
 		imageFile, runOptions, nil,
-		dev.NewStateScriptExecutor(&config), false); err == nil {
+		dev.NewStateScriptExecutor(&config), false); !errors.Is(err, ErrFetch) {
 
-		t.FailNow()
+		t.Fatalf("expected a fetch error, got %v", err)
 	}
 }
 
@@ -107,9 +108,9 @@ func Test_doManualUpdate_nonExistingFile_fail(t *testing.T) {
 	if err := DoStandaloneInstall(getTestDeviceManager(
 		fakeDevice, &config, deviceType, dbdir),
 		imageFile, client.Config{}, nil,
-		dev.NewStateScriptExecutor(&config), false); err == nil {
+		dev.NewStateScriptExecutor(&config), false); !errors.Is(err, ErrFetch) {
 
-		t.FailNow()
+		t.Fatalf("expected a fetch error, got %v", err)
 	}
 }
 
@@ -125,9 +126,9 @@ func Test_doManualUpdate_networkUpdateNoClient_fail(t *testing.T) {
 
 	config := conf.MenderConfig{}
 	if err := DoStandaloneInstall(getTestDeviceManager(fakeDevice, &config, deviceType, dbdir),
-		imageFile, client.Config{}, nil, dev.NewStateScriptExecutor(&config), false); err == nil {
+		imageFile, client.Config{}, nil, dev.NewStateScriptExecutor(&config), false); !errors.Is(err, ErrFetch) {
 
-		t.FailNow()
+		t.Fatalf("expected a fetch error, got %v", err)
 	}
 }
 
@@ -151,9 +152,9 @@ func Test_doManualUpdate_networkClientExistsNoServer_fail(t *testing.T) {
 	if err := DoStandaloneInstall(getTestDeviceManager(
 		fakeDevice, &config, deviceType, dbdir),
 		imageFile, fakeClientConfig, nil,
-		dev.NewStateScriptExecutor(&config), false); err == nil {
+		dev.NewStateScriptExecutor(&config), false); !errors.Is(err, ErrFetch) {
 
-		t.FailNow()
+		t.Fatalf("expected a fetch error, got %v", err)
 	}
 }
 
@@ -240,6 +241,51 @@ func Test_doManualUpdate_existingFile_updateSuccess_rebootExitCode(t *testing.T)
 	}
 }
 
+func Test_doManualUpdate_existingFile_checked(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	writeArtifact := func(signed bool) string {
+		artifact, err := MakeRootfsImageArtifact(2, signed)
+		require.NoError(t, err)
+		f, err := ioutil.TempFile(tmpdir, "update")
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = io.Copy(f, artifact)
+		require.NoError(t, err)
+		return f.Name()
+	}
+	install := func(deviceType, imageFileName string, vKey []byte) error {
+		deviceTypeFile := path.Join(tmpdir, "device_type")
+		require.NoError(t, ioutil.WriteFile(deviceTypeFile,
+			[]byte("device_type="+deviceType+"\n"), 0644))
+		dbdir, err := ioutil.TempDir(tmpdir, "menderDbdir")
+		require.NoError(t, err)
+
+		config := conf.MenderConfig{
+			ArtifactScriptsPath: tmpdir,
+		}
+		return DoStandaloneInstall(getTestDeviceManager(
+			FakeDevice{ConsumeUpdate: true}, &config, deviceTypeFile, dbdir),
+			imageFileName, client.Config{},
+			vKey, dev.NewStateScriptExecutor(&config), false)
+	}
+
+	assert.NoError(t, install("vexpress-qemu", writeArtifact(false), nil))
+
+	// A local file goes through the same checks as a deployment.
+	err = install("bogusdevicetype", writeArtifact(false), nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bogusdevicetype")
+
+	err = install("vexpress-qemu", writeArtifact(false), []byte(PublicRSAKey))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "signature")
+
+	assert.NoError(t, install("vexpress-qemu", writeArtifact(true), []byte(PublicRSAKey)))
+}
+
 func TestDoManualUpdateArtifactV3Dependencies(t *testing.T) {
 	// setup
 	deviceType := zeroLengthDeviceTypeFile(t)
@@ -292,20 +338,20 @@ func TestDoManualUpdateArtifactV3Dependencies(t *testing.T) {
 	err = DoStandaloneInstall(testDevMgr,
 		imageFileName, client.Config{},
 		nil, dev.NewStateScriptExecutor(&config), false)
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrVerify), "unexpected error: %v", err)
 
 	testDevMgr.Store.WriteAll(datastore.ArtifactNameKey,
 		[]byte("OldArtifact"))
 	err = DoStandaloneInstall(testDevMgr,
 		imageFileName, client.Config{},
 		nil, dev.NewStateScriptExecutor(&config), false)
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrVerify), "unexpected error: %v", err)
 	testDevMgr.Store.WriteAll(datastore.ArtifactGroupKey,
 		[]byte("testGroup"))
 	err = DoStandaloneInstall(testDevMgr,
 		imageFileName, client.Config{},
 		nil, dev.NewStateScriptExecutor(&config), false)
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrVerify), "unexpected error: %v", err)
 
 	typeProvidesBuf, err := json.Marshal(typeInfoDepends)
 	assert.NoError(t, err)
@@ -318,6 +364,70 @@ func TestDoManualUpdateArtifactV3Dependencies(t *testing.T) {
 
 }
 
+// TestDoManualUpdateArtifactV3ProvidesPersisted checks that the provides of an
+// installed Artifact are what the depends of the next one are checked against.
+func TestDoManualUpdateArtifactV3ProvidesPersisted(t *testing.T) {
+	deviceType := zeroLengthDeviceTypeFile(t)
+	defer os.Remove(deviceType)
+
+	tmpdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dbdir, err := ioutil.TempDir("", "menderDbdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dbdir)
+
+	config := conf.MenderConfig{
+		ArtifactScriptsPath: tmpdir,
+	}
+	testDevMgr := getTestDeviceManager(FakeDevice{ConsumeUpdate: true},
+		&config, deviceType, dbdir)
+
+	install := func(name string, depends *tests.ArtifactDepends,
+		typeProvides map[string]string, typeDepends map[string]interface{}) error {
+
+		artifactStream, err := tests.CreateTestArtifactV3("test", "gzip",
+			&tests.ArtifactProvides{ArtifactName: name}, depends,
+			typeProvides, typeDepends)
+		require.NoError(t, err)
+		f, err := ioutil.TempFile(tmpdir, "update")
+		require.NoError(t, err)
+		_, err = io.Copy(f, artifactStream)
+		require.NoError(t, err)
+		f.Close()
+		stateExec := dev.NewStateScriptExecutor(&config)
+		err = DoStandaloneInstall(testDevMgr, f.Name(), client.Config{},
+			nil, stateExec, false)
+		if err != nil {
+			return err
+		}
+		return DoStandaloneCommit(testDevMgr, stateExec)
+	}
+
+	require.NoError(t, install("first", nil,
+		map[string]string{"testKey": "testValue"}, nil))
+	providesBuf, err := testDevMgr.Store.ReadAll(datastore.ArtifactTypeInfoProvidesKey)
+	require.NoError(t, err)
+	var provides map[string]string
+	require.NoError(t, json.Unmarshal(providesBuf, &provides))
+	assert.Equal(t, "testValue", provides["testKey"])
+
+	depends := &tests.ArtifactDepends{
+		ArtifactName:      []string{"first"},
+		CompatibleDevices: []string{"qemux86-64"},
+	}
+	err = install("second", depends, nil,
+		map[string]interface{}{"testKey": "otherValue"})
+	assert.True(t, errors.Is(err, ErrVerify), "unexpected error: %v", err)
+
+	assert.NoError(t, install("second", depends, nil,
+		map[string]interface{}{"testKey": "testValue"}))
+	name, err := testDevMgr.Store.ReadAll(datastore.ArtifactNameKey)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(name))
+}
+
 type standaloneModuleInstallCase struct {
 	caseName    string
 	errInstall  string
@@ -1018,6 +1128,7 @@ func maybeDoPostStandaloneInstall(t *testing.T, c *standaloneModuleInstallCase,
 		if c.errCommit != "" {
 			require.Error(t, err)
 			assert.Contains(t, err.Error(), c.errCommit)
+			assert.True(t, errors.Is(err, ErrCommit), "unexpected error: %v", err)
 		} else {
 			assert.NoError(t, err)
 		}
@@ -1026,6 +1137,7 @@ func maybeDoPostStandaloneInstall(t *testing.T, c *standaloneModuleInstallCase,
 		if c.errRollback != "" {
 			require.Error(t, err)
 			assert.Contains(t, err.Error(), c.errRollback)
+			assert.True(t, errors.Is(err, ErrRollback), "unexpected error: %v", err)
 		} else {
 			assert.NoError(t, err)
 		}
@@ -17,6 +17,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"time"
 
@@ -25,6 +28,7 @@ import (
 	"github.com/mendersoftware/mender/datastore"
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
@@ -44,6 +48,28 @@ type StateContext struct {
 	lastInventoryUpdateAttempt time.Time
 	lastAuthorizeAttempt       time.Time
 	fetchInstallAttempts       int
+	// times the Artifact of the current update has been downloaded again
+	// for not matching its checksum
+	checksumMismatches int
+	// random offset added to the update poll interval until the next
+	// update check
+	updatePollJitter time.Duration
+	// no update check before this time, as asked by a busy server
+	updateCheckNotBefore time.Time
+	// nil unless metrics are enabled
+	metrics *Metrics
+	// receives a confirmation that the device is healthy after an update
+	HealthyChan chan bool
+	// receives the go-ahead to reboot into an update, if not automatic
+	RebootChan chan bool
+	// outcome of the last update check, kept in Store as well
+	lastUpdate *datastore.LastUpdate
+	// whether the device runs on battery; mains power if not set
+	PowerState PowerStateProvider
+	// hardware watchdog, if the device has one
+	Watchdog Watchdog
+	// aborts the update being downloaded
+	aborter updateAborter
 }
 
 type StateRunner interface {
@@ -209,6 +235,18 @@ func (ws *waitState) Cancel() bool {
 	return true
 }
 
+// logEvent returns a log entry for one of the milestones of an update, with
+// the same field names every time, so that they are easy to pick out when
+// logging in JSON format. The update may be nil.
+func logEvent(event string, update *datastore.UpdateInfo) *log.Entry {
+	fields := log.Fields{"event": event}
+	if update != nil {
+		fields["deployment_id"] = update.ID
+		fields["artifact_name"] = update.ArtifactName()
+	}
+	return log.WithFields(fields)
+}
+
 type updateState struct {
 	baseState
 	update datastore.UpdateInfo
@@ -293,6 +331,8 @@ func (i *initState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	msg := fmt.Sprintf("Mender shut down in state: %s", sd.Name)
 	switch sd.Name {
+	case datastore.MenderStateUpdateRebootWait:
+	case datastore.MenderStateUpdateHealthWait:
 	case datastore.MenderStateReboot:
 	case datastore.MenderStateRollbackReboot:
 		// Interruption is expected in these, don't produce error.
@@ -312,6 +352,10 @@ func (i *initState) Handle(ctx *StateContext, c Controller) (State, bool) {
 		return NewUpdateStatusReportState(&sd.UpdateInfo, client.StatusFailure), false
 	}
 
+	// Whatever is on a partially written partition is of no use. The
+	// update is then cleaned up and reported as usual.
+	recoverPartitionWrite(ctx.Store, c.GetInstallers())
+
 	return i.getNextState(ctx, &sd, me)
 }
 
@@ -338,6 +382,19 @@ func (i *initState) getNextState(ctx *StateContext, sd *datastore.StateData,
 
 		return NewUpdateCleanupState(&sd.UpdateInfo, client.StatusFailure), false
 
+	// Keep waiting for the maintenance window; it may have opened, or
+	// closed, while we were down.
+	case datastore.MenderStateUpdateRebootWait:
+		return NewUpdateRebootWaitState(&sd.UpdateInfo), false
+
+	// Keep waiting for the device to be confirmed healthy, until the
+	// deadline set before we went down.
+	case datastore.MenderStateUpdateHealthWait:
+		if deadline := sd.UpdateInfo.HealthCheckDeadline; deadline != nil {
+			return NewUpdateHealthWaitState(&sd.UpdateInfo, *deadline), false
+		}
+		return NewUpdateRollbackState(&sd.UpdateInfo), false
+
 	// After reboot into new update.
 	case datastore.MenderStateReboot:
 		return NewUpdateVerifyRebootState(&sd.UpdateInfo), false
@@ -514,6 +571,9 @@ func (uc *updateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 			Name:       uc.Id(),
 			UpdateInfo: *uc.Update(),
 		}, func(txn store.Transaction) error {
+			if err := rememberPreviousArtifact(txn, installers); err != nil {
+				return err
+			}
 			log.Debugf("Committing new artifact name: %s",
 				uc.Update().ArtifactName())
 			if err := txn.WriteAll(datastore.ArtifactNameKey,
@@ -576,7 +636,9 @@ func (usr *updatePreCommitStatusReportRetryState) Handle(ctx *StateContext, c Co
 	maxTrySending++
 
 	if usr.reportTries < maxTrySending {
-		return usr.Wait(usr.returnToState, usr, c.GetRetryPollInterval(), ctx.WakeupChan)
+		return usr.Wait(usr.returnToState, usr, statusReportRetryInterval(
+			c.GetRetryPollInterval(), c.GetUpdatePollInterval(), usr.reportTries),
+			ctx.WakeupChan)
 	}
 	return usr.returnToState.HandleError(ctx, c,
 		NewTransientError(errors.New("Tried sending status report maximum number of times.")))
@@ -661,6 +723,8 @@ type updateCheckState struct {
 
 func (u *updateCheckState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("Handle update check state")
+	logEvent("update-check", nil).Info("Checking for updates")
+	ctx.metrics.updateCheck()
 
 	update, err := c.CheckUpdate()
 
@@ -670,17 +734,81 @@ func (u *updateCheckState) Handle(ctx *StateContext, c Controller) (State, bool)
 			// Just report successful update and return to normal operations.
 			return NewUpdateStatusReportState(update, client.StatusAlreadyInstalled), false
 		}
+		if isIncompatibleDevice(err.Cause()) {
+			return incompatibleUpdate(update, err), false
+		}
+
+		if busy, ok := errors.Cause(err.Cause()).(*client.TooManyRequestsError); ok &&
+			busy.RetryAfter > 0 {
+			ctx.updateCheckNotBefore = time.Now().Add(busy.RetryAfter)
+		}
+		if d, ok := errors.Cause(err.Cause()).(*client.DecommissionedError); ok {
+			return NewDecommissionedState(d.Wipe), false
+		}
 
 		log.Errorf("Update check failed: %s", err)
 		return NewErrorState(err), false
 	}
 
+	if update != nil && givenUpOn(ctx, c, update) {
+		return States.CheckWait, false
+	}
+	if percent, low := lowBattery(ctx, c); update != nil && low {
+		log.Infof("Postponing the download of %s until the battery is charged "+
+			"(now at %d%%)", update.ArtifactName(), percent)
+		return States.CheckWait, false
+	}
 	if update != nil {
+		logEvent("update-available", update).Info("Update available")
+		ctx.metrics.updateAttempt()
+		ctx.checksumMismatches = 0
+		ctx.aborter.reset()
 		return NewUpdateFetchState(update), false
 	}
+	recordLastUpdate(ctx, datastore.LastUpdate{Status: datastore.LastUpdateNoUpdate})
 	return States.CheckWait, false
 }
 
+// abortedUpdate fails an update which was aborted before anything of it was
+// written to the device.
+func abortedUpdate(update *datastore.UpdateInfo, err error) State {
+	log.Errorf("Update fetch failed: %s", err)
+	return NewUpdateStatusReportState(update, client.StatusFailure)
+}
+
+// incompatibleUpdate fails an update which is not meant for this device. There
+// is no point in trying it again.
+func incompatibleUpdate(update *datastore.UpdateInfo, err error) State {
+	DeploymentLogger.Enable(update.ID)
+	log.Errorf("Refusing to install Artifact %s: %s", update.ArtifactName(), err)
+	return NewUpdateStatusReportState(update, client.StatusFailure)
+}
+
+// givenUpOn returns whether update is a deployment which has already failed
+// the maximum number of times, and must not be tried again.
+func givenUpOn(ctx *StateContext, c Controller, update *datastore.UpdateInfo) bool {
+	limit := c.GetMaxUpdateAttempts()
+	if limit <= 0 {
+		return false
+	}
+	attempts, err := datastore.LoadUpdateAttempts(ctx.Store)
+	if err != nil {
+		log.Errorf("Could not load the failed update attempts: %v", err)
+		return false
+	}
+	if attempts.DeploymentID != update.ID || attempts.Failures < limit {
+		return false
+	}
+	log.Infof("Ignoring deployment %s, which has already failed %d times",
+		update.ID, attempts.Failures)
+	return true
+}
+
+func isIncompatibleDevice(err error) bool {
+	_, ok := errors.Cause(err).(*installer.IncompatibleDeviceError)
+	return ok
+}
+
 type updateFetchState struct {
 	baseState
 	update datastore.UpdateInfo
@@ -704,15 +832,66 @@ func (u *updateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 	log.Debugf("Handling update fetch state")
 
+	if err := ctx.aborter.aborted(); err != nil {
+		return abortedUpdate(&u.update, err), false
+	}
+
 	merr := c.ReportUpdateStatus(&u.update, client.StatusDownloading)
 	if merr != nil && merr.IsFatal() {
 		return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
 	}
 
-	in, _, err := c.FetchUpdate(u.update.URI())
-	if err != nil {
-		log.Errorf("Update fetch failed: %s", err)
-		return NewFetchStoreRetryState(u, &u.update, err), false
+	cacheDir := c.GetArtifactCacheDir()
+	in, size := openCachedArtifact(cacheDir, &u.update)
+	cached := in != nil
+	if !cached {
+		var err error
+		stopPetting := keepWatchdogPetted(ctx)
+		in, size, err = c.FetchUpdate(u.update.URI())
+		stopPetting()
+		if abortErr := ctx.aborter.aborted(); abortErr != nil {
+			if err == nil {
+				in.Close()
+			}
+			return abortedUpdate(&u.update, abortErr), false
+		} else if err != nil {
+			log.Errorf("Update fetch failed: %s", err)
+			return NewFetchStoreRetryState(u, &u.update, err), false
+		}
+		in = cacheArtifact(cacheDir, &u.update, in)
+	}
+	in = ctx.aborter.watch(in)
+
+	// No point in retrying; the update will not get any smaller.
+	if err := c.CheckFreeSpace(&u.update, size); err != nil {
+		log.Errorf("Update fetch aborted: %s", err)
+		in.Close()
+		return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
+	}
+	logEvent("download", &u.update).WithField("size", size).Info("Downloading update")
+
+	// A cached Artifact has already been verified, and is on the device.
+	if downloadDir := c.GetArtifactDownloadDir(); downloadDir != "" && !cached {
+		var err error
+		stopPetting := keepWatchdogPetted(ctx)
+		stopWatching := watchServerAbort(ctx, c, &u.update)
+		in, size, err = downloadArtifact(downloadDir, &u.update, in)
+		stopWatching()
+		stopPetting()
+		if abortErr := ctx.aborter.aborted(); abortErr != nil {
+			if err == nil {
+				in.Close()
+			}
+			return abortedUpdate(&u.update, abortErr), false
+		} else if errors.Cause(err) == errArtifactChecksum {
+			if state := retryChecksumMismatch(ctx, c, u, &u.update, err); state != nil {
+				return state, false
+			}
+			return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
+		} else if err != nil {
+			log.Errorf("Update fetch failed: %s", err)
+			return NewFetchStoreRetryState(u, &u.update, err), false
+		}
 	}
 
 	return NewUpdateStoreState(in, &u.update), false
@@ -782,8 +961,22 @@ func (u *updateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
 	}
 
-	installer, err := c.ReadArtifactHeaders(u.imagein)
-	if err != nil {
+	imagein := ctx.metrics.countDownload(u.imagein)
+	var checksum *utils.ChecksumReadCloser
+	if expected := u.update.Artifact.Source.Checksum; expected != "" {
+		checksum = utils.NewChecksumReadCloser(imagein, expected)
+		imagein = checksum
+	}
+
+	// Only the header of the Artifact is read here. Everything which can
+	// be checked from it is checked before any payload is downloaded, and
+	// the download is closed if the update is refused.
+	installer, err := c.ReadArtifactHeaders(imagein)
+	if abortErr := ctx.aborter.aborted(); abortErr != nil {
+		return abortedUpdate(&u.update, abortErr), false
+	} else if isIncompatibleDevice(err) {
+		return incompatibleUpdate(&u.update, err), false
+	} else if err != nil {
 		log.Errorf("Fetching Artifact headers failed: %s", err)
 		return NewFetchStoreRetryState(u, &u.update, err), false
 	}
@@ -807,6 +1000,10 @@ func (u *updateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 			client.StatusFailure), false
 	}
 
+	if c.IsDryRun() {
+		return u.dryRun(imagein, checksum), false
+	}
+
 	// Store state so that all the payload handlers are recorded there. This
 	// is important since they need to call their Cleanup functions after we
 	// have started the download.
@@ -820,12 +1017,46 @@ func (u *updateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 			false, u.Id(), &u.update, err)
 	}
 
+	forgetPreviousArtifact(ctx.Store, installers)
+	// Without the record, a partially written partition could be left
+	// behind for a later update to enable.
+	if err = markPartitionWrite(ctx.Store, installers); err != nil {
+		log.Errorf("Could not record the write to the inactive partition: %s", err)
+		return NewUpdateCleanupState(&u.update, client.StatusFailure), false
+	}
+	// Any way out of here has either verified the image or invalidated the
+	// partition.
+	defer clearPartitionWrite(ctx.Store)
+	stopPetting := keepWatchdogPetted(ctx)
+	stopWatching := watchServerAbort(ctx, c, &u.update)
 	err = installer.StorePayloads()
+	stopWatching()
+	stopPetting()
+	// An abort which comes after the last read still counts, as long as
+	// the update is not installed yet.
+	if abortErr := ctx.aborter.aborted(); abortErr != nil {
+		err = abortErr
+	}
 	if err != nil {
 		log.Errorf("Artifact install failed: %s", err)
+		invalidatePartitions(c.GetInstallers())
 		return NewUpdateCleanupState(&u.update, client.StatusFailure), false
 	}
 
+	// Never go on to enable a partition holding a truncated or tampered
+	// image.
+	if checksum != nil {
+		if err = checksum.Verify(); err != nil {
+			invalidatePartitions(c.GetInstallers())
+			return u.checksumMismatch(ctx, c, err), false
+		}
+	}
+	// Whatever follows the payloads, such as padding, is needed too for a
+	// cached copy of the Artifact to be complete.
+	if _, err = io.Copy(ioutil.Discard, imagein); err != nil {
+		log.Warnf("Could not read the end of the Artifact: %s", err)
+	}
+
 	ok, state, cancelled := u.handleSupportsRollback(ctx, c)
 	if !ok {
 		return state, cancelled
@@ -845,6 +1076,145 @@ func (u *updateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 	return NewUpdateAfterStoreState(&u.update), false
 }
 
+// checksumMismatch downloads the Artifact again, if it is allowed to, since the
+// download may have been corrupted on the way. Otherwise the update fails.
+func (u *updateStoreState) checksumMismatch(ctx *StateContext, c Controller,
+	err error) State {
+
+	state := retryChecksumMismatch(ctx, c, u, &u.update, err)
+	if state == nil {
+		return NewUpdateCleanupState(&u.update, client.StatusFailure)
+	}
+	// The payloads are stored from scratch by the next attempt.
+	for _, i := range c.GetInstallers() {
+		if err := i.Cleanup(); err != nil {
+			log.Errorf("Cleanup failed: %s", err.Error())
+		}
+	}
+	return state
+}
+
+// retryChecksumMismatch returns the state which downloads an Artifact which
+// did not match its checksum again, or nil once there are no retries left.
+func retryChecksumMismatch(ctx *StateContext, c Controller, from State,
+	update *datastore.UpdateInfo, err error) State {
+
+	retries := c.GetChecksumMismatchRetries()
+	if ctx.checksumMismatches >= retries {
+		if retries > 0 {
+			log.Errorf("Artifact verification failed, giving up after "+
+				"downloading it %d times: %s", retries+1, err)
+		} else {
+			log.Errorf("Artifact verification failed: %s", err)
+		}
+		return nil
+	}
+
+	ctx.checksumMismatches++
+	log.Warnf("Artifact verification failed: %s; downloading it again (retry %d of %d)",
+		err, ctx.checksumMismatches, retries)
+	return NewFetchStoreRetryState(from, update, err)
+}
+
+// dryRun reads the rest of the Artifact without storing any of it, and ends
+// the update. Nothing has been written to the device at this point.
+func (u *updateStoreState) dryRun(imagein io.Reader,
+	checksum *utils.ChecksumReadCloser) State {
+
+	result := &datastore.DryRunResult{
+		PayloadTypes:      u.update.Artifact.PayloadTypes,
+		CompatibleDevices: u.update.CompatibleDevices(),
+	}
+	n, err := io.Copy(ioutil.Discard, imagein)
+	if err != nil {
+		log.Errorf("Dry run: Downloading the Artifact failed after %d bytes: %s", n, err)
+		result.Error = err.Error()
+		return NewDryRunStatusReportState(&u.update, result)
+	}
+	if checksum != nil {
+		if err = checksum.Verify(); err != nil {
+			log.Errorf("Dry run: Artifact verification failed: %s", err)
+			result.Error = err.Error()
+			return NewDryRunStatusReportState(&u.update, result)
+		}
+		result.ChecksumVerified = true
+		log.Infof("Dry run: Artifact checksum %s verified",
+			u.update.Artifact.Source.Checksum)
+	} else {
+		log.Info("Dry run: The server gave no Artifact checksum to verify")
+	}
+	log.Infof("Dry run: Artifact %s (payloads %v) for devices %v is "+
+		"installable; not installing it",
+		u.update.ArtifactName(), result.PayloadTypes, result.CompatibleDevices)
+	result.Installable = true
+	return NewDryRunStatusReportState(&u.update, result)
+}
+
+// invalidatePartitions makes sure that no partially written payload is left
+// behind in a state where it could be enabled by a later update.
+func invalidatePartitions(installers []installer.PayloadUpdatePerformer) {
+	for _, i := range installers {
+		inv, ok := i.(installer.PartitionInvalidator)
+		if !ok {
+			continue
+		}
+		if err := inv.InvalidatePartition(); err != nil {
+			log.Errorf("Failed to invalidate partition after failed install: %s", err)
+		}
+	}
+}
+
+// markPartitionWrite records that the inactive partition is about to be
+// written to, in case the device loses power before it is done. If the
+// inactive partition is not known, there is nothing to record, and the
+// installer fails to write to it anyway.
+func markPartitionWrite(s store.Store, installers []installer.PayloadUpdatePerformer) error {
+	restorer := partitionRestorer(installers)
+	if restorer == nil {
+		return nil
+	}
+	partition, err := restorer.GetInactive()
+	if err != nil {
+		log.Errorf("Could not get the inactive partition: %s", err)
+		return nil
+	}
+	return s.WriteAll(datastore.PartitionWriteKey, []byte(partition))
+}
+
+func clearPartitionWrite(s store.Store) {
+	if err := s.Remove(datastore.PartitionWriteKey); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Could not remove the record of the write to the inactive partition: %s", err)
+	}
+}
+
+// recoverPartitionWrite invalidates the inactive partition if writing an update
+// to it was interrupted.
+func recoverPartitionWrite(s store.Store, installers []installer.PayloadUpdatePerformer) {
+	partition, err := s.ReadAll(datastore.PartitionWriteKey)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorf("Could not read the record of the write to the inactive partition: %s", err)
+		return
+	}
+	defer clearPartitionWrite(s)
+
+	log.Warnf("Writing the update to partition %s was interrupted", partition)
+	restorer := partitionRestorer(installers)
+	if restorer == nil {
+		return
+	}
+	// Never touch a partition which has since become the active one.
+	if inactive, err := restorer.GetInactive(); err != nil {
+		log.Errorf("Could not get the inactive partition: %s", err)
+	} else if inactive != string(partition) {
+		log.Errorf("Partition %s is no longer the inactive partition; leaving it alone",
+			partition)
+	} else {
+		invalidatePartitions(installers)
+	}
+}
+
 func (u *updateStoreState) maybeVerifyArtifactDependsAndProvides(
 	ctx *StateContext, installer *installer.Installer) error {
 	// For artifact version >= 3 we need to fetch the artifact provides of
@@ -975,11 +1345,13 @@ func (is *updateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 
 	// If download was successful, install update, which for dual rootfs
 	// means marking inactive partition as the active one.
-	for _, i := range c.GetInstallers() {
-		if err := i.InstallUpdate(); err != nil {
-			return is.HandleError(ctx, c, NewTransientError(err))
-		}
+	stopPetting := keepWatchdogPetted(ctx)
+	err := installer.InstallPayloads(c.GetInstallers(), c.GetMaxConcurrentInstalls())
+	stopPetting()
+	if err != nil {
+		return is.HandleError(ctx, c, NewTransientError(err))
 	}
+	logEvent("update-installed", is.Update()).Info("Update installed")
 
 	ok, state, cancelled := is.handleRebootType(ctx, c)
 	if !ok {
@@ -998,7 +1370,16 @@ func (is *updateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 			// Do nothing.
 
 		case datastore.RebootTypeCustom, datastore.RebootTypeAutomatic:
+			if is.Update().PauseReboot {
+				if _, err := setRebootPaused(ctx.Store, true); err != nil {
+					log.Errorf("Could not pause reboots, as the deployment asks: %s", err)
+				}
+			}
 			// Go to reboot state if at least one payload requested it.
+			if !c.GetAutoReboot() || rebootPaused(ctx.Store) ||
+				(c.GetMaintenanceWindow().IsSet() && !is.Update().Force) {
+				return NewUpdateRebootWaitState(is.Update()), false
+			}
 			return NewUpdateRebootState(is.Update()), false
 
 		default:
@@ -1121,8 +1502,13 @@ func (cw *checkWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 	log.Debugf("Handle check wait state")
 
 	// calculate next interval
-	update := ctx.lastUpdateCheckAttempt.Add(c.GetUpdatePollInterval())
-	inventory := ctx.lastInventoryUpdateAttempt.Add(c.GetInventoryPollInterval())
+	update := ctx.lastUpdateCheckAttempt.Add(
+		powerPollInterval(ctx, c, c.GetUpdatePollInterval()) + ctx.updatePollJitter)
+	if update.Before(ctx.updateCheckNotBefore) {
+		update = ctx.updateCheckNotBefore
+	}
+	inventory := ctx.lastInventoryUpdateAttempt.Add(
+		powerPollInterval(ctx, c, c.GetInventoryPollInterval()))
 
 	// if we haven't sent inventory so far
 	if ctx.lastInventoryUpdateAttempt.IsZero() {
@@ -1172,6 +1558,8 @@ func (cw *checkWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 		} else {
 			ctx.lastUpdateCheckAttempt = next.when
 		}
+		ctx.updatePollJitter = pollJitter(c.GetUpdatePollInterval(),
+			c.GetUpdatePollJitter())
 	}
 
 	if wait != 0 {
@@ -1183,6 +1571,17 @@ func (cw *checkWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 	return next.state, false
 }
 
+// Source of randomness for pollJitter. Only changed by tests.
+var pollJitterRand = rand.Float64
+
+// pollJitter returns a random duration within ±fraction of interval.
+func pollJitter(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return 0
+	}
+	return time.Duration((2*pollJitterRand() - 1) * fraction * float64(interval))
+}
+
 type inventoryUpdateState struct {
 	baseState
 }
@@ -1322,6 +1721,9 @@ type updateStatusReportState struct {
 	triesSendingReport int
 	triesSendingLogs   int
 	logs               []byte
+	outcomeRecorded    bool
+	// Set if the update was a dry run.
+	dryRun *datastore.DryRunResult
 }
 
 func NewUpdateStatusReportState(update *datastore.UpdateInfo, status string) State {
@@ -1332,6 +1734,20 @@ func NewUpdateStatusReportState(update *datastore.UpdateInfo, status string) Sta
 	}
 }
 
+// NewDryRunStatusReportState ends a dry run. The server has no status for it,
+// and the Artifact is not installed, so the deployment is reported as failed,
+// with the dry run in the deployment log. The outcome kept on the device is
+// the result of the dry run, and it is not counted as a failed attempt.
+func NewDryRunStatusReportState(update *datastore.UpdateInfo,
+	result *datastore.DryRunResult) State {
+	return &updateStatusReportState{
+		updateState: NewUpdateState(datastore.MenderStateUpdateStatusReport,
+			ToNone, update),
+		status: client.StatusFailure,
+		dryRun: result,
+	}
+}
+
 func sendDeploymentLogs(update *datastore.UpdateInfo, sentTries *int,
 	logs []byte, c Controller) menderError {
 	if logs == nil {
@@ -1355,6 +1771,44 @@ func sendDeploymentLogs(update *datastore.UpdateInfo, sentTries *int,
 	return nil
 }
 
+// recordUpdateAttempt counts consecutive failures of the same deployment, so
+// that it can be given up on once MaxUpdateAttempts is reached.
+func recordUpdateAttempt(ctx *StateContext, c Controller,
+	update *datastore.UpdateInfo, status string) {
+	limit := c.GetMaxUpdateAttempts()
+	if limit <= 0 {
+		return
+	}
+	attempts, err := datastore.LoadUpdateAttempts(ctx.Store)
+	if err != nil {
+		log.Errorf("Could not load the failed update attempts: %v", err)
+	}
+	if status != client.StatusFailure {
+		attempts = datastore.UpdateAttempts{}
+	} else if attempts.DeploymentID != update.ID {
+		attempts = datastore.UpdateAttempts{DeploymentID: update.ID, Failures: 1}
+	} else {
+		attempts.Failures++
+	}
+	if attempts.Failures >= limit {
+		log.Errorf("Deployment %s has failed %d times in a row; giving up on it",
+			update.ID, attempts.Failures)
+	}
+	if err = datastore.StoreUpdateAttempts(ctx.Store, attempts); err != nil {
+		log.Errorf("Could not store the failed update attempts: %v", err)
+	}
+}
+
+// recordLastUpdate stores the outcome of an update check, so that it can be
+// reported by the control API, also after a reboot.
+func recordLastUpdate(ctx *StateContext, last datastore.LastUpdate) {
+	last.Time = time.Now().UTC()
+	if err := datastore.StoreLastUpdate(ctx.Store, last); err != nil {
+		log.Errorf("Could not store the outcome of the last update: %v", err)
+	}
+	ctx.lastUpdate = &last
+}
+
 func sendDeploymentStatus(update *datastore.UpdateInfo, status string,
 	tries *int, c Controller) menderError {
 	// check if the report was already sent
@@ -1373,6 +1827,28 @@ func (usr *updateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 
 	log.Debug("Handling update status report state")
 
+	if !usr.outcomeRecorded {
+		last := datastore.LastUpdate{
+			DeploymentID: usr.Update().ID,
+			ArtifactName: usr.Update().ArtifactName(),
+			Status:       usr.status,
+		}
+		if usr.dryRun != nil {
+			last.Status = datastore.LastUpdateDryRun
+			last.DryRun = usr.dryRun
+		} else {
+			recordUpdateAttempt(ctx, c, usr.Update(), usr.status)
+		}
+		recordLastUpdate(ctx, last)
+		if url := c.GetUpdateWebhookURL(); url != "" {
+			sendWebhook(url, *ctx.lastUpdate)
+		}
+		if usr.status == client.StatusSuccess {
+			clearArtifactCache(c.GetArtifactCacheDir())
+		}
+		usr.outcomeRecorded = true
+	}
+
 	if err := sendDeploymentStatus(usr.Update(), usr.status,
 		&usr.triesSendingReport, c); err != nil {
 
@@ -1400,7 +1876,9 @@ func (usr *updateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 		}
 	}
 
-	log.Debug("Reporting complete")
+	logEvent("update-status", usr.Update()).WithField("status", usr.status).
+		Info("Reporting complete")
+	ctx.metrics.updateReported(usr.status)
 	// stop deployment logging as the update is completed at this point
 	DeploymentLogger.Disable()
 
@@ -1462,6 +1940,22 @@ func maxSendingAttempts(upi, rpi time.Duration, minRetries int) int {
 // retry at least that many times
 var minReportSendRetries = 3
 
+// statusReportRetryInterval is how long to wait before sending a status report
+// again, after it has been tried the given number of times. The wait starts at
+// the retry poll interval and doubles with every try, so that a server which
+// is down is not flooded with reports, but it is never longer than the update
+// poll interval.
+func statusReportRetryInterval(rpi, upi time.Duration, tries int) time.Duration {
+	wait := rpi
+	for i := 1; i < tries && wait < upi; i++ {
+		wait *= 2
+	}
+	if wait > upi && upi > rpi {
+		return upi
+	}
+	return wait
+}
+
 func (usr *updateStatusReportRetryState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	maxTrySending :=
 		maxSendingAttempts(c.GetUpdatePollInterval(),
@@ -1470,7 +1964,9 @@ func (usr *updateStatusReportRetryState) Handle(ctx *StateContext, c Controller)
 	maxTrySending++
 
 	if usr.triesSending < maxTrySending {
-		return usr.Wait(usr.reportState, usr, c.GetRetryPollInterval(), ctx.WakeupChan)
+		return usr.Wait(usr.reportState, usr, statusReportRetryInterval(
+			c.GetRetryPollInterval(), c.GetUpdatePollInterval(), usr.triesSending),
+			ctx.WakeupChan)
 	}
 	return NewReportErrorState(&usr.update, usr.status), false
 }
@@ -1523,6 +2019,72 @@ func (res *reportErrorState) HandleError(ctx *StateContext, c Controller, merr m
 	return States.Idle, false
 }
 
+type updateRebootWaitState struct {
+	baseState
+	WaitState
+	update datastore.UpdateInfo
+}
+
+func NewUpdateRebootWaitState(update *datastore.UpdateInfo) State {
+	return &updateRebootWaitState{
+		baseState: baseState{
+			id: datastore.MenderStateUpdateRebootWait,
+			t:  ToNone,
+		},
+		WaitState: NewWaitState(datastore.MenderStateUpdateRebootWait, ToNone),
+		update:    *update,
+	}
+}
+
+func (rw *updateRebootWaitState) Cancel() bool {
+	return rw.WaitState.Cancel()
+}
+
+func (rw *updateRebootWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	// start deployment logging
+	if err := DeploymentLogger.Enable(rw.Update().ID); err != nil {
+		// just log error
+		log.Errorf("Failed to enable deployment logger: %s", err)
+	}
+
+	// Unpausing wakes us up, to go through the checks below.
+	if rebootPaused(ctx.Store) {
+		log.Info("Update installed; reboots are paused until unpaused through the control API")
+		logEvent("reboot-paused", rw.Update()).Info("Waiting for reboots to be unpaused")
+		return rw.Wait(NewUpdateRebootWaitState(rw.Update()), rw,
+			time.Duration(math.MaxInt64), ctx.WakeupChan)
+	}
+
+	if !c.GetAutoReboot() {
+		log.Info("Update installed; waiting for the reboot to be requested")
+		logEvent("reboot-pending", rw.Update()).Info("Waiting for the reboot")
+		// Nothing but the request ends the wait.
+		return rw.Wait(NewUpdateRebootState(rw.Update()), rw,
+			time.Duration(math.MaxInt64), ctx.RebootChan)
+	}
+
+	untilWindow, err := c.GetMaintenanceWindow().Until(time.Now())
+	if err != nil {
+		// The window was validated when loading the configuration, so
+		// this should not happen. Rather reboot than get stuck.
+		log.Errorf("Could not evaluate maintenance window, rebooting now: %s", err)
+		return NewUpdateRebootState(rw.Update()), false
+	}
+	if untilWindow == 0 {
+		return NewUpdateRebootState(rw.Update()), false
+	}
+
+	log.Infof("Update installed; postponing reboot for %v until the maintenance window opens",
+		untilWindow)
+	// Come back here after waiting, so that the window is checked again if
+	// we were woken up early.
+	return rw.Wait(NewUpdateRebootWaitState(rw.Update()), rw, untilWindow, ctx.WakeupChan)
+}
+
+func (rw *updateRebootWaitState) Update() *datastore.UpdateInfo {
+	return &rw.update
+}
+
 type updateRebootState struct {
 	*updateState
 }
@@ -1549,7 +2111,7 @@ func (e *updateRebootState) Handle(ctx *StateContext, c Controller) (State, bool
 		return NewUpdateRollbackState(e.Update()), false
 	}
 
-	log.Info("Rebooting device(s)")
+	logEvent("reboot", e.Update()).Info("Rebooting device(s)")
 
 	systemRebootRequested := false
 	for n, i := range c.GetInstallers() {
@@ -1624,9 +2186,71 @@ func (rs *updateAfterRebootState) Handle(ctx *StateContext,
 	// this state is needed to satisfy ToReboot transition Leave() action
 	log.Debug("Handling state after reboot")
 
+	if timeout := c.GetHealthCheckTimeout(); timeout > 0 {
+		if rs.Update().SupportsRollback == datastore.RollbackSupported {
+			// Drop a confirmation left over from an earlier update.
+			select {
+			case <-ctx.HealthyChan:
+			default:
+			}
+			return NewUpdateHealthWaitState(rs.Update(), time.Now().Add(timeout)), false
+		}
+		log.Warn("The update does not support rollback; committing it without " +
+			"waiting for the device to be confirmed healthy")
+	}
+
 	return NewUpdateCommitState(rs.Update()), false
 }
 
+// updateHealthWaitState holds off committing an update until the device is
+// confirmed healthy, and rolls the update back if that does not happen by the
+// deadline.
+type updateHealthWaitState struct {
+	*updateState
+	cancel chan bool
+}
+
+// NewUpdateHealthWaitState records the deadline in the update, so that it is
+// stored along with the state and the wait can be resumed after a restart.
+func NewUpdateHealthWaitState(update *datastore.UpdateInfo, deadline time.Time) State {
+	hw := &updateHealthWaitState{
+		updateState: NewUpdateState(datastore.MenderStateUpdateHealthWait,
+			ToArtifactReboot_Leave, update),
+		cancel: make(chan bool),
+	}
+	hw.Update().HealthCheckDeadline = &deadline
+	return hw
+}
+
+func (hw *updateHealthWaitState) Cancel() bool {
+	hw.cancel <- true
+	return true
+}
+
+func (hw *updateHealthWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	DeploymentLogger.Enable(hw.Update().ID)
+
+	wait := time.Until(*hw.Update().HealthCheckDeadline)
+	if wait < 0 {
+		wait = 0
+	}
+	log.Infof("Waiting up to %v for the device to be confirmed healthy", wait)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.HealthyChan:
+		log.Info("The device was confirmed healthy; committing the update")
+		return NewUpdateCommitState(hw.Update()), false
+	case <-timer.C:
+		log.Error("The device was not confirmed healthy in time; rolling back the update")
+		return NewUpdateRollbackState(hw.Update()), false
+	case <-hw.cancel:
+		log.Infof("Wait canceled")
+	}
+	return hw, true
+}
+
 type updateRollbackState struct {
 	*updateState
 }
@@ -1804,6 +2428,63 @@ func (rs *updateAfterRollbackRebootState) Handle(ctx *StateContext,
 		rs.Update()), false
 }
 
+// decommissionedState takes the device out of service, as the server asked,
+// and stops the daemon. It will not run again until the decommissioning is
+// removed from the store.
+type decommissionedState struct {
+	baseState
+	wipe bool
+}
+
+func NewDecommissionedState(wipe bool) State {
+	return &decommissionedState{
+		baseState: baseState{
+			id: datastore.MenderStateDecommissioned,
+			t:  ToNone,
+		},
+		wipe: wipe,
+	}
+}
+
+// What is removed when the server asks for the device to be wiped. The name of
+// the installed Artifact stays, since it is still what the device runs.
+var decommissionWipeKeys = []string{
+	datastore.AuthTokenName,
+	datastore.StateDataKey,
+	datastore.StateDataKeyUncommitted,
+	datastore.StandaloneStateKey,
+	datastore.UpdateAttemptsKey,
+	datastore.LastUpdateKey,
+}
+
+func (d *decommissionedState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Warn("The server has decommissioned the device; stopping")
+	if d.wipe {
+		log.Info("Wiping the client state")
+		for _, key := range decommissionWipeKeys {
+			if err := ctx.Store.Remove(key); err != nil {
+				log.Errorf("Could not remove %s from the store: %v", key, err)
+			}
+		}
+		clearArtifactCache(c.GetArtifactCacheDir())
+	}
+	err := ctx.Store.WriteAll(datastore.DecommissionedKey,
+		[]byte(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		log.Errorf("Could not record the decommissioning: %v", err)
+	}
+	return States.Final, false
+}
+
+// decommissioned tells whether the server has decommissioned the device.
+func decommissioned(s store.Store) bool {
+	if s == nil {
+		return false
+	}
+	_, err := s.ReadAll(datastore.DecommissionedKey)
+	return err == nil
+}
+
 type finalState struct {
 	baseState
 }
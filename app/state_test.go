@@ -14,17 +14,22 @@
 package app
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -39,6 +44,7 @@ import (
 	stest "github.com/mendersoftware/mender/system/testing"
 	"github.com/mendersoftware/mender/tests"
 	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -62,6 +68,23 @@ type stateTestController struct {
 	logUpdate       datastore.UpdateInfo
 	logs            []byte
 	inventoryErr    error
+	window          conf.MaintenanceWindow
+	freeSpaceErr    error
+	updateJitter    float64
+	dryRun          bool
+	maxAttempts     int
+	healthTimeout   time.Duration
+	startupDelay    time.Duration
+	batteryFactor   int
+	lowBattery      int
+	webhookURL      string
+	channel         string
+	cacheDir        string
+	downloadDir     string
+	noAutoReboot    bool
+	notAuthorized   bool
+
+	checksumMismatchRetries int
 }
 
 func (s *stateTestController) GetCurrentArtifactName() (string, error) {
@@ -71,10 +94,19 @@ func (s *stateTestController) GetCurrentArtifactName() (string, error) {
 	return s.artifactName, nil
 }
 
+func (s *stateTestController) InstalledArtifact() (string, string, error) {
+	name, err := s.GetCurrentArtifactName()
+	return name, "", err
+}
+
 func (s *stateTestController) GetUpdatePollInterval() time.Duration {
 	return s.updatePollIntvl
 }
 
+func (s *stateTestController) GetUpdatePollJitter() float64 {
+	return s.updateJitter
+}
+
 func (s *stateTestController) GetInventoryPollInterval() time.Duration {
 	return s.inventPollIntvl
 }
@@ -83,6 +115,86 @@ func (s *stateTestController) GetRetryPollInterval() time.Duration {
 	return s.retryIntvl
 }
 
+func (s *stateTestController) GetPartitions() ([]installer.Partition, error) {
+	return nil, nil
+}
+
+func (s *stateTestController) CheckFreeSpace(update *datastore.UpdateInfo, size int64) error {
+	return s.freeSpaceErr
+}
+
+func (s *stateTestController) ReloadConfig(config *conf.MenderConfig) {
+	s.updatePollIntvl = time.Duration(config.UpdatePollIntervalSeconds) * time.Second
+}
+
+func (s *stateTestController) IsDryRun() bool {
+	return s.dryRun
+}
+
+func (s *stateTestController) GetMaxUpdateAttempts() int {
+	return s.maxAttempts
+}
+
+func (s *stateTestController) GetHealthCheckTimeout() time.Duration {
+	return s.healthTimeout
+}
+
+func (s *stateTestController) GetStartupDelay() time.Duration {
+	return s.startupDelay
+}
+
+func (s *stateTestController) CheckClock() error {
+	return nil
+}
+
+func (s *stateTestController) GetBatteryPollIntervalFactor() int {
+	return s.batteryFactor
+}
+
+func (s *stateTestController) GetLowBatteryPercent() int {
+	return s.lowBattery
+}
+
+func (s *stateTestController) GetUpdateWebhookURL() string {
+	return s.webhookURL
+}
+
+func (s *stateTestController) GetMaxConcurrentInstalls() int {
+	return 1
+}
+
+func (s *stateTestController) GetChecksumMismatchRetries() int {
+	return s.checksumMismatchRetries
+}
+
+func (s *stateTestController) GetChannel() string {
+	return s.channel
+}
+
+func (s *stateTestController) SetChannel(channel string) {
+	s.channel = channel
+}
+
+func (s *stateTestController) NotAuthorized() bool {
+	return s.notAuthorized
+}
+
+func (s *stateTestController) GetArtifactCacheDir() string {
+	return s.cacheDir
+}
+
+func (s *stateTestController) GetArtifactDownloadDir() string {
+	return s.downloadDir
+}
+
+func (s *stateTestController) GetMaintenanceWindow() conf.MaintenanceWindow {
+	return s.window
+}
+
+func (s *stateTestController) GetAutoReboot() bool {
+	return !s.noAutoReboot
+}
+
 func (s *stateTestController) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 	return s.updateResp, s.updateRespErr
 }
@@ -119,6 +231,10 @@ func (s *stateTestController) ReportUpdateStatus(update *datastore.UpdateInfo, s
 	return s.reportError
 }
 
+func (s *stateTestController) NewStatusReporter(update *datastore.UpdateInfo) func(string) error {
+	return func(string) error { return nil }
+}
+
 func (s *stateTestController) UploadLog(update *datastore.UpdateInfo, logs []byte) menderError {
 	s.logUpdate = *update
 	s.logs = logs
@@ -304,6 +420,8 @@ func TestStateUpdateReportStatus(t *testing.T) {
 	usr.Handle(&ctx, sc)
 	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
 	assert.Equal(t, *update, sc.reportUpdate)
+	// Logs are only uploaded for failed deployments.
+	assert.Nil(t, sc.logs)
 
 	// cancelled state should not wipe state data, for this pretend the reporting
 	// fails and cancel
@@ -326,6 +444,10 @@ func TestStateUpdateReportStatus(t *testing.T) {
 	}
 
 	shouldTry := maxSendingAttempts(poll, retry, minReportSendRetries)
+	var backoff time.Duration
+	for i := 1; i <= shouldTry; i++ {
+		backoff += statusReportRetryInterval(retry, poll, i)
+	}
 	s = NewUpdateStatusReportState(update, client.StatusSuccess)
 
 	now := time.Now()
@@ -339,7 +461,7 @@ func TestStateUpdateReportStatus(t *testing.T) {
 		assert.IsType(t, &updateStatusReportState{}, s)
 		assert.False(t, c)
 	}
-	assert.WithinDuration(t, now, time.Now(), time.Duration(int64(shouldTry)*int64(retry))+time.Millisecond*10)
+	assert.WithinDuration(t, now, time.Now(), backoff+time.Millisecond*10)
 
 	// next attempt should return an error
 	s, _ = s.Handle(&ctx, sc)
@@ -366,7 +488,7 @@ func TestStateUpdateReportStatus(t *testing.T) {
 		assert.IsType(t, &updateStatusReportState{}, s)
 		assert.False(t, c)
 	}
-	assert.WithinDuration(t, now, time.Now(), time.Duration(int64(shouldTry)*int64(retry))+time.Millisecond*15)
+	assert.WithinDuration(t, now, time.Now(), backoff+time.Millisecond*15)
 
 	s, _ = s.Handle(&ctx, sc)
 	assert.IsType(t, &updateStatusReportRetryState{}, s)
@@ -616,9 +738,286 @@ func TestStateUpdateCheckWait(t *testing.T) {
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
 }
 
+type fakePower struct {
+	onBattery bool
+	percent   int
+}
+
+func (p *fakePower) OnBattery() bool {
+	return p.onBattery
+}
+
+func (p *fakePower) BatteryPercent() int {
+	return p.percent
+}
+
+func TestStatePowerState(t *testing.T) {
+	power := &fakePower{percent: 10}
+	cws := NewCheckWaitState().(*checkWaitState)
+	cws.WaitState = &waitStateTest{baseState{id: datastore.MenderStateCheckWait}}
+	start := time.Now()
+	ctx := &StateContext{
+		PowerState:                 power,
+		Store:                      store.NewMemStore(),
+		lastUpdateCheckAttempt:     start,
+		lastInventoryUpdateAttempt: start,
+	}
+	stc := &stateTestController{
+		updatePollIntvl: 10 * time.Minute,
+		inventPollIntvl: 20 * time.Minute,
+		batteryFactor:   3,
+		lowBattery:      20,
+		updateResp:      &datastore.UpdateInfo{ID: "foo"},
+	}
+
+	// On mains power, the intervals and downloads are as usual.
+	s, _ := cws.Handle(ctx, stc)
+	assert.IsType(t, &updateCheckState{}, s)
+	assert.Equal(t, start.Add(10*time.Minute), ctx.lastUpdateCheckAttempt)
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &updateFetchState{}, s)
+
+	// On battery, the intervals are stretched.
+	power.onBattery = true
+	ctx.lastUpdateCheckAttempt = start
+	s, _ = cws.Handle(ctx, stc)
+	assert.IsType(t, &updateCheckState{}, s)
+	assert.Equal(t, start.Add(30*time.Minute), ctx.lastUpdateCheckAttempt)
+	ctx.lastUpdateCheckAttempt = start.Add(time.Hour)
+	s, _ = cws.Handle(ctx, stc)
+	assert.IsType(t, &inventoryUpdateState{}, s)
+	assert.Equal(t, start.Add(time.Hour), ctx.lastInventoryUpdateAttempt)
+
+	// Below the threshold, the update is not downloaded.
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &checkWaitState{}, s)
+	power.percent = 20
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &updateFetchState{}, s)
+
+	// Without a threshold or factor, the battery makes no difference.
+	power.percent = 1
+	stc.batteryFactor = 0
+	stc.lowBattery = 0
+	ctx.lastUpdateCheckAttempt = start
+	ctx.lastInventoryUpdateAttempt = start
+	s, _ = cws.Handle(ctx, stc)
+	assert.Equal(t, start.Add(10*time.Minute), ctx.lastUpdateCheckAttempt)
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &updateFetchState{}, s)
+}
+
+func TestStateUpdateCheckWaitJitter(t *testing.T) {
+	rands := []float64{0, 1, 0.5, 0.25, 0.75}
+	oldRand := pollJitterRand
+	defer func() { pollJitterRand = oldRand }()
+	pollJitterRand = func() float64 {
+		r := rands[0]
+		rands = rands[1:]
+		return r
+	}
+
+	cws := NewCheckWaitState().(*checkWaitState)
+	cws.WaitState = &waitStateTest{baseState{id: datastore.MenderStateCheckWait}}
+	// inventory is not due for a long time
+	ctx := &StateContext{lastInventoryUpdateAttempt: time.Now()}
+	stc := &stateTestController{
+		updatePollIntvl: 10 * time.Minute,
+		inventPollIntvl: 24 * time.Hour,
+		updateJitter:    0.2,
+	}
+
+	// first check is straight away
+	s, _ := cws.Handle(ctx, stc)
+	assert.IsType(t, &updateCheckState{}, s)
+	last := ctx.lastUpdateCheckAttempt
+
+	var gaps []time.Duration
+	for i := 0; i < 4; i++ {
+		s, _ = cws.Handle(ctx, stc)
+		assert.IsType(t, &updateCheckState{}, s)
+		gaps = append(gaps, ctx.lastUpdateCheckAttempt.Sub(last))
+		last = ctx.lastUpdateCheckAttempt
+	}
+	assert.Equal(t, []time.Duration{
+		8 * time.Minute,
+		12 * time.Minute,
+		10 * time.Minute,
+		9 * time.Minute,
+	}, gaps)
+
+	// no jitter configured
+	assert.Equal(t, time.Duration(0), pollJitter(time.Minute, 0))
+}
+
+func TestStateUpdateCheckRetryAfter(t *testing.T) {
+	ctx := &StateContext{lastInventoryUpdateAttempt: time.Now()}
+	stc := &stateTestController{
+		updatePollIntvl: 10 * time.Minute,
+		inventPollIntvl: 24 * time.Hour,
+		updateRespErr: NewTransientError(
+			&client.TooManyRequestsError{RetryAfter: time.Hour}),
+	}
+
+	s, _ := States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &errorState{}, s)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), ctx.updateCheckNotBefore, time.Second)
+
+	// The next check waits for the server, rather than the poll interval.
+	cws := NewCheckWaitState().(*checkWaitState)
+	cws.WaitState = &waitStateTest{baseState{id: datastore.MenderStateCheckWait}}
+	ctx.lastUpdateCheckAttempt = time.Now()
+	s, _ = cws.Handle(ctx, stc)
+	assert.IsType(t, &updateCheckState{}, s)
+	assert.Equal(t, ctx.updateCheckNotBefore, ctx.lastUpdateCheckAttempt)
+
+	// A busy server that does not say for how long changes nothing.
+	ctx = new(StateContext)
+	stc.updateRespErr = NewTransientError(&client.TooManyRequestsError{})
+	States.UpdateCheck.Handle(ctx, stc)
+	assert.True(t, ctx.updateCheckNotBefore.IsZero())
+}
+
+func TestStateUpdateMaxAttempts(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{ID: "foobar"}
+	ctx := &StateContext{Store: store.NewMemStore()}
+	stc := &stateTestController{
+		maxAttempts: 3,
+		updateResp:  update,
+	}
+
+	fail := func(update *datastore.UpdateInfo) {
+		s, _ := NewUpdateStatusReportState(update, client.StatusFailure).Handle(ctx, stc)
+		assert.IsType(t, &idleState{}, s)
+	}
+
+	// Below the limit the deployment is tried again.
+	fail(update)
+	fail(update)
+	s, _ := States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &updateFetchState{}, s)
+
+	// Once it is reached, it is ignored when offered again.
+	fail(update)
+	attempts, err := datastore.LoadUpdateAttempts(ctx.Store)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.UpdateAttempts{DeploymentID: "foobar", Failures: 3}, attempts)
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &checkWaitState{}, s)
+
+	// Other deployments are not affected, and restart the count.
+	stc.updateResp = &datastore.UpdateInfo{ID: "other"}
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &updateFetchState{}, s)
+	fail(stc.updateResp)
+	attempts, err = datastore.LoadUpdateAttempts(ctx.Store)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.UpdateAttempts{DeploymentID: "other", Failures: 1}, attempts)
+
+	// Success wipes the count.
+	s, _ = NewUpdateStatusReportState(stc.updateResp, client.StatusSuccess).Handle(ctx, stc)
+	assert.IsType(t, &idleState{}, s)
+	attempts, err = datastore.LoadUpdateAttempts(ctx.Store)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.UpdateAttempts{}, attempts)
+
+	// Without a limit nothing is counted.
+	stc.maxAttempts = 0
+	fail(update)
+	attempts, err = datastore.LoadUpdateAttempts(ctx.Store)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.UpdateAttempts{}, attempts)
+}
+
+func TestStateLastUpdate(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	ctx := &StateContext{Store: ms}
+	stc := &stateTestController{}
+
+	last, err := datastore.LoadLastUpdate(ms)
+	require.NoError(t, err)
+	assert.Nil(t, last)
+
+	// An update check which finds nothing.
+	before := time.Now()
+	s, _ := States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &checkWaitState{}, s)
+	last, err = datastore.LoadLastUpdate(ms)
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, datastore.LastUpdateNoUpdate, last.Status)
+	assert.Empty(t, last.ArtifactName)
+	assert.WithinDuration(t, before, last.Time, time.Minute)
+	assert.Equal(t, last, ctx.lastUpdate)
+
+	// An update which ran to the end.
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+	stc.updateResp = update
+	s, _ = States.UpdateCheck.Handle(ctx, stc)
+	assert.IsType(t, &updateFetchState{}, s)
+	for _, status := range []string{client.StatusFailure, client.StatusSuccess} {
+		s, _ = NewUpdateStatusReportState(update, status).Handle(ctx, stc)
+		assert.IsType(t, &idleState{}, s)
+		last, err = datastore.LoadLastUpdate(ms)
+		require.NoError(t, err)
+		require.NotNil(t, last)
+		assert.Equal(t, "foo", last.DeploymentID)
+		assert.Equal(t, "release-2", last.ArtifactName)
+		assert.Equal(t, status, last.Status)
+		assert.False(t, last.Time.Before(before))
+	}
+
+	// Still known after a restart.
+	daemon := NewDaemon(stc, ms)
+	daemon.loadLastUpdate()
+	assert.Equal(t, last, daemon.Status().LastUpdate)
+}
+
+func TestStateLastUpdateAfterFailure(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	ctx := &StateContext{Store: ms}
+	stc := &stateTestController{}
+
+	// The outcome of a failed update is known from the states alone,
+	// through cleaning up and reporting it.
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+	var s State = NewUpdateErrorState(NewTransientError(errors.New("failed")), update)
+	for i := 0; i < 10; i++ {
+		if _, ok := s.(*idleState); ok {
+			break
+		}
+		s, _ = s.Handle(ctx, stc)
+	}
+	require.IsType(t, &idleState{}, s)
+
+	assert.Equal(t, client.StatusFailure, stc.reportStatus)
+	assert.Equal(t, "foo", stc.reportUpdate.ID)
+	last, err := datastore.LoadLastUpdate(ms)
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, "foo", last.DeploymentID)
+	assert.Equal(t, "release-2", last.ArtifactName)
+	assert.Equal(t, client.StatusFailure, last.Status)
+	assert.Equal(t, last, ctx.lastUpdate)
+}
+
 func TestStateUpdateCheck(t *testing.T) {
 	cs := updateCheckState{}
-	ctx := new(StateContext)
+	ctx := &StateContext{Store: store.NewMemStore()}
 
 	var s State
 	var c bool
@@ -636,8 +1035,11 @@ func TestStateUpdateCheck(t *testing.T) {
 	assert.False(t, c)
 
 	// pretend we have an update
-	update := &datastore.UpdateInfo{}
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
 
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
 	s, c = cs.Handle(ctx, &stateTestController{
 		updateResp: update,
 	})
@@ -645,6 +1047,16 @@ func TestStateUpdateCheck(t *testing.T) {
 	assert.False(t, c)
 	ufs, _ := s.(*updateFetchState)
 	assert.Equal(t, *update, ufs.update)
+
+	// the milestones are logged as structured records
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, "Update available", entry.Message)
+	assert.Equal(t, log.Fields{
+		"event":         "update-available",
+		"deployment_id": "foo",
+		"artifact_name": "release-2",
+	}, entry.Data)
 }
 
 func TestUpdateCheckSameImage(t *testing.T) {
@@ -713,7 +1125,9 @@ func TestStateUpdateFetch(t *testing.T) {
 	assert.Equal(t, client.StatusDownloading, sc.reportStatus)
 	assert.Equal(t, *update, sc.reportUpdate)
 	uis := s.(*updateStoreState)
-	assert.Equal(t, stream, uis.imagein)
+	// Read through the aborter.
+	require.IsType(t, &abortableReader{}, uis.imagein)
+	assert.Equal(t, stream, uis.imagein.(*abortableReader).ReadCloser)
 	s, c = transitionState(s, &ctx, sc)
 	assert.IsType(t, &fetchStoreRetryState{}, s)
 	assert.False(t, c)
@@ -727,6 +1141,13 @@ func TestStateUpdateFetch(t *testing.T) {
 		UpdateInfo: *update,
 		Name:       datastore.MenderStateUpdateStore,
 	}, ud)
+
+	// not enough space for the update; give up without retrying
+	sc.freeSpaceErr = errors.New("Not enough space for the update")
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
 }
 
 func TestStateUpdateFetchRetry(t *testing.T) {
@@ -775,6 +1196,127 @@ func TestStateUpdateFetchRetry(t *testing.T) {
 	assert.False(t, c)
 }
 
+func TestStateUpdateReportFailureDoesNotAbort(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID: "foobar",
+	}
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+	data := "test"
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+		reportError: NewTransientError(errors.New("server unreachable")),
+	}
+
+	// The server not taking the status carries on with the update.
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateStoreState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusDownloading, sc.reportStatus)
+
+	s, c = NewUpdateInstallState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateRebootState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusInstalling, sc.reportStatus)
+
+	// An aborted deployment stops it.
+	sc.reportError = NewFatalError(client.ErrDeploymentAborted)
+	s, c = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+
+	s, c = NewUpdateInstallState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateErrorState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateUpdateFetchLocalSocket(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "TestStateUpdateFetchLocalSocket")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	deviceType := path.Join(tempDir, "device_type")
+	require.NoError(t, ioutil.WriteFile(deviceType,
+		[]byte("device_type=vexpress-qemu\n"), 0600))
+
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	artifact, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+
+	// A sidecar handing over the Artifact to whoever connects.
+	socket := path.Join(tempDir, "artifact.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(artifact)
+		conn.Close()
+	}()
+
+	newMender := func(localSources bool) *Mender {
+		mender := newTestMender(nil, conf.MenderConfig{
+			MenderConfigFromFile: conf.MenderConfigFromFile{
+				Servers:              []client.MenderServer{{}},
+				LocalArtifactSources: localSources,
+			},
+		}, testMenderPieces{
+			MenderPieces: MenderPieces{
+				DualRootfsDevice: FakeDevice{ConsumeUpdate: true},
+			},
+		})
+		mender.DeviceTypeFile = deviceType
+		return mender
+	}
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+		},
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	update.Artifact.Source.URI = "unix://" + socket
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+
+	// Not taken unless enabled.
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, newMender(false))
+	assert.IsType(t, &fetchStoreRetryState{}, s)
+
+	mender := newMender(true)
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, mender)
+	require.IsType(t, &updateStoreState{}, s)
+	s, _ = s.Handle(&ctx, mender)
+	assert.IsType(t, &updateAfterStoreState{}, s)
+
+	// The same from a file.
+	file := path.Join(tempDir, "artifact.mender")
+	require.NoError(t, ioutil.WriteFile(file, artifact, 0600))
+	update.Artifact.Source.URI = "file://" + file
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, mender)
+	require.IsType(t, &updateStoreState{}, s)
+	s, _ = s.Handle(&ctx, mender)
+	assert.IsType(t, &updateAfterStoreState{}, s)
+}
+
 func TestStateUpdateStore(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -850,32 +1392,22 @@ func TestStateUpdateStore(t *testing.T) {
 	assert.IsType(t, &updateStatusReportState{}, s)
 }
 
-// Tests various cases of missing dependencies, and a final case with all
-// dependencies satisfied.
-func TestUpdateStoreDependencies(t *testing.T) {
+func TestStateUpdateStoreFailureInvalidatesPartition(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
 	DeploymentLogger = NewDeploymentLogManager(tempDir)
-	artifactProvides := &tests.ArtifactProvides{
-		ArtifactName:  "TestName",
-		ArtifactGroup: "TestGroup",
-	}
-	artifactDepends := &tests.ArtifactDepends{
-		ArtifactName:      []string{"OtherArtifact"},
-		ArtifactGroup:     []string{"TestGroup"},
-		CompatibleDevices: []string{"vexpress-qemu"},
-	}
 
-	stream, err := tests.CreateTestArtifactV3("test-image", "gzip",
-		artifactProvides, artifactDepends, nil, nil)
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
 	require.NoError(t, err)
 
 	update := &datastore.UpdateInfo{
 		ID: "foo",
 		Artifact: datastore.Artifact{
 			ArtifactName:      "TestName",
-			ArtifactGroup:     "TestGroup",
 			CompatibleDevices: []string{"vexpress-qemu"},
 			PayloadTypes:      []string{"rootfs-image"},
 		},
@@ -883,55 +1415,609 @@ func TestUpdateStoreDependencies(t *testing.T) {
 	}
 	uis := NewUpdateStoreState(stream, update)
 
-	ms := store.NewMemStore()
 	ctx := StateContext{
-		Store: ms,
+		Store: store.NewMemStore(),
 	}
+
+	invalidateCalls := 0
 	sc := &stateTestController{
 		FakeDevice: FakeDevice{
-			ConsumeUpdate: true,
+			RetStoreUpdate:  errors.New("write failed"),
+			InvalidateCalls: &invalidateCalls,
 		},
 	}
 
 	s, c := uis.Handle(&ctx, sc)
-	assert.IsType(t, &updateStatusReportState{}, s)
-	assert.False(t, c)
-	ms.WriteAll(datastore.ArtifactNameKey, []byte("NonExistingArtie"))
-	stream.Seek(0, io.SeekStart)
-	s, c = uis.Handle(&ctx, sc)
-	assert.IsType(t, &updateStatusReportState{}, s)
-	assert.False(t, c)
-	ms.WriteAll(datastore.ArtifactNameKey, []byte("OtherArtifact"))
-	stream.Seek(0, io.SeekStart)
-	s, c = uis.Handle(&ctx, sc)
-	assert.IsType(t, &updateStatusReportState{}, s)
-	assert.False(t, c)
-	ms.WriteAll(datastore.ArtifactGroupKey, []byte("WrongGroup"))
-	stream.Seek(0, io.SeekStart)
-	s, c = uis.Handle(&ctx, sc)
-	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.IsType(t, &updateCleanupState{}, s)
 	assert.False(t, c)
-	ms.WriteAll(datastore.ArtifactGroupKey, []byte("TestGroup"))
+	assert.Equal(t, 1, invalidateCalls)
+
+	// A successful store must leave the partition alone.
+	invalidateCalls = 0
 	stream.Seek(0, io.SeekStart)
+	sc.FakeDevice = FakeDevice{
+		ConsumeUpdate:   true,
+		InvalidateCalls: &invalidateCalls,
+	}
 	s, c = uis.Handle(&ctx, sc)
 	assert.IsType(t, &updateAfterStoreState{}, s)
 	assert.False(t, c)
+	assert.Equal(t, 0, invalidateCalls)
 }
 
-func TestStateWrongArtifactNameFromServer(t *testing.T) {
-	// create directory for storing deployments logs
+func TestStateInitResumesUpdate(t *testing.T) {
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
 	DeploymentLogger = NewDeploymentLogManager(tempDir)
-	artifactProvides := &tests.ArtifactProvides{
-		ArtifactGroup: "TestGroup",
-		ArtifactName:  "TestName",
-	}
-	artifactDepends := &tests.ArtifactDepends{
-		CompatibleDevices: []string{"vexpress-qemu"},
-	}
 
-	stream, err := tests.CreateTestArtifactV3("test-image", "gzip",
+	tc := []struct {
+		name     datastore.MenderState
+		expected State
+	}{
+		// Not started yet; it is picked up again at the next poll.
+		{datastore.MenderStateUpdateFetch, &idleState{}},
+		// Partly written, and not signature checked; thrown away.
+		{datastore.MenderStateUpdateStore, &updateCleanupState{}},
+		// Rebooted into the update, as intended.
+		{datastore.MenderStateReboot, &updateVerifyRebootState{}},
+		// Committed; only the leave scripts are left to run.
+		{datastore.MenderStateUpdateAfterCommit, &updateAfterCommitState{}},
+	}
+	for _, c := range tc {
+		t.Run(c.name.String(), func(t *testing.T) {
+			ctx := StateContext{
+				Store: store.NewMemStore(),
+			}
+			update := datastore.UpdateInfo{ID: "foo"}
+			require.NoError(t, datastore.StoreStateData(ctx.Store, datastore.StateData{
+				Name:       c.name,
+				UpdateInfo: update,
+			}))
+
+			s, cancelled := States.Init.Handle(&ctx, &stateTestController{})
+			assert.IsType(t, c.expected, s)
+			assert.False(t, cancelled)
+			if us, ok := s.(UpdateState); ok {
+				assert.Equal(t, update.ID, us.Update().ID)
+			}
+		})
+	}
+}
+
+func TestStateInitInterruptedPartitionWrite(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+			PayloadTypes:      []string{"rootfs-image"},
+		},
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		Store: ms,
+	}
+	invalidateCalls := 0
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{
+			ConsumeUpdate:   true,
+			RetActive:       "/dev/p2",
+			RetInactive:     "/dev/p3",
+			InvalidateCalls: &invalidateCalls,
+		},
+	}
+
+	// A completed write leaves nothing behind.
+	s, _ := NewUpdateStoreState(stream, update).Handle(&ctx, sc)
+	assert.IsType(t, &updateAfterStoreState{}, s)
+	_, err = ms.ReadAll(datastore.PartitionWriteKey)
+	assert.True(t, os.IsNotExist(err))
+
+	// Power is lost while the update is being written.
+	crash := func(partition string) {
+		require.NoError(t, datastore.StoreStateData(ms, datastore.StateData{
+			Name:       datastore.MenderStateUpdateStore,
+			UpdateInfo: *update,
+		}))
+		require.NoError(t, ms.WriteAll(datastore.PartitionWriteKey, []byte(partition)))
+	}
+
+	// The partition is invalidated, and the update is then cleaned up and
+	// reported as failed.
+	crash("/dev/p3")
+	s, c := States.Init.Handle(&ctx, sc)
+	require.IsType(t, &updateCleanupState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateCleanupState).status)
+	assert.False(t, c)
+	assert.Equal(t, 1, invalidateCalls)
+	_, err = ms.ReadAll(datastore.PartitionWriteKey)
+	assert.True(t, os.IsNotExist(err))
+
+	// The running partition is never invalidated.
+	crash("/dev/p2")
+	s, _ = States.Init.Handle(&ctx, sc)
+	assert.IsType(t, &updateCleanupState{}, s)
+	assert.Equal(t, 1, invalidateCalls)
+
+	// Without a record of the write, the update is cleaned up as before.
+	require.NoError(t, datastore.StoreStateData(ms, datastore.StateData{
+		Name:       datastore.MenderStateUpdateStore,
+		UpdateInfo: *update,
+	}))
+	s, _ = States.Init.Handle(&ctx, sc)
+	assert.IsType(t, &updateCleanupState{}, s)
+	assert.Equal(t, 1, invalidateCalls)
+}
+
+// partitionWriteFailingStore fails to record writes to the inactive partition.
+type partitionWriteFailingStore struct {
+	*store.MemStore
+}
+
+func (s partitionWriteFailingStore) WriteAll(name string, data []byte) error {
+	if name == datastore.PartitionWriteKey {
+		return errors.New("disk full")
+	}
+	return s.MemStore.WriteAll(name, data)
+}
+
+func TestStateUpdateStorePartitionWriteNotRecorded(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+			PayloadTypes:      []string{"rootfs-image"},
+		},
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	ctx := StateContext{
+		Store: partitionWriteFailingStore{store.NewMemStore()},
+	}
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{
+			ConsumeUpdate: true,
+			RetActive:     "/dev/p2",
+			RetInactive:   "/dev/p3",
+		},
+	}
+
+	// The update would be stored, but nothing is written to a partition
+	// which could not be recovered.
+	s, _ := NewUpdateStoreState(stream, update).Handle(&ctx, sc)
+	require.IsType(t, &updateCleanupState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateCleanupState).status)
+}
+
+func TestStateUpdateStoreChecksum(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+			PayloadTypes:      []string{"rootfs-image"},
+		},
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+	invalidateCalls := 0
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{
+			ConsumeUpdate:   true,
+			InvalidateCalls: &invalidateCalls,
+		},
+	}
+
+	stream.Seek(0, io.SeekStart)
+	s, c := NewUpdateStoreState(stream, update).Handle(&ctx, sc)
+	assert.IsType(t, &updateAfterStoreState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, 0, invalidateCalls)
+
+	// Wrong checksum; the stored payload must never be enabled.
+	update.Artifact.Source.Checksum = strings.Repeat("0", sha256.Size*2)
+	stream.Seek(0, io.SeekStart)
+	s, c = NewUpdateStoreState(stream, update).Handle(&ctx, sc)
+	assert.IsType(t, &updateCleanupState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, 1, invalidateCalls)
+}
+
+func TestStateUpdateStoreChecksumRetry(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	// Still a valid Artifact, but not what the server sent.
+	corrupt := append(append([]byte{}, content...), "garbage"...)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+			PayloadTypes:      []string{"rootfs-image"},
+		},
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+	invalidateCalls := 0
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{
+			ConsumeUpdate:   true,
+			InvalidateCalls: &invalidateCalls,
+		},
+		checksumMismatchRetries: 2,
+	}
+	storeArtifact := func(artifact []byte) State {
+		s, c := NewUpdateStoreState(
+			ioutil.NopCloser(bytes.NewReader(artifact)), update).Handle(&ctx, sc)
+		assert.False(t, c)
+		return s
+	}
+
+	// Retried, and then successful.
+	assert.IsType(t, &fetchStoreRetryState{}, storeArtifact(corrupt))
+	assert.IsType(t, &fetchStoreRetryState{}, storeArtifact(corrupt))
+	assert.IsType(t, &updateAfterStoreState{}, storeArtifact(content))
+	assert.Equal(t, 2, invalidateCalls)
+
+	// Given up on once the retries are used up.
+	s, _ := States.UpdateCheck.Handle(&ctx, &stateTestController{updateResp: update})
+	require.IsType(t, &updateFetchState{}, s)
+	invalidateCalls = 0
+	assert.IsType(t, &fetchStoreRetryState{}, storeArtifact(corrupt))
+	assert.IsType(t, &fetchStoreRetryState{}, storeArtifact(corrupt))
+	assert.IsType(t, &updateCleanupState{}, storeArtifact(corrupt))
+	assert.Equal(t, 3, invalidateCalls)
+
+	// Failed straight away without retries.
+	ctx.checksumMismatches = 0
+	sc.checksumMismatchRetries = 0
+	assert.IsType(t, &updateCleanupState{}, storeArtifact(corrupt))
+}
+
+func TestStateUpdateStoreDryRun(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+		},
+	}
+	update.Artifact.Source.Checksum = hex.EncodeToString(sum[:])
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{
+			RetStoreUpdate: errors.New("dry run must not store the payload"),
+		},
+		dryRun:      true,
+		maxAttempts: 1,
+	}
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	stream.Seek(0, io.SeekStart)
+	s, c := NewUpdateStoreState(stream, update).Handle(&ctx, sc)
+	require.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+	assert.Equal(t, &datastore.DryRunResult{
+		Installable:       true,
+		ChecksumVerified:  true,
+		PayloadTypes:      []string{"rootfs-image"},
+		CompatibleDevices: []string{"vexpress-qemu"},
+	}, s.(*updateStatusReportState).dryRun)
+	require.NotNil(t, hook.LastEntry())
+	assert.Contains(t, hook.LastEntry().Message, "is installable; not installing it")
+
+	// Nothing was stored, so there is no state data to recover from.
+	_, err = datastore.LoadStateData(ctx.Store)
+	assert.Error(t, err)
+
+	// The outcome is the dry run, which does not count as a failed attempt.
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &idleState{}, s)
+	last, err := datastore.LoadLastUpdate(ctx.Store)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.LastUpdateDryRun, last.Status)
+	require.NotNil(t, last.DryRun)
+	assert.True(t, last.DryRun.Installable)
+	attempts, err := datastore.LoadUpdateAttempts(ctx.Store)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.UpdateAttempts{}, attempts)
+
+	hook.Reset()
+	update.Artifact.Source.Checksum = strings.Repeat("0", sha256.Size*2)
+	stream.Seek(0, io.SeekStart)
+	s, _ = NewUpdateStoreState(stream, update).Handle(&ctx, sc)
+	require.IsType(t, &updateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+	require.NotNil(t, s.(*updateStatusReportState).dryRun)
+	assert.False(t, s.(*updateStatusReportState).dryRun.Installable)
+	assert.False(t, s.(*updateStatusReportState).dryRun.ChecksumVerified)
+	assert.NotEmpty(t, s.(*updateStatusReportState).dryRun.Error)
+	require.NotNil(t, hook.LastEntry())
+	assert.Contains(t, hook.LastEntry().Message, "Dry run: Artifact verification failed")
+}
+
+func TestStateUpdateIncompatibleDevice(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"beaglebone"},
+		},
+	}
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+
+	// The server response is already enough to tell.
+	s, _ := States.UpdateCheck.Handle(&ctx, &stateTestController{
+		updateResp: update,
+		updateRespErr: NewTransientError(&installer.IncompatibleDeviceError{
+			CompatibleDevices: []string{"beaglebone"},
+			DeviceType:        "vexpress-qemu",
+		}),
+	})
+	require.IsType(t, &updateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+
+	// Otherwise the Artifact header is, which is not worth retrying.
+	stream, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"beaglebone"}},
+		nil, nil)
+	require.NoError(t, err)
+	update.Artifact.CompatibleDevices = nil
+	s, _ = NewUpdateStoreState(stream, update).Handle(&ctx, &stateTestController{})
+	require.IsType(t, &updateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+}
+
+// headerOnlyStream serves the start of an Artifact, up to where the payload
+// data begins, and fails any read past that.
+type headerOnlyStream struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (h *headerOnlyStream) Read(p []byte) (int, error) {
+	n, err := h.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("read past the Artifact header")
+	}
+	return n, err
+}
+
+func (h *headerOnlyStream) Close() error {
+	h.closed = true
+	return nil
+}
+
+// newHeaderOnlyStream cuts the Artifact off at the payload data.
+func newHeaderOnlyStream(t *testing.T, artifact []byte) *headerOnlyStream {
+	r := bytes.NewReader(artifact)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		if strings.HasPrefix(hdr.Name, "data/") {
+			// Only the tar header of the data entry has been read.
+			read := len(artifact) - r.Len()
+			return &headerOnlyStream{
+				Reader: bytes.NewReader(artifact[:read-512]),
+			}
+		}
+	}
+}
+
+func TestStateUpdateStoreRejectsOnHeader(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	cases := map[string]struct {
+		artifactName string
+		devices      []string
+	}{
+		"name is not what the server claims": {
+			artifactName: "OtherName",
+			devices:      []string{"vexpress-qemu"},
+		},
+		"not for this device": {
+			artifactName: "TestName",
+			devices:      []string{"beaglebone"},
+		},
+	}
+
+	for name, test := range cases {
+		t.Run(name, func(t *testing.T) {
+			art, err := tests.CreateTestArtifactV3("test", "gzip",
+				&tests.ArtifactProvides{ArtifactName: "TestName"},
+				&tests.ArtifactDepends{CompatibleDevices: test.devices},
+				nil, nil)
+			require.NoError(t, err)
+			content, err := ioutil.ReadAll(art)
+			require.NoError(t, err)
+			stream := newHeaderOnlyStream(t, content)
+
+			update := &datastore.UpdateInfo{ID: "foo"}
+			update.Artifact.ArtifactName = test.artifactName
+			ctx := StateContext{Store: store.NewMemStore()}
+			s, _ := NewUpdateStoreState(stream, update).Handle(&ctx, &stateTestController{})
+			require.IsType(t, &updateStatusReportState{}, s)
+			assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+			assert.True(t, stream.closed)
+		})
+	}
+
+	// The header is accepted on its own, so the rejections above did not
+	// need the payload.
+	art, err := tests.CreateTestArtifactV3("test", "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(art)
+	require.NoError(t, err)
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.ArtifactName = "TestName"
+	ctx := StateContext{Store: store.NewMemStore()}
+	s, _ := NewUpdateStoreState(newHeaderOnlyStream(t, content), update).Handle(&ctx,
+		&stateTestController{FakeDevice: FakeDevice{ConsumeUpdate: true}})
+	assert.IsType(t, &updateCleanupState{}, s)
+}
+
+// Tests various cases of missing dependencies, and a final case with all
+// dependencies satisfied.
+func TestUpdateStoreDependencies(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	artifactProvides := &tests.ArtifactProvides{
+		ArtifactName:  "TestName",
+		ArtifactGroup: "TestGroup",
+	}
+	artifactDepends := &tests.ArtifactDepends{
+		ArtifactName:      []string{"OtherArtifact"},
+		ArtifactGroup:     []string{"TestGroup"},
+		CompatibleDevices: []string{"vexpress-qemu"},
+	}
+
+	stream, err := tests.CreateTestArtifactV3("test-image", "gzip",
+		artifactProvides, artifactDepends, nil, nil)
+	require.NoError(t, err)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			ArtifactGroup:     "TestGroup",
+			CompatibleDevices: []string{"vexpress-qemu"},
+			PayloadTypes:      []string{"rootfs-image"},
+		},
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	uis := NewUpdateStoreState(stream, update)
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		Store: ms,
+	}
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{
+			ConsumeUpdate: true,
+		},
+	}
+
+	s, c := uis.Handle(&ctx, sc)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	ms.WriteAll(datastore.ArtifactNameKey, []byte("NonExistingArtie"))
+	stream.Seek(0, io.SeekStart)
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	ms.WriteAll(datastore.ArtifactNameKey, []byte("OtherArtifact"))
+	stream.Seek(0, io.SeekStart)
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	ms.WriteAll(datastore.ArtifactGroupKey, []byte("WrongGroup"))
+	stream.Seek(0, io.SeekStart)
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &updateStatusReportState{}, s)
+	assert.False(t, c)
+	ms.WriteAll(datastore.ArtifactGroupKey, []byte("TestGroup"))
+	stream.Seek(0, io.SeekStart)
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &updateAfterStoreState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateWrongArtifactNameFromServer(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+	artifactProvides := &tests.ArtifactProvides{
+		ArtifactGroup: "TestGroup",
+		ArtifactName:  "TestName",
+	}
+	artifactDepends := &tests.ArtifactDepends{
+		CompatibleDevices: []string{"vexpress-qemu"},
+	}
+
+	stream, err := tests.CreateTestArtifactV3("test-image", "gzip",
 		artifactProvides, artifactDepends, nil, nil)
 	require.NoError(t, err)
 
@@ -1025,6 +2111,392 @@ func TestStateUpdateInstallRetry(t *testing.T) {
 	assert.False(t, c)
 }
 
+type countingWatchdog struct {
+	lock sync.Mutex
+	pets int
+}
+
+func (w *countingWatchdog) Pet() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pets++
+	return nil
+}
+
+func (w *countingWatchdog) Enable() error {
+	return nil
+}
+
+func (w *countingWatchdog) Disable() error {
+	return nil
+}
+
+func TestStateUpdateInstallPetsWatchdog(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	oldInterval := watchdogPetInterval
+	watchdogPetInterval = 10 * time.Millisecond
+	defer func() { watchdogPetInterval = oldInterval }()
+
+	watchdog := &countingWatchdog{}
+	ctx := StateContext{
+		Store:    store.NewMemStore(),
+		Watchdog: watchdog,
+	}
+	stc := stateTestController{
+		FakeDevice: FakeDevice{InstallDelay: 200 * time.Millisecond},
+	}
+	s, _ := NewUpdateInstallState(&datastore.UpdateInfo{ID: "foo"}).Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootState{}, s)
+
+	// Petted throughout the install, and not after it.
+	watchdog.lock.Lock()
+	pets := watchdog.pets
+	watchdog.lock.Unlock()
+	assert.True(t, pets >= 5, "petted %d times", pets)
+	time.Sleep(50 * time.Millisecond)
+	watchdog.lock.Lock()
+	assert.Equal(t, pets, watchdog.pets)
+	watchdog.lock.Unlock()
+}
+
+func TestStateUpdateRebootWait(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+	now := time.Now()
+
+	// Without a window we reboot straight after installing.
+	stc := stateTestController{}
+	s, c := NewUpdateInstallState(update).Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootState{}, s)
+	assert.False(t, c)
+
+	// Window opens in two hours; installing goes to the wait state, which
+	// waits and then checks again.
+	stc.window = conf.MaintenanceWindow{
+		Start:           now.Add(2 * time.Hour).Format("15:04"),
+		DurationMinutes: 30,
+	}
+	s, c = NewUpdateInstallState(update).Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, datastore.RebootRequestedType{datastore.RebootTypeCustom},
+		s.(UpdateState).Update().RebootRequested)
+
+	// Mandatory updates do not wait for the window.
+	forced := *update
+	forced.Force = true
+	forcedState, _ := NewUpdateInstallState(&forced).Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootState{}, forcedState)
+
+	s.(*updateRebootWaitState).WaitState = &waitStateTest{baseState{
+		id: datastore.MenderStateUpdateRebootWait,
+	}}
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+
+	// Inside the window; reboot.
+	stc.window = conf.MaintenanceWindow{
+		Start:           now.Add(-time.Minute).Format("15:04"),
+		DurationMinutes: 60,
+	}
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootState{}, s)
+	assert.False(t, c)
+
+	// Resuming after a restart keeps waiting.
+	sd := datastore.StateData{
+		Name:       datastore.MenderStateUpdateRebootWait,
+		UpdateInfo: *update,
+	}
+	s, c = States.Init.getNextState(&ctx, &sd, nil)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateUpdateRebootWaitNoAutoReboot(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		Store:      store.NewMemStore(),
+		RebootChan: make(chan bool, 1),
+	}
+	stc := stateTestController{noAutoReboot: true}
+
+	// Even mandatory updates wait for the reboot to be requested.
+	forced := *update
+	forced.Force = true
+	s, c := NewUpdateInstallState(&forced).Handle(&ctx, &stc)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+
+	// The wait state is stored before it is handled, so that a restart
+	// keeps waiting.
+	sd := datastore.StateData{
+		Name:       datastore.MenderStateUpdateRebootWait,
+		UpdateInfo: *update,
+	}
+	s, c = States.Init.getNextState(&ctx, &sd, nil)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+
+	// Nothing happens until the reboot is requested.
+	done := make(chan State)
+	go func() {
+		next, _ := s.Handle(&ctx, &stc)
+		done <- next
+	}()
+	select {
+	case <-done:
+		t.Fatal("rebooted without being asked to")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ctx.RebootChan <- true
+	select {
+	case next := <-done:
+		assert.IsType(t, &updateRebootState{}, next)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reboot request was not picked up")
+	}
+}
+
+func TestStateUpdateRebootPaused(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	stc := &stateTestController{}
+	daemon := NewDaemon(stc, ms)
+
+	// The deployment pauses reboots, even with AutoReboot on.
+	update := &datastore.UpdateInfo{
+		ID:          "foo",
+		PauseReboot: true,
+	}
+	s, c := NewUpdateInstallState(update).Handle(&daemon.Sctx, stc)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+	assert.True(t, daemon.Status().RebootPaused)
+
+	// The client restarts, and is still paused.
+	daemon = NewDaemon(stc, ms)
+	sd := datastore.StateData{
+		Name:       datastore.MenderStateUpdateRebootWait,
+		UpdateInfo: *update,
+	}
+	s, c = States.Init.getNextState(&daemon.Sctx, &sd, nil)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	assert.False(t, c)
+	assert.True(t, daemon.Status().RebootPaused)
+	assert.Error(t, daemon.RequestReboot())
+
+	done := make(chan State)
+	go func() {
+		next, _ := s.Handle(&daemon.Sctx, stc)
+		done <- next
+	}()
+	select {
+	case <-done:
+		t.Fatal("rebooted while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Pausing again changes nothing.
+	require.NoError(t, daemon.PauseReboot())
+	assert.Empty(t, daemon.Sctx.WakeupChan)
+
+	require.NoError(t, daemon.UnpauseReboot())
+	select {
+	case next := <-done:
+		assert.IsType(t, &updateRebootWaitState{}, next)
+		s, _ = next.Handle(&daemon.Sctx, stc)
+		assert.IsType(t, &updateRebootState{}, s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("unpausing was not picked up")
+	}
+	// Nor does unpausing again.
+	require.NoError(t, daemon.UnpauseReboot())
+	assert.Empty(t, daemon.Sctx.WakeupChan)
+	assert.False(t, daemon.Status().RebootPaused)
+
+	// Paused through the control API, for any update.
+	require.NoError(t, daemon.PauseReboot())
+	s, _ = NewUpdateInstallState(&datastore.UpdateInfo{ID: "bar"}).Handle(&daemon.Sctx, stc)
+	assert.IsType(t, &updateRebootWaitState{}, s)
+	require.NoError(t, daemon.UnpauseReboot())
+	s, _ = NewUpdateInstallState(&datastore.UpdateInfo{ID: "bar"}).Handle(&daemon.Sctx, stc)
+	assert.IsType(t, &updateRebootState{}, s)
+}
+
+func TestStateUpdateHealthWait(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID:               "foo",
+		SupportsRollback: datastore.RollbackSupported,
+	}
+	ctx := StateContext{
+		Store:       store.NewMemStore(),
+		HealthyChan: make(chan bool, 1),
+	}
+
+	// Without a timeout the update is committed straight away.
+	stc := stateTestController{}
+	s, c := NewUpdateAfterRebootState(update).Handle(&ctx, &stc)
+	assert.IsType(t, &updateCommitState{}, s)
+	assert.False(t, c)
+
+	// Likewise if it could not be rolled back anyway.
+	stc.healthTimeout = time.Hour
+	s, _ = NewUpdateAfterRebootState(&datastore.UpdateInfo{ID: "foo"}).Handle(&ctx, &stc)
+	assert.IsType(t, &updateCommitState{}, s)
+
+	// A stale confirmation does not count for this update.
+	ctx.HealthyChan <- true
+	s, c = NewUpdateAfterRebootState(update).Handle(&ctx, &stc)
+	require.IsType(t, &updateHealthWaitState{}, s)
+	assert.False(t, c)
+	deadline := s.(UpdateState).Update().HealthCheckDeadline
+	require.NotNil(t, deadline)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *deadline, time.Second)
+	assert.Empty(t, ctx.HealthyChan)
+
+	// Confirmed in time; commit.
+	ctx.HealthyChan <- true
+	next, c := s.Handle(&ctx, &stc)
+	assert.IsType(t, &updateCommitState{}, next)
+	assert.False(t, c)
+
+	// Not confirmed in time; roll back.
+	s = NewUpdateHealthWaitState(update, time.Now().Add(10*time.Millisecond))
+	next, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &updateRollbackState{}, next)
+	assert.False(t, c)
+
+	// Stopping the daemon interrupts the wait.
+	s = NewUpdateHealthWaitState(update, time.Now().Add(time.Hour))
+	go s.Cancel()
+	next, c = s.Handle(&ctx, &stc)
+	assert.Equal(t, s, next)
+	assert.True(t, c)
+
+}
+
+func TestStateUpdateHealthWaitRestart(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := StateContext{
+		Store:       store.NewMemStore(),
+		HealthyChan: make(chan bool, 1),
+	}
+	stc := stateTestController{}
+
+	// The deadline is stored with the state when the wait starts.
+	deadline := time.Now().Add(time.Hour).Round(0)
+	s := NewUpdateHealthWaitState(&datastore.UpdateInfo{
+		ID:               "foo",
+		SupportsRollback: datastore.RollbackSupported,
+	}, deadline)
+	require.NoError(t, datastore.StoreStateData(ctx.Store, datastore.StateData{
+		Name:       s.Id(),
+		UpdateInfo: *s.(UpdateState).Update(),
+	}))
+	sd, err := datastore.LoadStateData(ctx.Store)
+	require.NoError(t, err)
+
+	// After a restart the client keeps waiting until the same deadline.
+	s, c := States.Init.getNextState(&ctx, &sd, nil)
+	require.IsType(t, &updateHealthWaitState{}, s)
+	assert.False(t, c)
+	assert.True(t, deadline.Equal(*s.(UpdateState).Update().HealthCheckDeadline))
+
+	ctx.HealthyChan <- true
+	next, _ := s.Handle(&ctx, &stc)
+	assert.IsType(t, &updateCommitState{}, next)
+
+	// If the deadline passed while the client was down, the update is
+	// rolled back.
+	past := time.Now().Add(-time.Minute)
+	sd.UpdateInfo.HealthCheckDeadline = &past
+	s, _ = States.Init.getNextState(&ctx, &sd, nil)
+	require.IsType(t, &updateHealthWaitState{}, s)
+	next, _ = s.Handle(&ctx, &stc)
+	assert.IsType(t, &updateRollbackState{}, next)
+
+	// Without a deadline there is nothing to wait for; roll back.
+	sd.UpdateInfo.HealthCheckDeadline = nil
+	s, _ = States.Init.getNextState(&ctx, &sd, nil)
+	assert.IsType(t, &updateRollbackState{}, s)
+}
+
+func TestStateUpdateVerifyRebootFailure(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := StateContext{
+		Store: store.NewMemStore(),
+	}
+	// Not running the update after the reboot, which is how VerifyReboot
+	// fails when the old partition was booted.
+	sc := &stateTestController{
+		FakeDevice: FakeDevice{RetHasUpdate: false},
+	}
+
+	// The update is rolled back, rebooting into the old partition.
+	update := &datastore.UpdateInfo{
+		ID:               "foo",
+		SupportsRollback: datastore.RollbackSupported,
+		RebootRequested:  datastore.RebootRequestedType{datastore.RebootTypeCustom},
+	}
+	s, c := NewUpdateVerifyRebootState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateRollbackState{}, s)
+	assert.False(t, c)
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &updateRollbackRebootState{}, s)
+	assert.False(t, c)
+
+	// Without rollback, the update fails, and is reported as such.
+	update = &datastore.UpdateInfo{
+		ID:               "foo",
+		SupportsRollback: datastore.RollbackNotSupported,
+	}
+	s, c = NewUpdateVerifyRebootState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateErrorState{}, s)
+	assert.False(t, c)
+	s, c = s.Handle(&ctx, sc)
+	require.IsType(t, &updateCleanupState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateCleanupState).status)
+	assert.False(t, c)
+
+	// Running the update, it carries on.
+	sc.RetHasUpdate = true
+	s, c = NewUpdateVerifyRebootState(update).Handle(&ctx, sc)
+	assert.IsType(t, &updateAfterRebootState{}, s)
+	assert.False(t, c)
+}
+
 func TestStateFinal(t *testing.T) {
 	rs := finalState{}
 
@@ -1138,6 +2610,21 @@ func TestMaxSendingAttempts(t *testing.T) {
 			time.Second*10, minReportSendRetries))
 }
 
+func TestStatusReportRetryInterval(t *testing.T) {
+	assert.Equal(t, time.Second,
+		statusReportRetryInterval(time.Second, time.Minute, 1))
+	assert.Equal(t, 2*time.Second,
+		statusReportRetryInterval(time.Second, time.Minute, 2))
+	assert.Equal(t, 8*time.Second,
+		statusReportRetryInterval(time.Second, time.Minute, 4))
+	// Never longer than the update poll interval...
+	assert.Equal(t, time.Minute,
+		statusReportRetryInterval(time.Second, time.Minute, 10))
+	// ...unless that is shorter than the retry poll interval.
+	assert.Equal(t, time.Minute,
+		statusReportRetryInterval(time.Minute, time.Second, 5))
+}
+
 type menderWithCustomUpdater struct {
 	*Mender
 	updater                fakeUpdater
@@ -1172,6 +2659,10 @@ func (m *menderWithCustomUpdater) ReportUpdateStatus(update *datastore.UpdateInf
 	return nil
 }
 
+func (m *menderWithCustomUpdater) NewStatusReporter(update *datastore.UpdateInfo) func(string) error {
+	return func(string) error { return nil }
+}
+
 func (m *menderWithCustomUpdater) FetchUpdate(url string) (io.ReadCloser, int64, error) {
 	return m.updater.FetchUpdate(nil, url)
 }
@@ -0,0 +1,112 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// The most status reports kept waiting for the server to be reachable. A
+// deployment only has a few statuses before its final one, so this is only
+// reached if the same deployment is retried over and over.
+const maxQueuedStatusReports = 10
+
+// finalStatus tells whether status ends a deployment. Those are not queued,
+// since the update status report state keeps retrying them, and gives up on
+// the deployment if they cannot be sent.
+func finalStatus(status string) bool {
+	switch status {
+	case client.StatusSuccess, client.StatusFailure, client.StatusAlreadyInstalled:
+		return true
+	}
+	return false
+}
+
+// queueStatusReport keeps a status report which could not be sent, to send it
+// before the next one.
+func (m *Mender) queueStatusReport(deploymentID, status string) {
+	if m.Store == nil || finalStatus(status) {
+		return
+	}
+	queue, err := datastore.LoadStatusReportQueue(m.Store)
+	if err != nil {
+		log.Errorf("Could not load the queued status reports: %v", err)
+	}
+	report := datastore.QueuedStatusReport{
+		DeploymentID: deploymentID,
+		Status:       status,
+	}
+	if len(queue) > 0 && queue[len(queue)-1] == report {
+		return
+	}
+	queue = append(queue, report)
+	if len(queue) > maxQueuedStatusReports {
+		queue = queue[len(queue)-maxQueuedStatusReports:]
+	}
+	log.Infof("Queued the %s status report until the server can be reached", status)
+	if err = datastore.StoreStatusReportQueue(m.Store, queue); err != nil {
+		log.Errorf("Could not store the queued status reports: %v", err)
+	}
+}
+
+// sendQueuedStatusReports sends the queued status reports of the deployment,
+// oldest first, and stops at the first one which fails. Those of any other
+// deployment are dropped, since that deployment is over. So is the last one,
+// if it is the status about to be sent, which is then the retry of a report
+// which was queued when it failed.
+func (m *Mender) sendQueuedStatusReports(deploymentID, status string) menderError {
+	if m.Store == nil {
+		return nil
+	}
+	queue, err := datastore.LoadStatusReportQueue(m.Store)
+	if err != nil {
+		log.Errorf("Could not load the queued status reports: %v", err)
+		return nil
+	} else if len(queue) == 0 {
+		return nil
+	}
+
+	var pending []datastore.QueuedStatusReport
+	for _, report := range queue {
+		if report.DeploymentID == deploymentID {
+			pending = append(pending, report)
+		}
+	}
+	if len(pending) > 0 && pending[len(pending)-1].Status == status {
+		pending = pending[:len(pending)-1]
+	}
+
+	var merr menderError
+	var left []datastore.QueuedStatusReport
+	for _, report := range pending {
+		if merr == nil {
+			merr = m.sendUpdateStatus(report.DeploymentID, report.Status)
+			if merr == nil {
+				log.Infof("Sent the queued %s status report", report.Status)
+				continue
+			} else if merr.IsFatal() {
+				// The deployment is over, and so is the queue.
+				left = nil
+				break
+			}
+		}
+		left = append(left, report)
+	}
+	if err = datastore.StoreStatusReportQueue(m.Store, left); err != nil {
+		log.Errorf("Could not store the queued status reports: %v", err)
+	}
+	return merr
+}
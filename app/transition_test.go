@@ -248,8 +248,9 @@ func TestTransitionReporting(t *testing.T) {
 	update := &datastore.UpdateInfo{
 		Artifact: datastore.Artifact{
 			Source: struct {
-				URI    string
-				Expire string
+				URI      string
+				Expire   string
+				Checksum string `json:"checksum,omitempty"`
 			}{
 				URI: strings.Join([]string{"www.example.com", "test"}, "/"),
 			},
@@ -0,0 +1,142 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errUpdateAborted is the cause of the error reading the download of an
+// aborted update.
+var errUpdateAborted = errors.New("the update was aborted")
+
+// updateAborter aborts the download of an update from outside the state
+// machine. The download is closed, so that a read waiting for the network
+// returns at once. A write to the device already under way is finished, and
+// the update then fails the same way as with any broken download.
+type updateAborter struct {
+	lock   sync.Mutex
+	reason string
+	// the download being read, if any
+	in io.Closer
+}
+
+func (a *updateAborter) abort(reason string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.reason != "" {
+		return
+	}
+	log.Warnf("Aborting the update: %s", reason)
+	a.reason = reason
+	if a.in != nil {
+		a.in.Close()
+	}
+}
+
+// aborted returns an error if the update has been aborted.
+func (a *updateAborter) aborted() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.reason == "" {
+		return nil
+	}
+	return errors.Wrap(errUpdateAborted, a.reason)
+}
+
+// reset clears an abort which came too late for the previous update.
+func (a *updateAborter) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.reason = ""
+	a.in = nil
+}
+
+// watch returns in, which fails to be read once the update is aborted.
+func (a *updateAborter) watch(in io.ReadCloser) io.ReadCloser {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.in = in
+	return &abortableReader{ReadCloser: in, a: a}
+}
+
+type abortableReader struct {
+	io.ReadCloser
+	a *updateAborter
+}
+
+func (r *abortableReader) Read(p []byte) (int, error) {
+	if err := r.a.aborted(); err != nil {
+		return 0, err
+	}
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		if aerr := r.a.aborted(); aerr != nil {
+			err = aerr
+		}
+	}
+	return n, err
+}
+
+func (r *abortableReader) Close() error {
+	r.a.lock.Lock()
+	if r.a.in == r.ReadCloser {
+		r.a.in = nil
+	}
+	r.a.lock.Unlock()
+	return r.ReadCloser.Close()
+}
+
+// watchServerAbort reports the download of update to the server at every
+// update poll interval, until the returned function is called, and aborts the
+// update if the server answers that the deployment has been aborted there.
+// The reports are sent with c.NewStatusReporter, since c itself is only used
+// by the state machine.
+func watchServerAbort(ctx *StateContext, c Controller, update *datastore.UpdateInfo) func() {
+	interval := c.GetUpdatePollInterval()
+	if interval <= 0 {
+		return func() {}
+	}
+	report := c.NewStatusReporter(update)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := report(client.StatusDownloading)
+				if errors.Cause(err) == client.ErrDeploymentAborted {
+					ctx.aborter.abort("the deployment was aborted on the server")
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
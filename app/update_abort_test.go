@@ -0,0 +1,214 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/tests"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowDownload returns a download of artifact which stalls half way through,
+// and a channel which is closed once it gets there.
+func slowDownload(artifact []byte) (io.ReadCloser, <-chan struct{}) {
+	pr, pw := io.Pipe()
+	halfway := make(chan struct{})
+	go func() {
+		pw.Write(artifact[:len(artifact)/2])
+		close(halfway)
+	}()
+	return pr, halfway
+}
+
+// serverAbortController answers status reports the way the server does once
+// the deployment has been aborted there, after the first two.
+type serverAbortController struct {
+	*stateTestController
+	lock    sync.Mutex
+	reports int
+}
+
+func (c *serverAbortController) NewStatusReporter(update *datastore.UpdateInfo) func(string) error {
+	return func(string) error {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.reports++
+		if c.reports > 2 {
+			return client.ErrDeploymentAborted
+		}
+		return nil
+	}
+}
+
+func TestAbortUpdateDuringDownload(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	// Big enough for the download to stall in the middle of the payload.
+	payload := make([]byte, 256*1024)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+	stream, err := tests.CreateTestArtifactV3(hex.EncodeToString(payload), "gzip",
+		&tests.ArtifactProvides{ArtifactName: "TestName"},
+		&tests.ArtifactDepends{CompatibleDevices: []string{"vexpress-qemu"}},
+		nil, nil)
+	require.NoError(t, err)
+	artifact, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName:      "TestName",
+			CompatibleDevices: []string{"vexpress-qemu"},
+			PayloadTypes:      []string{"rootfs-image"},
+		},
+	}
+
+	for _, byServer := range []bool{false, true} {
+		invalidateCalls := 0
+		in, halfway := slowDownload(artifact)
+		stc := &stateTestController{
+			FakeDevice: FakeDevice{
+				ConsumeUpdate:   true,
+				InvalidateCalls: &invalidateCalls,
+			},
+			updater: fakeUpdater{
+				fetchUpdateReturnReadCloser: in,
+				fetchUpdateReturnSize:       int64(len(artifact)),
+			},
+		}
+		var c Controller = stc
+		if byServer {
+			stc.updatePollIntvl = 10 * time.Millisecond
+			c = &serverAbortController{stateTestController: stc}
+		}
+		daemon := NewDaemon(c, store.NewMemStore())
+		ctx := &daemon.Sctx
+
+		s, _ := NewUpdateFetchState(update).Handle(ctx, c)
+		require.IsType(t, &updateStoreState{}, s)
+		daemon.recordState(s)
+		stored := make(chan State)
+		go func() {
+			next, _ := s.Handle(ctx, c)
+			stored <- next
+		}()
+
+		<-halfway
+		if !byServer {
+			require.NoError(t, daemon.AbortUpdate())
+		}
+		select {
+		case s = <-stored:
+		case <-time.After(10 * time.Second):
+			t.Fatal("The download was not aborted")
+		}
+
+		// Whatever was written of the update is invalidated, and the
+		// update fails.
+		require.IsType(t, &updateCleanupState{}, s, "by server: %v", byServer)
+		assert.Equal(t, client.StatusFailure, s.(*updateCleanupState).status)
+		assert.Equal(t, 1, invalidateCalls)
+		assert.Error(t, ctx.aborter.aborted())
+	}
+}
+
+func TestAbortUpdateBeforeDownload(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{ID: "foo"}
+	stc := &stateTestController{
+		updater: fakeUpdater{fetchUpdateReturnError: io.ErrUnexpectedEOF},
+	}
+	daemon := NewDaemon(stc, store.NewMemStore())
+
+	// Aborted while waiting to download it again, the update is not
+	// downloaded at all.
+	daemon.recordState(NewFetchStoreRetryState(NewUpdateFetchState(update), update,
+		io.ErrUnexpectedEOF))
+	require.NoError(t, daemon.AbortUpdate())
+	assert.True(t, <-daemon.Sctx.WakeupChan)
+	s, _ := NewUpdateFetchState(update).Handle(&daemon.Sctx, stc)
+	require.IsType(t, &updateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*updateStatusReportState).status)
+
+	// The next update starts afresh.
+	daemon.Sctx.aborter.reset()
+	s, _ = NewUpdateFetchState(update).Handle(&daemon.Sctx, stc)
+	assert.IsType(t, &fetchStoreRetryState{}, s)
+}
+
+// The watcher reports from its own goroutine while the state machine goes on
+// using the Mender; run with -race, which catches any state they share.
+func TestWatchServerAbortMender(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	config := conf.MenderConfig{
+		MenderConfigFromFile: conf.MenderConfigFromFile{
+			Servers:                   []client.MenderServer{{ServerURL: srv.URL}},
+			UpdatePollIntervalSeconds: 1,
+		},
+	}
+	mender := newTestMender(nil, config, testMenderPieces{
+		MenderPieces: MenderPieces{Store: ms},
+	})
+	ms.WriteAll(datastore.AuthTokenName, []byte("tokendata"))
+	require.NoError(t, mender.Authorize())
+
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	srv.Status.Aborted = true
+
+	// Quiet, as the loop below reloads the configuration as often as it can.
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	var ctx StateContext
+	stop := watchServerAbort(&ctx, mender, &datastore.UpdateInfo{ID: "foo"})
+	defer stop()
+
+	reloaded := config
+	reloaded.Servers = []client.MenderServer{{ServerURL: srv.URL}, {ServerURL: srv.URL}}
+	deadline := time.Now().Add(10 * time.Second)
+	for ctx.aborter.aborted() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("The update was not aborted")
+		}
+		mender.ReloadConfig(&reloaded)
+		mender.ReloadConfig(&config)
+		assert.NoError(t, mender.Authorize())
+	}
+	assert.Contains(t, ctx.aborter.aborted().Error(), "aborted on the server")
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Watchdog is a hardware watchdog, which resets the device unless it is
+// petted in time. The daemon enables it when it starts and disables it when it
+// stops; in between it is petted before every state, for as long as the daemon
+// waits for the next poll, and throughout the download and install of an
+// update, which can take much longer than the timeout of the watchdog.
+type Watchdog interface {
+	Pet() error
+	Enable() error
+	Disable() error
+}
+
+// NoWatchdog is the Watchdog of devices which do not have one.
+type NoWatchdog struct{}
+
+func (NoWatchdog) Pet() error {
+	return nil
+}
+
+func (NoWatchdog) Enable() error {
+	return nil
+}
+
+func (NoWatchdog) Disable() error {
+	return nil
+}
+
+// How often the watchdog is petted while something long is going on.
+var watchdogPetInterval = 10 * time.Second
+
+func watchdog(ctx *StateContext) Watchdog {
+	if ctx.Watchdog == nil {
+		return NoWatchdog{}
+	}
+	return ctx.Watchdog
+}
+
+func petWatchdog(ctx *StateContext) {
+	if err := watchdog(ctx).Pet(); err != nil {
+		log.Warnf("Could not pet the watchdog: %s", err)
+	}
+}
+
+// keepWatchdogPetted pets the watchdog until the returned function is called.
+func keepWatchdogPetted(ctx *StateContext) func() {
+	petWatchdog(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(watchdogPetInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				petWatchdog(ctx)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/mender/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the webhook receiver has to answer. Only changed by tests.
+var webhookTimeout = 10 * time.Second
+
+// sendWebhook posts the outcome of an update to url in the background. The
+// update carries on regardless; failing to deliver it is only logged.
+func sendWebhook(url string, outcome datastore.LastUpdate) {
+	body, err := json.Marshal(outcome)
+	if err != nil {
+		log.Errorf("Could not encode the update webhook: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	go func() {
+		rsp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Errorf("Could not send the update webhook: %v", err)
+			return
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode >= 300 {
+			log.Errorf("The update webhook at %s answered %s", url, rsp.Status)
+		}
+	}()
+}
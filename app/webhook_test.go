@@ -0,0 +1,90 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateWebhook(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	received := make(chan datastore.LastUpdate, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var outcome datastore.LastUpdate
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&outcome))
+		received <- outcome
+	}))
+	defer ts.Close()
+
+	ctx := &StateContext{Store: store.NewMemStore()}
+	stc := &stateTestController{webhookURL: ts.URL}
+	update := &datastore.UpdateInfo{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+
+	s, _ := NewUpdateStatusReportState(update, client.StatusSuccess).Handle(ctx, stc)
+	assert.IsType(t, &idleState{}, s)
+	select {
+	case outcome := <-received:
+		assert.Equal(t, "foo", outcome.DeploymentID)
+		assert.Equal(t, "release-2", outcome.ArtifactName)
+		assert.Equal(t, client.StatusSuccess, outcome.Status)
+		assert.True(t, ctx.lastUpdate.Time.Equal(outcome.Time))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+}
+
+func TestUpdateWebhookFailure(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	oldTimeout := webhookTimeout
+	defer func() { webhookTimeout = oldTimeout }()
+	webhookTimeout = 100 * time.Millisecond
+
+	// A receiver which never answers in time.
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx := &StateContext{Store: store.NewMemStore()}
+	update := &datastore.UpdateInfo{ID: "foo"}
+	for _, url := range []string{ts.URL, "http://127.0.0.1:0/unreachable"} {
+		start := time.Now()
+		s, _ := NewUpdateStatusReportState(update, client.StatusFailure).Handle(
+			ctx, &stateTestController{webhookURL: url})
+		assert.IsType(t, &idleState{}, s)
+		assert.WithinDuration(t, start, time.Now(), 50*time.Millisecond)
+	}
+}
@@ -182,12 +182,26 @@ func SetupCLI(args []string) error {
 				},
 			},
 		},
+		{
+			Name: "restore-previous",
+			Usage: "Reboot into the previously committed Artifact, " +
+				"if it is still intact.",
+			Action: runOptions.handleCLIOptions,
+		},
 		{
 			Name: "rollback",
 			Usage: "Rollback current Artifact. Returns (2) " +
 				"if no update in progress.",
 			Action: runOptions.handleCLIOptions,
 		},
+		{
+			Name: "self-test",
+			Usage: "Check that the device is ready to run the client: " +
+				"the configuration, the data directory, the connection " +
+				"to the server, the inactive partition and the free " +
+				"space. Returns (1) if any check fails.",
+			Action: runOptions.selfTestHandler,
+		},
 		{
 			Name:  "send-inventory",
 			Usage: "Force inventory update.",
@@ -332,6 +346,23 @@ func SetupCLI(args []string) error {
 				return runOptions.handleCLIOptions(ctx)
 			},
 		},
+		{
+			Name: "update-once",
+			Usage: "Check for an update and install it, without " +
+				"starting the daemon. Returns (0) if there was no " +
+				"update, (3) if an update was installed, and (1) " +
+				"on errors.",
+			Action: runOptions.handleCLIOptions,
+		},
+		{
+			Name: "version",
+			Usage: "Print the version of the client, and the commit " +
+				"and date it was built from, and exit.",
+			Action: func(ctx *cli.Context) error {
+				fmt.Fprint(ctx.App.Writer, conf.BuildInfo())
+				return nil
+			},
+		},
 	}
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
@@ -363,6 +394,11 @@ func SetupCLI(args []string) error {
 			Usage:       "Set logging `level`.",
 			Value:       "info",
 			Destination: &runOptions.logOptions.logLevel},
+		&cli.StringFlag{
+			Name:        "log-format",
+			Usage:       "Log `FORMAT`, either text or json (one record per line).",
+			Value:       "text",
+			Destination: &runOptions.logOptions.logFormat},
 		&cli.StringFlag{
 			Name:    "log-modules",
 			Aliases: []string{"m"},
@@ -372,7 +408,7 @@ func SetupCLI(args []string) error {
 		&cli.StringFlag{
 			Name:        "trusted-certs",
 			Aliases:     []string{"E"},
-			Usage:       "Trusted server certificates `FILE` path.",
+			Usage:       "Trusted server certificates `FILE` or directory path.",
 			Destination: &runOptions.Config.ServerCert},
 		&cli.BoolFlag{
 			Name:        "forcebootstrap",
@@ -387,6 +423,11 @@ func SetupCLI(args []string) error {
 			Name:        "skipverify",
 			Usage:       "Skip certificate verification.",
 			Destination: &runOptions.Config.NoVerify},
+		&cli.BoolFlag{
+			Name: "dry-run",
+			Usage: "Download and verify updates, but do not " +
+				"install them.",
+			Destination: &runOptions.dryRun},
 	}
 	cli.HelpPrinter = upgradeHelpPrinter(cli.HelpPrinter)
 	cli.VersionPrinter = func(c *cli.Context) {
@@ -395,6 +436,30 @@ func SetupCLI(args []string) error {
 	return app.Run(args)
 }
 
+// loadConfig reads the configuration files, and applies the command line flags
+// which override them. It is used both on start and when the configuration is
+// reloaded, so that the flags keep overriding it.
+func (runOptions *runOptionsType) loadConfig() (*conf.MenderConfig, error) {
+	config, err := conf.LoadConfig(
+		runOptions.config, runOptions.fallbackConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if runOptions.Config.NoVerify {
+		config.SkipVerify = true
+	}
+	if runOptions.dryRun {
+		config.DryRun = true
+	}
+	// The data directory given on the command line wins over the
+	// configuration.
+	if runOptions.dataStoreSet {
+		config.DataDir = runOptions.dataStore
+	}
+	return config, nil
+}
+
 func (runOptions *runOptionsType) commonCLIHandler(
 	ctx *cli.Context) (*conf.MenderConfig,
 	installer.DualRootfsDevice, error) {
@@ -406,8 +471,8 @@ func (runOptions *runOptionsType) commonCLIHandler(
 	}
 
 	// Handle config flags
-	config, err := conf.LoadConfig(
-		runOptions.config, runOptions.fallbackConfig)
+	runOptions.dataStoreSet = ctx.IsSet("data")
+	config, err := runOptions.loadConfig()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -419,9 +484,15 @@ func (runOptions *runOptionsType) commonCLIHandler(
 			return nil, nil, err
 		}
 	}
+	if !runOptions.dataStoreSet {
+		runOptions.dataStore = config.GetDataDir()
+	}
 
-	if runOptions.Config.NoVerify {
-		config.SkipVerify = true
+	switch ctx.Command.Name {
+	case "bootstrap", "daemon", "update-once":
+		if err = config.ValidateServer(); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	env := installer.NewEnvironment(new(system.OsCalls))
@@ -447,7 +518,7 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 		return err
 	}
 
-	app.DeploymentLogger = app.NewDeploymentLogManager(runOptions.dataStore)
+	app.DeploymentLogger = app.NewDeploymentLogManager(config.GetDeploymentLogLocation())
 
 	// Execute commands
 	switch ctx.Command.Name {
@@ -456,6 +527,7 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 		"show-provides",
 		"install",
 		"commit",
+		"restore-previous",
 		"rollback":
 		return handleArtifactOperations(ctx, *runOptions, dualRootfsDevice, config)
 
@@ -468,7 +540,23 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 			return err
 		}
 		defer d.Cleanup()
-		return runDaemon(d)
+		return runDaemon(d, func() (*conf.MenderConfig, error) {
+			config, err := runOptions.loadConfig()
+			if err != nil {
+				return nil, err
+			}
+			if err = config.Validate(); err != nil {
+				return nil, err
+			}
+			return config, config.ValidateServer()
+		})
+	case "update-once":
+		d, err := initDaemon(config, dualRootfsDevice, runOptions)
+		if err != nil {
+			return err
+		}
+		defer d.Cleanup()
+		return d.RunOnce()
 	case "setup":
 		// Check that user has permission to directories so that
 		// the user doesn't have to perform the setup before raising
@@ -604,6 +692,16 @@ func (runOptions *runOptionsType) handleLogFlags(ctx *cli.Context) error {
 		log.SetReportCaller(true)
 	}
 
+	switch runOptions.logOptions.logFormat {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errors.Errorf("Unknown log format %q; must be text or json",
+			runOptions.logOptions.logFormat)
+	}
+
 	if ctx.IsSet("log-file") {
 		fd, err := os.Create(runOptions.logOptions.logFile)
 		if err != nil {
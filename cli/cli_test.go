@@ -97,6 +97,9 @@ func TestRunDaemon(t *testing.T) {
 		"send-inventory": {
 			signal: syscall.SIGUSR2,
 		},
+		"reload-config": {
+			signal: syscall.SIGHUP,
+		},
 	}
 	config := conf.MenderConfig{
 		MenderConfigFromFile: conf.MenderConfigFromFile{
@@ -128,9 +131,14 @@ func TestRunDaemon(t *testing.T) {
 			},
 			Store:        ds,
 			ForceToState: make(chan app.State, 1),
+			ReloadConfig: make(chan *conf.MenderConfig, 1),
 		}
+		reloaded := config
+		reloaded.UpdatePollIntervalSeconds = 42
 		go func() {
-			err := runDaemon(td)
+			err := runDaemon(td, func() (*conf.MenderConfig, error) {
+				return &reloaded, nil
+			})
 			require.Nil(t, err, "Daemon returned with an error code")
 		}()
 
@@ -146,6 +154,9 @@ func TestRunDaemon(t *testing.T) {
 		time.Sleep(time.Second * 1)
 		td.StopDaemon()
 		assert.True(t, testLogContainsMessage(hook.AllEntries(), "Forced wake-up"), name+" signal did not force daemon from sleep")
+		if test.signal == syscall.SIGHUP {
+			assert.Equal(t, 42*time.Second, mender.GetUpdatePollInterval())
+		}
 
 	}
 }
@@ -191,6 +202,22 @@ func TestLoggingOptions(t *testing.T) {
 	err = SetupCLI([]string{"mender", "-no-syslog"})
 	// Just check that the flag can be specified.
 	assert.True(t, err == nil)
+
+	err = SetupCLI([]string{"mender", "--log-format", "xml"})
+	assert.Error(t, err)
+
+	defer os.Remove("test.json")
+	SetupCLI([]string{"mender", "--log-format", "json", "-log-file", "test.json"})
+	log.WithField("deployment_id", "foo").Errorln("Should be a JSON record")
+	log.SetFormatter(&log.TextFormatter{})
+	data, err := ioutil.ReadFile("test.json")
+	require.NoError(t, err)
+	var record map[string]interface{}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &record))
+	assert.Equal(t, "Should be a JSON record", record["msg"])
+	assert.Equal(t, "error", record["level"])
+	assert.Equal(t, "foo", record["deployment_id"])
 }
 
 func TestVersion(t *testing.T) {
@@ -222,6 +249,31 @@ func TestVersion(t *testing.T) {
 		"unexpected version output '%s' expected '%s'", string(data), expected)
 }
 
+func TestVersionCommand(t *testing.T) {
+	oldVersion, oldCommit, oldDate := conf.Version, conf.GitCommit, conf.BuildDate
+	defer func() {
+		conf.Version, conf.GitCommit, conf.BuildDate = oldVersion, oldCommit, oldDate
+	}()
+	conf.Version = "2.4.0"
+	conf.GitCommit = "1e46f84"
+	conf.BuildDate = "2020-09-01"
+
+	oldstdout := os.Stdout
+	tfile, err := ioutil.TempFile("", "mendertest")
+	require.NoError(t, err)
+	defer os.Remove(tfile.Name())
+	os.Stdout = tfile
+	err = SetupCLI([]string{"mender", "version"})
+	os.Stdout = oldstdout
+	assert.NoError(t, err)
+
+	tfile.Seek(0, 0)
+	data, _ := ioutil.ReadAll(tfile)
+	tfile.Close()
+	assert.Equal(t, "version: 2.4.0\ncommit: 1e46f84\nbuild date: 2020-09-01\n"+
+		"runtime: "+runtime.Version()+"\n", string(data))
+}
+
 func writeConfig(t *testing.T, path string, config conf.MenderConfig) {
 	cf, err := os.Create(path)
 	assert.NoError(t, err)
@@ -520,6 +572,69 @@ func TestInvalidServerCertificateBoot(t *testing.T) {
 	assert.True(t, testLogContainsMessage(hook.AllEntries(), "IGNORING ERROR"))
 }
 
+func TestPrepareDataDir(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "datadir-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	// Created, only accessible by its owner.
+	dataDir := path.Join(tdir, "var", "lib", "mender")
+	require.NoError(t, prepareDataDir(dataDir))
+	stat, err := os.Stat(dataDir)
+	require.NoError(t, err)
+	assert.True(t, stat.IsDir())
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	// Existing directories are left as they are.
+	require.NoError(t, os.Chmod(dataDir, 0755))
+	assert.NoError(t, prepareDataDir(dataDir))
+
+	// Unless anybody may write to them.
+	require.NoError(t, os.Chmod(dataDir, 0777))
+	err = prepareDataDir(dataDir)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "world-writable")
+
+	file := path.Join(tdir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	assert.Error(t, prepareDataDir(file))
+}
+
+func TestLoadConfigCommandLineOverrides(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	config := conf.NewMenderConfig()
+	config.ServerURL = "https://hosted.mender.io"
+	config.DataDir = path.Join(tdir, "from-config")
+	cpath := path.Join(tdir, "mender.conf")
+	writeConfig(t, cpath, *config)
+
+	runOptions := &runOptionsType{
+		config:         cpath,
+		fallbackConfig: path.Join(tdir, "does-not-exist.conf"),
+		dataStore:      path.Join(tdir, "from-flag"),
+		dataStoreSet:   true,
+		dryRun:         true,
+	}
+	runOptions.Config.NoVerify = true
+
+	// Reloading the configuration keeps what the flags override.
+	for i := 0; i < 2; i++ {
+		loaded, err := runOptions.loadConfig()
+		require.NoError(t, err)
+		assert.Equal(t, path.Join(tdir, "from-flag"), loaded.DataDir)
+		assert.True(t, loaded.DryRun)
+		assert.True(t, loaded.SkipVerify)
+	}
+
+	runOptions.dataStoreSet = false
+	loaded, err := runOptions.loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(tdir, "from-config"), loaded.DataDir)
+}
+
 func TestIgnoreServerConfigVerification(t *testing.T) {
 	// Config with invalid Server fields
 	config := conf.NewMenderConfig()
@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mendersoftware/mender/app"
 	"github.com/mendersoftware/mender/client"
@@ -30,6 +31,7 @@ import (
 	dev "github.com/mendersoftware/mender/device"
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/system"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
@@ -40,6 +42,7 @@ type logOptionsType struct {
 	logLevel   string
 	logModules string
 	logFile    string
+	logFormat  string
 	noSyslog   bool
 }
 
@@ -47,12 +50,14 @@ type runOptionsType struct {
 	config         string
 	fallbackConfig string
 	dataStore      string
+	dataStoreSet   bool // Whether --data was given, overriding the configuration
 	imageFile      string
 	bootstrapForce bool
 	client.Config
 	logOptions     logOptionsType
 	setupOptions   setupOptionsType // Options for setup subcommand
 	rebootExitCode bool
+	dryRun         bool
 }
 
 var out io.Writer = os.Stdout
@@ -61,21 +66,29 @@ var (
 	errArtifactNameEmpty = errors.New("The Artifact name is empty. Please set a valid name for the Artifact!")
 )
 
+// prepareDataDir creates the data directory, only accessible by its owner, if
+// it does not exist. One which anybody may write to is refused, since the
+// client trusts the keys and state it finds there.
+func prepareDataDir(dir string) error {
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0700)
+	} else if err != nil {
+		return errors.Wrapf(err, "Could not stat data directory: %s", dir)
+	} else if !stat.IsDir() {
+		return errors.Errorf("%s is not a directory", dir)
+	} else if stat.Mode().Perm()&0002 != 0 {
+		return errors.Errorf("Data directory %s must not be world-writable", dir)
+	}
+	return nil
+}
+
 func commonInit(config *conf.MenderConfig, opts *runOptionsType) (*app.MenderPieces, error) {
 
 	tentok := config.GetTenantToken()
 
-	stat, err := os.Stat(opts.dataStore)
-	if os.IsNotExist(err) {
-		// Create data directory if it does not exist.
-		err = os.MkdirAll(opts.dataStore, 0700)
-		if err != nil {
-			return nil, err
-		}
-	} else if err != nil {
-		return nil, errors.Wrapf(err, "Could not stat data directory: %s", opts.dataStore)
-	} else if !stat.IsDir() {
-		return nil, errors.Errorf("%s is not a directory", opts.dataStore)
+	if err := prepareDataDir(opts.dataStore); err != nil {
+		return nil, err
 	}
 
 	var (
@@ -107,15 +120,17 @@ func commonInit(config *conf.MenderConfig, opts *runOptionsType) (*app.MenderPie
 		return nil, errors.New("failed to setup key storage")
 	}
 
-	dbstore := store.NewDBStore(opts.dataStore)
-	if dbstore == nil {
+	db := store.NewDBStore(opts.dataStore)
+	if db == nil {
 		return nil, errors.New("failed to initialize DB store")
 	}
+	// Carry on in memory should the data partition be read-only.
+	dbstore := store.NewFallbackStore(db)
 
 	authmgr := app.NewAuthManager(app.AuthManagerConfig{
 		AuthDataStore:  dbstore,
 		KeyStore:       ks,
-		IdentitySource: dev.NewIdentityDataGetter(),
+		IdentitySource: dev.NewIdentityDataGetter(config),
 		TenantToken:    tentok,
 	})
 	if authmgr == nil {
@@ -204,6 +219,16 @@ func handleArtifactOperations(ctx *cli.Context, runOptions runOptionsType,
 	case "rollback":
 		return app.DoStandaloneRollback(deviceManager, stateExec)
 
+	case "restore-previous":
+		rebooter, err := app.NewRebooter(config, system.OsCalls{})
+		if err != nil {
+			return err
+		}
+		if err = app.DoRestorePrevious(deviceManager); err != nil {
+			return err
+		}
+		return rebooter.Reboot()
+
 	default:
 		return errors.New("handleArtifactOperations: Should never get here")
 	}
@@ -219,6 +244,12 @@ func initDaemon(config *conf.MenderConfig,
 	}
 	mp.DualRootfsDevice = dev
 
+	rebooter, err := app.NewRebooter(config, system.OsCalls{})
+	if err != nil {
+		mp.Store.Close()
+		return nil, err
+	}
+
 	controller, err := app.NewMender(config, *mp)
 	if err != nil {
 		mp.Store.Close()
@@ -230,6 +261,10 @@ func initDaemon(config *conf.MenderConfig,
 	}
 
 	daemon := app.NewDaemon(controller, mp.Store)
+	daemon.Sctx.Rebooter = rebooter
+	daemon.StopTimeout = time.Duration(config.StopTimeoutSeconds) * time.Second
+	daemon.MetricsAddress = config.MetricsListenAddress
+	daemon.ControlAddress = config.ControlAPIAddress
 
 	// add logging hook; only daemon needs this
 	log.AddHook(app.NewDeploymentLogHook(app.DeploymentLogger))
@@ -264,31 +299,70 @@ func PrintProvides(device *dev.DeviceManager) error {
 	return nil
 }
 
-func runDaemon(d *app.MenderDaemon) error {
+// runDaemon runs the daemon until it stops. loadConfig is used to read the
+// configuration again on SIGHUP.
+func runDaemon(d *app.MenderDaemon, loadConfig func() (*conf.MenderConfig, error)) error {
+	shutdownErr := make(chan error, 1)
 	// Handle user forcing update check.
 	go func() {
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, syscall.SIGUSR1) // SIGUSR1 forces an update check.
 		signal.Notify(c, syscall.SIGUSR2) // SIGUSR2 forces an inventory update.
 		signal.Notify(c, syscall.SIGTERM) // SIGTERM marks the exit.
+		signal.Notify(c, syscall.SIGHUP)  // SIGHUP reloads the configuration.
 		defer signal.Stop(c)
 
 		for {
 			s := <-c // Block until a signal is received.
 			if s == syscall.SIGUSR1 {
 				log.Debug("SIGUSR1 signal received.")
-				d.ForceToState <- app.States.UpdateCheck
+				d.ForceUpdateCheck()
+				continue
 			} else if s == syscall.SIGUSR2 {
 				log.Debug("SIGUSR2 signal received.")
-				d.ForceToState <- app.States.InventoryUpdate
+				d.ForceInventoryUpdate()
+				continue
+			} else if s == syscall.SIGHUP {
+				log.Info("SIGHUP signal received, reloading the configuration.")
+				config, err := loadConfig()
+				if err != nil {
+					log.Errorf("Failed to reload the configuration; "+
+						"keeping the running one: %s", err)
+					continue
+				}
+				// Replace a configuration which is yet to be applied.
+				select {
+				case <-d.ReloadConfig:
+				default:
+				}
+				d.ReloadConfig <- config
 			} else if s == syscall.SIGTERM {
-				d.StopDaemon()
+				go func() {
+					shutdownErr <- d.Shutdown()
+				}()
+				continue
+			}
+			select {
+			case d.Sctx.WakeupChan <- true:
+				log.Debug("Sent wake up!")
+			default:
 			}
-			d.Sctx.WakeupChan <- true
-			log.Debug("Sent wake up!")
 		}
 	}()
-	return d.Run()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- d.Run()
+	}()
+	select {
+	case err := <-runErr:
+		return err
+	case err := <-shutdownErr:
+		if err != nil {
+			return errors.Wrap(err, "shutdown was not clean")
+		}
+		return <-runErr
+	}
 }
 
 // updateCheck sends a SIGUSR{1,2} signal to the running mender daemon.
@@ -0,0 +1,177 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/system"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// How much room the data directory needs at the least, for the database, the
+// deployment logs and the state of an update.
+const minDataDirFreeSpace = 10 * 1024 * 1024
+
+// selfTestDevice is what the self-test asks the dual rootfs device.
+type selfTestDevice interface {
+	GetInactive() (string, error)
+	installer.FreeSpaceReporter
+}
+
+// selfTest checks whether the device is ready to run the client. Everything
+// it checks with can be replaced, so that tests do not need a real device or
+// server.
+type selfTest struct {
+	loadConfig func() (*conf.MenderConfig, error)
+	// Does a TLS handshake with the server, and authorizes.
+	authorize func(config *conf.MenderConfig) error
+	// Returns nil if there is no dual rootfs configuration.
+	device    func(config *conf.MenderConfig) selfTestDevice
+	freeSpace func(dir string) (uint64, error)
+}
+
+func newSelfTest(runOptions *runOptionsType) *selfTest {
+	return &selfTest{
+		loadConfig: func() (*conf.MenderConfig, error) {
+			config, err := runOptions.loadConfig()
+			if err != nil {
+				return nil, err
+			}
+			if !runOptions.dataStoreSet {
+				runOptions.dataStore = config.GetDataDir()
+			}
+			return config, nil
+		},
+		authorize: func(config *conf.MenderConfig) error {
+			return doBootstrapAuthorize(config, runOptions)
+		},
+		device: func(config *conf.MenderConfig) selfTestDevice {
+			device := installer.NewDualRootfsDevice(
+				installer.NewEnvironment(new(system.OsCalls)),
+				new(system.OsCalls), config.GetDeviceConfig())
+			if device == nil {
+				return nil
+			}
+			return device
+		},
+		freeSpace: func(dir string) (uint64, error) {
+			var stat syscall.Statfs_t
+			if err := syscall.Statfs(dir, &stat); err != nil {
+				return 0, err
+			}
+			return stat.Bavail * uint64(stat.Bsize), nil
+		},
+	}
+}
+
+// selfTestSkipped is returned by checks which do not apply, or cannot be done.
+type selfTestSkipped string
+
+func (s selfTestSkipped) Error() string {
+	return string(s)
+}
+
+// Run does every check, writes a report of them to w, and fails if any of
+// them did.
+func (s *selfTest) Run(w io.Writer) error {
+	var failed, total int
+	report := func(name string, err error) {
+		total++
+		switch err.(type) {
+		case nil:
+			fmt.Fprintf(w, "PASS  %s\n", name)
+		case selfTestSkipped:
+			fmt.Fprintf(w, "SKIP  %s: %s\n", name, err)
+		default:
+			fmt.Fprintf(w, "FAIL  %s: %s\n", name, err)
+			failed++
+		}
+	}
+
+	config, err := s.loadConfig()
+	if err == nil {
+		err = config.Validate()
+	}
+	if err == nil {
+		err = config.ValidateServer()
+	}
+	report("configuration", err)
+
+	if err != nil {
+		skipped := selfTestSkipped("needs a valid configuration")
+		for _, name := range []string{"data directory", "server",
+			"inactive partition", "free space"} {
+			report(name, skipped)
+		}
+	} else {
+		dataDir := config.GetDataDir()
+		report("data directory", checkWritePermissions(dataDir))
+		report("server", s.authorize(config))
+		device := s.device(config)
+		report("inactive partition", checkInactivePartition(device))
+		report("free space", s.checkFreeSpace(dataDir))
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d self-test checks failed", failed, total)
+	}
+	return nil
+}
+
+func checkInactivePartition(device selfTestDevice) error {
+	if device == nil {
+		return selfTestSkipped("no dual rootfs configuration")
+	}
+	inactive, err := device.GetInactive()
+	if err != nil {
+		return err
+	}
+	if _, err := device.FreeSpace(); err != nil {
+		return errors.Wrapf(err, "could not get the size of %s", inactive)
+	}
+	return nil
+}
+
+func (s *selfTest) checkFreeSpace(dataDir string) error {
+	free, err := s.freeSpace(dataDir)
+	if err != nil {
+		return errors.Wrapf(err, "could not get the free space in %s", dataDir)
+	}
+	if free < minDataDirFreeSpace {
+		return errors.Errorf("only %d bytes are free in %s; at least %d are needed",
+			free, dataDir, minDataDirFreeSpace)
+	}
+	return nil
+}
+
+func (runOptions *runOptionsType) selfTestHandler(ctx *cli.Context) error {
+	if ctx.Args().Len() > 0 {
+		return errors.Errorf(
+			errMsgAmbiguousArgumentsGivenF,
+			ctx.Args().First())
+	}
+	if !ctx.IsSet("log-level") {
+		log.SetLevel(log.WarnLevel)
+	}
+	runOptions.dataStoreSet = ctx.IsSet("data")
+	return newSelfTest(runOptions).Run(out)
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/conf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSelfTestDevice struct {
+	inactiveErr  error
+	freeSpaceErr error
+}
+
+func (f fakeSelfTestDevice) GetInactive() (string, error) {
+	return "/dev/mmcblk0p3", f.inactiveErr
+}
+
+func (f fakeSelfTestDevice) FreeSpace() (uint64, error) {
+	return 1 << 30, f.freeSpaceErr
+}
+
+func TestSelfTest(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "TestSelfTest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	newConfig := func() *conf.MenderConfig {
+		config := conf.NewMenderConfig()
+		config.Servers = []client.MenderServer{{ServerURL: "https://localhost"}}
+		config.DataDir = tdir
+		return config
+	}
+	passing := func() *selfTest {
+		return &selfTest{
+			loadConfig: func() (*conf.MenderConfig, error) {
+				return newConfig(), nil
+			},
+			authorize: func(*conf.MenderConfig) error { return nil },
+			device: func(*conf.MenderConfig) selfTestDevice {
+				return fakeSelfTestDevice{}
+			},
+			freeSpace: func(string) (uint64, error) { return 1 << 30, nil },
+		}
+	}
+
+	tests := map[string]struct {
+		change func(s *selfTest)
+		report string
+	}{
+		"ready": {
+			change: func(*selfTest) {},
+			report: "PASS  configuration\n" +
+				"PASS  data directory\n" +
+				"PASS  server\n" +
+				"PASS  inactive partition\n" +
+				"PASS  free space\n",
+		},
+		"unreadable configuration": {
+			change: func(s *selfTest) {
+				s.loadConfig = func() (*conf.MenderConfig, error) {
+					return nil, errors.New("broken JSON")
+				}
+			},
+			report: "FAIL  configuration: broken JSON\n" +
+				"SKIP  data directory: needs a valid configuration\n" +
+				"SKIP  server: needs a valid configuration\n" +
+				"SKIP  inactive partition: needs a valid configuration\n" +
+				"SKIP  free space: needs a valid configuration\n",
+		},
+		"no server": {
+			change: func(s *selfTest) {
+				s.loadConfig = func() (*conf.MenderConfig, error) {
+					config := newConfig()
+					config.Servers = nil
+					return config, nil
+				}
+			},
+			report: "FAIL  configuration: Invalid server URL",
+		},
+		"server unreachable": {
+			change: func(s *selfTest) {
+				s.authorize = func(*conf.MenderConfig) error {
+					return errors.New("x509: certificate signed by unknown authority")
+				}
+			},
+			report: "FAIL  server: x509: certificate signed by unknown authority\n",
+		},
+		"no data directory": {
+			change: func(s *selfTest) {
+				s.loadConfig = func() (*conf.MenderConfig, error) {
+					config := newConfig()
+					config.DataDir = path.Join(tdir, "file", "data")
+					return config, nil
+				}
+			},
+			report: "FAIL  data directory: ",
+		},
+		"unknown inactive partition": {
+			change: func(s *selfTest) {
+				s.device = func(*conf.MenderConfig) selfTestDevice {
+					return fakeSelfTestDevice{inactiveErr: errors.New("no match")}
+				}
+			},
+			report: "FAIL  inactive partition: no match\n",
+		},
+		"unreadable partition size": {
+			change: func(s *selfTest) {
+				s.device = func(*conf.MenderConfig) selfTestDevice {
+					return fakeSelfTestDevice{freeSpaceErr: errors.New("no such device")}
+				}
+			},
+			report: "FAIL  inactive partition: could not get the size of " +
+				"/dev/mmcblk0p3: no such device\n",
+		},
+		"no dual rootfs": {
+			change: func(s *selfTest) {
+				s.device = func(*conf.MenderConfig) selfTestDevice { return nil }
+			},
+			report: "SKIP  inactive partition: no dual rootfs configuration\n",
+		},
+		"disk full": {
+			change: func(s *selfTest) {
+				s.freeSpace = func(string) (uint64, error) { return 4096, nil }
+			},
+			report: "FAIL  free space: only 4096 bytes are free",
+		},
+	}
+	// A file where the data directory would have to be created.
+	require.NoError(t, ioutil.WriteFile(path.Join(tdir, "file"), nil, 0600))
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := passing()
+			test.change(s)
+			var report bytes.Buffer
+			err := s.Run(&report)
+			assert.Contains(t, report.String(), test.report)
+			if bytes.Contains(report.Bytes(), []byte("FAIL")) {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -94,7 +94,7 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 	log.Debugf("Got response: %v", rsp)
 
 	switch rsp.StatusCode {
-	case http.StatusUnauthorized:
+	case http.StatusUnauthorized, http.StatusForbidden:
 		return nil, NewAPIError(AuthErrorUnauthorized, rsp)
 	case http.StatusOK:
 		log.Debugf("Receive response data")
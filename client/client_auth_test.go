@@ -15,14 +15,17 @@ package client
 
 import (
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/mendersoftware/openssl"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testAuthDataMessenger struct {
@@ -121,6 +124,18 @@ func TestClientAuth(t *testing.T) {
 	responder.httpStatus = 401
 	_, err = client.Request(ac, ts.URL, msger)
 	assert.Error(t, err)
+	assert.Equal(t, AuthErrorUnauthorized, errors.Cause(err))
+
+	// A rejected device is told apart from other failures however the
+	// server turns it down.
+	responder.httpStatus = http.StatusForbidden
+	_, err = client.Request(ac, ts.URL, msger)
+	assert.Equal(t, AuthErrorUnauthorized, errors.Cause(err))
+
+	responder.httpStatus = http.StatusInternalServerError
+	_, err = client.Request(ac, ts.URL, msger)
+	assert.Error(t, err)
+	assert.NotEqual(t, AuthErrorUnauthorized, errors.Cause(err))
 }
 
 func TestClientAuthExpiredCert(t *testing.T) {
@@ -177,6 +192,60 @@ func TestClientAuthUnknownAuthorityCert(t *testing.T) {
 	assert.Nil(t, rsp)
 }
 
+func TestClientAuthServerCertificateBundle(t *testing.T) {
+	ts := startTestHTTPS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "foobar-token")
+	}),
+		localhostCert,
+		localhostKey)
+	defer ts.Close()
+
+	tdir, err := ioutil.TempDir("", "TestClientAuthServerCertificateBundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	other, err := ioutil.ReadFile("testdata/server.unknown-authority.crt")
+	require.NoError(t, err)
+	server, err := ioutil.ReadFile("testdata/server.crt")
+	require.NoError(t, err)
+
+	authorize := func(config Config) error {
+		config.IsHttps = true
+		ac, err := NewApiClient(config)
+		require.NoError(t, err)
+		_, err = NewAuth().Request(ac, ts.URL, &testAuthDataMessenger{
+			reqData: []byte("foobar"),
+		})
+		return err
+	}
+
+	// The certificate which the server is signed with need not be the
+	// first one in the bundle.
+	bundle := path.Join(tdir, "bundle.crt")
+	require.NoError(t, ioutil.WriteFile(bundle, append(append([]byte{}, other...),
+		server...), 0644))
+	assert.NoError(t, authorize(Config{ServerCert: bundle}))
+	assert.NoError(t, authorize(Config{ServerCert: bundle, IgnoreSystemCerts: true}))
+
+	// Neither do the files in a directory need to be named after their
+	// hashes.
+	certDir := path.Join(tdir, "certs")
+	require.NoError(t, os.Mkdir(certDir, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(certDir, "other.pem"), other, 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(certDir, "README"),
+		[]byte("Not a certificate"), 0644))
+	assert.Error(t, authorize(Config{ServerCert: certDir}))
+
+	require.NoError(t, ioutil.WriteFile(path.Join(certDir, "server.crt"), server, 0644))
+	assert.NoError(t, authorize(Config{ServerCert: certDir}))
+	assert.NoError(t, authorize(Config{ServerCert: certDir, IgnoreSystemCerts: true}))
+
+	// The server is not trusted by a directory without any certificates.
+	emptyDir := path.Join(tdir, "empty")
+	require.NoError(t, os.Mkdir(emptyDir, 0755))
+	assert.Error(t, authorize(Config{ServerCert: emptyDir}))
+}
+
 //X509_V_ERR_DEPTH_ZERO_SELF_SIGNED_CERT
 func TestClientAuthDepthZeroSelfSignedCert(t *testing.T) {
 	if openssl.GetSecurityLevelGlobal() < 2 {
@@ -19,8 +19,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mendersoftware/mender/datastore"
@@ -39,10 +45,94 @@ type Updater interface {
 
 var (
 	ErrNotAuthorized = errors.New("client not authorized")
+	// Returned when an Artifact download is, or turns out to be, larger
+	// than the maximum set with SetMaxArtifactSize.
+	ErrArtifactTooLarge = errors.New("Artifact is larger than the maximum allowed size")
 )
 
+// TooManyRequestsError is returned when the server is too busy to answer an
+// update check (HTTP 429), and asks not to be asked again for RetryAfter.
+type TooManyRequestsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyRequestsError) Error() string {
+	if e.RetryAfter == 0 {
+		return "the server is busy"
+	}
+	return fmt.Sprintf("the server is busy; retry after %s", e.RetryAfter)
+}
+
+// DecommissionedError is returned when the server answers an update check by
+// taking the device out of service. Wipe asks for the state the client keeps
+// to be removed too.
+type DecommissionedError struct {
+	Wipe bool `json:"wipe"`
+}
+
+func (e *DecommissionedError) Error() string {
+	return "the server has decommissioned the device"
+}
+
+func newTooManyRequestsError(r *http.Response) *TooManyRequestsError {
+	return &TooManyRequestsError{
+		RetryAfter: parseRetryAfter(r.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter returns how long from now a Retry-After header, either a
+// number of seconds or an HTTP date, asks to wait. It is 0 if the header is
+// missing or malformed, or the date has passed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		log.Warnf("Ignoring malformed Retry-After header: %q", value)
+		return 0
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait.Round(time.Second)
+	}
+	return 0
+}
+
 type UpdateClient struct {
 	minImageSize int64
+	// Credentials for downloads from Artifact storage.
+	storageCredentials []StorageCredentials
+	// See SetMaxResumes.
+	maxResumes int
+	// See SetMaxArtifactSize.
+	maxArtifactSize int64
+	// See SetLocalSources.
+	localSources bool
+	// See SetETag.
+	etag string
+}
+
+// StorageCredentials are basic auth credentials sent along with Artifact
+// downloads from hosts which match HostPattern, a shell pattern such as
+// "*.s3.example.com". They are never sent to the Mender server itself.
+type StorageCredentials struct {
+	HostPattern string
+	Username    string
+	Password    string
+}
+
+// String leaves the password out, so that logging the configuration does not
+// give it away.
+func (c StorageCredentials) String() string {
+	return fmt.Sprintf("{%s %s ********}", c.HostPattern, c.Username)
+}
+
+func (c StorageCredentials) GoString() string {
+	return fmt.Sprintf("client.StorageCredentials{HostPattern:%q, Username:%q, Password:\"********\"}",
+		c.HostPattern, c.Username)
 }
 
 func NewUpdate() *UpdateClient {
@@ -52,12 +142,80 @@ func NewUpdate() *UpdateClient {
 	return &up
 }
 
+// SetStorageCredentials sets the basic auth credentials to download Artifacts
+// with. The first entry whose pattern matches the host is used.
+func (u *UpdateClient) SetStorageCredentials(credentials []StorageCredentials) {
+	u.storageCredentials = credentials
+}
+
+// SetMaxResumes limits how many times a download which breaks off is
+// continued. There is no limit if it is 0.
+func (u *UpdateClient) SetMaxResumes(maxResumes int) {
+	u.maxResumes = maxResumes
+}
+
+// SetMaxArtifactSize makes downloads of Artifacts larger than maxSize bytes
+// fail, whether the server says so up front or not. There is no limit if it
+// is 0.
+func (u *UpdateClient) SetMaxArtifactSize(maxSize int64) {
+	u.maxArtifactSize = maxSize
+}
+
+// SetLocalSources lets FetchUpdate read Artifacts from file:// and unix://
+// URLs, for gateways where a program on the device hands over the Artifacts.
+// It is off by default, since the URLs come from the server.
+func (u *UpdateClient) SetLocalSources(allow bool) {
+	u.localSources = allow
+}
+
+// SetETag sets the ETag of the last answer to an update check, which is sent
+// along with the next one, so that the server can answer it with 304 Not
+// Modified if nothing has changed. Only answers that there is no update have
+// one kept; an update is acted on long before the next check.
+func (u *UpdateClient) SetETag(etag string) {
+	u.etag = etag
+}
+
+// ETag returns the ETag of the last answer to an update check, if it is to be
+// sent along with the next one.
+func (u *UpdateClient) ETag() string {
+	return u.etag
+}
+
+// rememberETag keeps the ETag of the answer r to an update check, if it says
+// that there is no update.
+func (u *UpdateClient) rememberETag(r *http.Response) {
+	switch r.StatusCode {
+	case http.StatusNoContent:
+		u.etag = r.Header.Get("ETag")
+	case http.StatusNotModified:
+		if etag := r.Header.Get("ETag"); etag != "" {
+			u.etag = etag
+		}
+	default:
+		u.etag = ""
+	}
+}
+
+func (u *UpdateClient) storageCredentialsFor(host string) *StorageCredentials {
+	for i := range u.storageCredentials {
+		if match, _ := path.Match(u.storageCredentials[i].HostPattern, host); match {
+			return &u.storageCredentials[i]
+		}
+	}
+	return nil
+}
+
 // CurrentUpdate describes currently installed update. Non empty fields will be
 // used when querying for the next update.
 type CurrentUpdate struct {
-	Artifact   string
-	DeviceType string
-	Provides   map[string]string
+	Artifact string
+	// Version of the installed Artifact, if known
+	ArtifactVersion string
+	DeviceType      string
+	// Update channel of the device, if any
+	Channel  string
+	Provides map[string]string
 }
 
 func (u *CurrentUpdate) MarshalJSON() ([]byte, error) {
@@ -65,7 +223,13 @@ func (u *CurrentUpdate) MarshalJSON() ([]byte, error) {
 		u.Provides = make(map[string]string)
 	}
 	u.Provides["artifact_name"] = u.Artifact
+	if u.ArtifactVersion != "" {
+		u.Provides["artifact_version"] = u.ArtifactVersion
+	}
 	u.Provides["device_type"] = u.DeviceType
+	if u.Channel != "" {
+		u.Provides["channel"] = u.Channel
+	}
 	return json.Marshal(u.Provides)
 }
 
@@ -86,6 +250,10 @@ func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessing
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create update check request")
 	}
+	if u.etag != "" {
+		postReq.Header.Set("If-None-Match", u.etag)
+		getReq.Header.Set("If-None-Match", u.etag)
+	}
 
 	r, err := api.Do(postReq)
 	if err != nil {
@@ -95,13 +263,22 @@ func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessing
 
 	defer r.Body.Close()
 
-	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusNoContent {
+	// Asking again with GET would only add to the load.
+	if r.StatusCode == http.StatusTooManyRequests {
+		return nil, newTooManyRequestsError(r)
+	}
+
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusNoContent &&
+		r.StatusCode != http.StatusNotModified {
 
 		// Fall back to the GET (Open-Source) functionality on all error codes
 		if r.StatusCode >= 400 && r.StatusCode < 600 {
 
 			log.Debugf("device provides not accepted by the server. Response code: %d", r.StatusCode)
 
+			// Done with the response, so that the GET can reuse its
+			// connection.
+			r.Body.Close()
 			r, err = api.Do(getReq)
 
 			if err != nil {
@@ -111,6 +288,10 @@ func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessing
 
 			defer r.Body.Close()
 
+			if r.StatusCode == http.StatusTooManyRequests {
+				return nil, newTooManyRequestsError(r)
+			}
+
 		} else {
 			return nil, fmt.Errorf("failed to post update info to the server. Response: %v", r)
 		}
@@ -127,6 +308,7 @@ func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessing
 		r.Body = ioutil.NopCloser(bytes.NewReader(respdata))
 		return data, NewAPIError(err, r)
 	}
+	u.rememberETag(r)
 	return data, err
 }
 
@@ -136,6 +318,15 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Du
 	if err != nil {
 		return nil, -1, errors.Wrapf(err, "failed to create update fetch request")
 	}
+	if req.URL.Scheme == "file" || req.URL.Scheme == "unix" {
+		return u.fetchLocalUpdate(req.URL)
+	}
+	if creds := u.storageCredentialsFor(req.URL.Hostname()); creds != nil {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	// Storage credentials may differ for the host a download is redirected
+	// to, typically a CDN serving the Artifacts.
+	req = withRedirectCredentials(req, u.storageCredentialsFor)
 
 	r, err := api.Do(req)
 	if err != nil {
@@ -152,25 +343,120 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Du
 		return nil, -1, err
 	}
 
-	if r.ContentLength < 0 {
-		r.Body.Close()
-		return nil, -1, errors.New("Will not continue with unknown image size.")
-	} else if r.ContentLength < u.minImageSize {
+	if err := u.checkImageSize(r.ContentLength); err != nil {
 		r.Body.Close()
-		log.Errorf("Image smaller than expected. Expected: %d, received: %d", u.minImageSize, r.ContentLength)
-		return nil, -1, errors.New("Image size is smaller than expected. Aborting.")
+		return nil, -1, err
+	}
+
+	resumer := NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req)
+	resumer.noRanges = !acceptsRanges(r)
+	resumer.maxResumes = u.maxResumes
+	resumer.maxSize = u.maxArtifactSize
+	return resumer, r.ContentLength, nil
+}
+
+func (u *UpdateClient) checkImageSize(size int64) error {
+	if size < 0 {
+		return errors.New("Will not continue with unknown image size.")
+	} else if size < u.minImageSize {
+		log.Errorf("Image smaller than expected. Expected: %d, received: %d", u.minImageSize, size)
+		return errors.New("Image size is smaller than expected. Aborting.")
+	} else if u.maxArtifactSize > 0 && size > u.maxArtifactSize {
+		return errors.Wrapf(ErrArtifactTooLarge, "%d bytes, with a maximum of %d",
+			size, u.maxArtifactSize)
 	}
+	return nil
+}
+
+// fetchLocalUpdate opens an Artifact which is handed over on the device: the
+// file of a file:// URL, or what the socket of a unix:// URL sends once it is
+// connected to, up to when it closes the connection. The size of the latter is
+// not known up front, so -1 is returned for it.
+func (u *UpdateClient) fetchLocalUpdate(source *url.URL) (io.ReadCloser, int64, error) {
+	if !u.localSources {
+		return nil, -1, errors.Errorf("fetching updates from %s:// URLs is not enabled",
+			source.Scheme)
+	}
+
+	if source.Scheme == "file" {
+		file, err := os.Open(source.Path)
+		if err != nil {
+			return nil, -1, errors.Wrap(err, "update fetch failed")
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = u.checkImageSize(info.Size())
+		}
+		if err != nil {
+			file.Close()
+			return nil, -1, err
+		}
+		return file, info.Size(), nil
+	}
+
+	conn, err := net.Dial("unix", source.Path)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "update fetch failed")
+	}
+	return &localUpdateStream{ReadCloser: conn, maxSize: u.maxArtifactSize}, -1, nil
+}
+
+// localUpdateStream cuts off a stream of unknown size beyond maxSize bytes, if
+// that is set.
+type localUpdateStream struct {
+	io.ReadCloser
+	maxSize int64
+	read    int64
+}
+
+func (s *localUpdateStream) Read(buf []byte) (int, error) {
+	n, err := s.ReadCloser.Read(buf)
+	s.read += int64(n)
+	if s.maxSize > 0 && s.read > s.maxSize {
+		return n, errors.Wrapf(ErrArtifactTooLarge, "more than %d bytes received",
+			s.maxSize)
+	}
+	return n, err
+}
 
-	return NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req), r.ContentLength, nil
+// IsTransientFetchError returns true if a failed FetchUpdate is worth retrying
+// straight away. Network errors and server side (5xx) errors may go away by
+// themselves, while any other error, most notably a 4xx response, will not.
+func IsTransientFetchError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *APIError:
+			return e.StatusCode() >= 500 && e.StatusCode() < 600
+		case net.Error:
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return false
 }
 
 func validateGetUpdate(update datastore.UpdateInfo) error {
 	// check if we have JSON data correctly decoded
-	if update.ID == "" ||
-		len(update.Artifact.CompatibleDevices) == 0 ||
-		update.Artifact.ArtifactName == "" ||
-		update.Artifact.Source.URI == "" {
-		return errors.New("Missing parameters in encoded JSON update response")
+	var missing []string
+	if update.ID == "" {
+		missing = append(missing, "id")
+	}
+	if len(update.Artifact.CompatibleDevices) == 0 {
+		missing = append(missing, "device_types_compatible")
+	}
+	if update.Artifact.ArtifactName == "" {
+		missing = append(missing, "artifact_name")
+	}
+	if update.Artifact.Source.URI == "" {
+		missing = append(missing, "uri")
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("Missing parameters in encoded JSON update response: %s",
+			strings.Join(missing, ", "))
 	}
 
 	log.Infof("Correct request for getting image from: %s [name: %v; devices: %v]",
@@ -180,21 +466,123 @@ func validateGetUpdate(update datastore.UpdateInfo) error {
 	return nil
 }
 
+// The versions of the update response which can be parsed. Servers which do
+// not give the version send the first one.
+const (
+	updateResponseV1 = 1
+	updateResponseV2 = 2
+)
+
+// updateResponseBodyV2 describes the deployment apart from the Artifact, and does
+// not nest the source of the Artifact.
+type updateResponseBodyV2 struct {
+	Deployment struct {
+		ID          string `json:"id"`
+		Force       bool   `json:"force"`
+		PauseReboot bool   `json:"pause_reboot"`
+		datastore.UpdateWindow
+	} `json:"deployment"`
+	Artifact struct {
+		Name              string            `json:"name"`
+		Group             string            `json:"group"`
+		URI               string            `json:"uri"`
+		Expire            string            `json:"expire"`
+		Checksum          string            `json:"checksum"`
+		CompatibleDevices []string          `json:"compatible_devices"`
+		Provides          map[string]string `json:"provides"`
+	} `json:"artifact"`
+}
+
+func (r *updateResponseBodyV2) updateInfo() datastore.UpdateInfo {
+	var update datastore.UpdateInfo
+	update.ID = r.Deployment.ID
+	update.Force = r.Deployment.Force
+	update.PauseReboot = r.Deployment.PauseReboot
+	update.UpdateWindow = r.Deployment.UpdateWindow
+	update.Artifact.ArtifactName = r.Artifact.Name
+	update.Artifact.ArtifactGroup = r.Artifact.Group
+	update.Artifact.Source.URI = r.Artifact.URI
+	update.Artifact.Source.Expire = r.Artifact.Expire
+	update.Artifact.Source.Checksum = r.Artifact.Checksum
+	update.Artifact.CompatibleDevices = r.Artifact.CompatibleDevices
+	update.Artifact.TypeInfoProvides = r.Artifact.Provides
+	return update
+}
+
+// parseUpdateResponse decodes the update response in body, in whichever
+// version the server sent it.
+func parseUpdateResponse(body []byte) (datastore.UpdateInfo, error) {
+	var update datastore.UpdateInfo
+	var header struct {
+		Version *int `json:"version"`
+	}
+	// Tell a truncated or garbled body apart from a JSON value of the wrong
+	// shape, which the errors of Unmarshal do not make very clear.
+	if !json.Valid(body) {
+		return update, errors.New("failed to parse response: not valid JSON, " +
+			"it may have been cut off")
+	}
+	if err := json.Unmarshal(body, &header); err != nil {
+		return update, errors.Wrapf(err, "failed to parse response")
+	}
+	version := updateResponseV1
+	if header.Version != nil {
+		version = *header.Version
+	}
+
+	var err error
+	switch version {
+	case updateResponseV1:
+		err = json.Unmarshal(body, &update)
+	case updateResponseV2:
+		var rsp updateResponseBodyV2
+		if err = json.Unmarshal(body, &rsp); err == nil {
+			update = rsp.updateInfo()
+		}
+	default:
+		return update, errors.Errorf("unsupported update response version %d", version)
+	}
+	if err != nil {
+		return update, errors.Wrapf(err, "failed to parse version %d response", version)
+	}
+	return update, nil
+}
+
+// maxUpdateResponseSize bounds how much of the update check response is read;
+// a real one is a few hundred bytes.
+const maxUpdateResponseSize = 1024 * 1024
+
 func processUpdateResponse(response *http.Response) (interface{}, error) {
 	log.Debug("Received response:", response.Status)
 
-	respBody, err := ioutil.ReadAll(response.Body)
+	respBody, err := ioutil.ReadAll(io.LimitReader(response.Body, maxUpdateResponseSize+1))
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "failed to read update response")
+	}
+	if len(respBody) > maxUpdateResponseSize {
+		return nil, errors.Errorf("update response is larger than %d bytes",
+			maxUpdateResponseSize)
 	}
 
 	switch response.StatusCode {
 	case http.StatusOK:
+		if err := checkUpdateResponseBody(response, respBody); err != nil {
+			return nil, err
+		}
+
+		var directive struct {
+			Decommission *DecommissionedError `json:"decommission"`
+		}
+		if err := json.Unmarshal(respBody, &directive); err == nil &&
+			directive.Decommission != nil {
+			return nil, directive.Decommission
+		}
+
 		log.Debug("Have update available")
 
-		var data datastore.UpdateInfo
-		if err := json.Unmarshal(respBody, &data); err != nil {
-			return nil, errors.Wrapf(err, "failed to parse response")
+		data, err := parseUpdateResponse(respBody)
+		if err != nil {
+			return nil, err
 		}
 
 		if err := validateGetUpdate(data); err != nil {
@@ -204,10 +592,16 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 		return data, nil
 
 	case http.StatusNoContent:
+		// Whatever the headers say, there is no body to a 204.
 		log.Debug("No update available")
 		return nil, nil
 
-	case http.StatusUnauthorized:
+	case http.StatusNotModified:
+		// Asked for with the ETag of an answer that there is no update.
+		log.Debug("No update available; nothing has changed since the last check")
+		return nil, nil
+
+	case http.StatusUnauthorized, http.StatusForbidden:
 		log.Warn("Client not authorized to get update schedule.")
 		return nil, ErrNotAuthorized
 
@@ -217,6 +611,23 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 	}
 }
 
+// checkUpdateResponseBody makes sure that a 200 response carries JSON, so that
+// an empty reply, or a page from something in between, is not taken for an
+// update which is just missing some fields.
+func checkUpdateResponseBody(response *http.Response, body []byte) error {
+	contentType := response.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil ||
+		mediaType != "application/json" {
+		return errors.Errorf("update response has content type %q instead of "+
+			"application/json", contentType)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errors.New("update response has status 200 but no body; " +
+			"no update is given as status 204")
+	}
+	return nil
+}
+
 func makeUpdateCheckRequest(server string, current *CurrentUpdate) (*http.Request, *http.Request, error) {
 	vals := url.Values{}
 	if current.DeviceType != "" {
@@ -225,6 +636,12 @@ func makeUpdateCheckRequest(server string, current *CurrentUpdate) (*http.Reques
 	if current.Artifact != "" {
 		vals.Add("artifact_name", current.Artifact)
 	}
+	if current.ArtifactVersion != "" {
+		vals.Add("artifact_version", current.ArtifactVersion)
+	}
+	if current.Channel != "" {
+		vals.Add("channel", current.Channel)
+	}
 
 	providesBody, err := json.Marshal(current)
 	if err != nil {
@@ -260,5 +677,5 @@ func makeUpdateFetchRequest(url string) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	return req, nil
+	return WithDownloadTimeout(req), nil
 }
@@ -15,18 +15,20 @@ package client
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/mendersoftware/mender/datastore"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const correctUpdateResponse = `{
@@ -108,6 +110,60 @@ const missingNameUpdateResponse = `{
 	}
 }`
 
+const correctUpdateResponseV1 = `{
+	"version": 1,
+	"id": "deployment-123",
+	"artifact": {
+		"source": {
+			"uri": "https://menderupdate.com",
+			"expire": "2016-03-11T13:03:17.063+0000"
+		},
+		"device_types_compatible": ["BBB"],
+		"artifact_name": "myapp-release-z-build-123"
+	}
+}`
+
+const correctUpdateResponseV2 = `{
+	"version": 2,
+	"deployment": {
+		"id": "deployment-123",
+		"force": true,
+		"pause_reboot": true,
+		"valid_before": "2016-03-12T00:00:00Z"
+	},
+	"artifact": {
+		"name": "myapp-release-z-build-123",
+		"group": "myapp",
+		"uri": "https://menderupdate.com",
+		"expire": "2016-03-11T13:03:17.063+0000",
+		"checksum": "abcd",
+		"compatible_devices": ["BBB", "IS 3"],
+		"provides": {"rootfs-image.checksum": "abcd"}
+	}
+}`
+
+const missingDevicesUpdateResponseV2 = `{
+	"version": 2,
+	"deployment": {"id": "deployment-123"},
+	"artifact": {
+		"name": "myapp-release-z-build-123",
+		"uri": "https://menderupdate.com"
+	}
+}`
+
+const unknownVersionUpdateResponse = `{
+	"version": 3,
+	"id": "deployment-123",
+	"artifact": {
+		"source": {
+			"uri": "https://menderupdate.com",
+			"expire": "2016-03-11T13:03:17.063+0000"
+		},
+		"device_types_compatible": ["BBB"],
+		"artifact_name": "myapp-release-z-build-123"
+	}
+}`
+
 var updateTest = []struct {
 	responseStatusCode    int
 	responseBody          []byte
@@ -128,6 +184,10 @@ var updateTest = []struct {
 	{200, []byte(malformedUpdateResponse), true, false, 0},
 	{200, []byte(missingDevicesUpdateResponse), true, false, 0},
 	{200, []byte(missingNameUpdateResponse), true, false, 0},
+	{200, []byte(correctUpdateResponseV1), false, true, http.StatusOK},
+	{200, []byte(correctUpdateResponseV2), false, true, http.StatusOK},
+	{200, []byte(missingDevicesUpdateResponseV2), true, false, 0},
+	{200, []byte(unknownVersionUpdateResponse), true, false, 0},
 }
 
 type testReadCloser struct {
@@ -155,6 +215,7 @@ func TestParseUpdateResponse(t *testing.T) {
 
 			response := &http.Response{
 				StatusCode: tt.responseStatusCode,
+				Header:     http.Header{"Content-Type": {"application/json"}},
 				Body:       &testReadCloser{strings.NewReader(string(tt.responseBody))},
 			}
 
@@ -171,6 +232,159 @@ func TestParseUpdateResponse(t *testing.T) {
 	}
 }
 
+func TestProcessUpdateResponseNotAuthorized(t *testing.T) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		_, err := processUpdateResponse(&http.Response{
+			StatusCode: code,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		})
+		assert.Equal(t, ErrNotAuthorized, err, "status %d", code)
+	}
+}
+
+func TestProcessUpdateResponseMalformed(t *testing.T) {
+	process := func(body string) error {
+		_, err := processUpdateResponse(&http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		})
+		return err
+	}
+
+	err := process(correctUpdateResponse[:len(correctUpdateResponse)/2])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not valid JSON")
+
+	err = process(strings.Replace(correctUpdateResponse,
+		`"deployment-123"`, `123`, 1))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse")
+
+	err = process(`{"version": "2"}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse")
+
+	err = process(`{"id": "deployment-123", "artifact": {}}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "device_types_compatible, artifact_name, uri")
+
+	// Valid, but padded beyond the limit.
+	err = process(correctUpdateResponse + strings.Repeat(" ", maxUpdateResponseSize))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "larger than")
+
+	assert.NoError(t, process(correctUpdateResponse))
+}
+
+func TestProcessUpdateResponseShapes(t *testing.T) {
+	tests := map[string]struct {
+		status      int
+		contentType string
+		body        string
+		update      bool
+		err         string
+	}{
+		"update": {
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        correctUpdateResponse,
+			update:      true,
+		},
+		"update with charset": {
+			status:      http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+			body:        correctUpdateResponse,
+			update:      true,
+		},
+		"empty 200": {
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        "\n",
+			err:         "no body",
+		},
+		"wrong content type": {
+			status:      http.StatusOK,
+			contentType: "text/html",
+			body:        correctUpdateResponse,
+			err:         `content type "text/html"`,
+		},
+		"no content type": {
+			status: http.StatusOK,
+			body:   correctUpdateResponse,
+			err:    `content type ""`,
+		},
+		"no update": {
+			status: http.StatusNoContent,
+		},
+		"no update, claiming JSON": {
+			status:      http.StatusNoContent,
+			contentType: "application/json",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			if test.contentType != "" {
+				header.Set("Content-Type", test.contentType)
+			}
+			data, err := processUpdateResponse(&http.Response{
+				StatusCode: test.status,
+				Header:     header,
+				Body:       ioutil.NopCloser(strings.NewReader(test.body)),
+			})
+			if test.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.err)
+				assert.Nil(t, data)
+				return
+			}
+			require.NoError(t, err)
+			if test.update {
+				assert.IsType(t, datastore.UpdateInfo{}, data)
+			} else {
+				assert.Nil(t, data)
+			}
+		})
+	}
+}
+
+func TestParseUpdateResponseVersions(t *testing.T) {
+	v1, err := parseUpdateResponse([]byte(correctUpdateResponse))
+	require.NoError(t, err)
+	explicit, err := parseUpdateResponse([]byte(correctUpdateResponseV1))
+	require.NoError(t, err)
+	assert.Equal(t, v1, explicit)
+	assert.Equal(t, "deployment-123", v1.ID)
+	assert.Equal(t, "myapp-release-z-build-123", v1.ArtifactName())
+	assert.Equal(t, []string{"BBB"}, v1.CompatibleDevices())
+	assert.Equal(t, "https://menderupdate.com", v1.Artifact.Source.URI)
+
+	v2, err := parseUpdateResponse([]byte(correctUpdateResponseV2))
+	require.NoError(t, err)
+	assert.Equal(t, "deployment-123", v2.ID)
+	assert.True(t, v2.Force)
+	assert.True(t, v2.PauseReboot)
+	require.NotNil(t, v2.ValidBefore)
+	assert.Equal(t, time.Date(2016, 3, 12, 0, 0, 0, 0, time.UTC), v2.ValidBefore.UTC())
+	assert.Equal(t, "myapp-release-z-build-123", v2.ArtifactName())
+	assert.Equal(t, "myapp", v2.ArtifactGroup())
+	assert.Equal(t, []string{"BBB", "IS 3"}, v2.CompatibleDevices())
+	assert.Equal(t, "https://menderupdate.com", v2.Artifact.Source.URI)
+	assert.Equal(t, "2016-03-11T13:03:17.063+0000", v2.Artifact.Source.Expire)
+	assert.Equal(t, "abcd", v2.Artifact.Source.Checksum)
+	assert.Equal(t, map[string]string{"rootfs-image.checksum": "abcd"},
+		v2.Artifact.TypeInfoProvides)
+
+	_, err = parseUpdateResponse([]byte(unknownVersionUpdateResponse))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported update response version 3")
+
+	_, err = parseUpdateResponse([]byte(`{"version": "2"}`))
+	assert.Error(t, err)
+}
+
 func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 	// Test server that always responds with 200 code, and specific payload
 	ts := startTestHTTPS(
@@ -230,8 +444,8 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	// Test server that always responds with 200 code, and specific payload
 	ts := startTestHTTPS(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(200)
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
 
 			fmt.Fprint(w, correctUpdateResponse)
 		}),
@@ -334,6 +548,54 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func Test_FetchUpdate_storageCredentials(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "storage" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "some content to be fetched")
+		}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	client := NewUpdate()
+	client.minImageSize = 1
+
+	// Without credentials the storage turns the download down.
+	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	assert.Error(t, err)
+
+	// Credentials for other hosts are not sent.
+	client.SetStorageCredentials([]StorageCredentials{
+		{HostPattern: "*.example.com", Username: "storage", Password: "secret"},
+	})
+	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	assert.Error(t, err)
+
+	client.SetStorageCredentials([]StorageCredentials{
+		{HostPattern: "*.example.com", Username: "other", Password: "other"},
+		{HostPattern: "127.0.0.*", Username: "storage", Password: "secret"},
+	})
+	in, _, err := client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "some content to be fetched", string(data))
+
+	// The password stays out of the logs.
+	creds := StorageCredentials{HostPattern: "*", Username: "storage", Password: "secret"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		formatted := fmt.Sprintf(format, struct{ C []StorageCredentials }{
+			[]StorageCredentials{creds}})
+		assert.NotContains(t, formatted, "secret")
+		assert.Contains(t, formatted, "storage")
+	}
+}
+
 func Test_UpdateApiClientError(t *testing.T) {
 	client := NewUpdate()
 
@@ -391,6 +653,35 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "foo", provides["artifact_name"], string(body))
 	assert.Equal(t, "hammer", provides["device_type"], string(body))
+
+	ent_req, req, err = makeUpdateCheckRequest("http://foo.bar", &CurrentUpdate{
+		Artifact:        "foo",
+		ArtifactVersion: "1.2.3",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://foo.bar/api/devices/v1/deployments/device/deployments/next?artifact_name=foo&artifact_version=1.2.3",
+		req.URL.String())
+	body, err = ioutil.ReadAll(ent_req.Body)
+	assert.NoError(t, err)
+	provides = make(map[string]interface{})
+	err = json.Unmarshal(body, &provides)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3", provides["artifact_version"], string(body))
+	assert.NotContains(t, provides, "channel")
+
+	ent_req, req, err = makeUpdateCheckRequest("http://foo.bar", &CurrentUpdate{
+		Artifact: "foo",
+		Channel:  "beta",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://foo.bar/api/devices/v1/deployments/device/deployments/next?artifact_name=foo&channel=beta",
+		req.URL.String())
+	body, err = ioutil.ReadAll(ent_req.Body)
+	assert.NoError(t, err)
+	provides = make(map[string]interface{})
+	err = json.Unmarshal(body, &provides)
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", provides["channel"], string(body))
 }
 
 func TestGetUpdateInfo(t *testing.T) {
@@ -471,3 +762,243 @@ func TestGetUpdateInfo(t *testing.T) {
 	}
 
 }
+
+func TestGetUpdateInfoTooManyRequests(t *testing.T) {
+	requests := 0
+	ts := startTestHTTPS(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}),
+		localhostCert,
+		localhostKey)
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "testdata/server.crt", IsHttps: true},
+	)
+	assert.NoError(t, err)
+
+	_, err = NewUpdate().GetScheduledUpdate(ac, ts.URL, &CurrentUpdate{})
+	busy, ok := err.(*TooManyRequestsError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, 120*time.Second, busy.RetryAfter)
+	// No falling back to GET.
+	assert.Equal(t, 1, requests)
+}
+
+func TestGetUpdateInfoETag(t *testing.T) {
+	etag := `"v1"`
+	var sent []string
+	hasUpdate := false
+	ts := startTestHTTPS(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sent = append(sent, r.Header.Get("If-None-Match"))
+			if hasUpdate {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", `"update"`)
+				fmt.Fprint(w, correctUpdateResponse)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}),
+		localhostCert,
+		localhostKey)
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "testdata/server.crt", IsHttps: true},
+	)
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	check := func() interface{} {
+		data, err := client.GetScheduledUpdate(ac, ts.URL, &CurrentUpdate{})
+		require.NoError(t, err)
+		return data
+	}
+
+	// Unchanged since the last check, there is still no update.
+	assert.Nil(t, check())
+	assert.Equal(t, `"v1"`, client.ETag())
+	assert.Nil(t, check())
+	assert.Equal(t, []string{"", `"v1"`}, sent)
+
+	// Once it changes, the new one is sent along.
+	etag = `"v2"`
+	assert.Nil(t, check())
+	assert.Nil(t, check())
+	assert.Equal(t, []string{"", `"v1"`, `"v1"`, `"v2"`}, sent)
+
+	// An update is not kept track of.
+	hasUpdate = true
+	_, ok := check().(datastore.UpdateInfo)
+	assert.True(t, ok)
+	assert.Empty(t, client.ETag())
+	check()
+	assert.Equal(t, "", sent[len(sent)-1])
+}
+
+func TestProcessUpdateResponseNotModified(t *testing.T) {
+	data, err := processUpdateResponse(&http.Response{
+		StatusCode: http.StatusNotModified,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestGetUpdateInfoDecommission(t *testing.T) {
+	ts := startTestHTTPS(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"decommission": {"wipe": true}}`)
+		}),
+		localhostCert,
+		localhostKey)
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "testdata/server.crt", IsHttps: true},
+	)
+	assert.NoError(t, err)
+
+	update, err := NewUpdate().GetScheduledUpdate(ac, ts.URL, &CurrentUpdate{})
+	assert.Nil(t, update)
+	apiErr, ok := err.(*APIError)
+	require.True(t, ok, "%v", err)
+	decommission, ok := apiErr.Cause().(*DecommissionedError)
+	require.True(t, ok, "%v", err)
+	assert.True(t, decommission.Wipe)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                               0,
+		"0":                              0,
+		"30":                             30 * time.Second,
+		"Mon, 01 Jun 2020 12:05:00 GMT":  5 * time.Minute,
+		"Monday, 01-Jun-20 13:00:00 GMT": time.Hour,
+		"Mon, 01 Jun 2020 11:00:00 GMT":  0,
+		"-5":                             0,
+		"soon":                           0,
+	}
+	for value, expected := range tests {
+		assert.Equal(t, expected, parseRetryAfter(value, now), value)
+	}
+}
+
+func TestSetMaxResumes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Write([]byte("artifact"))
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	client := NewUpdate()
+	client.minImageSize = 1
+	client.SetMaxResumes(5)
+	rc, _, err := client.FetchUpdate(ac, ts.URL+"/artifact", time.Minute)
+	require.NoError(t, err)
+	defer rc.Close()
+	assert.Equal(t, 5, rc.(*UpdateResumer).maxResumes)
+}
+
+func TestFetchUpdateRedirect(t *testing.T) {
+	var cdnAuth, cdnUser string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = r.Header.Get("Authorization")
+		cdnUser, _, _ = r.BasicAuth()
+		w.Write([]byte("artifact"))
+	}))
+	defer cdn.Close()
+	cdnURL := strings.Replace(cdn.URL, "127.0.0.1", "localhost", 1)
+
+	var apiAuth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiAuth = r.Header.Get("Authorization")
+		if r.URL.Path == "/download" {
+			http.Redirect(w, r, "/redirected", http.StatusFound)
+		} else {
+			http.Redirect(w, r, cdnURL+"/signed", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer api.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	client := NewUpdate()
+	client.minImageSize = 1
+	client.SetStorageCredentials([]StorageCredentials{
+		{HostPattern: "127.0.0.1", Username: "api", Password: "secret"},
+	})
+
+	// The credentials for the server follow it around on the same host, but
+	// are not sent to the CDN.
+	rc, _, err := client.FetchUpdate(ac, api.URL+"/download", time.Minute)
+	require.NoError(t, err)
+	rc.Close()
+	assert.NotEmpty(t, apiAuth)
+	assert.Empty(t, cdnAuth)
+
+	// The CDN gets credentials of its own.
+	client.SetStorageCredentials([]StorageCredentials{
+		{HostPattern: "127.0.0.1", Username: "api", Password: "secret"},
+		{HostPattern: "localhost", Username: "cdn", Password: "secret"},
+	})
+	rc, _, err = client.FetchUpdate(ac, api.URL+"/download", time.Minute)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, "cdn", cdnUser)
+}
+
+func TestCheckRedirectSubdomain(t *testing.T) {
+	// Unlike the default policy, a subdomain is treated as another host.
+	orig, err := http.NewRequest(http.MethodGet, "https://example.com/download", nil)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, "https://cdn.example.com/signed", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	require.NoError(t, checkRedirect(req, []*http.Request{orig}))
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	req.Header.Set("Authorization", "Bearer token")
+	req.URL.Host = "example.com"
+	require.NoError(t, checkRedirect(req, []*http.Request{orig}))
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+	assert.Error(t, checkRedirect(req, make([]*http.Request, maxRedirects)))
+}
+
+func TestFetchUpdateMaxArtifactSize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	client := NewUpdate()
+	client.minImageSize = 1
+
+	client.SetMaxArtifactSize(99)
+	_, _, err = client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.Equal(t, ErrArtifactTooLarge, errors.Cause(err))
+	assert.False(t, IsTransientFetchError(err))
+
+	client.SetMaxArtifactSize(100)
+	rc, size, err := client.FetchUpdate(ac, ts.URL, time.Minute)
+	require.NoError(t, err)
+	defer rc.Close()
+	assert.EqualValues(t, 100, size)
+	assert.EqualValues(t, 100, rc.(*UpdateResumer).maxSize)
+}
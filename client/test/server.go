@@ -55,6 +55,10 @@ type statusType struct {
 	Status  string
 	Aborted bool
 	Called  bool
+	// Fail reports with 503 Service Unavailable.
+	Unavailable bool
+	// Every status reported, in order.
+	Reported []string
 }
 
 type logType struct {
@@ -311,6 +315,11 @@ func (cts *ClientTestServer) statusReq(w http.ResponseWriter, r *http.Request, i
 		return
 	}
 
+	if cts.Status.Unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	var report client.StatusReport
 	if err := fromJSON(r.Body, &report); err != nil {
 		log.Errorf("failed to parse status data: %v", err)
@@ -319,6 +328,7 @@ func (cts *ClientTestServer) statusReq(w http.ResponseWriter, r *http.Request, i
 	}
 
 	cts.Status.Status = report.Status
+	cts.Status.Reported = append(cts.Status.Reported, report.Status)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -397,6 +407,7 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 	case !cts.Update.Has:
 		w.WriteHeader(http.StatusNoContent)
 	case cts.Update.Has:
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
 		if cts.Update.Data.ID == "" {
@@ -411,7 +422,6 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 		if len(cts.Update.Data.Artifact.CompatibleDevices) == 0 {
 			cts.Update.Data.Artifact.CompatibleDevices = []string{"vexpress"}
 		}
-		w.Header().Set("Content-Type", "application/json")
 		writeJSON(w, &cts.Update.Data)
 	default:
 		log.Errorf("Unrecognized update status: %v", cts.Update)
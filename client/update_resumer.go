@@ -34,6 +34,29 @@ type UpdateResumer struct {
 	contentLength int64
 	retryAttempts int
 	maxWait       time.Duration
+	// Set if the server did not advertise support for range requests, in
+	// which case the download is restarted from the beginning instead.
+	noRanges bool
+	// How many times the download may break off and be continued; no
+	// limit if 0.
+	maxResumes int
+	resumes    int
+	// Where the download was last continued from.
+	resumedAt int64
+	// The stream is cut off with ErrArtifactTooLarge beyond this many
+	// bytes, even if it is longer than contentLength; no limit if 0.
+	maxSize int64
+}
+
+// acceptsRanges tells whether the server advertised support for byte range
+// requests in its response.
+func acceptsRanges(res *http.Response) bool {
+	for _, unit := range strings.Split(res.Header.Get("Accept-Ranges"), ",") {
+		if strings.TrimSpace(unit) == "bytes" {
+			return true
+		}
+	}
+	return false
 }
 
 // Note: It is important that nothing has been read from the stream yet.
@@ -59,6 +82,10 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 		if bytesRead > 0 {
 			h.offset += int64(bytesRead)
 		}
+		if h.maxSize > 0 && h.offset > h.maxSize {
+			return int(h.offset - origOffset), errors.Wrapf(ErrArtifactTooLarge,
+				"more than %d bytes received", h.maxSize)
+		}
 		if err == nil ||
 			h.offset <= 0 ||
 			(err == io.EOF && h.offset >= h.contentLength) {
@@ -70,7 +97,23 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 		// EOF, or a normal EOF, but with an unexpected number of bytes. This is
 		// a sign that we should try to resume from the same position.
 
-		h.req.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
+		h.resumes++
+		if h.maxResumes > 0 && h.resumes > h.maxResumes {
+			return int(h.offset - origOffset), errors.Wrapf(err,
+				"Download broke off more than %d times; giving up", h.maxResumes)
+		}
+		// A flaky link which keeps making progress is not given up on;
+		// only one which stops getting any further runs out of retries.
+		if h.offset > h.resumedAt {
+			h.retryAttempts = 0
+		}
+		h.resumedAt = h.offset
+
+		if h.noRanges {
+			h.req.Header.Del("Range")
+		} else {
+			h.req.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
+		}
 
 		var res *http.Response
 		for {
@@ -111,6 +154,10 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.ReadCloser, error) {
 	var err error
 
+	if h.offset > 0 && res.StatusCode == http.StatusOK {
+		return h.getStreamFromFullContent(res)
+	}
+
 	if h.offset > 0 && res.StatusCode != http.StatusPartialContent {
 		return nil, fmt.Errorf("Could not resume download from offset %d. HTTP status code: %s",
 			h.offset, res.Status)
@@ -170,6 +217,27 @@ func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.Read
 	return res.Body, nil
 }
 
+// getStreamFromFullContent handles servers which do not support range
+// requests, and hence send the whole artifact again. The part we already have
+// is skipped.
+func (h *UpdateResumer) getStreamFromFullContent(res *http.Response) (io.ReadCloser, error) {
+	if res.ContentLength >= 0 && res.ContentLength != h.contentLength {
+		res.Body.Close()
+		return nil, fmt.Errorf("Size of artifact changed after download was restarted "+
+			"(expected %d, got %d)", h.contentLength, res.ContentLength)
+	}
+
+	log.Infof("Server does not support resuming the download. Downloading again, "+
+		"skipping the first %d bytes", h.offset)
+	if _, err := io.CopyN(ioutil.Discard, res.Body, h.offset); err != nil {
+		res.Body.Close()
+		return nil, errors.Wrapf(err,
+			"Could not restart download, unable to catch up to offset %d", h.offset)
+	}
+
+	return res.Body, nil
+}
+
 func (h *UpdateResumer) Close() error {
 	return h.stream.Close()
 }
@@ -15,8 +15,8 @@
 package client
 
 import (
+	"bytes"
 	"fmt"
-	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -24,7 +24,12 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testHandler struct {
@@ -42,6 +47,9 @@ type testHandler struct {
 	breakAfterShortRange    bool
 	serverDownAfter         time.Duration
 	serverUpAgainAfter      time.Duration
+	// Send the whole file on every download after the first one.
+	fullContentOnRetry bool
+	downloads          int
 
 	success bool
 }
@@ -91,6 +99,9 @@ func (h *testHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		pos = 0
 	}
 
+	if !h.noPartialContentSupport {
+		res.Header().Set("Accept-Ranges", "bytes")
+	}
 	res.Header().Set("Content-Length", fmt.Sprintf("%d", size-pos))
 
 	_, err = f.Seek(pos, io.SeekStart)
@@ -106,6 +117,12 @@ func (h *testHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		// Only do this once.
 		h.breakAfterShortRange = false
 	}
+	if req.URL.Path == "/update_resumer_test.go" {
+		h.downloads++
+		if h.fullContentOnRetry && h.downloads > 1 {
+			toCopy = size
+		}
+	}
 	if toCopy > size-pos {
 		toCopy = size - pos
 	}
@@ -165,6 +182,7 @@ func testBrokenReadAndPartialDownload_oneCase(t *testing.T, h *testHandler) {
 	assert.NoError(t, err)
 
 	updateResumer := NewUpdateResumer(res.Body, contentLength, 3*time.Second, &client, req)
+	updateResumer.noRanges = !acceptsRanges(res)
 	defer updateResumer.Close()
 
 	if h.serverDownAfter > 0 {
@@ -252,6 +270,17 @@ func testBrokenReadAndPartialDownload_group(t *testing.T) {
 		})
 	}
 
+	{
+		h := base
+		h.addr = ":9769"
+		h.success = true
+		h.noPartialContentSupport = true
+		h.fullContentOnRetry = true
+		t.Run("noPartialContentSupportFullDownload", func(t *testing.T) {
+			testBrokenReadAndPartialDownload_oneCase(t, &h)
+		})
+	}
+
 	{
 		h := base
 		h.addr = ":9759"
@@ -365,3 +394,120 @@ func TestBrokenReadAndPartialDownload(t *testing.T) {
 
 	t.Run("group", testBrokenReadAndPartialDownload_group)
 }
+
+// flakyRequester serves data, breaking off the n:th connection at breaks[n].
+// Connections past the end of breaks are not broken.
+type flakyRequester struct {
+	data   []byte
+	breaks []int64
+	conns  int
+}
+
+func (f *flakyRequester) open(pos int64) io.ReadCloser {
+	end := int64(len(f.data))
+	if f.conns < len(f.breaks) && f.breaks[f.conns] < end {
+		end = f.breaks[f.conns]
+	}
+	f.conns++
+	body := io.Reader(bytes.NewReader(f.data[pos:end]))
+	if end < int64(len(f.data)) {
+		body = io.MultiReader(body, iotest.DataErrReader(brokenReader{}))
+	}
+	return ioutil.NopCloser(body)
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (f *flakyRequester) Do(req *http.Request) (*http.Response, error) {
+	var pos int64
+	_, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &pos)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     http.Header{},
+		Body:       f.open(pos),
+	}
+	rsp.Header.Set("Content-Range",
+		fmt.Sprintf("bytes %d-%d/%d", pos, len(f.data)-1, len(f.data)))
+	return rsp, nil
+}
+
+func TestUpdateResumerContinuations(t *testing.T) {
+	oldExponentialBackoffSmallestUnit := ExponentialBackoffSmallestUnit
+	ExponentialBackoffSmallestUnit = time.Millisecond
+	defer func() {
+		ExponentialBackoffSmallestUnit = oldExponentialBackoffSmallestUnit
+	}()
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	tests := map[string]struct {
+		breaks     []int64
+		maxResumes int
+		success    bool
+	}{
+		"unbroken":     {nil, 0, true},
+		"at the start": {[]int64{1}, 0, true},
+		"halfway":      {[]int64{500}, 0, true},
+		"near the end": {[]int64{999}, 0, true},
+		"every 50":     {[]int64{50, 100, 150, 200, 250, 300, 350, 400, 450}, 0, true},
+		"within limit": {[]int64{100, 200, 300}, 3, true},
+		"over limit":   {[]int64{100, 200, 300, 400}, 3, false},
+		"stuck": {[]int64{100, 100, 100, 100, 100, 100, 100, 100, 100, 100,
+			100, 100}, 0, false},
+		"stuck briefly": {[]int64{100, 100, 200, 200, 300}, 0, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := &flakyRequester{data: data, breaks: test.breaks}
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/artifact", nil)
+			require.NoError(t, err)
+			resumer := NewUpdateResumer(f.open(0), int64(len(data)),
+				4*time.Millisecond, f, req)
+			resumer.maxResumes = test.maxResumes
+
+			got, err := ioutil.ReadAll(resumer)
+			if test.success {
+				require.NoError(t, err)
+				assert.Equal(t, data, got)
+			} else {
+				assert.Error(t, err)
+				assert.Equal(t, data[:len(got)], got)
+			}
+		})
+	}
+}
+
+func TestUpdateResumerMaxSize(t *testing.T) {
+	// The stream is longer than the length given by the server.
+	data := make([]byte, 200)
+	resumer := NewUpdateResumer(ioutil.NopCloser(bytes.NewReader(data)), 100,
+		time.Minute, &flakyRequester{data: data}, nil)
+	got, err := ioutil.ReadAll(resumer)
+	assert.NoError(t, err)
+	assert.Len(t, got, 200)
+
+	resumer = NewUpdateResumer(ioutil.NopCloser(bytes.NewReader(data)), 100,
+		time.Minute, &flakyRequester{data: data}, nil)
+	resumer.maxSize = 100
+	got, err = ioutil.ReadAll(resumer)
+	assert.Equal(t, ErrArtifactTooLarge, errors.Cause(err))
+	assert.True(t, len(got) > 100)
+
+	// Up to the limit is fine.
+	resumer = NewUpdateResumer(ioutil.NopCloser(bytes.NewReader(data)), 200,
+		time.Minute, &flakyRequester{data: data}, nil)
+	resumer.maxSize = 200
+	got, err = ioutil.ReadAll(resumer)
+	assert.NoError(t, err)
+	assert.Len(t, got, 200)
+}
@@ -14,15 +14,23 @@
 package conf
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/installer"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpguts"
 )
 
 type MenderConfigFromFile struct {
@@ -37,13 +45,41 @@ type MenderConfigFromFile struct {
 	// Rootfs device path
 	RootfsPartA string
 	RootfsPartB string
+	// Fail updates if the inactive partition is mounted, such as by an
+	// auto mount service, instead of unmounting it before writing to it.
+	RefuseMountedInactivePartition bool
 	// Path to the device type file
 	DeviceTypeFile string
+	// Path to the file written when the device was flashed, with the
+	// artifact_name and, optionally, artifact_version of the image. The
+	// artifact_info file in the configuration directory if empty.
+	ProvisioningFile string
+	// Where the device identity comes from: "script" (the default) runs
+	// the identity helper, "file" reads DeviceIdentityFile, and "mac"
+	// uses the MAC address of the first network interface.
+	DeviceIdentitySource string
+	// File with key=value identity data, for the "file" identity source
+	DeviceIdentityFile string
 
 	// Poll interval for checking for new updates
 	UpdatePollIntervalSeconds int
+	// Randomly lengthen or shorten each update poll interval by up to
+	// this many percent, so that devices started at the same time do not
+	// keep polling at the same time
+	UpdatePollIntervalJitterPercent int
+	// Update channel, such as "beta", sent with each update check so that
+	// the server can give the device the deployments for that channel;
+	// none by default. It can be changed through the control API until the
+	// client is restarted.
+	Channel string
 	// Poll interval for periodically sending inventory data
 	InventoryPollIntervalSeconds int
+	// Systemd units whose states are sent as service_<unit> inventory
+	// attributes
+	InventoryServices []string
+	// Shell command whose key=value output is sent as inventory
+	// attributes. Only the first 4 KiB of output are used.
+	InventoryCommand string
 
 	// Skip CA certificate validation
 	SkipVerify bool
@@ -51,30 +87,241 @@ type MenderConfigFromFile struct {
 	// Global retry polling max interval for fetching update, authorize wait and update status
 	RetryPollIntervalSeconds int
 
+	// Number of times a failed update fetch is retried straight away,
+	// before falling back to the RetryPollIntervalSeconds schedule. Only
+	// network and server (5xx) errors are retried.
+	UpdateFetchRetries int
+	// Wait before the first such retry; doubled for each following retry
+	UpdateFetchRetryBackoffSeconds int
+	// Maximum average download rate for updates. 0 means no limit.
+	DownloadLimitBytesPerSecond int64
+	// How many times a download which breaks off is continued from where
+	// it got to, before the update fails. 0 means for as long as every
+	// continuation gets further, within RetryPollIntervalSeconds.
+	DownloadMaxResumes int
+	// How many times an Artifact which does not match the checksum given
+	// by the server is downloaded again, in case the download was corrupt,
+	// before the update fails. 0 fails the update straight away.
+	ChecksumMismatchRetries int
+	// Updates whose Artifacts are larger than this fail without being
+	// installed. 0 means no limit.
+	MaxArtifactSizeBytes int64
+	// Take Artifacts from file:// and unix:// URLs, for gateways where a
+	// program on the device hands them over. The socket of a unix:// URL
+	// is expected to send the Artifact as soon as it is connected to.
+	LocalArtifactSources bool
+
+	// Timeouts for connecting to the server, for the TLS handshake, for
+	// the response headers to arrive, and for whole API requests
+	ConnectTimeoutSeconds        int
+	TLSHandshakeTimeoutSeconds   int
+	ResponseHeaderTimeoutSeconds int
+	RequestTimeoutSeconds        int
+	// How long an update download may stall before it is resumed.
+	// Downloads are not limited by RequestTimeoutSeconds.
+	DownloadIdleTimeoutSeconds int
+	// How long a connection to the server is kept open between requests,
+	// such as update polls, for reuse. 0 leaves it up to the server.
+	IdleConnectionTimeoutSeconds int
+
 	// State script parameters
 	StateScriptTimeoutSeconds      int
 	StateScriptRetryTimeoutSeconds int
 	// Poll interval for checking for update (check-update)
 	StateScriptRetryIntervalSeconds int
 
+	// How long to wait on shutdown for the daemon to finish the state it
+	// is in, before giving up
+	StopTimeoutSeconds int
+	// Address, such as "localhost:9100", on which the daemon serves
+	// metrics at /metrics in the Prometheus text format. Disabled if empty.
+	MetricsListenAddress string
+
+	// Unix socket path, such as "/run/mender/control.sock", or loopback
+	// address, such as "127.0.0.1:9101", on which the daemon serves the
+	// local control API. Disabled if empty. On a loopback address, which
+	// any user of the device can connect to, only the status is served.
+	ControlAPIAddress string
+
+	// If set, reboots into a new update are postponed until the device is
+	// within this daily window. The update is downloaded and installed
+	// straight away.
+	MaintenanceWindow MaintenanceWindow
+	// If false, the device is not rebooted into a new update until the
+	// reboot is requested through the control API. True if not set.
+	AutoReboot *bool
+
+	// How much space, in bytes, must be left over on top of the size of
+	// the Artifact for a download to be started
+	FreeSpaceMarginBytes int64
+
+	// Keep a copy of each downloaded Artifact until its update succeeds,
+	// so that retrying the same deployment does not download it again.
+	// This needs room for a second copy of the Artifact.
+	CacheArtifacts bool
+	// How Artifacts are installed: ArtifactDownloadStream, the default,
+	// writes them to the device as they are downloaded.
+	// ArtifactDownloadThenInstall downloads each of them to a file in
+	// DataDir first, and only installs it once it has been verified
+	// against the checksum given by the server. This needs room for a
+	// second copy of the Artifact.
+	ArtifactDownloadMode string
+
+	// Download and verify updates, but never install them. The deployment
+	// is reported as failed, with the result in its log.
+	DryRun bool
+
+	// The first update check after the daemon starts is put off by a
+	// random time of up to this many seconds, so that devices powering on
+	// together do not all poll the server at once. 0 checks straight away.
+	StartupDelaySeconds int
+
+	// What the daemon does when it starts with the system clock before
+	// the build date of the client, as on devices without a real-time
+	// clock: ClockCheckWait waits for the time to be synchronized,
+	// ClockCheckServer sets the clock from the Date header of the server.
+	// Nothing is done if empty.
+	ClockCheck string
+	// How long ClockCheckWait waits before carrying on regardless.
+	ClockCheckTimeoutSeconds int
+
+	// How long to wait, after rebooting into an update, for the device to
+	// be confirmed healthy through the control API. The update is rolled
+	// back if no confirmation arrives in time. 0 commits straight away.
+	HealthCheckTimeoutSeconds int
+
+	// How many times in a row the same deployment may fail before the
+	// client gives up on it, and ignores it whenever the server offers it
+	// again. 0 means no limit.
+	MaxUpdateAttempts int
+
+	// While the device is on battery, the update and inventory poll
+	// intervals are multiplied by this factor. 0 or 1 polls as usual.
+	BatteryPollIntervalFactor int
+	// While the device is on battery with less charge than this, in
+	// percent, updates are not downloaded. 0 downloads regardless.
+	LowBatteryPercent int
+
+	// URL, such as "http://localhost:8080/mender", which the outcome of
+	// every update is posted to as JSON. Disabled if empty.
+	UpdateWebhookURL string
+
+	// How the device is rebooted into an update: "command" (the default)
+	// runs RebootCommand, "systemd" asks systemd to reboot, and "syscall"
+	// calls the kernel straight away, without a clean shutdown.
+	RebootMethod string
+	// Command line run by the "command" reboot method. "reboot" if empty.
+	RebootCommand []string
+
+	// Basic auth credentials for downloading Artifacts from storage which
+	// needs them, such as an S3 compatible store. They are matched against
+	// the host of the download URL.
+	ArtifactStorageCredentials []client.StorageCredentials
+
 	// Update module parameters:
 
 	// The timeout for the execution of the update module, after which it
 	// will be killed.
 	ModuleTimeoutSeconds int
-
-	// Path to server SSL certificate
+	// How many payloads of an Artifact with several of them are installed
+	// at the same time, such as by update modules which take a while.
+	// They are installed one after the other by default.
+	MaxConcurrentInstalls int
+
+	// Path to server SSL certificate: a file of one or more PEM
+	// certificates, such as a CA bundle or a chain with its intermediates,
+	// or a directory of such files. Trusted on top of the CA certificates
+	// of the system.
 	ServerCertificate string
+	// Trust only ServerCertificate, and not the CA certificates of the
+	// system as well.
+	IgnoreSystemCertificates bool
+	// SHA256 fingerprints of the server certificate, one of which it must
+	// match on top of being trusted. Empty to not pin the certificate.
+	ServerCertificateFingerprints []string
 	// Server URL (For single server conf)
 	ServerURL string
-	// Path to deployment log file
+	// Directory which the state the client keeps lives under: the database,
+	// the keys, deployment logs and cached Artifacts. It is created, only
+	// accessible by its owner, if missing, and must not be world-writable.
+	// /var/lib/mender if empty. The --data option takes precedence.
+	DataDir string
+	// Directory to keep deployment logs in, if not DataDir
 	UpdateLogPath string
 	// Server JWT TenantToken
 	TenantToken string
 	// List of available servers, to which client can fall over
 	Servers []client.MenderServer
+	// dhclient lease file, such as /var/lib/dhcp/dhclient.leases, to read
+	// the server URL from. A server found there is tried before the
+	// configured ones. Not looked for if empty.
+	ServerDiscoveryLeaseFile string
+	// Lease option holding the server URL, either as text or in a custom
+	// option defined in dhclient.conf; DefaultServerDiscoveryOption if
+	// empty.
+	ServerDiscoveryOption string
+
+	// Proxies to use for outbound connections, and hosts to reach
+	// without one. They override the http_proxy, https_proxy and
+	// no_proxy environment variables.
+	HttpProxy  string
+	HttpsProxy string
+	NoProxy    string
+
+	// DNS server, such as "192.0.2.53" or "[2001:db8::53]:5353", to
+	// resolve the server addresses with, instead of the system resolver.
+	DNSServer string
+
+	// Lowest TLS version, such as "TLSv1.3", the client connects to the
+	// server with. TLSv1.2 if empty.
+	TLSMinVersion string
+	// OpenSSL names of the cipher suites allowed up to TLSv1.2. OpenSSL's
+	// defaults are used if empty.
+	TLSCipherSuites []string
+	// Name the server certificate is issued for, for servers given by IP
+	// address, such as behind a shared load balancer. It is sent in SNI
+	// in place of the address.
+	ServerName string
+
+	// User-Agent the client identifies itself with; DefaultUserAgent() if
+	// empty.
+	UserAgent string
+	// Extra headers, such as those a gateway needs, to send with every
+	// request to the server.
+	HttpHeaders map[string]string
+	// Authorize the device again, and retry once, when the server answers a
+	// request with 403 (Forbidden), as is done for 401 (Unauthorized). For
+	// servers, or gateways in front of them, which reject expired tokens
+	// with 403.
+	ReauthorizeOnForbidden bool
 }
 
+// Values of ArtifactDownloadMode.
+const (
+	ArtifactDownloadStream      = "stream"
+	ArtifactDownloadThenInstall = "download-then-install"
+)
+
+// Values of ClockCheck.
+const (
+	ClockCheckWait   = "wait"
+	ClockCheckServer = "server"
+)
+
+// Values of DeviceIdentitySource.
+const (
+	IdentitySourceScript = "script"
+	IdentitySourceFile   = "file"
+	IdentitySourceMAC    = "mac"
+)
+
+// Values of RebootMethod.
+const (
+	RebootMethodCommand = "command"
+	RebootMethodSystemd = "systemd"
+	RebootMethodSyscall = "syscall"
+)
+
 type MenderConfig struct {
 	MenderConfigFromFile
 
@@ -105,6 +352,16 @@ func NewMenderConfig() *MenderConfig {
 // (/etc/mender/mender.conf and /var/lib/mender/mender.conf) and loads the
 // values into the MenderConfig structure defining high level client
 // configurations.
+//
+// Environment variables override both files: each setting can be given as
+// MENDER_ followed by its name in upper case, with words separated by
+// underscores, such as MENDER_SERVER_URL or
+// MENDER_UPDATE_POLL_INTERVAL_SECONDS. So the precedence is environment,
+// main file, fallback file, and then the defaults.
+//
+// If DefaultConfVerifyKeyFile exists, each file must have a valid detached
+// signature next to it, with ".sig" appended to the name, or it is refused.
+// The environment is then ignored, as it is not signed.
 func LoadConfig(mainConfigFile string, fallbackConfigFile string) (*MenderConfig, error) {
 	// Load fallback configuration first, then main configuration.
 	// It is OK if either file does not exist, so long as the other one does exist.
@@ -127,7 +384,10 @@ func LoadConfig(mainConfigFile string, fallbackConfigFile string) (*MenderConfig
 
 	if filesLoadedCount == 0 {
 		log.Info("No configuration files present. Using defaults")
-		return config, nil
+	}
+
+	if err := loadConfigEnvironment(&config.MenderConfigFromFile); err != nil {
+		return nil, err
 	}
 
 	log.Debugf("Loaded configuration = %#v", config)
@@ -135,10 +395,66 @@ func LoadConfig(mainConfigFile string, fallbackConfigFile string) (*MenderConfig
 	return config, nil
 }
 
+// envPrefix starts the names of the environment variables which override
+// the configuration files.
+const envPrefix = "MENDER_"
+
+// loadConfigEnvironment sets every setting for which there is an environment
+// variable. Text settings take the value as it is; all others are given as
+// JSON, such as 30, true or ["a", "b"]. If the configuration files are signed,
+// the variables are ignored.
+func loadConfigEnvironment(config *MenderConfigFromFile) error {
+	// Unless the key is certainly not there, the files have been checked
+	// against it, or refused.
+	_, err := os.Stat(DefaultConfVerifyKeyFile)
+	signed := !os.IsNotExist(err)
+
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		variable := envPrefix + envName(name)
+		env, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+		if signed {
+			log.Warnf("Ignoring the %s environment variable; the configuration "+
+				"must be signed, as required by %s", variable, DefaultConfVerifyKeyFile)
+			continue
+		}
+		field := value.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(env)
+		} else if err := json.Unmarshal([]byte(env), field.Addr().Interface()); err != nil {
+			return errors.Wrapf(err, "Error parsing the %s environment variable", variable)
+		}
+		log.Infof("Configuration setting %s taken from the environment", name)
+	}
+	return nil
+}
+
+// envName turns a setting name such as "ServerURL" into "SERVER_URL".
+func envName(setting string) string {
+	runes := []rune(setting)
+	var name strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && nextLower) {
+				name.WriteByte('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
 // Validate verifies the Servers fields in the configuration
 func (c *MenderConfig) Validate() error {
 	if c.Servers == nil {
-		if c.ServerURL == "" {
+		if c.ServerURL == "" && c.ServerDiscoveryLeaseFile == "" {
 			log.Warn("No server URL(s) specified in mender configuration.")
 		}
 		c.Servers = make([]client.MenderServer, 1)
@@ -151,6 +467,7 @@ func (c *MenderConfig) Validate() error {
 		return errors.New("Both Servers AND ServerURL given in " +
 			"mender.conf")
 	}
+	c.addDiscoveredServer()
 	for i := 0; i < len(c.Servers); i++ {
 		// Trim possible '/' suffix, which is added back in URL path
 		if strings.HasSuffix(c.Servers[i].ServerURL, "/") {
@@ -165,6 +482,77 @@ func (c *MenderConfig) Validate() error {
 
 	c.HttpsClient.Validate()
 
+	if err := c.MaintenanceWindow.Validate(); err != nil {
+		return err
+	}
+
+	// 0 means the default interval.
+	for setting, interval := range map[string]int{
+		"UpdatePollIntervalSeconds":    c.UpdatePollIntervalSeconds,
+		"InventoryPollIntervalSeconds": c.InventoryPollIntervalSeconds,
+		"RetryPollIntervalSeconds":     c.RetryPollIntervalSeconds,
+	} {
+		if interval < 0 {
+			return errors.Errorf("%s must not be negative, not %d", setting, interval)
+		}
+	}
+
+	if c.UpdatePollIntervalJitterPercent < 0 || c.UpdatePollIntervalJitterPercent >= 100 {
+		return errors.Errorf("UpdatePollIntervalJitterPercent must be between 0 and 99, not %d",
+			c.UpdatePollIntervalJitterPercent)
+	}
+
+	for _, creds := range c.ArtifactStorageCredentials {
+		if _, err := path.Match(creds.HostPattern, ""); err != nil || creds.HostPattern == "" {
+			return errors.Errorf("Invalid ArtifactStorageCredentials HostPattern: %q",
+				creds.HostPattern)
+		}
+	}
+
+	for name, value := range c.HttpHeaders {
+		if !httpguts.ValidHeaderFieldName(name) ||
+			!httpguts.ValidHeaderFieldValue(value) {
+			return errors.Errorf("Invalid HttpHeaders entry: %q: %q", name, value)
+		}
+	}
+	if !httpguts.ValidHeaderFieldValue(c.UserAgent) {
+		return errors.Errorf("Invalid UserAgent: %q", c.UserAgent)
+	}
+
+	for _, fingerprint := range c.ServerCertificateFingerprints {
+		if _, err := client.NormalizeFingerprint(fingerprint); err != nil {
+			return errors.Wrap(err, "ServerCertificateFingerprints")
+		}
+	}
+
+	switch c.RebootMethod {
+	case "", RebootMethodCommand, RebootMethodSystemd, RebootMethodSyscall:
+	default:
+		return errors.Errorf("Unknown RebootMethod: %q", c.RebootMethod)
+	}
+
+	switch c.ArtifactDownloadMode {
+	case "", ArtifactDownloadStream, ArtifactDownloadThenInstall:
+	default:
+		return errors.Errorf("Unknown ArtifactDownloadMode: %q", c.ArtifactDownloadMode)
+	}
+
+	switch c.ClockCheck {
+	case "", ClockCheckWait, ClockCheckServer:
+	default:
+		return errors.Errorf("Unknown ClockCheck: %q", c.ClockCheck)
+	}
+
+	switch c.DeviceIdentitySource {
+	case "", IdentitySourceScript, IdentitySourceMAC:
+	case IdentitySourceFile:
+		if c.DeviceIdentityFile == "" {
+			return errors.New("DeviceIdentityFile must be set when DeviceIdentitySource is \"file\"")
+		}
+	default:
+		return errors.Errorf("Unknown DeviceIdentitySource: %q", c.DeviceIdentitySource)
+	}
+
 	if c.HttpsClient.Key != "" && c.Security.AuthPrivateKey != "" {
 		log.Warn("both config.HttpsClient.Key and config.Security.AuthPrivateKey" +
 			" specified; config.Security.AuthPrivateKey will take precedence over" +
@@ -176,6 +564,46 @@ func (c *MenderConfig) Validate() error {
 	return nil
 }
 
+// ValidateServer verifies the settings needed to talk to the server: that
+// every server has a valid http(s) URL, and that the certificates given can
+// be read. It is called on top of Validate, by the commands which connect to
+// the server.
+func (c *MenderConfig) ValidateServer() error {
+	if len(c.Servers) == 0 {
+		return errors.New("No server URL given in mender.conf")
+	}
+	for _, server := range c.Servers {
+		u, err := url.Parse(server.ServerURL)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid server URL %q", server.ServerURL)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("Invalid server URL %q; it must be "+
+				"an http:// or https:// URL", server.ServerURL)
+		}
+	}
+
+	for setting, file := range map[string]string{
+		"ServerCertificate":       c.ServerCertificate,
+		"HttpsClient.Certificate": c.HttpsClient.Certificate,
+	} {
+		if file == "" {
+			continue
+		}
+		var err error
+		if info, statErr := os.Stat(file); statErr == nil && info.IsDir() &&
+			setting == "ServerCertificate" {
+			_, err = ioutil.ReadDir(file)
+		} else {
+			_, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Could not read the %s", setting)
+		}
+	}
+	return nil
+}
+
 func loadConfigFile(configFile string, config *MenderConfig, filesLoadedCount *int) error {
 	// Do not treat a single config file not existing as an error here.
 	// It is up to the caller to fail when both config files don't exist.
@@ -194,6 +622,37 @@ func loadConfigFile(configFile string, config *MenderConfig, filesLoadedCount *i
 	return nil
 }
 
+// configSignatureSuffix is appended to the name of a configuration file to get
+// the name of its detached signature.
+const configSignatureSuffix = ".sig"
+
+// verifyConfigSignature checks the content of a configuration file against its
+// detached signature, which is the base64 encoded signature made with the
+// private key matching DefaultConfVerifyKeyFile, the same as for Artifacts.
+// Without the key file, configuration files are not signed.
+func verifyConfigSignature(content []byte, fileName string) error {
+	key, err := ioutil.ReadFile(DefaultConfVerifyKeyFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Error reading configuration verification key")
+	}
+
+	sig, err := ioutil.ReadFile(fileName + configSignatureSuffix)
+	if os.IsNotExist(err) {
+		return errors.Errorf("Configuration file %s is not signed; a signature "+
+			"is required by %s", fileName, DefaultConfVerifyKeyFile)
+	} else if err != nil {
+		return errors.Wrap(err, "Error reading configuration signature")
+	}
+
+	if err := artifact.NewVerifier(key).Verify(content, bytes.TrimSpace(sig)); err != nil {
+		return errors.Wrapf(err, "Invalid signature of configuration file %s", fileName)
+	}
+	log.Debug("Verified the signature of configuration file ", fileName)
+	return nil
+}
+
 func readConfigFile(config interface{}, fileName string) error {
 	// Reads mender configuration (JSON) file.
 
@@ -203,6 +662,10 @@ func readConfigFile(config interface{}, fileName string) error {
 		return err
 	}
 
+	if err := verifyConfigSignature(conf, fileName); err != nil {
+		return err
+	}
+
 	if err := json.Unmarshal(conf, &config); err != nil {
 		switch err.(type) {
 		case *json.SyntaxError:
@@ -245,22 +708,76 @@ func (c *MenderConfig) GetHttpConfig() client.Config {
 		IsHttps:    c.ClientProtocol == "https",
 		// The HttpsClient config is only loaded when both a cert and
 		// key is given
-		HttpsClient: maybeHTTPSClient(c),
-		NoVerify:    c.SkipVerify,
+		HttpsClient:            maybeHTTPSClient(c),
+		NoVerify:               c.SkipVerify,
+		IgnoreSystemCerts:      c.IgnoreSystemCertificates,
+		ServerCertFingerprints: c.ServerCertificateFingerprints,
+		Timeouts: client.Timeouts{
+			Connect:        time.Duration(c.ConnectTimeoutSeconds) * time.Second,
+			TLSHandshake:   time.Duration(c.TLSHandshakeTimeoutSeconds) * time.Second,
+			ResponseHeader: time.Duration(c.ResponseHeaderTimeoutSeconds) * time.Second,
+			Request:        time.Duration(c.RequestTimeoutSeconds) * time.Second,
+			DownloadIdle:   time.Duration(c.DownloadIdleTimeoutSeconds) * time.Second,
+			IdleConnection: time.Duration(c.IdleConnectionTimeoutSeconds) * time.Second,
+		},
+		Proxy: client.ProxyConfig{
+			HttpProxy:  c.HttpProxy,
+			HttpsProxy: c.HttpsProxy,
+			NoProxy:    c.NoProxy,
+		},
+		DNSServer:       c.DNSServer,
+		TLSMinVersion:   c.TLSMinVersion,
+		TLSCipherSuites: c.TLSCipherSuites,
+		ServerName:      c.ServerName,
+		UserAgent:       c.GetUserAgent(),
+		ClientVersion:   VersionString(),
+		Headers:         c.HttpHeaders,
 	}
 }
 
+// GetUserAgent returns the configured User-Agent, or the default one, which
+// includes the version of the client.
+func (c *MenderConfig) GetUserAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return DefaultUserAgent()
+}
+
 func (c *MenderConfig) GetDeviceConfig() installer.DualRootfsDeviceConfig {
 	return installer.DualRootfsDeviceConfig{
-		RootfsPartA: c.RootfsPartA,
-		RootfsPartB: c.RootfsPartB,
+		RootfsPartA:           c.RootfsPartA,
+		RootfsPartB:           c.RootfsPartB,
+		RefuseMountedInactive: c.RefuseMountedInactivePartition,
+	}
+}
+
+func (c *MenderConfig) GetDataDir() string {
+	if c.DataDir == "" {
+		return DefaultDataStore
 	}
+	return c.DataDir
 }
 
 func (c *MenderConfig) GetDeploymentLogLocation() string {
+	if c.UpdateLogPath == "" {
+		return c.GetDataDir()
+	}
 	return c.UpdateLogPath
 }
 
+// GetArtifactCacheDir returns where downloaded Artifacts are cached, if
+// CacheArtifacts is set.
+func (c *MenderConfig) GetArtifactCacheDir() string {
+	return path.Join(c.GetDataDir(), "artifact-cache")
+}
+
+// GetArtifactDownloadDir returns where Artifacts are downloaded to before they
+// are installed, if ArtifactDownloadMode is ArtifactDownloadThenInstall.
+func (c *MenderConfig) GetArtifactDownloadDir() string {
+	return path.Join(c.GetDataDir(), "artifact-download")
+}
+
 // GetTenantToken returns a default tenant-token if
 // no custom token is set in local.conf
 func (c *MenderConfig) GetTenantToken() []byte {
@@ -14,15 +14,23 @@
 package conf
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testConfig = `{
@@ -175,6 +183,33 @@ func TestMultipleServersConfig(t *testing.T) {
 	assert.Equal(t, "https://server.three", conf.Servers[2].ServerURL)
 }
 
+// TestServerURLConfigLineEndings checks that the server is read from a
+// configuration file with CRLF line endings and trailing blank lines, as
+// edited by hand.
+func TestServerURLConfigLineEndings(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	require.NoError(t, ioutil.WriteFile(confPath,
+		[]byte("{\r\n  \"ServerURL\": \"https://mender.io/\"\r\n}\r\n\r\n  \n"), 0600))
+	config, err := LoadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+	assert.Equal(t, "https://mender.io", config.Servers[0].ServerURL)
+
+	require.NoError(t, ioutil.WriteFile(confPath,
+		[]byte("{\r\n  \"Servers\": [\r\n    {\"ServerURL\": \"https://server.one/\"},\r\n"+
+			"    {\"ServerURL\": \"https://server.two\"}\r\n  ]\r\n}\r\n"), 0600))
+	config, err = LoadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+	require.Len(t, config.Servers, 2)
+	assert.Equal(t, "https://server.one", config.Servers[0].ServerURL)
+	assert.Equal(t, "https://server.two", config.Servers[1].ServerURL)
+}
+
 func TestConfigurationMergeSettings(t *testing.T) {
 	var mainConfigJson = `{
 		"RootfsPartA": "Eggplant",
@@ -215,3 +250,323 @@ func TestConfigurationNeitherFileExistsIsNotError(t *testing.T) {
 	assert.NoError(t, err)
 	assert.IsType(t, &MenderConfig{}, config)
 }
+
+func TestDeviceIdentitySourceConfig(t *testing.T) {
+	config := NewMenderConfig()
+	assert.NoError(t, config.Validate())
+
+	config.DeviceIdentitySource = IdentitySourceMAC
+	assert.NoError(t, config.Validate())
+
+	config.DeviceIdentitySource = IdentitySourceFile
+	assert.Error(t, config.Validate())
+	config.DeviceIdentityFile = "/etc/mender/identity"
+	assert.NoError(t, config.Validate())
+
+	config.DeviceIdentitySource = "tpm"
+	assert.Error(t, config.Validate())
+}
+
+func TestServerCertificateFingerprintsConfig(t *testing.T) {
+	config := NewMenderConfig()
+	config.ServerCertificateFingerprints = []string{strings.Repeat("ab", 32)}
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, config.ServerCertificateFingerprints,
+		config.GetHttpConfig().ServerCertFingerprints)
+
+	config.ServerCertificateFingerprints = append(config.ServerCertificateFingerprints, "abcd")
+	assert.Error(t, config.Validate())
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	configFile, _ := os.Create("mender.config")
+	defer os.Remove("mender.config")
+	configFile.WriteString(testConfig)
+
+	env := map[string]string{
+		"MENDER_SERVER_URL":                      "https://env.example.com",
+		"MENDER_UPDATE_POLL_INTERVAL_SECONDS":    "300",
+		"MENDER_SKIP_VERIFY":                     "true",
+		"MENDER_SERVER_CERTIFICATE_FINGERPRINTS": `["ab", "cd"]`,
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	config, err := LoadConfig("mender.config", "does-not-exist.config")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://env.example.com", config.ServerURL)
+	assert.Equal(t, 300, config.UpdatePollIntervalSeconds)
+	assert.True(t, config.SkipVerify)
+	assert.Equal(t, []string{"ab", "cd"}, config.ServerCertificateFingerprints)
+	// Not in the environment, so taken from the file.
+	assert.Equal(t, 60, config.InventoryPollIntervalSeconds)
+
+	// Also without any configuration file.
+	config, err = LoadConfig("does-not-exist.config", "does-not-exist.config")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://env.example.com", config.ServerURL)
+	assert.Equal(t, DefaultDeviceTypeFile, config.DeviceTypeFile)
+
+	os.Setenv("MENDER_UPDATE_POLL_INTERVAL_SECONDS", "often")
+	_, err = LoadConfig("mender.config", "does-not-exist.config")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "MENDER_UPDATE_POLL_INTERVAL_SECONDS")
+}
+
+func TestConfigEnvironmentNames(t *testing.T) {
+	for setting, name := range map[string]string{
+		"ServerURL":                       "SERVER_URL",
+		"UpdatePollIntervalSeconds":       "UPDATE_POLL_INTERVAL_SECONDS",
+		"DNSServer":                       "DNS_SERVER",
+		"TLSMinVersion":                   "TLS_MIN_VERSION",
+		"HttpsProxy":                      "HTTPS_PROXY",
+		"RootfsPartA":                     "ROOTFS_PART_A",
+		"UpdatePollIntervalJitterPercent": "UPDATE_POLL_INTERVAL_JITTER_PERCENT",
+	} {
+		assert.Equal(t, name, envName(setting))
+	}
+}
+
+func TestValidatePollIntervals(t *testing.T) {
+	// The defaults are valid.
+	assert.NoError(t, NewMenderConfig().Validate())
+
+	for _, set := range []func(c *MenderConfig){
+		func(c *MenderConfig) { c.UpdatePollIntervalSeconds = -1 },
+		func(c *MenderConfig) { c.InventoryPollIntervalSeconds = -1 },
+		func(c *MenderConfig) { c.RetryPollIntervalSeconds = -1 },
+	} {
+		config := NewMenderConfig()
+		set(config)
+		err := config.Validate()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "must not be negative")
+	}
+}
+
+func TestValidateStorageCredentials(t *testing.T) {
+	config := NewMenderConfig()
+	config.ArtifactStorageCredentials = []client.StorageCredentials{
+		{HostPattern: "*.s3.example.com", Username: "user", Password: "pass"},
+	}
+	assert.NoError(t, config.Validate())
+
+	for _, pattern := range []string{"", "[broken"} {
+		config.ArtifactStorageCredentials[0].HostPattern = pattern
+		assert.Error(t, config.Validate())
+	}
+}
+
+func TestValidateRebootMethod(t *testing.T) {
+	config := NewMenderConfig()
+	for _, method := range []string{"", RebootMethodCommand, RebootMethodSystemd,
+		RebootMethodSyscall} {
+		config.RebootMethod = method
+		assert.NoError(t, config.Validate())
+	}
+	config.RebootMethod = "kexec"
+	assert.Error(t, config.Validate())
+}
+
+func TestUserAgentAndHeaders(t *testing.T) {
+	config := NewMenderConfig()
+	assert.Contains(t, config.GetHttpConfig().UserAgent,
+		"mender-client/"+VersionString())
+
+	config.UserAgent = "gateway-device/2"
+	config.HttpHeaders = map[string]string{"X-Gateway-Token": "secret"}
+	assert.NoError(t, config.Validate())
+	httpConfig := config.GetHttpConfig()
+	assert.Equal(t, "gateway-device/2", httpConfig.UserAgent)
+	// The version is sent along, whatever the User-Agent.
+	assert.NotEmpty(t, httpConfig.ClientVersion)
+	assert.Equal(t, VersionString(), httpConfig.ClientVersion)
+	assert.Equal(t, map[string]string{"X-Gateway-Token": "secret"}, httpConfig.Headers)
+
+	config.HttpHeaders = map[string]string{"X Token": "secret"}
+	assert.Error(t, config.Validate())
+	config.HttpHeaders = map[string]string{"X-Token": "line\nbreak"}
+	assert.Error(t, config.Validate())
+	config.HttpHeaders = nil
+	config.UserAgent = "agent\r\n"
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateClockCheck(t *testing.T) {
+	config := NewMenderConfig()
+	for _, check := range []string{"", ClockCheckWait, ClockCheckServer} {
+		config.ClockCheck = check
+		assert.NoError(t, config.Validate())
+	}
+	config.ClockCheck = "ntp"
+	assert.Error(t, config.Validate())
+}
+
+func TestValidateArtifactDownloadMode(t *testing.T) {
+	config := NewMenderConfig()
+	for _, mode := range []string{"", ArtifactDownloadStream,
+		ArtifactDownloadThenInstall} {
+		config.ArtifactDownloadMode = mode
+		assert.NoError(t, config.Validate())
+	}
+	config.ArtifactDownloadMode = "download"
+	assert.Error(t, config.Validate())
+}
+
+func TestDataDir(t *testing.T) {
+	config := NewMenderConfig()
+	assert.Equal(t, DefaultDataStore, config.GetDataDir())
+	assert.Equal(t, DefaultDataStore, config.GetDeploymentLogLocation())
+	assert.Equal(t, path.Join(DefaultDataStore, "artifact-cache"), config.GetArtifactCacheDir())
+
+	config.DataDir = "/data/mender"
+	assert.Equal(t, "/data/mender", config.GetDeploymentLogLocation())
+	assert.Equal(t, "/data/mender/artifact-cache", config.GetArtifactCacheDir())
+
+	config.UpdateLogPath = "/var/log/mender"
+	assert.Equal(t, "/var/log/mender", config.GetDeploymentLogLocation())
+}
+
+func TestValidateServer(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "TestValidateServer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	cert := path.Join(tdir, "server.crt")
+	assert.NoError(t, ioutil.WriteFile(cert, []byte("certificate"), 0600))
+
+	tests := map[string]struct {
+		set   func(c *MenderConfig)
+		valid bool
+	}{
+		"valid": {
+			set: func(c *MenderConfig) {
+				c.ServerURL = "https://hosted.mender.io"
+				c.ServerCertificate = cert
+				c.HttpsClient.Certificate = cert
+			},
+			valid: true,
+		},
+		"server certificate directory": {
+			set: func(c *MenderConfig) {
+				c.ServerURL = "https://hosted.mender.io"
+				c.ServerCertificate = tdir
+			},
+			valid: true,
+		},
+		"client certificate directory": {
+			set: func(c *MenderConfig) {
+				c.ServerURL = "https://hosted.mender.io"
+				c.HttpsClient.Certificate = tdir
+				c.HttpsClient.Key = path.Join(tdir, "client.key")
+			},
+		},
+		"no server": {
+			set: func(c *MenderConfig) {},
+		},
+		"no scheme": {
+			set: func(c *MenderConfig) { c.ServerURL = "hosted.mender.io" },
+		},
+		"other scheme": {
+			set: func(c *MenderConfig) { c.ServerURL = "ftp://hosted.mender.io" },
+		},
+		"unparsable": {
+			set: func(c *MenderConfig) { c.ServerURL = "https://hosted.mender.io:port" },
+		},
+		"invalid second server": {
+			set: func(c *MenderConfig) {
+				c.Servers = []client.MenderServer{
+					{ServerURL: "https://hosted.mender.io"},
+					{ServerURL: "https://"},
+				}
+			},
+		},
+		"unreadable server certificate": {
+			set: func(c *MenderConfig) {
+				c.ServerURL = "https://hosted.mender.io"
+				c.ServerCertificate = path.Join(tdir, "missing.crt")
+			},
+		},
+		"unreadable client certificate": {
+			set: func(c *MenderConfig) {
+				c.ServerURL = "https://hosted.mender.io"
+				c.HttpsClient.Certificate = path.Join(tdir, "missing.crt")
+				c.HttpsClient.Key = path.Join(tdir, "client.key")
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := NewMenderConfig()
+			test.set(config)
+			assert.NoError(t, config.Validate())
+			err := config.ValidateServer()
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigSignature(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "TestConfigSignature")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	privDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	pubDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	signer := artifact.NewSigner(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDer}))
+
+	confFile := path.Join(tdir, "mender.conf")
+	require.NoError(t, ioutil.WriteFile(confFile, []byte(testConfig), 0600))
+	sig, err := signer.Sign([]byte(testConfig))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(confFile+".sig", sig, 0600))
+
+	oldKeyFile := DefaultConfVerifyKeyFile
+	DefaultConfVerifyKeyFile = path.Join(tdir, "verify-key.pem")
+	defer func() { DefaultConfVerifyKeyFile = oldKeyFile }()
+
+	// Without the key, the signature is not looked at.
+	config, err := LoadConfig(confFile, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, "mender.io", config.ServerURL)
+
+	require.NoError(t, ioutil.WriteFile(DefaultConfVerifyKeyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}), 0600))
+
+	// Valid signature.
+	config, err = LoadConfig(confFile, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, "mender.io", config.ServerURL)
+
+	// The environment, which is not signed, does not override it.
+	os.Setenv("MENDER_SERVER_URL", "https://evil.example.com")
+	defer os.Unsetenv("MENDER_SERVER_URL")
+	config, err = LoadConfig(confFile, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, "mender.io", config.ServerURL)
+	os.Unsetenv("MENDER_SERVER_URL")
+
+	// Tampered configuration.
+	tampered := strings.Replace(testConfig, "mender.io", "evil.example.com", 1)
+	require.NoError(t, ioutil.WriteFile(confFile, []byte(tampered), 0600))
+	config, err = LoadConfig(confFile, "does-not-exist.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+
+	// Missing signature.
+	require.NoError(t, ioutil.WriteFile(confFile, []byte(testConfig), 0600))
+	require.NoError(t, os.Remove(confFile+".sig"))
+	config, err = LoadConfig(confFile, "does-not-exist.config")
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
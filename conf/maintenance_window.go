@@ -0,0 +1,73 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package conf
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaintenanceWindow is a daily time window, in local time, during which the
+// device may reboot into a new update.
+type MaintenanceWindow struct {
+	// Start of the window, as "HH:MM"
+	Start string
+	// Length of the window
+	DurationMinutes int
+}
+
+// IsSet returns true if a maintenance window has been configured.
+func (w MaintenanceWindow) IsSet() bool {
+	return w.Start != ""
+}
+
+// Validate checks that the window is well formed. An unset window is valid.
+func (w MaintenanceWindow) Validate() error {
+	if !w.IsSet() {
+		return nil
+	}
+	if _, err := time.Parse("15:04", w.Start); err != nil {
+		return errors.Wrapf(err, "invalid MaintenanceWindow start %q", w.Start)
+	}
+	if w.DurationMinutes <= 0 || w.DurationMinutes >= 24*60 {
+		return errors.Errorf("invalid MaintenanceWindow duration: %d minutes",
+			w.DurationMinutes)
+	}
+	return nil
+}
+
+// Until returns how long it is from now until the window opens, or 0 if now is
+// within the window, or no window is set.
+func (w MaintenanceWindow) Until(now time.Time) (time.Duration, error) {
+	if !w.IsSet() {
+		return 0, nil
+	}
+	if err := w.Validate(); err != nil {
+		return 0, err
+	}
+	start, _ := time.Parse("15:04", w.Start)
+	length := time.Duration(w.DurationMinutes) * time.Minute
+
+	// Start with yesterday's window, since it may still be open.
+	opens := time.Date(now.Year(), now.Month(), now.Day()-1,
+		start.Hour(), start.Minute(), 0, 0, now.Location())
+	for !now.Before(opens.Add(length)) {
+		opens = opens.AddDate(0, 0, 1)
+	}
+	if now.Before(opens) {
+		return opens.Sub(now), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package conf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2020, time.March, 10, hour, min, 0, 0, time.UTC)
+	}
+
+	tc := map[string]struct {
+		window MaintenanceWindow
+		now    time.Time
+		until  time.Duration
+	}{
+		"not set": {
+			now: at(12, 0),
+		},
+		"inside": {
+			window: MaintenanceWindow{Start: "02:00", DurationMinutes: 120},
+			now:    at(3, 0),
+		},
+		"before": {
+			window: MaintenanceWindow{Start: "02:00", DurationMinutes: 120},
+			now:    at(1, 30),
+			until:  30 * time.Minute,
+		},
+		"after": {
+			window: MaintenanceWindow{Start: "02:00", DurationMinutes: 120},
+			now:    at(4, 0),
+			until:  22 * time.Hour,
+		},
+		"across midnight, before midnight": {
+			window: MaintenanceWindow{Start: "23:00", DurationMinutes: 180},
+			now:    at(23, 30),
+		},
+		"across midnight, after midnight": {
+			window: MaintenanceWindow{Start: "23:00", DurationMinutes: 180},
+			now:    at(1, 0),
+		},
+		"across midnight, outside": {
+			window: MaintenanceWindow{Start: "23:00", DurationMinutes: 180},
+			now:    at(2, 0),
+			until:  21 * time.Hour,
+		},
+	}
+
+	for name, c := range tc {
+		t.Run(name, func(t *testing.T) {
+			until, err := c.window.Until(c.now)
+			assert.NoError(t, err)
+			assert.Equal(t, c.until, until)
+		})
+	}
+
+	_, err := MaintenanceWindow{Start: "25:00", DurationMinutes: 10}.Until(at(1, 0))
+	assert.Error(t, err)
+	_, err = MaintenanceWindow{Start: "01:00"}.Until(at(1, 0))
+	assert.Error(t, err)
+}
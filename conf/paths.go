@@ -32,6 +32,11 @@ var (
 
 	DefaultConfFile         = path.Join(GetConfDirPath(), "mender.conf")
 	DefaultFallbackConfFile = path.Join(GetStateDirPath(), "mender.conf")
+
+	// If present, configuration files must be signed with the matching
+	// private key. It lives with the read-only parts of the client, so it
+	// cannot be swapped out together with the configuration.
+	DefaultConfVerifyKeyFile = path.Join(GetDataDirPath(), "config-verify-key.pem")
 )
 
 var (
@@ -0,0 +1,132 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package conf
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultServerDiscoveryOption is the lease option the server URL is read
+// from, unless ServerDiscoveryOption names another one. It is DHCP option 43.
+const DefaultServerDiscoveryOption = "vendor-encapsulated-options"
+
+// discoverServer returns the server URL in the given option of the most recent
+// lease in a dhclient lease file, or "" if that lease does not have it.
+func discoverServer(leaseFile, option string) (string, error) {
+	file, err := os.Open(leaseFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// dhclient appends each new lease, so the last one is the current one.
+	var value, lease string
+	inLease := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "lease ") || line == "lease{":
+			inLease = true
+			lease = ""
+		case line == "}" && inLease:
+			inLease = false
+			value = lease
+		case inLease && strings.HasPrefix(line, "option "+option+" "):
+			lease = strings.TrimSuffix(
+				strings.TrimSpace(strings.TrimPrefix(line, "option "+option)), ";")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", nil
+	}
+
+	serverURL, err := decodeLeaseValue(value)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid value of option %s", option)
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.Errorf("Option %s holds %q, which is not an http:// "+
+			"or https:// URL", option, serverURL)
+	}
+	return strings.TrimSuffix(serverURL, "/"), nil
+}
+
+// decodeLeaseValue returns the text of an option value, which dhclient writes
+// either as a quoted string or as colon separated hex bytes, such as
+// "68:74:74:70".
+func decodeLeaseValue(value string) (string, error) {
+	if strings.HasPrefix(value, `"`) {
+		return strconv.Unquote(value)
+	}
+	var text []byte
+	for _, b := range strings.Split(value, ":") {
+		if len(b) == 1 {
+			b = "0" + b
+		}
+		decoded, err := hex.DecodeString(b)
+		if err != nil {
+			return "", err
+		}
+		text = append(text, decoded...)
+	}
+	return strings.TrimRight(string(text), "\x00"), nil
+}
+
+// addDiscoveredServer puts the server advertised over DHCP, if any, first in
+// the list, so that the configured servers are only failed over to.
+func (c *MenderConfig) addDiscoveredServer() {
+	if c.ServerDiscoveryLeaseFile == "" {
+		return
+	}
+	option := c.ServerDiscoveryOption
+	if option == "" {
+		option = DefaultServerDiscoveryOption
+	}
+	serverURL, err := discoverServer(c.ServerDiscoveryLeaseFile, option)
+	if err != nil {
+		log.Warnf("Could not read the server from %s, using the configured "+
+			"servers: %s", c.ServerDiscoveryLeaseFile, err)
+		return
+	} else if serverURL == "" {
+		log.Debugf("No server advertised in %s", c.ServerDiscoveryLeaseFile)
+		return
+	}
+
+	for _, server := range c.Servers {
+		if strings.TrimSuffix(server.ServerURL, "/") == serverURL {
+			return
+		}
+	}
+	log.Infof("Using server %s, advertised over DHCP", serverURL)
+	if len(c.Servers) == 1 && c.Servers[0].ServerURL == "" {
+		c.Servers[0].ServerURL = serverURL
+		return
+	}
+	c.Servers = append([]client.MenderServer{{ServerURL: serverURL}},
+		c.Servers...)
+}
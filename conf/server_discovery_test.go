@@ -0,0 +1,98 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Two leases from dhclient, the second one of which is the current one.
+const testLeases = `lease {
+  interface "eth0";
+  fixed-address 192.168.1.10;
+  option subnet-mask 255.255.255.0;
+  option vendor-encapsulated-options "https://old.mender.example.com";
+  renew 4 2020/06/04 10:00:00;
+}
+lease {
+  interface "eth0";
+  fixed-address 192.168.1.11;
+  option subnet-mask 255.255.255.0;
+  option vendor-encapsulated-options "https://mender.example.com/";
+  option mender-server 68:74:74:70:73:3a:2f:2f:68:65:78:2e:65:78:61:6d:70:6c:65;
+  renew 5 2020/06/05 10:00:00;
+}
+`
+
+func TestDiscoverServer(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "TestDiscoverServer")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	leaseFile := path.Join(tdir, "dhclient.leases")
+	require.NoError(t, ioutil.WriteFile(leaseFile, []byte(testLeases), 0644))
+
+	server, err := discoverServer(leaseFile, DefaultServerDiscoveryOption)
+	require.NoError(t, err)
+	assert.Equal(t, "https://mender.example.com", server)
+
+	server, err = discoverServer(leaseFile, "mender-server")
+	require.NoError(t, err)
+	assert.Equal(t, "https://hex.example", server)
+
+	// Not in the current lease.
+	server, err = discoverServer(leaseFile, "domain-name")
+	require.NoError(t, err)
+	assert.Equal(t, "", server)
+
+	_, err = discoverServer(leaseFile, "subnet-mask")
+	assert.Error(t, err)
+	_, err = discoverServer(path.Join(tdir, "missing.leases"),
+		DefaultServerDiscoveryOption)
+	assert.Error(t, err)
+
+	// The advertised server comes first, and the configured one is kept
+	// to fall back to.
+	config := NewMenderConfig()
+	config.ServerURL = "https://configured.example.com"
+	config.ServerDiscoveryLeaseFile = leaseFile
+	require.NoError(t, config.Validate())
+	assert.Equal(t, []client.MenderServer{
+		{ServerURL: "https://mender.example.com"},
+		{ServerURL: "https://configured.example.com"},
+	}, config.Servers)
+
+	// Only the configured server without a lease.
+	config = NewMenderConfig()
+	config.ServerURL = "https://configured.example.com"
+	config.ServerDiscoveryLeaseFile = path.Join(tdir, "missing.leases")
+	require.NoError(t, config.Validate())
+	assert.Equal(t, []client.MenderServer{
+		{ServerURL: "https://configured.example.com"},
+	}, config.Servers)
+
+	// The advertised server is enough by itself.
+	config = NewMenderConfig()
+	config.ServerDiscoveryLeaseFile = leaseFile
+	require.NoError(t, config.Validate())
+	assert.Equal(t, []client.MenderServer{
+		{ServerURL: "https://mender.example.com"},
+	}, config.Servers)
+}
@@ -16,13 +16,31 @@ package conf
 import (
 	"fmt"
 	"runtime"
+	"time"
 )
 
 var (
 	// Version information of current build
 	Version string
+	// Git commit the client was built from
+	GitCommit string
+	// Date of the build, as YYYY-MM-DD
+	BuildDate string
 )
 
+// Used when BuildDate is not set at build time.
+const defaultBuildDate = "2020-06-01"
+
+// BuildTime returns the date the client was built. The system clock is known
+// to be wrong if it is earlier than that.
+func BuildTime() time.Time {
+	if t, err := time.Parse("2006-01-02", BuildDate); err == nil {
+		return t
+	}
+	t, _ := time.Parse("2006-01-02", defaultBuildDate)
+	return t
+}
+
 func VersionString() string {
 	if Version != "" {
 		return Version
@@ -30,6 +48,26 @@ func VersionString() string {
 	return "unknown"
 }
 
+// DefaultUserAgent is what the client identifies itself with to the server,
+// unless configured otherwise.
+func DefaultUserAgent() string {
+	return fmt.Sprintf("mender-client/%s (%s; %s)",
+		VersionString(), runtime.GOOS, runtime.GOARCH)
+}
+
+// BuildInfo describes the build of the client, one line for each of the
+// version, the commit and the date it was built from, and the Go runtime.
+func BuildInfo() string {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	return fmt.Sprintf("version: %s\ncommit: %s\nbuild date: %s\nruntime: %s\n",
+		VersionString(), unknown(GitCommit), unknown(BuildDate), runtime.Version())
+}
+
 func ShowVersion() string {
 	return fmt.Sprintf("%s\truntime: %s",
 		VersionString(), runtime.Version())
@@ -14,8 +14,11 @@
 package conf
 
 import (
-	"github.com/stretchr/testify/assert"
+	"runtime"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestVersionUnknown(t *testing.T) {
@@ -32,3 +35,19 @@ func TestVersionVersion(t *testing.T) {
 	// tag takes priority over other settings
 	assert.Equal(t, "foo", v)
 }
+
+func TestBuildTime(t *testing.T) {
+	BuildDate = "2021-03-04"
+	assert.Equal(t, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), BuildTime())
+
+	BuildDate = ""
+	assert.Equal(t, defaultBuildDate, BuildTime().Format("2006-01-02"))
+}
+
+func TestBuildInfo(t *testing.T) {
+	Version = ""
+	GitCommit = ""
+	BuildDate = ""
+	assert.Equal(t, "version: unknown\ncommit: unknown\nbuild date: unknown\n"+
+		"runtime: "+runtime.Version()+"\n", BuildInfo())
+}
@@ -16,6 +16,7 @@ package datastore
 import (
 	"encoding/json"
 	"os"
+	"time"
 
 	"github.com/mendersoftware/mender/store"
 	"github.com/pkg/errors"
@@ -73,6 +74,64 @@ func LoadProvides(store store.Store) (map[string]string, error) {
 	return provides, nil
 }
 
+// PreviousArtifact is an Artifact which can be restored from the partition it
+// was installed on.
+type PreviousArtifact struct {
+	ArtifactName     string            `json:"artifact_name"`
+	ArtifactGroup    string            `json:"artifact_group,omitempty"`
+	TypeInfoProvides map[string]string `json:"artifact_provides,omitempty"`
+	Partition        string            `json:"partition"`
+}
+
+// StorePreviousArtifact records the currently installed Artifact as the
+// previous one, found on partition once the new Artifact is committed.
+func StorePreviousArtifact(txn store.Transaction, partition string) error {
+	prev := PreviousArtifact{Partition: partition}
+	name, err := txn.ReadAll(ArtifactNameKey)
+	if os.IsNotExist(err) {
+		// Nothing known to go back to.
+		return txn.Remove(PreviousArtifactKey)
+	} else if err != nil {
+		return errors.Wrapf(err, errMsgReadingFromStoreF, "ArtifactName")
+	}
+	prev.ArtifactName = string(name)
+	group, err := txn.ReadAll(ArtifactGroupKey)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, errMsgReadingFromStoreF, "ArtifactGroup")
+	}
+	prev.ArtifactGroup = string(group)
+	provides, err := txn.ReadAll(ArtifactTypeInfoProvidesKey)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, errMsgReadingFromStoreF,
+			"ArtifactTypeInfoProvides")
+	} else if err == nil {
+		if err = json.Unmarshal(provides, &prev.TypeInfoProvides); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(prev)
+	if err != nil {
+		return err
+	}
+	return txn.WriteAll(PreviousArtifactKey, data)
+}
+
+// LoadPreviousArtifact returns the previous Artifact, or nil if there is none
+// which can be restored.
+func LoadPreviousArtifact(store store.Store) (*PreviousArtifact, error) {
+	data, err := store.ReadAll(PreviousArtifactKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, errMsgReadingFromStoreF, "PreviousArtifact")
+	}
+	var prev PreviousArtifact
+	if err = json.Unmarshal(data, &prev); err != nil {
+		return nil, err
+	}
+	return &prev, nil
+}
+
 func StoreStateData(dbStore store.Store, sd StateData) error {
 	return StoreStateDataAndTransaction(dbStore, sd, nil)
 }
@@ -237,3 +296,128 @@ func LoadStateData(dbStore store.Store) (StateData, error) {
 
 	return sd, err
 }
+
+// UpdateAttempts counts the consecutive failures of the most recent
+// deployment.
+type UpdateAttempts struct {
+	DeploymentID string `json:"deployment_id"`
+	Failures     int    `json:"failures"`
+}
+
+// LoadUpdateAttempts returns the stored failure count, which is empty if no
+// deployment has failed since the last successful one.
+func LoadUpdateAttempts(dbStore store.Store) (UpdateAttempts, error) {
+	var attempts UpdateAttempts
+	data, err := dbStore.ReadAll(UpdateAttemptsKey)
+	if os.IsNotExist(err) {
+		return attempts, nil
+	} else if err != nil {
+		return attempts, errors.Wrapf(err, errMsgReadingFromStoreF,
+			"UpdateAttempts")
+	}
+	if err = json.Unmarshal(data, &attempts); err != nil {
+		return attempts, errors.Wrap(err, "corrupt update attempts")
+	}
+	return attempts, nil
+}
+
+func StoreUpdateAttempts(dbStore store.Store, attempts UpdateAttempts) error {
+	data, err := json.Marshal(attempts)
+	if err != nil {
+		return err
+	}
+	return dbStore.WriteAll(UpdateAttemptsKey, data)
+}
+
+// QueuedStatusReport is a status report which is waiting to be sent.
+type QueuedStatusReport struct {
+	DeploymentID string `json:"deployment_id"`
+	Status       string `json:"status"`
+}
+
+// LoadStatusReportQueue returns the status reports waiting to be sent, oldest
+// first.
+func LoadStatusReportQueue(dbStore store.Store) ([]QueuedStatusReport, error) {
+	data, err := dbStore.ReadAll(StatusReportQueueKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, errMsgReadingFromStoreF,
+			"QueuedStatusReport")
+	}
+	var queue []QueuedStatusReport
+	if err = json.Unmarshal(data, &queue); err != nil {
+		return nil, errors.Wrap(err, "corrupt status report queue")
+	}
+	return queue, nil
+}
+
+// StoreStatusReportQueue stores the status reports waiting to be sent, and
+// removes the queue altogether when there are none.
+func StoreStatusReportQueue(dbStore store.Store, queue []QueuedStatusReport) error {
+	if len(queue) == 0 {
+		err := dbStore.Remove(StatusReportQueueKey)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	return dbStore.WriteAll(StatusReportQueueKey, data)
+}
+
+// LastUpdateNoUpdate is the LastUpdate status of an update check which found
+// nothing to install.
+const LastUpdateNoUpdate = "no-update"
+
+// LastUpdateDryRun is the LastUpdate status of an update which was downloaded
+// and verified in a dry run, but not installed. The details are in DryRun.
+const LastUpdateDryRun = "dry-run"
+
+// LastUpdate is the outcome of the most recent update check; either no update,
+// a dry run, or the status the update ended with, as reported to the server.
+type LastUpdate struct {
+	Time         time.Time     `json:"time"`
+	DeploymentID string        `json:"deployment_id,omitempty"`
+	ArtifactName string        `json:"artifact_name,omitempty"`
+	Status       string        `json:"status"`
+	DryRun       *DryRunResult `json:"dry_run,omitempty"`
+}
+
+// DryRunResult is what a dry run found out about the Artifact of an update.
+type DryRunResult struct {
+	// Whether the whole Artifact was downloaded, and verified if the
+	// server gave a checksum; if not, Error says why.
+	Installable       bool     `json:"installable"`
+	Error             string   `json:"error,omitempty"`
+	ChecksumVerified  bool     `json:"checksum_verified"`
+	PayloadTypes      []string `json:"payload_types,omitempty"`
+	CompatibleDevices []string `json:"compatible_devices,omitempty"`
+}
+
+// LoadLastUpdate returns the stored outcome of the last update check, or nil
+// if there has not been any.
+func LoadLastUpdate(dbStore store.Store) (*LastUpdate, error) {
+	data, err := dbStore.ReadAll(LastUpdateKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, errMsgReadingFromStoreF, "LastUpdate")
+	}
+	var last LastUpdate
+	if err = json.Unmarshal(data, &last); err != nil {
+		return nil, errors.Wrap(err, "corrupt last update")
+	}
+	return &last, nil
+}
+
+func StoreLastUpdate(dbStore store.Store, last LastUpdate) error {
+	data, err := json.Marshal(last)
+	if err != nil {
+		return err
+	}
+	return dbStore.WriteAll(LastUpdateKey, data)
+}
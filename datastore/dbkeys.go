@@ -43,6 +43,47 @@ const (
 	// StateDataKey for this, because it contains a lot less information.
 	StandaloneStateKey = "standalone-state"
 
+	// How many times in a row the most recent deployment has failed. Uses
+	// the UpdateAttempts structure, marshalled to JSON. Used to give up on
+	// deployments which keep failing, see MaxUpdateAttempts.
+	UpdateAttemptsKey = "update-attempts"
+
+	// When the daemon last checked for an update, and what came of it.
+	// Uses the LastUpdate structure, marshalled to JSON.
+	LastUpdateKey = "last-update"
+
+	// The ETag of the last answer to an update check, which is sent along
+	// with the next one, so that the first check after a restart can be
+	// answered with 304 Not Modified too.
+	UpdateCheckETagKey = "update-check-etag"
+
+	// Status reports of the ongoing deployment which could not be sent,
+	// oldest first, so that they reach the server in order once it can be
+	// reached again. Uses a list of QueuedStatusReport structures,
+	// marshalled to JSON.
+	StatusReportQueueKey = "status-report-queue"
+
+	// Set once the server has decommissioned the device, after which the
+	// daemon refuses to run. Holds the time of the decommissioning, in
+	// RFC 3339 format.
+	DecommissionedKey = "decommissioned"
+
+	// Set while reboots into installed updates are paused, through the
+	// control API or by a deployment, so that the pause outlasts restarts
+	// of the client. Holds the time of the pause, in RFC 3339 format.
+	RebootPausedKey = "reboot-paused"
+
+	// The Artifact which was committed before the current one, and which
+	// is still intact on the inactive root filesystem partition, so that
+	// it can be booted again. Uses the PreviousArtifact structure,
+	// marshalled to JSON. Removed as soon as the partition is written to.
+	PreviousArtifactKey = "previous-artifact"
+
+	// Holds the name of the inactive root filesystem partition while an
+	// update is being written to it, until the written image has been
+	// verified. If it is still there on startup, the write was cut short.
+	PartitionWriteKey = "partition-write"
+
 	// Name of key that state data is stored under across reboots. Uses the
 	// StateData structure, marshalled to JSON.
 	StateDataKey = "state"
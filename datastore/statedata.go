@@ -16,6 +16,7 @@ package datastore
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -83,12 +84,16 @@ const (
 	MenderStatusReportRetryState
 	// error reporting status
 	MenderStateReportStatusError
+	// wait for the maintenance window before rebooting
+	MenderStateUpdateRebootWait
 	// reboot
 	MenderStateReboot
 	// first state after booting device after rollback reboot
 	MenderStateVerifyReboot
 	// state which runs the ArtifactReboot_Leave scripts
 	MenderStateAfterReboot
+	// wait for the device to be confirmed healthy before committing
+	MenderStateUpdateHealthWait
 	// rollback
 	MenderStateRollback
 	// reboot after rollback
@@ -103,6 +108,8 @@ const (
 	MenderStateUpdateError
 	// cleanup state
 	MenderStateUpdateCleanup
+	// the server has taken the device out of service
+	MenderStateDecommissioned
 	// exit state
 	MenderStateDone
 )
@@ -129,9 +136,11 @@ var (
 		MenderStateUpdateStatusReport:               "update-status-report",
 		MenderStatusReportRetryState:                "update-retry-report",
 		MenderStateReportStatusError:                "status-report-error",
+		MenderStateUpdateRebootWait:                 "update-reboot-wait",
 		MenderStateReboot:                           "reboot",
 		MenderStateVerifyReboot:                     "verify-reboot",
 		MenderStateAfterReboot:                      "after-reboot",
+		MenderStateUpdateHealthWait:                 "update-health-wait",
 		MenderStateRollback:                         "rollback",
 		MenderStateRollbackReboot:                   "rollback-reboot",
 		MenderStateVerifyRollbackReboot:             "verify-rollback-reboot",
@@ -139,6 +148,7 @@ var (
 		MenderStateError:                            "error",
 		MenderStateUpdateError:                      "update-error",
 		MenderStateUpdateCleanup:                    "cleanup",
+		MenderStateDecommissioned:                   "decommissioned",
 		MenderStateDone:                             "finished",
 	}
 )
@@ -226,6 +236,9 @@ type Artifact struct {
 	Source struct {
 		URI    string
 		Expire string
+		// Optional hex encoded SHA256 sum of the whole Artifact, as
+		// provided by the server.
+		Checksum string `json:"checksum,omitempty"`
 	}
 	// Compatible devices for dependency checking.
 	CompatibleDevices []string `json:"device_types_compatible"`
@@ -241,11 +254,45 @@ type Artifact struct {
 	TypeInfoProvides map[string]string `json:"artifact_provides,omitempty"`
 }
 
+// UpdateWindow is an optional period, given by the server, within which an
+// update may be started. Either end may be left out.
+type UpdateWindow struct {
+	ValidAfter  *time.Time `json:"valid_after,omitempty"`
+	ValidBefore *time.Time `json:"valid_before,omitempty"`
+}
+
+// ValidAt returns whether the update may be started at t.
+func (w UpdateWindow) ValidAt(t time.Time) bool {
+	if w.ValidAfter != nil && t.Before(*w.ValidAfter) {
+		return false
+	}
+	if w.ValidBefore != nil && !t.Before(*w.ValidBefore) {
+		return false
+	}
+	return true
+}
+
 // Info about the update in progress.
 type UpdateInfo struct {
 	Artifact Artifact
 	ID       string
 
+	// When the update may be started; any time if not given.
+	UpdateWindow
+
+	// Set by the server for mandatory updates, which reboot as soon as
+	// they are installed, even outside the maintenance window.
+	Force bool `json:"force,omitempty"`
+
+	// Set by the server for deployments which pause reboots once the
+	// update is installed, for when a rollout is coordinated across the
+	// fleet. They stay paused until unpaused through the control API.
+	PauseReboot bool `json:"pause_reboot,omitempty"`
+
+	// When the update is rolled back unless the device has been confirmed
+	// healthy; kept here so that the wait survives a restart.
+	HealthCheckDeadline *time.Time `json:"health_check_deadline,omitempty"`
+
 	// Whether the currently running payloads asked for reboots. It is
 	// indexed the same as PayloadTypes above.
 	RebootRequested RebootRequestedType
@@ -16,6 +16,7 @@ package datastore
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,3 +37,32 @@ func TestMenderState(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, MenderStateInit, s)
 }
+
+func TestUpdateForce(t *testing.T) {
+	var update UpdateInfo
+	assert.NoError(t, json.Unmarshal([]byte(`{"id": "foo"}`), &update))
+	assert.False(t, update.Force)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"id": "foo", "force": true}`), &update))
+	assert.True(t, update.Force)
+}
+
+func TestUpdateWindow(t *testing.T) {
+	var update UpdateInfo
+	err := json.Unmarshal([]byte(`{
+		"id": "foo",
+		"valid_after": "2020-06-01T10:00:00Z",
+		"valid_before": "2020-06-01T12:00:00Z"
+	}`), &update)
+	assert.NoError(t, err)
+
+	at := func(hour, min int) time.Time {
+		return time.Date(2020, 6, 1, hour, min, 0, 0, time.UTC)
+	}
+	assert.False(t, update.ValidAt(at(9, 59)))
+	assert.True(t, update.ValidAt(at(10, 0)))
+	assert.True(t, update.ValidAt(at(11, 59)))
+	assert.False(t, update.ValidAt(at(12, 0)))
+
+	assert.True(t, UpdateWindow{}.ValidAt(at(0, 0)))
+}
@@ -41,8 +41,12 @@ type DeviceManager struct {
 }
 
 func NewDeviceManager(dualRootfsDevice installer.DualRootfsDevice, config *conf.MenderConfig, store store.Store) *DeviceManager {
+	artifactInfoFile := config.ArtifactInfoFile
+	if config.ProvisioningFile != "" {
+		artifactInfoFile = config.ProvisioningFile
+	}
 	d := &DeviceManager{
-		ArtifactInfoFile: config.ArtifactInfoFile,
+		ArtifactInfoFile: artifactInfoFile,
 		DeviceTypeFile:   config.DeviceTypeFile,
 		Config:           *config,
 		StateScriptPath:  config.ArtifactScriptsPath,
@@ -135,6 +139,36 @@ func (d *DeviceManager) GetCurrentArtifactName() (string, error) {
 	return GetManifestData("artifact_name", d.ArtifactInfoFile)
 }
 
+// InstalledArtifact returns the name and version of the installed Artifact.
+// The version is read from the provisioning file, as long as the device still
+// runs the Artifact it was flashed with, and is otherwise the artifact_version
+// provided by the update which installed it. It is empty if neither gives one.
+func (d *DeviceManager) InstalledArtifact() (name, version string, err error) {
+	name, err = d.GetCurrentArtifactName()
+	if err != nil {
+		return "", "", err
+	}
+
+	flashedName, err := GetManifestData("artifact_name", d.ArtifactInfoFile)
+	if err == nil && flashedName == name {
+		version, err = GetManifestData("artifact_version", d.ArtifactInfoFile)
+		if err != nil {
+			return "", "", err
+		}
+		return name, version, nil
+	}
+
+	if d.Store != nil {
+		provides, err := d.GetProvides()
+		if err != nil {
+			log.Errorf("Could not read the Artifact provides from the database: %s", err)
+		} else {
+			version = provides["artifact_version"]
+		}
+	}
+	return name, version, nil
+}
+
 func (d *DeviceManager) GetCurrentArtifactGroup() (string, error) {
 	return GetManifestData("artifact_group", d.ArtifactInfoFile)
 }
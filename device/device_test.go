@@ -0,0 +1,70 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/conf"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstalledArtifact(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestInstalledArtifact")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	provisioning := path.Join(tmpdir, "provisioning")
+	require.NoError(t, ioutil.WriteFile(provisioning, []byte(
+		"# Written by the image build\n"+
+			"artifact_name=release-1\n"+
+			"artifact_version=1.0.4\n"), 0644))
+
+	config := conf.NewMenderConfig()
+	config.ProvisioningFile = provisioning
+	db := store.NewMemStore()
+	d := NewDeviceManager(nil, config, db)
+
+	// Still running the image the device was flashed with.
+	name, version, err := d.InstalledArtifact()
+	require.NoError(t, err)
+	assert.Equal(t, "release-1", name)
+	assert.Equal(t, "1.0.4", version)
+
+	// Updated since; the provisioning file is out of date.
+	require.NoError(t, db.WriteAll(datastore.ArtifactNameKey, []byte("release-2")))
+	name, version, err = d.InstalledArtifact()
+	require.NoError(t, err)
+	assert.Equal(t, "release-2", name)
+	assert.Equal(t, "", version)
+
+	require.NoError(t, db.WriteAll(datastore.ArtifactTypeInfoProvidesKey,
+		[]byte(`{"artifact_version": "2.0.0"}`)))
+	name, version, err = d.InstalledArtifact()
+	require.NoError(t, err)
+	assert.Equal(t, "release-2", name)
+	assert.Equal(t, "2.0.0", version)
+
+	// Neither the database nor the provisioning file name an Artifact.
+	d = NewDeviceManager(nil, config, store.NewMemStore())
+	d.ArtifactInfoFile = path.Join(tmpdir, "missing")
+	_, _, err = d.InstalledArtifact()
+	assert.Error(t, err)
+}
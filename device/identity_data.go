@@ -15,6 +15,8 @@ package device
 
 import (
 	"encoding/json"
+	"net"
+	"os"
 	"path"
 
 	"github.com/mendersoftware/mender/conf"
@@ -41,10 +43,20 @@ type IdentityDataRunner struct {
 	Cmdr   system.Commander
 }
 
-func NewIdentityDataGetter() IdentityDataGetter {
-	return &IdentityDataRunner{
-		IdentityDataHelper,
-		&system.OsCalls{},
+// NewIdentityDataGetter returns the identity source selected by
+// DeviceIdentitySource in the configuration. The identity helper script is
+// used if none is selected.
+func NewIdentityDataGetter(config *conf.MenderConfig) IdentityDataGetter {
+	switch config.DeviceIdentitySource {
+	case conf.IdentitySourceFile:
+		return &IdentityDataFile{Path: config.DeviceIdentityFile}
+	case conf.IdentitySourceMAC:
+		return &IdentityDataMAC{}
+	default:
+		return &IdentityDataRunner{
+			IdentityDataHelper,
+			&system.OsCalls{},
+		}
 	}
 }
 
@@ -76,7 +88,57 @@ func (id IdentityDataRunner) Get() (string, error) {
 		return "", errors.Wrapf(err, "wait for helper failed")
 	}
 
-	collected := p.Collect()
+	return encodeIdentityData(p.Collect())
+}
+
+// IdentityDataFile reads identity data from a file, in the same key=value
+// format as the output of the identity helper.
+type IdentityDataFile struct {
+	Path string
+}
+
+func (id IdentityDataFile) Get() (string, error) {
+	f, err := os.Open(id.Path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open identity file")
+	}
+	defer f.Close()
+
+	p := utils.KeyValParser{}
+	if err := p.Parse(f); err != nil {
+		return "", errors.Wrapf(err, "failed to parse identity data")
+	}
+	return encodeIdentityData(p.Collect())
+}
+
+// IdentityDataMAC uses the MAC address of the first network interface which
+// has one, and is not a loopback interface, as the identity.
+type IdentityDataMAC struct {
+	// Lists the network interfaces, net.Interfaces if nil.
+	Interfaces func() ([]net.Interface, error)
+}
+
+func (id IdentityDataMAC) Get() (string, error) {
+	interfaces := id.Interfaces
+	if interfaces == nil {
+		interfaces = net.Interfaces
+	}
+	ifaces, err := interfaces()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list network interfaces")
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		return encodeIdentityData(map[string][]string{
+			"mac": {iface.HardwareAddr.String()},
+		})
+	}
+	return "", errors.New("no network interface with a MAC address found")
+}
+
+func encodeIdentityData(collected map[string][]string) (string, error) {
 	if len(collected) == 0 {
 		return "", errors.New("no identity data colleted")
 	}
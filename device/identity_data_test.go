@@ -15,10 +15,17 @@ package device
 
 import (
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
 	"testing"
 
+	"github.com/mendersoftware/mender/conf"
 	stest "github.com/mendersoftware/mender/system/testing"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeviceIdentityGet(t *testing.T) {
@@ -109,3 +116,74 @@ keyvalue
 		}
 	}
 }
+
+func TestDeviceIdentityFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "identity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	idFile := path.Join(tmpdir, "identity")
+	require.NoError(t, ioutil.WriteFile(idFile,
+		[]byte("serial=1234\nmac=de:ad:be:ef:00:01\n"), 0644))
+
+	id, err := IdentityDataFile{Path: idFile}.Get()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"serial":"1234","mac":"de:ad:be:ef:00:01"}`, id)
+
+	require.NoError(t, ioutil.WriteFile(idFile, []byte("keyvalue\n"), 0644))
+	_, err = IdentityDataFile{Path: idFile}.Get()
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(idFile, nil, 0644))
+	_, err = IdentityDataFile{Path: idFile}.Get()
+	assert.Error(t, err)
+
+	_, err = IdentityDataFile{Path: path.Join(tmpdir, "missing")}.Get()
+	assert.Error(t, err)
+}
+
+func TestDeviceIdentityMAC(t *testing.T) {
+	mac, _ := net.ParseMAC("de:ad:be:ef:00:01")
+	loMAC, _ := net.ParseMAC("00:00:00:00:00:01")
+
+	ir := IdentityDataMAC{
+		Interfaces: func() ([]net.Interface, error) {
+			return []net.Interface{
+				{Name: "lo", Flags: net.FlagLoopback, HardwareAddr: loMAC},
+				{Name: "tun0"},
+				{Name: "eth0", HardwareAddr: mac},
+			}, nil
+		},
+	}
+	id, err := ir.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"mac":"de:ad:be:ef:00:01"}`, id)
+
+	ir.Interfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Name: "lo", Flags: net.FlagLoopback}}, nil
+	}
+	_, err = ir.Get()
+	assert.Error(t, err)
+
+	ir.Interfaces = func() ([]net.Interface, error) {
+		return nil, errors.New("no network")
+	}
+	_, err = ir.Get()
+	assert.Error(t, err)
+}
+
+func TestNewIdentityDataGetter(t *testing.T) {
+	config := conf.NewMenderConfig()
+	assert.IsType(t, &IdentityDataRunner{}, NewIdentityDataGetter(config))
+
+	config.DeviceIdentitySource = conf.IdentitySourceScript
+	assert.IsType(t, &IdentityDataRunner{}, NewIdentityDataGetter(config))
+
+	config.DeviceIdentitySource = conf.IdentitySourceFile
+	config.DeviceIdentityFile = "/etc/mender/identity"
+	assert.Equal(t, &IdentityDataFile{Path: "/etc/mender/identity"},
+		NewIdentityDataGetter(config))
+
+	config.DeviceIdentitySource = conf.IdentitySourceMAC
+	assert.IsType(t, &IdentityDataMAC{}, NewIdentityDataGetter(config))
+}
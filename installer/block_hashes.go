@@ -0,0 +1,151 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The payload meta-data key which holds the hashes of the blocks of a rootfs
+// image, in this form:
+//
+//   "block_hashes": {
+//       "block_size": 1048576,
+//       "sha256": ["<hash of the first block>", ...]
+//   }
+//
+// The last block may be shorter than the others.
+const blockHashesKey = "block_hashes"
+
+// maxHashedBlockSize bounds the block_size, since a whole block is held in
+// memory until it has been verified.
+const maxHashedBlockSize = 4 * 1024 * 1024
+
+type blockHashes struct {
+	BlockSize int      `json:"block_size"`
+	Sha256    []string `json:"sha256"`
+
+	sums [][]byte
+}
+
+// parseBlockHashes returns the block hashes in the meta-data of a payload, or
+// nil if it does not have any.
+func parseBlockHashes(metaData map[string]interface{}) (*blockHashes, error) {
+	value, ok := metaData[blockHashesKey]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var hashes blockHashes
+	if err = json.Unmarshal(data, &hashes); err != nil {
+		return nil, errors.Wrapf(err, "Invalid %s in the payload meta-data", blockHashesKey)
+	}
+	if hashes.BlockSize <= 0 || len(hashes.Sha256) == 0 {
+		return nil, errors.Errorf("The %s in the payload meta-data need both "+
+			"a block_size and a list of sha256 hashes", blockHashesKey)
+	}
+	if hashes.BlockSize > maxHashedBlockSize {
+		return nil, errors.Errorf("The block_size of %d in the %s of the payload "+
+			"meta-data is larger than the maximum of %d", hashes.BlockSize,
+			blockHashesKey, maxHashedBlockSize)
+	}
+	for n, h := range hashes.Sha256 {
+		sum, err := hex.DecodeString(h)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, errors.Errorf("Hash %d in the %s of the payload meta-data "+
+				"is not a SHA256 hash: %q", n, blockHashesKey, h)
+		}
+		hashes.sums = append(hashes.sums, sum)
+	}
+	return &hashes, nil
+}
+
+// blockVerifier checks each block of an image against its hash before passing
+// it on, so that a corrupt block is caught as soon as it has been downloaded,
+// and never gets written.
+type blockVerifier struct {
+	w      io.Writer
+	hashes *blockHashes
+	block  []byte
+	n      int
+}
+
+func newBlockVerifier(w io.Writer, hashes *blockHashes) *blockVerifier {
+	return &blockVerifier{
+		w:      w,
+		hashes: hashes,
+		block:  make([]byte, 0, hashes.BlockSize),
+	}
+}
+
+func (v *blockVerifier) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		fill := cap(v.block) - len(v.block)
+		if fill > len(p) {
+			fill = len(p)
+		}
+		v.block = append(v.block, p[:fill]...)
+		p = p[fill:]
+		written += fill
+		if len(v.block) == cap(v.block) {
+			if err := v.writeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (v *blockVerifier) writeBlock() error {
+	if v.n >= len(v.hashes.sums) {
+		return errors.Errorf("The image is longer than the %d blocks it has hashes for",
+			len(v.hashes.sums))
+	}
+	sum := sha256.Sum256(v.block)
+	if !bytes.Equal(sum[:], v.hashes.sums[v.n]) {
+		return errors.Errorf("Block %d of the image, at offset %d, does not match its hash",
+			v.n, v.n*v.hashes.BlockSize)
+	}
+	if _, err := v.w.Write(v.block); err != nil {
+		return err
+	}
+	v.n++
+	v.block = v.block[:0]
+	return nil
+}
+
+// Flush verifies and writes the last, short, block, and makes sure that the
+// image was not cut short.
+func (v *blockVerifier) Flush() error {
+	if len(v.block) > 0 {
+		if err := v.writeBlock(); err != nil {
+			return err
+		}
+	}
+	if v.n != len(v.hashes.sums) {
+		return errors.Errorf("The image has %d blocks, but there are hashes for %d",
+			v.n, len(v.hashes.sums))
+	}
+	return nil
+}
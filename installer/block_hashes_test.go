@@ -0,0 +1,137 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockHashesMetaData returns payload meta-data with the hashes of image, as
+// it would be read from an Artifact.
+func blockHashesMetaData(t *testing.T, image []byte, blockSize int) map[string]interface{} {
+	var sums []string
+	for off := 0; off < len(image); off += blockSize {
+		end := off + blockSize
+		if end > len(image) {
+			end = len(image)
+		}
+		sum := sha256.Sum256(image[off:end])
+		sums = append(sums, hex.EncodeToString(sum[:]))
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"block_hashes": map[string]interface{}{
+			"block_size": blockSize,
+			"sha256":     sums,
+		},
+	})
+	require.NoError(t, err)
+	var metaData map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &metaData))
+	return metaData
+}
+
+func TestParseBlockHashes(t *testing.T) {
+	hashes, err := parseBlockHashes(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, hashes)
+
+	hashes, err = parseBlockHashes(blockHashesMetaData(t, []byte("0123456789"), 4))
+	require.NoError(t, err)
+	assert.Equal(t, 4, hashes.BlockSize)
+	assert.Len(t, hashes.sums, 3)
+
+	for _, bad := range []string{
+		`{"block_hashes": "abc"}`,
+		`{"block_hashes": {"sha256": []}}`,
+		`{"block_hashes": {"block_size": 4, "sha256": []}}`,
+		`{"block_hashes": {"block_size": 4, "sha256": ["abc"]}}`,
+		`{"block_hashes": {"block_size": 4194305, "sha256": ["` +
+			strings.Repeat("0", sha256.Size*2) + `"]}}`,
+	} {
+		var metaData map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(bad), &metaData))
+		_, err = parseBlockHashes(metaData)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestStoreUpdateBlockHashes(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "blockhashes")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	const blockSize = 1024
+	image := make([]byte, 3*blockSize+100)
+	for n := range image {
+		image[n] = byte(n * 7)
+	}
+	part := filepath.Join(tmpdir, "inactivePart")
+
+	oldSizeOf := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = oldSizeOf
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, uint64(len(image)), nil, part)
+	BlockDeviceGetSectorSizeOf = makeBlockDeviceSectorSize(t, 512, nil, part)
+
+	testDevice := dualRootfsDeviceImpl{}
+	testDevice.partitions = &partitions{inactive: part}
+
+	storeImage := func(image, hashed []byte) error {
+		require.NoError(t, ioutil.WriteFile(part, make([]byte, len(image)), 0600))
+		hashes, err := parseBlockHashes(blockHashesMetaData(t, hashed, blockSize))
+		require.NoError(t, err)
+		testDevice.blockHashes = hashes
+		return testDevice.StoreUpdate(bytes.NewReader(image),
+			&sizeOnlyFileInfo{int64(len(image))})
+	}
+
+	// A good image is written in full.
+	require.NoError(t, storeImage(image, image))
+	written, err := ioutil.ReadFile(part)
+	require.NoError(t, err)
+	assert.Equal(t, image, written)
+
+	// A corrupt block in the middle stops the write before it gets there.
+	corrupt := append([]byte{}, image...)
+	corrupt[blockSize+blockSize/2] ^= 0xff
+	err = storeImage(corrupt, image)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(),
+		"Block 1 of the image, at offset 1024, does not match its hash")
+	written, err = ioutil.ReadFile(part)
+	require.NoError(t, err)
+	assert.NotEqual(t, corrupt[blockSize:2*blockSize], written[blockSize:2*blockSize])
+
+	// So do images which do not have as many blocks as there are hashes.
+	err = storeImage(image[:2*blockSize], image)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "The image has 2 blocks, but there are hashes for 4")
+	err = storeImage(image, image[:2*blockSize])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "longer than the 2 blocks")
+}
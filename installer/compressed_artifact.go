@@ -0,0 +1,63 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Compression formats an Artifact may be wrapped in as a whole, to save
+// bandwidth, and how to recognize them. An uncompressed Artifact is a tar
+// archive, which starts with neither.
+var artifactCompressions = []struct {
+	name       string
+	compressor string
+	magic      []byte
+}{
+	{"gzip", "gzip", []byte{0x1f, 0x8b, 0x08}},
+	{"xz", "lzma", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// decompressArtifact returns the uncompressed Artifact if art is a gzip or xz
+// compressed Artifact, and art as it is otherwise. The Artifact reader
+// verifies the size and checksum of each payload as usual, so a truncated or
+// corrupt stream is caught there.
+func decompressArtifact(art io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(art)
+	for _, c := range artifactCompressions {
+		// Errors are returned again on the first read.
+		head, _ := buffered.Peek(len(c.magic))
+		if !bytes.Equal(head, c.magic) {
+			continue
+		}
+
+		compressor, err := artifact.NewCompressorFromId(c.compressor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "the Artifact is %s compressed", c.name)
+		}
+		decompressed, err := compressor.NewReader(buffered)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress the %s compressed Artifact", c.name)
+		}
+		log.Infof("Installer: The Artifact is %s compressed; decompressing it", c.name)
+		return decompressed, nil
+	}
+	return buffered, nil
+}
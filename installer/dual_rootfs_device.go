@@ -20,6 +20,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/handlers"
@@ -34,37 +35,58 @@ const (
 		"Either the switch to the new partition was unsuccessful, or the bootloader rolled back"
 	verifyRollbackRebootError = "Reboot to the old update failed. " +
 		"Expected \"upgrade_available\" flag to be false but it was true"
+	verifyRebootPartitionErrorF = "Reboot to the new update failed. " +
+		"Running from partition %s, but the bootloader was told to boot partition %s. " +
+		"The bootloader did not switch to the new partition"
+
+	// Enough to wipe the superblock of any filesystem we support, as well
+	// as the bootloader signatures some boards look for.
+	invalidatePartitionSize = 64 * 1024
 )
 
 type DualRootfsDeviceConfig struct {
 	RootfsPartA string
 	RootfsPartB string
+	// Fail the update if the inactive partition is mounted, instead of
+	// unmounting it.
+	RefuseMountedInactive bool
 }
 
 type dualRootfsDeviceImpl struct {
 	BootEnvReadWriter
 	system.Commander
 	*partitions
-	rebooter *system.SystemRebootCmd
+	rebooter      *system.SystemRebootCmd
+	refuseMounted bool
+	// Of the payload being stored, if its meta-data has them.
+	blockHashes *blockHashes
 }
 
 // This interface is only here for tests.
 type DualRootfsDevice interface {
 	PayloadUpdatePerformer
 	handlers.UpdateStorerProducer
-	GetInactive() (string, error)
-	GetActive() (string, error)
+	PartitionInvalidator
+	FreeSpaceReporter
+	PartitionRestorer
+	PartitionLister
+	InactiveIsSafe() (bool, error)
+	IsInactiveMounted() (bool, error)
 }
 
+// The mount table checkMounted looks in.
+var mountsFile = "/proc/self/mounts"
+
 // checkMounted parses /proc/self/mounts to check
 // if device partition @part is a mounted fileststem.
 // return: The mount target if partition is mounted
 //         else an empty string is returned
 func checkMounted(part string) string {
-	file, err := os.Open("/proc/self/mounts")
+	file, err := os.Open(mountsFile)
 	if err != nil {
 		return ""
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		words := strings.Fields(scanner.Text())
@@ -95,6 +117,7 @@ func NewDualRootfsDevice(env BootEnvReadWriter, sc system.StatCommander, config
 		Commander:         sc,
 		partitions:        &partitions,
 		rebooter:          system.NewSystemRebootCmd(sc),
+		refuseMounted:     config.RefuseMountedInactive,
 	}
 	return &dualRootfsDevice
 }
@@ -173,10 +196,50 @@ func (d *dualRootfsDeviceImpl) Initialize(artifactHeaders,
 	artifactAugmentedHeaders artifact.HeaderInfoer,
 	payloadHeaders handlers.ArtifactUpdateHeaders) error {
 
+	d.blockHashes = nil
+	if payloadHeaders == nil {
+		return nil
+	}
+	metaData, err := payloadHeaders.GetUpdateMetaData()
+	if err != nil {
+		return err
+	}
+	d.blockHashes, err = parseBlockHashes(metaData)
+	if err != nil {
+		return err
+	}
+	if d.blockHashes != nil {
+		log.Infof("Verifying the image in %d blocks of %d bytes",
+			len(d.blockHashes.sums), d.blockHashes.BlockSize)
+	}
 	return nil
 }
 
 func (d *dualRootfsDeviceImpl) PrepareStoreUpdate() error {
+	safe, err := d.InactiveIsSafe()
+	if err != nil {
+		return errors.Wrap(err, "Could not check the inactive partition")
+	}
+	if !safe {
+		inactive, _ := d.GetInactive()
+		log.Errorf("Partition %s is both the inactive partition and the running root filesystem",
+			inactive)
+		return ErrorInactivePartitionIsRoot
+	}
+
+	// Otherwise it is unmounted when it is opened for writing.
+	if d.refuseMounted {
+		mounted, err := d.IsInactiveMounted()
+		if err != nil {
+			return errors.Wrap(err, "Could not check whether the inactive partition is mounted")
+		}
+		if mounted {
+			inactive, _ := d.GetInactive()
+			log.Errorf("Partition %s, which the update is written to, is mounted at %s",
+				inactive, checkMounted(inactive))
+			return ErrorInactivePartitionMounted
+		}
+	}
 	return nil
 }
 
@@ -195,7 +258,17 @@ func (d *dualRootfsDeviceImpl) StoreUpdate(image io.Reader, info os.FileInfo) er
 		return errors.Wrapf(err, errmsg, inactivePartition)
 	}
 
-	n, err := io.Copy(dev, image)
+	var w io.Writer = dev
+	var verifier *blockVerifier
+	if d.blockHashes != nil {
+		verifier = newBlockVerifier(dev, d.blockHashes)
+		w = verifier
+	}
+
+	n, err := io.Copy(w, image)
+	if err == nil && verifier != nil {
+		err = verifier.Flush()
+	}
 	if err != nil {
 		dev.Close()
 		return err
@@ -215,6 +288,74 @@ func (d *dualRootfsDeviceImpl) FinishStoreUpdate() error {
 	return nil
 }
 
+// InvalidatePartition overwrites the start of the inactive partition with
+// zeros, so that a partially written image can never be mistaken for a valid
+// filesystem.
+func (d *dualRootfsDeviceImpl) InvalidatePartition() error {
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Invalidating the inactive partition: %s", inactivePartition)
+
+	dev, err := blockdevice.Open(inactivePartition, invalidatePartitionSize)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to invalidate the inactive partition: %q",
+			inactivePartition)
+	}
+
+	_, err = dev.Write(make([]byte, invalidatePartitionSize))
+	if err != nil {
+		dev.Close()
+		return errors.Wrapf(err, "Failed to invalidate the inactive partition: %q",
+			inactivePartition)
+	}
+
+	return dev.Close()
+}
+
+// FreeSpace returns the size of the inactive partition, since the whole of it
+// is overwritten by the update.
+func (d *dualRootfsDeviceImpl) FreeSpace() (uint64, error) {
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return 0, err
+	}
+	bd := BlockDevice{Path: inactivePartition}
+	size, err := bd.Size()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get the size of the inactive partition: %q",
+			inactivePartition)
+	}
+	return size, nil
+}
+
+// Partitions returns the active partition, with the free space on the root
+// filesystem it is mounted as, and the inactive partition.
+func (d *dualRootfsDeviceImpl) Partitions() ([]Partition, error) {
+	active, err := d.GetActive()
+	if err != nil {
+		return nil, err
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/", &stat); err != nil {
+		return nil, errors.Wrap(err, "Failed to get the free space on the root filesystem")
+	}
+	inactive, err := d.GetInactive()
+	if err != nil {
+		return nil, err
+	}
+	size, err := d.FreeSpace()
+	if err != nil {
+		return nil, err
+	}
+	return []Partition{
+		{Device: active, Active: true, FreeSpace: stat.Bavail * uint64(stat.Bsize)},
+		{Device: inactive, FreeSpace: size},
+	}, nil
+}
+
 func (d *dualRootfsDeviceImpl) getInactivePartition() (string, string, error) {
 	inactivePartition, err := d.GetInactive()
 	if err != nil {
@@ -269,6 +410,31 @@ func (d *dualRootfsDeviceImpl) InstallUpdate() error {
 	return nil
 }
 
+// EnableInactive switches the bootloader over to the inactive partition for
+// good. Unlike InstallUpdate, the bootloader does not fall back if it fails to
+// boot, so it is only meant for partitions which were committed before.
+func (d *dualRootfsDeviceImpl) EnableInactive() error {
+	hasUpdate, err := d.HasUpdate()
+	if err != nil {
+		return err
+	} else if hasUpdate {
+		return errors.New("An update is in progress; commit or roll it back first")
+	}
+
+	inactivePartition, inactivePartitionHex, err := d.getInactivePartition()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Enabling the previous root filesystem on partition %s", inactivePartition)
+	return d.WriteEnv(BootVars{
+		"upgrade_available":    "0",
+		"mender_boot_part":     inactivePartition,
+		"mender_boot_part_hex": inactivePartitionHex,
+		"bootcount":            "0",
+	})
+}
+
 func (d *dualRootfsDeviceImpl) CommitUpdate() error {
 	// Check if the user has an upgrade to commit, if not, throw an error
 	hasUpdate, err := d.HasUpdate()
@@ -302,9 +468,31 @@ func (d *dualRootfsDeviceImpl) VerifyReboot() error {
 		return err
 	} else if !hasUpdate {
 		return errors.New(verifyRebootError)
-	} else {
-		return nil
 	}
+	return d.verifyBootedPartition()
+}
+
+// verifyBootedPartition checks that the partition we are running from is the
+// one InstallUpdate marked as the boot candidate. If the bootloader did not
+// honor the switch we are still running the old partition, and committing now
+// would make the untested partition the permanent one.
+func (d *dualRootfsDeviceImpl) verifyBootedPartition() error {
+	env, err := d.ReadEnv("mender_boot_part")
+	if err != nil {
+		return errors.Wrapf(err, "failed to read environment variable")
+	}
+	bootPartition, ok := env["mender_boot_part"]
+	if !ok {
+		return errors.New("The bootloader environment does not have the 'mender_boot_part' set. This is a critical error.")
+	}
+	activePartition, _, err := d.getActivePartition()
+	if err != nil {
+		return err
+	}
+	if bootPartition != activePartition {
+		return errors.Errorf(verifyRebootPartitionErrorF, activePartition, bootPartition)
+	}
+	return nil
 }
 
 func (d *dualRootfsDeviceImpl) VerifyRollbackReboot() error {
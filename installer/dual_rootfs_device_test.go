@@ -14,8 +14,12 @@
 package installer
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -24,6 +28,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // implements BootEnvReadWriter
@@ -116,6 +121,137 @@ func Test_enableUpdatedPartition_correctPartitionNumber(t *testing.T) {
 	}
 }
 
+func TestEnableInactive(t *testing.T) {
+	env := &fakeBootEnv{readVars: BootVars{"upgrade_available": "0"}}
+	testDevice := dualRootfsDeviceImpl{
+		BootEnvReadWriter: env,
+		partitions:        &partitions{inactive: "/dev/mmcblk0p3"},
+	}
+	require.NoError(t, testDevice.EnableInactive())
+	assert.Equal(t, BootVars{
+		"upgrade_available":    "0",
+		"mender_boot_part":     "3",
+		"mender_boot_part_hex": "3",
+		"bootcount":            "0",
+	}, env.writeVars)
+
+	// Not while an update waits to be committed.
+	env = &fakeBootEnv{readVars: BootVars{"upgrade_available": "1"}}
+	testDevice.BootEnvReadWriter = env
+	assert.Error(t, testDevice.EnableInactive())
+	assert.Nil(t, env.writeVars)
+}
+
+func TestInvalidatePartition(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "invalidate")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	testDevice := dualRootfsDeviceImpl{}
+	fakePartitions := partitions{}
+	fakePartitions.inactive = filepath.Join(tmpdir, "non-existing")
+	testDevice.partitions = &fakePartitions
+
+	assert.Error(t, testDevice.InvalidatePartition())
+
+	// Fill the partition with a left-over, half-written image.
+	part := filepath.Join(tmpdir, "inactivePart")
+	partSize := 2 * invalidatePartitionSize
+	require.NoError(t, ioutil.WriteFile(part,
+		bytes.Repeat([]byte{0xaa}, partSize), 0600))
+	fakePartitions.inactive = part
+
+	oldSizeOf := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = oldSizeOf
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, uint64(partSize), nil, part)
+	BlockDeviceGetSectorSizeOf = makeBlockDeviceSectorSize(t, 512, nil, part)
+
+	require.NoError(t, testDevice.InvalidatePartition())
+
+	content, err := ioutil.ReadFile(part)
+	require.NoError(t, err)
+	require.Len(t, content, partSize)
+	assert.Equal(t, make([]byte, invalidatePartitionSize), content[:invalidatePartitionSize])
+	assert.Equal(t, bytes.Repeat([]byte{0xaa}, partSize-invalidatePartitionSize),
+		content[invalidatePartitionSize:])
+}
+
+func TestPrepareStoreUpdateRefusesRunningRoot(t *testing.T) {
+	testDevice := dualRootfsDeviceImpl{}
+	testDevice.partitions = &partitions{
+		active:   "/dev/mmcblk0p2",
+		inactive: "/dev/mmcblk0p2",
+	}
+	assert.Equal(t, ErrorInactivePartitionIsRoot, testDevice.PrepareStoreUpdate())
+}
+
+func TestPrepareStoreUpdateMountedInactive(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mounted")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	oldMountsFile := mountsFile
+	defer func() { mountsFile = oldMountsFile }()
+	mountsFile = filepath.Join(tmpdir, "mounts")
+
+	testDevice := dualRootfsDeviceImpl{refuseMounted: true}
+	testDevice.partitions = &partitions{
+		StatCommander: fakeStatCommander{err: errors.New("no root")},
+		active:        "/dev/mmcblk0p2",
+		inactive:      "/dev/mmcblk0p3",
+	}
+
+	require.NoError(t, ioutil.WriteFile(mountsFile,
+		[]byte("/dev/mmcblk0p2 / ext4 rw,relatime 0 0\n"), 0600))
+	mounted, err := testDevice.IsInactiveMounted()
+	require.NoError(t, err)
+	assert.False(t, mounted)
+	assert.NoError(t, testDevice.PrepareStoreUpdate())
+
+	require.NoError(t, ioutil.WriteFile(mountsFile,
+		[]byte("/dev/mmcblk0p2 / ext4 rw,relatime 0 0\n"+
+			"/dev/mmcblk0p3 /media/rootfs ext4 rw,relatime 0 0\n"), 0600))
+	mounted, err = testDevice.IsInactiveMounted()
+	require.NoError(t, err)
+	assert.True(t, mounted)
+	assert.Equal(t, ErrorInactivePartitionMounted, testDevice.PrepareStoreUpdate())
+
+	// Left to be unmounted when the partition is opened.
+	testDevice.refuseMounted = false
+	assert.NoError(t, testDevice.PrepareStoreUpdate())
+}
+
+func TestFreeSpace(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "freespace")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	testDevice := dualRootfsDeviceImpl{}
+	fakePartitions := partitions{}
+	fakePartitions.inactive = filepath.Join(tmpdir, "non-existing")
+	testDevice.partitions = &fakePartitions
+
+	_, err = testDevice.FreeSpace()
+	assert.Error(t, err)
+
+	part := filepath.Join(tmpdir, "inactivePart")
+	require.NoError(t, ioutil.WriteFile(part, nil, 0600))
+	fakePartitions.inactive = part
+
+	oldSizeOf := BlockDeviceGetSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = oldSizeOf
+	}()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, 4096, nil, part)
+
+	size, err := testDevice.FreeSpace()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4096), size)
+}
+
 type sizeOnlyFileInfo struct {
 	size int64
 }
@@ -258,8 +394,8 @@ func Test_Rollback_OK(t *testing.T) {
 
 func TestDeviceVerifyReboot(t *testing.T) {
 	config := DualRootfsDeviceConfig{
-		"part1",
-		"part2",
+		RootfsPartA: "part1",
+		RootfsPartB: "part2",
 	}
 
 	runner := stest.NewTestOSCalls("", 255)
@@ -279,11 +415,33 @@ func TestDeviceVerifyReboot(t *testing.T) {
 	err = testDevice.VerifyReboot()
 	assert.EqualError(t, err, verifyRebootError)
 
-	runner = stest.NewTestOSCalls("upgrade_available=1", 0)
+	// Booted into the partition the bootloader was told to boot.
+	runner = stest.NewTestOSCalls("upgrade_available=1\nmender_boot_part=2", 0)
 	testDevice = NewDualRootfsDevice(
 		&UBootEnv{runner},
 		nil,
 		config)
+	testDevice.(*dualRootfsDeviceImpl).active = "part2"
 	err = testDevice.VerifyReboot()
 	assert.NoError(t, err)
+
+	// The bootloader ignored the switch, and we are still running from
+	// the old partition.
+	runner = stest.NewTestOSCalls("upgrade_available=1\nmender_boot_part=2", 0)
+	testDevice = NewDualRootfsDevice(
+		&UBootEnv{runner},
+		nil,
+		config)
+	testDevice.(*dualRootfsDeviceImpl).active = "part1"
+	err = testDevice.VerifyReboot()
+	assert.EqualError(t, err, fmt.Sprintf(verifyRebootPartitionErrorF, "1", "2"))
+
+	runner = stest.NewTestOSCalls("upgrade_available=1", 0)
+	testDevice = NewDualRootfsDevice(
+		&UBootEnv{runner},
+		nil,
+		config)
+	testDevice.(*dualRootfsDeviceImpl).active = "part1"
+	err = testDevice.VerifyReboot()
+	assert.Error(t, err)
 }
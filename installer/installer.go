@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/mendersoftware/mender-artifact/areader"
 	"github.com/mendersoftware/mender-artifact/artifact"
@@ -31,6 +32,8 @@ type Rebooter interface {
 	Reboot() error
 }
 
+// PayloadUpdatePerformer is the update module for one payload in an Artifact.
+// Each payload is handed to the performer registered for its type.
 type PayloadUpdatePerformer interface {
 	Rebooter
 	handlers.UpdateStorer
@@ -50,6 +53,48 @@ type PayloadUpdatePerformer interface {
 	GetType() string
 }
 
+// PartitionInvalidator is implemented by payload handlers which write straight
+// to a partition, and which therefore may leave it half-written if storing the
+// payload fails.
+type PartitionInvalidator interface {
+	// Make the partition unbootable, so that a later update cannot enable
+	// it by mistake.
+	InvalidatePartition() error
+}
+
+// FreeSpaceReporter is implemented by payload handlers which can tell up front
+// how much space there is for a new payload.
+type FreeSpaceReporter interface {
+	// Number of bytes available for storing the payload.
+	FreeSpace() (uint64, error)
+}
+
+// Partition is a root filesystem partition, and how much room it has.
+type Partition struct {
+	Device string `json:"device"`
+	Active bool   `json:"active"`
+	// Bytes free on the filesystem for the active partition, and the size
+	// of the inactive one, since it is overwritten by the next update.
+	FreeSpace uint64 `json:"free_space"`
+}
+
+// PartitionLister is implemented by devices which keep the root filesystem
+// on partitions.
+type PartitionLister interface {
+	Partitions() ([]Partition, error)
+}
+
+// PartitionRestorer is implemented by payload handlers which leave the previous
+// root filesystem on a partition of its own, so that it can be booted again.
+type PartitionRestorer interface {
+	// The partition the previous root filesystem is on.
+	GetInactive() (string, error)
+	GetActive() (string, error)
+	// Boot the inactive partition from the next reboot on, as a committed
+	// root filesystem.
+	EnableInactive() error
+}
+
 type AllModules struct {
 	// Built-in module.
 	DualRootfs handlers.UpdateStorerProducer
@@ -82,6 +127,32 @@ var (
 	ErrorNothingToCommit = errors.New("There is nothing to commit")
 )
 
+// IncompatibleDeviceError is returned for an Artifact which is not meant for
+// the type of this device.
+type IncompatibleDeviceError struct {
+	CompatibleDevices []string
+	DeviceType        string
+}
+
+func (e *IncompatibleDeviceError) Error() string {
+	return fmt.Sprintf("installer: image (device types %v) not compatible with device %v",
+		e.CompatibleDevices, e.DeviceType)
+}
+
+// CheckCompatibleDevices returns an IncompatibleDeviceError unless deviceType
+// is one of devices.
+func CheckCompatibleDevices(devices []string, deviceType string) error {
+	for _, dev := range devices {
+		if dev == deviceType {
+			return nil
+		}
+	}
+	return &IncompatibleDeviceError{
+		CompatibleDevices: devices,
+		DeviceType:        deviceType,
+	}
+}
+
 func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 	inst *AllModules) ([]PayloadUpdatePerformer, error) {
 
@@ -101,11 +172,17 @@ func ReadHeaders(art io.ReadCloser, dt string, key []byte, scrDir string,
 	var installers []PayloadUpdatePerformer
 	var err error
 
+	// The whole Artifact may be compressed in transit.
+	in, err := decompressArtifact(art)
+	if err != nil {
+		return nil, installers, errors.Wrap(err, "installer: failed to read Artifact")
+	}
+
 	// if there is a verification key artifact must be signed
 	if key != nil {
-		ar = areader.NewReaderSigned(art)
+		ar = areader.NewReaderSigned(in)
 	} else {
-		ar = areader.NewReader(art)
+		ar = areader.NewReader(in)
 		log.Info("No public key was provided for authenticating the artifact")
 	}
 
@@ -123,13 +200,7 @@ func ReadHeaders(art io.ReadCloser, dt string, key []byte, scrDir string,
 			log.Errorf("Unknown device_type. Continuing with update")
 			return nil
 		}
-		for _, dev := range devices {
-			if dev == dt {
-				return nil
-			}
-		}
-		return errors.Errorf("installer: image (device types %v) not compatible with device %v",
-			devices, dt)
+		return CheckCompatibleDevices(devices, dt)
 	}
 
 	// VerifySignatureCallback needs to be registered both for
@@ -174,6 +245,13 @@ func ReadHeaders(art io.ReadCloser, dt string, key []byte, scrDir string,
 		return nil, installers, errors.Wrap(err, "installer: failed to read Artifact")
 	}
 
+	// With a key configured the reader refuses unsigned artifacts, so
+	// this only happens when verification is disabled.
+	if !ar.IsSigned {
+		log.Warn("Installer: Installing unsigned artifact, since no " +
+			"verification key is configured")
+	}
+
 	if err = scr.Finalize(ar.GetInfo().Version); err != nil {
 		return nil, installers, errors.Wrap(err, "installer: error finalizing writing scripts")
 	}
@@ -183,9 +261,16 @@ func ReadHeaders(art io.ReadCloser, dt string, key []byte, scrDir string,
 		return nil, installers, err
 	}
 
-	// Remove this when adding support for more than one payload.
-	if len(updateStorers) > 1 {
-		return nil, installers, errors.New("Artifacts with more than one payload are not supported yet!")
+	// Every rootfs-image payload would be written to the same inactive
+	// partition, so an Artifact can carry at most one of them.
+	rootfsPayloads := 0
+	for _, upd := range ar.GetUpdates() {
+		if upd.Type == "rootfs-image" {
+			rootfsPayloads++
+		}
+	}
+	if rootfsPayloads > 1 {
+		return nil, installers, errors.New("Artifacts with more than one rootfs-image payload are not supported")
 	}
 
 	installers, err = getInstallerList(updateStorers)
@@ -204,6 +289,55 @@ func (i *Installer) StorePayloads() error {
 	return i.ar.ReadArtifactData()
 }
 
+// InstallPayloads calls InstallUpdate of each payload, running at most
+// maxConcurrent of them at the same time; one at a time, in order, if
+// maxConcurrent is less than two. No more are started once one fails, and the
+// error of the first payload in the list which failed is returned.
+func InstallPayloads(installers []PayloadUpdatePerformer, maxConcurrent int) error {
+	if maxConcurrent < 2 {
+		for _, i := range installers {
+			if err := i.InstallUpdate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		lock   sync.Mutex
+		failed bool
+		wg     sync.WaitGroup
+	)
+	errs := make([]error, len(installers))
+	slots := make(chan struct{}, maxConcurrent)
+	for n, i := range installers {
+		slots <- struct{}{}
+		lock.Lock()
+		stop := failed
+		lock.Unlock()
+		if stop {
+			break
+		}
+		wg.Add(1)
+		go func(n int, i PayloadUpdatePerformer) {
+			defer wg.Done()
+			err := i.InstallUpdate()
+			lock.Lock()
+			errs[n] = err
+			failed = failed || err != nil
+			lock.Unlock()
+			<-slots
+		}(n, i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (i *Installer) GetArtifactName() string {
 	return i.ar.GetArtifactName()
 }
@@ -19,12 +19,16 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/pkg/errors"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -51,6 +55,38 @@ func TestInstall(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestInstallCompressedArtifact(t *testing.T) {
+	updateProducers := AllModules{
+		DualRootfs: new(fDevice),
+	}
+
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	require.NoError(t, err)
+	plain, err := ioutil.ReadAll(art)
+	require.NoError(t, err)
+
+	for _, compressorID := range []string{"gzip", "lzma"} {
+		compressor, err := artifact.NewCompressorFromId(compressorID)
+		require.NoError(t, err)
+		buf := bytes.Buffer{}
+		w, err := compressor.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = w.Write(plain)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		compressed := buf.Bytes()
+
+		_, err = Install(&rc{bytes.NewBuffer(compressed)}, "vexpress-qemu", nil, "",
+			&updateProducers)
+		assert.NoError(t, err, compressorID)
+
+		// A truncated stream must not install.
+		_, err = Install(&rc{bytes.NewBuffer(compressed[:len(compressed)/2])},
+			"vexpress-qemu", nil, "", &updateProducers)
+		assert.Error(t, err, compressorID)
+	}
+}
+
 func TestInstallSigned(t *testing.T) {
 	updateProducers := AllModules{
 		DualRootfs: new(fDevice),
@@ -98,6 +134,29 @@ func TestInstallNoSignature(t *testing.T) {
 		"expecting signed artifact, but no signature file found")
 }
 
+func TestInstallUnsignedWarning(t *testing.T) {
+	updateProducers := AllModules{
+		DualRootfs: new(fDevice),
+	}
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	require.NoError(t, err)
+	_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
+	assert.NoError(t, err)
+	assert.True(t, testLogContainsMessage(t, hook.AllEntries(),
+		"Installer: Installing unsigned artifact, since no verification key is configured"))
+	hook.Reset()
+
+	art, err = MakeRootfsImageArtifact(2, true, false)
+	require.NoError(t, err)
+	_, err = Install(art, "vexpress-qemu", []byte(PublicRSAKey), "", &updateProducers)
+	assert.NoError(t, err)
+	assert.False(t, testLogContainsMessage(t, hook.AllEntries(),
+		"Installer: Installing unsigned artifact, since no verification key is configured"))
+}
+
 func TestInstallWithScripts(t *testing.T) {
 	updateProducers := AllModules{
 		DualRootfs: new(fDevice),
@@ -131,7 +190,7 @@ func TestCorrectUpdateProducerReturned(t *testing.T) {
 	assert.Equal(t, updateProducers.DualRootfs, returned[0])
 }
 
-func TestMultiplePayloadsRejected(t *testing.T) {
+func TestMultipleRootfsPayloadsRejected(t *testing.T) {
 	updateProducers := AllModules{
 		DualRootfs: new(fDevice),
 	}
@@ -141,7 +200,78 @@ func TestMultiplePayloadsRejected(t *testing.T) {
 
 	_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
 	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "Artifacts with more than one payload are not supported yet")
+	assert.Contains(t, err.Error(), "more than one rootfs-image payload")
+}
+
+func TestMultiplePayloads(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestMultiplePayloads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	modulesPath := path.Join(tmpdir, "modules")
+	workPath := path.Join(tmpdir, "work")
+	require.NoError(t, os.MkdirAll(modulesPath, 0755))
+	require.NoError(t, os.MkdirAll(workPath, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(modulesPath, "test-type"),
+		[]byte("#!/bin/sh\nexit 0\n"), 0755))
+
+	rootfs := new(fDevice)
+	updateProducers := AllModules{
+		DualRootfs: rootfs,
+		Modules: NewModuleInstallerFactory(modulesPath, workPath,
+			&testStreamsTreeInfo{}, &testStreamsTreeInfo{}, 10),
+	}
+
+	art, err := MakeRootfsAndModuleImageArtifact("test-type")
+	require.NoError(t, err)
+
+	installers, err := Install(art, "vexpress-qemu", nil, "", &updateProducers)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(installers))
+	assert.Equal(t, rootfs, installers[0])
+	assert.Equal(t, "test-type", installers[1].GetType())
+
+	// The module stored its payload on its own.
+	verifyFileContent(t, path.Join(workPath, "payloads", "0001", "tree", "files",
+		"module-payload"), "module update")
+}
+
+func TestModulePayloadHandedToModule(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestModulePayloadHandedToModule")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	modulesPath := path.Join(tmpdir, "modules")
+	workPath := path.Join(tmpdir, "work")
+	require.NoError(t, os.MkdirAll(modulesPath, 0755))
+	require.NoError(t, os.MkdirAll(workPath, 0755))
+
+	updateProducers := AllModules{
+		DualRootfs: new(fDevice),
+		Modules: NewModuleInstallerFactory(modulesPath, workPath,
+			&testStreamsTreeInfo{}, &testStreamsTreeInfo{}, 10),
+	}
+
+	// Without a module for the type, the Artifact is refused.
+	art, err := MakeModuleImageArtifact("rootfs-delta")
+	require.NoError(t, err)
+	_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
+	assert.Error(t, err)
+
+	// With one, the payload goes to the module, and not to the rootfs
+	// installer.
+	require.NoError(t, ioutil.WriteFile(path.Join(modulesPath, "rootfs-delta"),
+		[]byte("#!/bin/sh\nexit 0\n"), 0755))
+	art, err = MakeModuleImageArtifact("rootfs-delta")
+	require.NoError(t, err)
+	installers, err := Install(art, "vexpress-qemu", nil, "", &updateProducers)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, len(installers))
+	assert.Equal(t, "rootfs-delta", installers[0].GetType())
+	verifyFileContent(t, path.Join(workPath, "payloads", "0000", "tree", "files",
+		"module-payload"), "module update")
 }
 
 type fDevice struct{}
@@ -340,6 +470,83 @@ func MakeDoubleRootfsImageArtifact(version int) (io.ReadCloser, error) {
 	return &rc{art}, nil
 }
 
+// typedComposer gives a payload its own type-info, since the Artifact writer
+// otherwise uses the same one for every payload.
+type typedComposer struct {
+	handlers.Composer
+	typeInfo *artifact.TypeInfoV3
+}
+
+func (c *typedComposer) ComposeHeader(args *handlers.ComposeHeaderArgs) error {
+	args.TypeInfoV3 = c.typeInfo
+	return c.Composer.ComposeHeader(args)
+}
+
+func MakeRootfsAndModuleImageArtifact(moduleType string) (io.ReadCloser, error) {
+	return makeModuleImageArtifact(moduleType, true)
+}
+
+func MakeModuleImageArtifact(moduleType string) (io.ReadCloser, error) {
+	return makeModuleImageArtifact(moduleType, false)
+}
+
+func makeModuleImageArtifact(moduleType string, withRootfs bool) (io.ReadCloser, error) {
+	var composers []handlers.Composer
+	if withRootfs {
+		upd, err := MakeFakeUpdate("test update")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(upd)
+		composers = append(composers, &typedComposer{
+			Composer: handlers.NewRootfsV3(upd),
+			typeInfo: &artifact.TypeInfoV3{Type: "rootfs-image"},
+		})
+	}
+
+	tmpdir, err := ioutil.TempDir("", "module-payload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	modUpd := path.Join(tmpdir, "module-payload")
+	if err = ioutil.WriteFile(modUpd, []byte("module update"), 0644); err != nil {
+		return nil, err
+	}
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art, artifact.NewCompressorGzip())
+
+	module := handlers.NewModuleImage(moduleType)
+	if err = module.SetUpdateFiles([](*handlers.DataFile){{Name: modUpd}}); err != nil {
+		return nil, err
+	}
+	composers = append(composers, &typedComposer{
+		Composer: module,
+		typeInfo: &artifact.TypeInfoV3{Type: moduleType},
+	})
+
+	updates := &awriter.Updates{Updates: composers}
+	err = aw.WriteArtifact(&awriter.WriteArtifactArgs{
+		Format:  "mender",
+		Version: 3,
+		Devices: []string{"vexpress-qemu"},
+		Name:    "mender-1.1",
+		Updates: updates,
+		Scripts: &artifact.Scripts{},
+		Depends: &artifact.ArtifactDepends{
+			CompatibleDevices: []string{"vexpress-qemu"},
+		},
+		Provides: &artifact.ArtifactProvides{
+			ArtifactName: "artifact-name",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rc{art}, nil
+}
+
 func MakeFakeUpdate(data string) (string, error) {
 	f, err := ioutil.TempFile("", "test_update")
 	if err != nil {
@@ -362,3 +569,64 @@ type rc struct {
 func (r *rc) Close() error {
 	return nil
 }
+
+// slowInstall is a payload which takes a while to install, and counts how
+// many of its kind install at the same time.
+type slowInstall struct {
+	PayloadUpdatePerformer
+	running   *int32
+	most      *int32
+	installed *int32
+	err       error
+}
+
+func (s slowInstall) InstallUpdate() error {
+	now := atomic.AddInt32(s.running, 1)
+	for {
+		most := atomic.LoadInt32(s.most)
+		if now <= most || atomic.CompareAndSwapInt32(s.most, most, now) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt32(s.running, -1)
+	atomic.AddInt32(s.installed, 1)
+	return s.err
+}
+
+func TestInstallPayloadsConcurrency(t *testing.T) {
+	install := func(maxConcurrent int, failing int) (most, installed int32, err error) {
+		var running int32
+		installers := make([]PayloadUpdatePerformer, 6)
+		for n := range installers {
+			module := slowInstall{running: &running, most: &most, installed: &installed}
+			if n == failing {
+				module.err = errors.Errorf("module %d failed", n)
+			}
+			installers[n] = module
+		}
+		err = InstallPayloads(installers, maxConcurrent)
+		return most, installed, err
+	}
+
+	for _, maxConcurrent := range []int{0, 1, 2, 4} {
+		most, installed, err := install(maxConcurrent, -1)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 6, installed)
+		expected := int32(maxConcurrent)
+		if expected < 1 {
+			expected = 1
+		}
+		assert.Equal(t, expected, most, "at most %d", maxConcurrent)
+	}
+
+	// One at a time stops straight after the failing module.
+	_, installed, err := install(1, 1)
+	assert.EqualError(t, err, "module 1 failed")
+	assert.EqualValues(t, 2, installed)
+
+	// Those already running are waited for, but no more are started.
+	_, installed, err = install(2, 0)
+	assert.EqualError(t, err, "module 0 failed")
+	assert.True(t, installed >= 2 && installed < 6, "%d installed", installed)
+}
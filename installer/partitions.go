@@ -31,6 +31,10 @@ var (
 	ErrorPartitionNumberNotSet     = errors.New("RootfsPartA and RootfsPartB settings are not both set.")
 	ErrorPartitionNumberSame       = errors.New("RootfsPartA and RootfsPartB cannot be set to the same value.")
 	ErrorPartitionNoMatchActive    = errors.New("Active root partition matches neither RootfsPartA nor RootfsPartB.")
+	ErrorInactivePartitionIsRoot   = errors.New("The inactive partition is the one the system is running from. " +
+		"Refusing to overwrite it; check RootfsPartA, RootfsPartB and the boot environment.")
+	ErrorInactivePartitionMounted = errors.New("The inactive partition is mounted. " +
+		"Refusing to overwrite it; unmount it, or stop whatever mounts it, such as an auto mount service.")
 )
 
 type partitions struct {
@@ -58,6 +62,45 @@ func (p *partitions) GetActive() (string, error) {
 	return p.getAndCacheActivePartition(isMountedRoot, getAllMountedDevices)
 }
 
+// InactiveIsSafe returns whether the inactive partition, which updates are
+// written to, is really a different partition than the running root
+// filesystem.
+func (p *partitions) InactiveIsSafe() (bool, error) {
+	return p.inactiveIsSafe(isMountedRoot)
+}
+
+// IsInactiveMounted returns whether the inactive partition is mounted, which
+// writing an update to it would corrupt.
+func (p *partitions) IsInactiveMounted() (bool, error) {
+	inactive, err := p.GetInactive()
+	if err != nil {
+		return false, err
+	}
+	return checkMounted(inactive) != "", nil
+}
+
+func (p *partitions) inactiveIsSafe(
+	rootChecker func(system.StatCommander, string, *syscall.Stat_t) bool) (bool, error) {
+
+	inactive, err := p.GetInactive()
+	if err != nil {
+		return false, err
+	}
+	active, err := p.GetActive()
+	if err != nil {
+		return false, err
+	}
+	if maybeResolveLink(inactive) == maybeResolveLink(active) {
+		return false, nil
+	}
+	// The active partition may have been picked from the configuration and
+	// the boot environment alone, so check what "/" is really on.
+	if root := getRootDevice(p); root != nil && rootChecker(p, inactive, root) {
+		return false, nil
+	}
+	return true, nil
+}
+
 func (p *partitions) getAndCacheInactivePartition() (string, error) {
 	if p.rootfsPartA == "" || p.rootfsPartB == "" {
 		return "", ErrorPartitionNumberNotSet
@@ -141,6 +141,44 @@ func Test_matchRootWithMout_HaveValidMount(t *testing.T) {
 	}
 }
 
+func TestInactiveIsSafe(t *testing.T) {
+	file, err := ioutil.TempFile("", "root")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	root, err := file.Stat()
+	require.NoError(t, err)
+	file.Close()
+
+	falseChecker := func(system.StatCommander, string, *syscall.Stat_t) bool { return false }
+	trueChecker := func(system.StatCommander, string, *syscall.Stat_t) bool { return true }
+
+	p := partitions{
+		StatCommander: fakeStatCommander{file: root},
+		active:        "/dev/mmcblk0p2",
+		inactive:      "/dev/mmcblk0p3",
+	}
+	safe, err := p.inactiveIsSafe(falseChecker)
+	assert.NoError(t, err)
+	assert.True(t, safe)
+
+	// The active partition was wrong; "/" is on the inactive one.
+	safe, err = p.inactiveIsSafe(trueChecker)
+	assert.NoError(t, err)
+	assert.False(t, safe)
+
+	// Both point at the same partition.
+	p.inactive = p.active
+	safe, err = p.inactiveIsSafe(falseChecker)
+	assert.NoError(t, err)
+	assert.False(t, safe)
+
+	// Not knowing the partitions is not safe either.
+	p = partitions{}
+	safe, err = p.inactiveIsSafe(falseChecker)
+	assert.Equal(t, ErrorPartitionNumberNotSet, err)
+	assert.False(t, safe)
+}
+
 // Be ready for the hard stuff...
 // Hope this can be simplified somehow
 func Test_getActivePartition_noActiveInactiveSet(t *testing.T) {
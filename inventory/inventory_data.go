@@ -31,6 +31,12 @@ const (
 	inventoryToolPrefix = "mender-inventory-"
 )
 
+// InventoryDataGetter is a source of inventory data. The inventory scripts
+// are one; integrators may provide others.
+type InventoryDataGetter interface {
+	Get() (client.InventoryData, error)
+}
+
 func NewInventoryDataRunner(scriptsDir string) InventoryDataRunner {
 	return InventoryDataRunner{
 		scriptsDir,
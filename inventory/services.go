@@ -0,0 +1,109 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package inventory
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/system"
+	"github.com/mendersoftware/mender/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	serviceAttributePrefix = "service_"
+	// How much of the output of the inventory command is used; the rest
+	// is thrown away.
+	maxCommandOutput = 4096
+)
+
+// ServicesInventory reports the states of systemd units, and the key=value
+// output of a command, as inventory attributes.
+type ServicesInventory struct {
+	units   []string
+	command string
+	cmd     system.Commander
+}
+
+func NewServicesInventory(units []string, command string) *ServicesInventory {
+	return &ServicesInventory{
+		units:   units,
+		command: command,
+		cmd:     &system.OsCalls{},
+	}
+}
+
+func (s *ServicesInventory) Get() (client.InventoryData, error) {
+	idec := NewInventoryDataDecoder()
+	for _, unit := range s.units {
+		// is-active exits with an error for any state but "active", but
+		// prints the state all the same.
+		out, _ := s.cmd.Command("systemctl", "is-active", unit).Output()
+		state := strings.TrimSpace(string(out))
+		if state == "" {
+			state = "unknown"
+		}
+		idec.AppendFromRaw(map[string][]string{
+			serviceAttributePrefix + unit: {state},
+		})
+	}
+
+	if s.command != "" {
+		// The unit states are still worth reporting if the command fails.
+		if data, err := s.runCommand(); err != nil {
+			log.Errorf("Inventory command '%s' failed: %v", s.command, err)
+		} else {
+			idec.AppendFromRaw(data)
+		}
+	}
+	return idec.GetInventoryData(), nil
+}
+
+func (s *ServicesInventory) runCommand() (map[string][]string, error) {
+	cmd := s.cmd.Command("/bin/sh", "-c", s.command)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(out, maxCommandOutput+1))
+	// Keep reading, so that the command is not stuck writing to a full pipe.
+	io.Copy(ioutil.Discard, out)
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) > maxCommandOutput {
+		log.Warnf("Only the first %d bytes of the output of the inventory "+
+			"command are used", maxCommandOutput)
+		// Drop the line which was cut off.
+		buf = buf[:bytes.LastIndexByte(buf[:maxCommandOutput], '\n')+1]
+	}
+
+	p := utils.KeyValParser{}
+	if err := p.Parse(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	return p.Collect(), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package inventory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	stest "github.com/mendersoftware/mender/system/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServicesInventory(t *testing.T) {
+	services := NewServicesInventory([]string{"sshd", "nginx.service"}, "")
+	services.cmd = stest.NewTestOSCalls("inactive", 3)
+	data, err := services.Get()
+	require.NoError(t, err)
+	assert.Len(t, data, 2)
+	assert.Contains(t, data, client.InventoryAttribute{Name: "service_sshd", Value: "inactive"})
+	assert.Contains(t, data, client.InventoryAttribute{Name: "service_nginx.service", Value: "inactive"})
+
+	services = NewServicesInventory(nil, "print-versions")
+	services.cmd = stest.NewTestOSCalls("nginx_version=1.18\nmodules=ssl\nmodules=gzip", 0)
+	data, err = services.Get()
+	require.NoError(t, err)
+	assert.Len(t, data, 2)
+	assert.Contains(t, data, client.InventoryAttribute{Name: "nginx_version", Value: "1.18"})
+	assert.Contains(t, data, client.InventoryAttribute{Name: "modules", Value: []string{"ssl", "gzip"}})
+
+	// A failing command still leaves the unit states.
+	services = NewServicesInventory([]string{"sshd"}, "print-versions")
+	services.cmd = stest.NewTestOSCalls("garbage", 1)
+	data, err = services.Get()
+	require.NoError(t, err)
+	assert.Len(t, data, 1)
+	assert.Contains(t, data, client.InventoryAttribute{Name: "service_sshd", Value: "garbage"})
+
+	// Output beyond the limit is dropped, along with the line it cuts off.
+	line := "key=" + strings.Repeat("x", 95) + "\n"
+	services = NewServicesInventory(nil, "print-a-lot")
+	services.cmd = stest.NewTestOSCalls(strings.Repeat(line, 100)+"last=line", 0)
+	data, err = services.Get()
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Len(t, data[0].Value, maxCommandOutput/len(line))
+}
@@ -27,6 +27,8 @@ func doMain() int {
 	if err := cli.SetupCLI(os.Args); err != nil {
 		if err == app.ErrorManualRebootRequired {
 			return 4
+		} else if err == app.ErrorUpdateApplied {
+			return 3
 		} else if err == installer.ErrorNothingToCommit {
 			log.Warnln(err.Error())
 			return 2
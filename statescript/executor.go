@@ -206,6 +206,7 @@ func execute(name string, timeout time.Duration) error {
 	cmd := exec.Command(name)
 
 	var stderr io.ReadCloser
+	stdout := tailBuffer{limit: scriptOutputLimit}
 	var err error
 
 	if !strings.HasPrefix(name, "Idle") && !strings.HasPrefix(name, "Sync") {
@@ -214,6 +215,7 @@ func execute(name string, timeout time.Duration) error {
 			log.Errorf("statescript: %v", err)
 			return errors.Wrap(err, "statescript: unable to open stderr pipe")
 		}
+		cmd.Stdout = &stdout
 	}
 
 	// As child process gets the same PGID as the parent by default, in order
@@ -241,18 +243,52 @@ func execute(name string, timeout time.Duration) error {
 		}
 	}
 
+	logScriptOutput(name, "stderr", bts)
+
+	err = cmd.Wait()
+	// Wait returns once all the output of the script has been copied to
+	// stdout, so it is not written to any more.
+	if stdout.truncated {
+		log.Infof("Collected output (stdout) while running script %s (Truncated to the last 10KB)\n%s\n---------- end of script output", name, stdout.buf)
+	} else {
+		logScriptOutput(name, "stdout", stdout.buf)
+	}
+	return err
+}
+
+// Most of the output of a script which is logged.
+const scriptOutputLimit = 10 * 1024
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= b.limit {
+		b.truncated = b.truncated || len(b.buf) > 0 || len(p) > b.limit
+		b.buf = append(b.buf[:0], p[len(p)-b.limit:]...)
+		return n, nil
+	}
+	if drop := len(b.buf) + len(p) - b.limit; drop > 0 {
+		b.truncated = true
+		b.buf = append(b.buf[:0], b.buf[drop:]...)
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+func logScriptOutput(name, stream string, bts []byte) {
 	if len(bts) > 0 {
-		if len(bts) > 10*1024 {
-			log.Infof("Collected output (stderr) while running script %s (Truncated to 10KB)\n%s\n---------- end of script output", name, bts[:10*1024])
+		if len(bts) > scriptOutputLimit {
+			log.Infof("Collected output (%s) while running script %s (Truncated to 10KB)\n%s\n---------- end of script output", stream, name, bts[:scriptOutputLimit])
 		} else {
-			log.Infof("Collected output (stderr) while running script %s\n%s\n---------- end of script output", name, string(bts))
+			log.Infof("Collected output (%s) while running script %s\n%s\n---------- end of script output", stream, name, string(bts))
 		}
 	}
-
-	if err := cmd.Wait(); err != nil {
-		return err
-	}
-	return nil
 }
 
 func retCode(err error) int {
@@ -206,6 +206,15 @@ func TestExecutor(t *testing.T) {
 	assert.True(t, testLogContainsMessage(hook.AllEntries(), "error data"))
 	hook.Reset()
 
+	fileP, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_01", "#!/bin/bash \necho 'stopping services'\necho 'error data' >&2")
+	assert.NoError(t, err)
+	err = execute(fileP.Name(), 100*time.Second)
+	assert.NoError(t, err)
+	assert.True(t, testLogContainsMessage(hook.AllEntries(), "Collected output (stdout)"))
+	assert.True(t, testLogContainsMessage(hook.AllEntries(), "stopping services"))
+	assert.True(t, testLogContainsMessage(hook.AllEntries(), "error data"))
+	hook.Reset()
+
 	// write more than 10KB to stderr
 	fileP, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_11", "#!/bin/bash \nhead -c 89999 </dev/urandom >&2\n exit 1")
 	assert.NoError(t, err)
@@ -214,6 +223,15 @@ func TestExecutor(t *testing.T) {
 	assert.True(t, testLogContainsMessage(hook.AllEntries(), "Truncated to 10KB"))
 	hook.Reset()
 
+	// only the end of more than 10KB on stdout is kept
+	fileP, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_12", "#!/bin/bash \nhead -c 89999 </dev/zero | tr '\\0' x\necho 'the end'")
+	assert.NoError(t, err)
+	err = execute(fileP.Name(), 100*time.Second)
+	assert.NoError(t, err)
+	assert.True(t, testLogContainsMessage(hook.AllEntries(), "Truncated to the last 10KB"))
+	assert.True(t, testLogContainsMessage(hook.AllEntries(), "the end"))
+	hook.Reset()
+
 	// add a script that will time-out, and die
 	filep, err := createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_10_btoot", "#!/bin/bash \nsleep 2")
 	assert.NoError(t, err)
@@ -481,3 +499,22 @@ func TestReadVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestTailBuffer(t *testing.T) {
+	b := tailBuffer{limit: 4}
+	b.Write([]byte("ab"))
+	b.Write([]byte("cd"))
+	assert.Equal(t, "abcd", string(b.buf))
+	assert.False(t, b.truncated)
+
+	n, err := b.Write([]byte("ef"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "cdef", string(b.buf))
+	assert.True(t, b.truncated)
+
+	b = tailBuffer{limit: 4}
+	b.Write([]byte("abcdefgh"))
+	assert.Equal(t, "efgh", string(b.buf))
+	assert.True(t, b.truncated)
+}
@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"syscall"
 
 	"github.com/bmatsuo/lmdb-go/lmdb"
 	"github.com/pkg/errors"
@@ -36,7 +37,10 @@ var (
 // DBStore is an opaque structure representing a database backed storage.
 // Implements `Store` interface.
 type DBStore struct {
-	env *lmdb.Env
+	env  *lmdb.Env
+	path string
+	// Set when the DB could only be opened for reading.
+	readOnly bool
 }
 
 type DBStoreWrite struct {
@@ -51,27 +55,71 @@ var LmdbNoSync bool = false
 
 // NewDBStore creates an instance of Store backed by LMDB database. DBStore uses
 // a single file for DB data (named `DBStoreName`). Parameter `dirpath` is a
-// directory where the file will be stored. Returns nil if initialization
-// failed.
+// directory where the file will be stored. If `dirpath` is on a read-only
+// filesystem, the DB is opened for reading only, and writes to it fail as they
+// would on the filesystem. Returns nil if initialization failed.
 func NewDBStore(dirpath string) *DBStore {
-	env, err := lmdb.NewEnv()
+	db := &DBStore{
+		path: path.Join(dirpath, DBStoreName),
+	}
+	err := db.open(0)
+	if IsReadOnlyError(err) {
+		log.Warnf("The DB is on a read-only filesystem; opening it for reading only")
+		if err = db.open(lmdb.Readonly); err != nil {
+			// Without a lock file, which could not be created.
+			err = db.open(lmdb.Readonly | lmdb.NoLock)
+		}
+		db.readOnly = err == nil
+	}
 	if err != nil {
-		log.Errorf("Failed to create DB environment: %v", err)
+		log.Errorf("Failed to open DB environment: %v", err)
 		return nil
 	}
+	return db
+}
+
+func (db *DBStore) open(flags uint) error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return errors.Wrap(err, "failed to create DB environment")
+	}
 
-	var noSyncFlag uint = 0
 	if LmdbNoSync {
-		noSyncFlag = lmdb.NoSync
+		flags |= lmdb.NoSync
 	}
-	if err := env.Open(path.Join(dirpath, DBStoreName), lmdb.NoSubdir|noSyncFlag, 0600); err != nil {
-		log.Errorf("Failed to open DB environment: %v", err)
+	if err := env.Open(db.path, lmdb.NoSubdir|flags, 0600); err != nil {
+		env.Close()
+		return err
+	}
+	db.env = env
+	return nil
+}
+
+// Reopen opens a DB which could only be opened for reading, for writing, if
+// its filesystem has become writable since. It must not be called while the DB
+// is in use.
+func (db *DBStore) Reopen() error {
+	if !db.readOnly || db.env == nil {
 		return nil
 	}
+	probe, err := ioutil.TempFile(path.Dir(db.path), DBStoreName+"-probe")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	os.Remove(probe.Name())
 
-	return &DBStore{
-		env: env,
+	db.env.Close()
+	db.env = nil
+	if err := db.open(0); err != nil {
+		if rerr := db.open(lmdb.Readonly); rerr != nil {
+			db.open(lmdb.Readonly | lmdb.NoLock)
+		}
+		return err
 	}
+	log.Info("The DB is writable again")
+	db.readOnly = false
+	return nil
 }
 
 func (db *DBStore) Close() error {
@@ -148,6 +196,9 @@ func (dbw *DBStoreWrite) Commit() error {
 }
 
 func (db *DBStore) WriteTransaction(txnFunc func(txn Transaction) error) error {
+	if db.readOnly {
+		return &os.PathError{Op: "write", Path: db.path, Err: syscall.EROFS}
+	}
 	return db.env.Update(func(lmdbTxn *lmdb.Txn) error {
 		dbi, err := lmdbTxn.OpenRoot(0)
 		if err != nil {
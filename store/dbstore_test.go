@@ -20,7 +20,9 @@ import (
 	"path"
 	"testing"
 
+	"github.com/bmatsuo/lmdb-go/lmdb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDBStore(t *testing.T) {
@@ -104,3 +106,31 @@ func TestDBStore(t *testing.T) {
 	err = d.Remove("bar")
 	assert.NoError(t, err)
 }
+
+func TestDBStoreReopen(t *testing.T) {
+	tmppath, err := ioutil.TempDir("", "mendertest-dbstore-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmppath)
+
+	d := NewDBStore(tmppath)
+	require.NotNil(t, d)
+	defer d.Close()
+	require.NoError(t, d.WriteAll("foo", []byte("bar")))
+
+	// Opened for reading only, as on a read-only filesystem, the DB fails
+	// to be written to the same way.
+	require.NoError(t, d.Close())
+	d = &DBStore{path: d.path, readOnly: true}
+	require.NoError(t, d.open(lmdb.Readonly))
+	data, err := d.ReadAll("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+	err = d.WriteAll("foo", []byte("baz"))
+	assert.True(t, IsReadOnlyError(err))
+
+	require.NoError(t, d.Reopen())
+	require.NoError(t, d.WriteAll("foo", []byte("baz")))
+	data, err = d.ReadAll("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("baz"), data)
+}
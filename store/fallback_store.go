@@ -0,0 +1,255 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// IsReadOnlyError returns whether err is the failure to write to a read-only
+// filesystem.
+func IsReadOnlyError(err error) bool {
+	err = errors.Cause(err)
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case *lmdb.OpError:
+		err = e.Errno
+	}
+	return err == syscall.EROFS
+}
+
+// FallbackStore passes everything through to the Store it wraps, until a write
+// to it fails because its filesystem is read-only. From then on, what is
+// written is kept in memory instead, and read back from there, so that the
+// client carries on as before, only without persisting its state. Every write
+// tries the wrapped Store again first, and once that takes what is kept in
+// memory, the state is persisted again. Implements `Store` interface.
+type FallbackStore struct {
+	store Store
+	lock  sync.Mutex
+	// What has been written while the store is read-only, if it is.
+	pending map[string]*MemStoreData
+}
+
+// reopener is implemented by stores which have to be opened again to be
+// written to, once their filesystem is writable.
+type reopener interface {
+	Reopen() error
+}
+
+func NewFallbackStore(store Store) *FallbackStore {
+	return &FallbackStore{
+		store: store,
+	}
+}
+
+// ReadOnly returns whether what is written to the store is only kept in
+// memory.
+func (s *FallbackStore) ReadOnly() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pending != nil
+}
+
+func (s *FallbackStore) ReadAll(name string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending == nil {
+		return s.store.ReadAll(name)
+	}
+	return (&fallbackTransaction{s: s}).ReadAll(name)
+}
+
+func (s *FallbackStore) WriteAll(name string, data []byte) error {
+	return s.WriteTransaction(func(txn Transaction) error {
+		return txn.WriteAll(name, data)
+	})
+}
+
+func (s *FallbackStore) Remove(name string) error {
+	return s.WriteTransaction(func(txn Transaction) error {
+		return txn.Remove(name)
+	})
+}
+
+func (s *FallbackStore) OpenRead(name string) (io.ReadCloser, error) {
+	b, err := s.ReadAll(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(b)), nil
+}
+
+func (s *FallbackStore) OpenWrite(name string) (WriteCloserCommitter, error) {
+	return &fallbackStoreWrite{s: s, name: name}, nil
+}
+
+func (s *FallbackStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending != nil {
+		log.Warn("The data store is still read-only; the state kept in memory is lost")
+		s.pending = nil
+	}
+	return s.store.Close()
+}
+
+func (s *FallbackStore) WriteTransaction(txnFunc func(txn Transaction) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pending != nil && !s.flush() {
+		return s.writePending(txnFunc)
+	}
+	err := s.writeThrough(txnFunc)
+	if !IsReadOnlyError(err) {
+		return err
+	}
+	log.Warnf("The data store is read-only; keeping the state in memory until "+
+		"it can be written again: %v", err)
+	s.pending = make(map[string]*MemStoreData)
+	return s.writePending(txnFunc)
+}
+
+func (s *FallbackStore) ReadTransaction(txnFunc func(txn Transaction) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending == nil {
+		return s.store.ReadTransaction(txnFunc)
+	}
+	return txnFunc(&fallbackTransaction{s: s})
+}
+
+func (s *FallbackStore) writeThrough(txnFunc func(txn Transaction) error) error {
+	err := s.store.WriteTransaction(txnFunc)
+	if err == NoTransactionSupport {
+		err = txnFunc(s.store)
+	}
+	return err
+}
+
+// writePending runs txnFunc against what is kept in memory. As in a
+// transaction, nothing is written unless all of it succeeds.
+func (s *FallbackStore) writePending(txnFunc func(txn Transaction) error) error {
+	txn := &fallbackTransaction{
+		s:      s,
+		writes: make(map[string]*MemStoreData),
+	}
+	if err := txnFunc(txn); err != nil {
+		return err
+	}
+	for name, entry := range txn.writes {
+		s.pending[name] = entry
+	}
+	return nil
+}
+
+// flush writes what is kept in memory to the wrapped store, and returns
+// whether it could.
+func (s *FallbackStore) flush() bool {
+	if r, ok := s.store.(reopener); ok {
+		if err := r.Reopen(); err != nil {
+			return false
+		}
+	}
+	err := s.writeThrough(func(txn Transaction) error {
+		for name, entry := range s.pending {
+			var err error
+			if entry.data == nil {
+				err = txn.Remove(name)
+			} else {
+				err = txn.WriteAll(name, entry.data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if !IsReadOnlyError(err) {
+			log.Errorf("Could not write the state kept in memory to the data store: %v", err)
+		}
+		return false
+	}
+	log.Info("The data store is writable again; the state is persisted from now on")
+	s.pending = nil
+	return true
+}
+
+// fallbackTransaction reads what is kept in memory, or else the wrapped
+// store, and keeps what is written until the transaction is done. An entry
+// with nil data has been removed.
+type fallbackTransaction struct {
+	s      *FallbackStore
+	writes map[string]*MemStoreData
+}
+
+func (txn *fallbackTransaction) ReadAll(name string) ([]byte, error) {
+	entry, ok := txn.writes[name]
+	if !ok {
+		entry, ok = txn.s.pending[name]
+	}
+	if !ok {
+		return txn.s.store.ReadAll(name)
+	}
+	if entry.data == nil {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte{}, entry.data...), nil
+}
+
+func (txn *fallbackTransaction) WriteAll(name string, data []byte) error {
+	if txn.writes == nil {
+		return errors.New("read-only transaction")
+	}
+	txn.writes[name] = &MemStoreData{data: append([]byte{}, data...)}
+	return nil
+}
+
+func (txn *fallbackTransaction) Remove(name string) error {
+	if txn.writes == nil {
+		return errors.New("read-only transaction")
+	}
+	txn.writes[name] = &MemStoreData{}
+	return nil
+}
+
+type fallbackStoreWrite struct {
+	bytes.Buffer
+	s    *FallbackStore
+	name string
+}
+
+func (w *fallbackStoreWrite) Close() error {
+	return nil
+}
+
+func (w *fallbackStoreWrite) Commit() error {
+	return w.s.WriteAll(w.name, w.Bytes())
+}
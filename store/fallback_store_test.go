@@ -0,0 +1,108 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsReadOnlyError(t *testing.T) {
+	assert.True(t, IsReadOnlyError(&os.PathError{Op: "open", Err: syscall.EROFS}))
+	assert.True(t, IsReadOnlyError(errors.Wrap(os.NewSyscallError("write", syscall.EROFS),
+		"failed")))
+	assert.False(t, IsReadOnlyError(&os.PathError{Op: "open", Err: syscall.ENOSPC}))
+	assert.False(t, IsReadOnlyError(errReadOnly))
+	assert.False(t, IsReadOnlyError(nil))
+}
+
+func TestFallbackStore(t *testing.T) {
+	disk := NewReadOnlyFSStore()
+	require.NoError(t, disk.WriteAll("kept", []byte("on disk")))
+	require.NoError(t, disk.WriteAll("removed", []byte("on disk")))
+	s := NewFallbackStore(disk)
+	defer s.Close()
+
+	require.NoError(t, s.WriteAll("foo", []byte("bar")))
+	assert.False(t, s.ReadOnly())
+	data, err := disk.ReadAll("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+
+	// On a read-only filesystem, writes go to memory, and read back.
+	disk.ReadOnlyFS(true)
+	require.NoError(t, s.WriteAll("foo", []byte("baz")))
+	assert.True(t, s.ReadOnly())
+	require.NoError(t, s.Remove("removed"))
+	data, err = s.ReadAll("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("baz"), data)
+	_, err = s.ReadAll("removed")
+	assert.True(t, os.IsNotExist(err))
+	data, err = s.ReadAll("kept")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("on disk"), data)
+	require.NoError(t, s.ReadTransaction(func(txn Transaction) error {
+		data, err = txn.ReadAll("foo")
+		return err
+	}))
+	assert.Equal(t, []byte("baz"), data)
+	data, err = disk.ReadAll("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+
+	// Transactions which fail leave nothing behind.
+	err = s.WriteTransaction(func(txn Transaction) error {
+		txn.WriteAll("foo", []byte("broken"))
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	data, err = s.ReadAll("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("baz"), data)
+
+	// Once the filesystem is writable, the next write persists all of it.
+	disk.ReadOnlyFS(false)
+	w, err := s.OpenWrite("new")
+	require.NoError(t, err)
+	w.Write([]byte("entry"))
+	require.NoError(t, w.Commit())
+	assert.False(t, s.ReadOnly())
+	for name, expected := range map[string]string{
+		"foo":  "baz",
+		"kept": "on disk",
+		"new":  "entry",
+	} {
+		data, err = disk.ReadAll(name)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(expected), data, name)
+	}
+	_, err = disk.ReadAll("removed")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFallbackStoreOtherErrors(t *testing.T) {
+	ms := NewMemStore()
+	ms.ReadOnly(true)
+	s := NewFallbackStore(ms)
+
+	// Only failures of a read-only filesystem are covered for.
+	assert.Error(t, s.WriteAll("foo", []byte("bar")))
+	assert.False(t, s.ReadOnly())
+}
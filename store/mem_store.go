@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"os"
 	"sync"
+	"syscall"
 )
 
 var (
@@ -152,3 +153,25 @@ func (ms *MemStore) ReadTransaction(txnFunc func(txn Transaction) error) error {
 
 	return txnFunc(ms)
 }
+
+// in-memory store for testing purposes, which fails to be written to the way
+// a store on a read-only filesystem does, while ReadOnlyFS is set
+type ReadOnlyFSStore struct {
+	*MemStore
+	readOnlyFS bool
+}
+
+func NewReadOnlyFSStore() *ReadOnlyFSStore {
+	return &ReadOnlyFSStore{MemStore: NewMemStore()}
+}
+
+func (s *ReadOnlyFSStore) ReadOnlyFS(ro bool) {
+	s.readOnlyFS = ro
+}
+
+func (s *ReadOnlyFSStore) WriteTransaction(txnFunc func(txn Transaction) error) error {
+	if s.readOnlyFS {
+		return &os.PathError{Op: "write", Path: "store", Err: syscall.EROFS}
+	}
+	return s.MemStore.WriteTransaction(txnFunc)
+}
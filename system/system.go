@@ -20,20 +20,34 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
+// How long a Rebooter waits for the reboot to kill the client. Only changed by
+// tests.
+var rebootWait = 10 * time.Minute
+
+// SystemRebootCmd reboots the device by running a command.
 type SystemRebootCmd struct {
 	command Commander
+	cmdline []string
 }
 
 func NewSystemRebootCmd(command Commander) *SystemRebootCmd {
+	return NewRebootCommand(command, "reboot")
+}
+
+// NewRebootCommand returns a SystemRebootCmd which reboots by running the
+// command line cmdline, such as "systemctl", "reboot".
+func NewRebootCommand(command Commander, cmdline ...string) *SystemRebootCmd {
 	return &SystemRebootCmd{
 		command: command,
+		cmdline: cmdline,
 	}
 }
 
 func (s *SystemRebootCmd) Reboot() error {
-	err := s.command.Command("reboot").Run()
+	err := s.command.Command(s.cmdline[0], s.cmdline[1:]...).Run()
 	if err != nil {
 		return err
 	}
@@ -41,8 +55,22 @@ func (s *SystemRebootCmd) Reboot() error {
 	// Wait up to ten minutes for reboot to kill the client, otherwise the
 	// client may mistake a successful return code as "reboot is complete,
 	// continue". *Any* return from this function is an error.
-	time.Sleep(10 * time.Minute)
-	return errors.New("System did not reboot, even though 'reboot' call succeeded.")
+	time.Sleep(rebootWait)
+	return errors.Errorf("System did not reboot, even though '%s' call succeeded.",
+		s.cmdline[0])
+}
+
+// SyscallReboot reboots the device through the reboot system call. Nothing is
+// shut down first, apart from syncing the filesystems.
+type SyscallReboot struct{}
+
+func (SyscallReboot) Reboot() error {
+	unix.Sync()
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+		return errors.Wrap(err, "reboot system call failed")
+	}
+	time.Sleep(rebootWait)
+	return errors.New("System did not reboot, even though the reboot system call succeeded.")
 }
 
 type Commander interface {
@@ -0,0 +1,61 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package system
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingCommander runs "true" or "false" in place of whatever it is asked
+// to, and remembers what that was.
+type recordingCommander struct {
+	fail    bool
+	cmdline []string
+}
+
+func (r *recordingCommander) Command(name string, arg ...string) *exec.Cmd {
+	r.cmdline = append([]string{name}, arg...)
+	if r.fail {
+		return exec.Command("false")
+	}
+	return exec.Command("true")
+}
+
+func TestRebootCommand(t *testing.T) {
+	oldWait := rebootWait
+	defer func() { rebootWait = oldWait }()
+	rebootWait = 10 * time.Millisecond
+
+	cmd := &recordingCommander{}
+	err := NewSystemRebootCmd(cmd).Reboot()
+	assert.Equal(t, []string{"reboot"}, cmd.cmdline)
+	// Returning at all means the reboot did not happen.
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not reboot")
+
+	cmd = &recordingCommander{}
+	err = NewRebootCommand(cmd, "systemctl", "reboot", "--no-wall").Reboot()
+	assert.Equal(t, []string{"systemctl", "reboot", "--no-wall"}, cmd.cmdline)
+	assert.Error(t, err)
+
+	cmd = &recordingCommander{fail: true}
+	err = NewRebootCommand(cmd, "/usr/local/bin/orchestrated-reboot").Reboot()
+	assert.Equal(t, []string{"/usr/local/bin/orchestrated-reboot"}, cmd.cmdline)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "did not reboot")
+}
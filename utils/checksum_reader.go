@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumReadCloser computes the SHA256 sum of everything read through it, so
+// that the stream can be verified against an expected checksum once it has
+// been consumed.
+type ChecksumReadCloser struct {
+	rc       io.ReadCloser
+	h        hash.Hash
+	expected string
+	offset   int64
+}
+
+// ChecksumCheckpoint is how far a ChecksumReadCloser got, from which hashing
+// can be resumed without reading the first Offset bytes again.
+type ChecksumCheckpoint struct {
+	Offset int64  `json:"offset"`
+	State  []byte `json:"state"`
+}
+
+// NewChecksumReadCloser wraps rc. expected is the hex encoded SHA256 sum the
+// stream is supposed to have.
+func NewChecksumReadCloser(rc io.ReadCloser, expected string) *ChecksumReadCloser {
+	return &ChecksumReadCloser{
+		rc:       rc,
+		h:        sha256.New(),
+		expected: strings.ToLower(expected),
+	}
+}
+
+// ResumeChecksumReadCloser continues hashing where cp left off. rc must
+// start at cp.Offset in the stream.
+func ResumeChecksumReadCloser(rc io.ReadCloser, expected string,
+	cp ChecksumCheckpoint) (*ChecksumReadCloser, error) {
+
+	c := NewChecksumReadCloser(rc, expected)
+	if err := c.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.State); err != nil {
+		return nil, errors.Wrap(err, "invalid checksum checkpoint")
+	}
+	c.offset = cp.Offset
+	return c, nil
+}
+
+func (c *ChecksumReadCloser) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	if n > 0 {
+		c.h.Write(p[:n])
+		c.offset += int64(n)
+	}
+	return n, err
+}
+
+// Checkpoint returns the progress so far, to be stored so that hashing can
+// be resumed with ResumeChecksumReadCloser.
+func (c *ChecksumReadCloser) Checkpoint() (ChecksumCheckpoint, error) {
+	state, err := c.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return ChecksumCheckpoint{}, errors.Wrap(err, "could not save the checksum state")
+	}
+	return ChecksumCheckpoint{Offset: c.offset, State: state}, nil
+}
+
+func (c *ChecksumReadCloser) Close() error {
+	return c.rc.Close()
+}
+
+// Verify reads whatever is left of the stream, and then compares the checksum
+// of the whole stream with the expected one.
+func (c *ChecksumReadCloser) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		return errors.Wrap(err, "failed to read the remainder of the stream")
+	}
+	sum := hex.EncodeToString(c.h.Sum(nil))
+	if sum != c.expected {
+		return errors.Errorf("checksum mismatch: expected %s, but got %s",
+			c.expected, sum)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumReadCloser(t *testing.T) {
+	data := []byte("test data for checksumming")
+	sum := sha256.Sum256(data)
+	expected := hex.EncodeToString(sum[:])
+
+	// Fully consumed stream.
+	c := NewChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data)), expected)
+	read, err := ioutil.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.NoError(t, c.Verify())
+	assert.NoError(t, c.Close())
+
+	// Partially consumed stream; Verify reads the rest.
+	c = NewChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data)),
+		strings.ToUpper(expected))
+	_, err = io.ReadFull(c, make([]byte, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Verify())
+
+	// Truncated stream.
+	c = NewChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data[:10])), expected)
+	err = c.Verify()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestChecksumReadCloserResume(t *testing.T) {
+	data := []byte("test data for checksumming, interrupted half way")
+	sum := sha256.Sum256(data)
+	expected := hex.EncodeToString(sum[:])
+	const cut = 20
+
+	// Interrupted at a known offset.
+	c := NewChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data[:cut])), expected)
+	_, err := ioutil.ReadAll(c)
+	require.NoError(t, err)
+	cp, err := c.Checkpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(cut), cp.Offset)
+
+	// The checkpoint survives being stored.
+	stored, err := json.Marshal(cp)
+	require.NoError(t, err)
+	var loaded ChecksumCheckpoint
+	require.NoError(t, json.Unmarshal(stored, &loaded))
+
+	// Resumed with only the rest of the stream.
+	c, err = ResumeChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data[cut:])),
+		expected, loaded)
+	require.NoError(t, err)
+	assert.NoError(t, c.Verify())
+	cp, err = c.Checkpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), cp.Offset)
+
+	// Resuming from the wrong offset is caught by the checksum.
+	c, err = ResumeChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data[cut+1:])),
+		expected, loaded)
+	require.NoError(t, err)
+	assert.Error(t, c.Verify())
+
+	_, err = ResumeChecksumReadCloser(ioutil.NopCloser(bytes.NewReader(data)),
+		expected, ChecksumCheckpoint{State: []byte("garbage")})
+	assert.Error(t, err)
+}
@@ -16,6 +16,7 @@ package utils
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 type ProgressWriter struct {
@@ -113,3 +114,116 @@ func (p *ProgressWriter) reportGeneric(n int) {
 		p.Out.Write([]byte(s))
 	}
 }
+
+// Progress tells how far reading a stream has come.
+type Progress struct {
+	// Bytes read so far, out of Total.
+	Current int64
+	Total   int64
+	// Bytes per second, averaged over the last RateWindow. 0 until known.
+	Rate float64
+	// Estimated time until the stream is read in full. 0 if unknown.
+	ETA time.Duration
+}
+
+// ProgressFunc receives the progress of a stream being read.
+type ProgressFunc func(progress Progress)
+
+// RateWindow is how far back the rate given in a Progress is averaged over, so
+// that a short stall does not throw out the estimated time left.
+const RateWindow = 10 * time.Second
+
+type rateSample struct {
+	at time.Time
+	n  int64
+}
+
+// rateEstimator averages a rate over a sliding window.
+type rateEstimator struct {
+	window  time.Duration
+	samples []rateSample
+}
+
+func (r *rateEstimator) add(at time.Time, n int64) {
+	r.samples = append(r.samples, rateSample{at: at, n: n})
+	// The oldest sample kept is the last one from before the window.
+	for len(r.samples) > 2 && at.Sub(r.samples[1].at) >= r.window {
+		r.samples = r.samples[1:]
+	}
+}
+
+// rate returns the average rate per second between the samples, or 0 without
+// enough of them.
+func (r *rateEstimator) rate() float64 {
+	if len(r.samples) < 2 {
+		return 0
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.n-first.n) / elapsed
+}
+
+// ProgressReadCloser reports the progress of reading a stream of known size to
+// a ProgressFunc. The reports are throttled to one per interval, except the
+// final one, which is always made once the whole stream has been read.
+type ProgressReadCloser struct {
+	rc       io.ReadCloser
+	report   ProgressFunc
+	interval time.Duration
+	total    int64
+	current  int64
+	last     time.Time
+	done     bool
+	rate     rateEstimator
+}
+
+func NewProgressReadCloser(rc io.ReadCloser, total int64, interval time.Duration,
+	report ProgressFunc) *ProgressReadCloser {
+	return &ProgressReadCloser{
+		rc:       rc,
+		report:   report,
+		interval: interval,
+		total:    total,
+		rate:     rateEstimator{window: RateWindow},
+	}
+}
+
+func (p *ProgressReadCloser) Read(buf []byte) (int, error) {
+	if p.rate.samples == nil {
+		p.rate.add(time.Now(), p.current)
+	}
+	n, err := p.rc.Read(buf)
+	p.current += int64(n)
+	if p.done {
+		return n, err
+	}
+	if p.current >= p.total || err == io.EOF {
+		p.done = true
+		p.sendReport(time.Now())
+	} else if now := time.Now(); n > 0 && now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.sendReport(now)
+	}
+	return n, err
+}
+
+func (p *ProgressReadCloser) sendReport(now time.Time) {
+	p.rate.add(now, p.current)
+	progress := Progress{
+		Current: p.current,
+		Total:   p.total,
+		Rate:    p.rate.rate(),
+	}
+	if progress.Rate > 0 && p.current < p.total {
+		progress.ETA = time.Duration(float64(p.total-p.current) /
+			progress.Rate * float64(time.Second))
+	}
+	p.report(progress)
+}
+
+func (p *ProgressReadCloser) Close() error {
+	return p.rc.Close()
+}
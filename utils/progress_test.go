@@ -16,9 +16,12 @@ package utils
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func writeZeros(out io.Writer, cnt int64) {
@@ -122,3 +125,94 @@ going over declared size, expected 100 N, now 101
 		b.String())
 
 }
+
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+func TestProgressReadCloser(t *testing.T) {
+	var reports [][2]int64
+	report := func(progress Progress) {
+		reports = append(reports, [2]int64{progress.Current, progress.Total})
+	}
+
+	// Reports are throttled; 20 reads of 10ms each, with a 50ms interval.
+	data := make([]byte, 200)
+	r := &slowReader{r: bytes.NewReader(data), delay: 10 * time.Millisecond}
+	p := NewProgressReadCloser(ioutil.NopCloser(r), int64(len(data)),
+		50*time.Millisecond, report)
+	buf := make([]byte, 10)
+	for {
+		_, err := p.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Close())
+
+	assert.True(t, len(reports) > 1)
+	assert.True(t, len(reports) < 10, "too many reports: %v", reports)
+	// Final report is always 100%.
+	assert.Equal(t, [2]int64{200, 200}, reports[len(reports)-1])
+	for i := 1; i < len(reports); i++ {
+		assert.True(t, reports[i][0] > reports[i-1][0])
+	}
+}
+
+func TestProgressReadCloserRate(t *testing.T) {
+	var last Progress
+	report := func(progress Progress) {
+		last = progress
+	}
+
+	// 100 bytes every 10ms make 10000 bytes per second; somewhat less,
+	// since sleeping takes a little longer than asked for.
+	data := make([]byte, 4000)
+	r := &slowReader{r: bytes.NewReader(data), delay: 10 * time.Millisecond}
+	p := NewProgressReadCloser(ioutil.NopCloser(r), int64(len(data)), 0, report)
+	buf := make([]byte, 100)
+	for i := 0; i < 30; i++ {
+		_, err := p.Read(buf)
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 3000, last.Current)
+	assert.InDelta(t, 10000, last.Rate, 2500)
+	// 1000 bytes left.
+	assert.InDelta(t, float64(100*time.Millisecond), float64(last.ETA),
+		float64(50*time.Millisecond))
+
+	_, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4000, last.Current)
+	assert.Equal(t, time.Duration(0), last.ETA)
+}
+
+func TestRateEstimator(t *testing.T) {
+	start := time.Now()
+	r := rateEstimator{window: 10 * time.Second}
+	assert.Equal(t, 0.0, r.rate())
+
+	// 1000 bytes a second for a minute.
+	for i := 0; i <= 60; i++ {
+		r.add(start.Add(time.Duration(i)*time.Second), int64(i)*1000)
+	}
+	assert.InDelta(t, 1000, r.rate(), 0.01)
+	assert.True(t, len(r.samples) <= 12, "samples are not dropped: %d", len(r.samples))
+
+	// A two second stall only takes a fifth off the average.
+	r.add(start.Add(62*time.Second), 60000)
+	assert.InDelta(t, 800, r.rate(), 0.01)
+
+	// Once it picks up again, so does the average.
+	for i := 63; i <= 80; i++ {
+		r.add(start.Add(time.Duration(i)*time.Second), int64(i-2)*1000)
+	}
+	assert.InDelta(t, 1000, r.rate(), 0.01)
+}
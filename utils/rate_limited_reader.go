@@ -0,0 +1,111 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var errRateLimitedReaderClosed = errors.New("read from a closed reader")
+
+// RateLimitedReadCloser limits the average rate at which data can be read from
+// the underlying reader. It is a token bucket which holds at most one second
+// worth of data, so short bursts are allowed as long as the average over a
+// second stays at the limit.
+type RateLimitedReadCloser struct {
+	rc io.ReadCloser
+	// bytes per second
+	limit  int64
+	tokens int64
+	last   time.Time
+	// Closed by Close, to end a wait for the limit.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRateLimitedReadCloser wraps rc, limiting reads to limit bytes per second.
+func NewRateLimitedReadCloser(rc io.ReadCloser, limit int64) *RateLimitedReadCloser {
+	return &RateLimitedReadCloser{
+		rc:     rc,
+		limit:  limit,
+		tokens: limit,
+		last:   time.Now(),
+		closed: make(chan struct{}),
+	}
+}
+
+func (r *RateLimitedReadCloser) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.rc.Read(p)
+	}
+
+	// Wait for a reasonably sized chunk, rather than waking up for every
+	// single byte that becomes available.
+	want := r.limit / 10
+	if want < 1 {
+		want = 1
+	}
+	if int64(len(p)) < want {
+		want = int64(len(p))
+	}
+	r.refill()
+	for r.tokens < want {
+		timer := time.NewTimer(time.Duration(want-r.tokens) * time.Second /
+			time.Duration(r.limit))
+		select {
+		case <-timer.C:
+		case <-r.closed:
+			timer.Stop()
+			return 0, errRateLimitedReaderClosed
+		}
+		r.refill()
+	}
+
+	if int64(len(p)) > r.tokens {
+		p = p[:r.tokens]
+	}
+	n, err := r.rc.Read(p)
+	r.tokens -= int64(n)
+	return n, err
+}
+
+// Close closes the underlying reader, and ends a Read which waits for the
+// limit at once.
+func (r *RateLimitedReadCloser) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return r.rc.Close()
+}
+
+func (r *RateLimitedReadCloser) refill() {
+	now := time.Now()
+	elapsed := now.Sub(r.last)
+	if elapsed >= time.Second {
+		r.tokens = r.limit
+		r.last = now
+		return
+	}
+	added := int64(elapsed) * r.limit / int64(time.Second)
+	if added == 0 {
+		// Keep the fraction for the next time.
+		return
+	}
+	r.tokens += added
+	if r.tokens > r.limit {
+		r.tokens = r.limit
+	}
+	r.last = now
+}
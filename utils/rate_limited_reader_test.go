@@ -0,0 +1,67 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedReadCloser(t *testing.T) {
+	const limit = 512 * 1024
+	data := make([]byte, 2*limit)
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	r := NewRateLimitedReadCloser(ioutil.NopCloser(bytes.NewReader(data)), limit)
+	start := time.Now()
+	read, err := ioutil.ReadAll(r)
+	elapsed := time.Since(start)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.NoError(t, r.Close())
+
+	// The first second worth of data is allowed as a burst, the rest has to
+	// wait for the limit.
+	assert.True(t, elapsed >= 900*time.Millisecond, "too fast: %v", elapsed)
+	assert.True(t, elapsed < 2*time.Second, "too slow: %v", elapsed)
+}
+
+func TestRateLimitedReadCloserClose(t *testing.T) {
+	// One byte per second, so that the second read waits for a second.
+	r := NewRateLimitedReadCloser(ioutil.NopCloser(bytes.NewReader(make([]byte, 10))), 1)
+	_, err := r.Read(make([]byte, 1))
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, r.Close())
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Read still waits for the limit")
+	}
+}